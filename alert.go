@@ -0,0 +1,594 @@
+// Copyright (C) 2025 Russell Li (xiaoxinmm)
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"sysmon/monitor"
+)
+
+// Threshold alerting. Rules from the "alerts" config list are evaluated on
+// every collection. An alert for a rule and instance (mountpoint,
+// interface, container) goes pending when the threshold is crossed, fires
+// once it has stayed crossed for the rule's "for" duration, and resolves
+// when the value gets back past "clear". See docs/alerts.md.
+
+// AlertRule is one entry of the "alerts" config list.
+type AlertRule struct {
+	Name      string   `json:"name"`
+	Metric    string   `json:"metric"`
+	Match     string   `json:"match,omitempty"` // glob on the instance, e.g. "/var/*", "eth*"
+	Op        string   `json:"op,omitempty"`    // ">" (default) or "<"
+	Threshold float64  `json:"threshold"`
+	Clear     *float64 `json:"clear,omitempty"` // resolve only past this; defaults to threshold
+	For       string   `json:"for,omitempty"`   // e.g. "5m"; empty fires at once
+	Severity  string   `json:"severity,omitempty"`
+}
+
+const (
+	alertPending  = "pending"
+	alertFiring   = "firing"
+	alertResolved = "resolved"
+	alertInactive = "inactive" // a pending alert that went away before firing
+)
+
+// 只保留最近这么多条已恢复的告警
+const alertResolvedKeep = 100
+
+var alertSeverities = []string{"info", "warning", "critical"}
+
+// alert is one rule/instance pair that is or was out of bounds. It is the
+// payload of the alert websocket message and what the API returns.
+type alert struct {
+	ID         string  `json:"id"` // rule, or rule:instance
+	Rule       string  `json:"rule"`
+	Metric     string  `json:"metric"`
+	Instance   string  `json:"instance,omitempty"`
+	Severity   string  `json:"severity"`
+	State      string  `json:"state"`
+	Value      float64 `json:"value"`
+	Threshold  float64 `json:"threshold"`
+	Summary    string  `json:"summary"`
+	Since      int64   `json:"since"` // unix ms, first out of bounds
+	FiredAt    int64   `json:"firedAt,omitempty"`
+	ResolvedAt int64   `json:"resolvedAt,omitempty"`
+	AckedAt    int64   `json:"ackedAt,omitempty"`
+	AckComment string  `json:"ackComment,omitempty"`
+	Muted      string  `json:"muted,omitempty"` // why notifications are off: acknowledged, silence <id>, maintenance <name>
+}
+
+type alertSample struct {
+	instance string
+	value    float64
+}
+
+// alertMetric is something a rule can watch.
+type alertMetric struct {
+	unit   string
+	docker bool // needs the container list
+	values func(snap Snapshot, containers []monitor.DockerContainer) []alertSample
+}
+
+func perCore(load float64, snap Snapshot) []alertSample {
+	if !snap.has("load") {
+		return nil
+	}
+	n := snap.CPU.Threads
+	if n <= 0 {
+		n = 1
+	}
+	return []alertSample{{value: load / float64(n)}}
+}
+
+var alertMetrics = map[string]alertMetric{
+	"cpu": {unit: "%", values: func(s Snapshot, _ []monitor.DockerContainer) []alertSample {
+		if !s.has("cpu") {
+			return nil
+		}
+		return []alertSample{{value: s.CPU.AvgUsage}}
+	}},
+	"memory": {unit: "%", values: func(s Snapshot, _ []monitor.DockerContainer) []alertSample {
+		if !s.has("memory") {
+			return nil
+		}
+		return []alertSample{{value: s.Memory.UsedPercent}}
+	}},
+	"swap": {unit: "%", values: func(s Snapshot, _ []monitor.DockerContainer) []alertSample {
+		if s.Memory.SwapTotal == 0 {
+			return nil
+		}
+		return []alertSample{{value: s.Memory.SwapPercent}}
+	}},
+	"disk": {unit: "%", values: func(s Snapshot, _ []monitor.DockerContainer) []alertSample {
+		var out []alertSample
+		for _, d := range s.Disks {
+			out = append(out, alertSample{d.Mountpoint, d.UsedPercent})
+		}
+		return out
+	}},
+	"load1":  {values: func(s Snapshot, _ []monitor.DockerContainer) []alertSample { return perCore(s.Load.Load1, s) }},
+	"load5":  {values: func(s Snapshot, _ []monitor.DockerContainer) []alertSample { return perCore(s.Load.Load5, s) }},
+	"load15": {values: func(s Snapshot, _ []monitor.DockerContainer) []alertSample { return perCore(s.Load.Load15, s) }},
+	"net_recv": {unit: " B/s", values: func(s Snapshot, _ []monitor.DockerContainer) []alertSample {
+		var out []alertSample
+		for _, n := range s.Network {
+			out = append(out, alertSample{n.Name, n.RecvRate})
+		}
+		return out
+	}},
+	"net_send": {unit: " B/s", values: func(s Snapshot, _ []monitor.DockerContainer) []alertSample {
+		var out []alertSample
+		for _, n := range s.Network {
+			out = append(out, alertSample{n.Name, n.SendRate})
+		}
+		return out
+	}},
+	"anomaly": {values: func(_ Snapshot, _ []monitor.DockerContainer) []alertSample {
+		var out []alertSample
+		for _, a := range anomalies.scores() {
+			out = append(out, alertSample{a.ID, a.Score})
+		}
+		return out
+	}},
+	"full_in_hours": {unit: " h", values: func(_ Snapshot, _ []monitor.DockerContainer) []alertSample {
+		var out []alertSample
+		for _, f := range forecasts.list() {
+			if f.FullIn > 0 {
+				out = append(out, alertSample{f.ID, float64(f.FullIn) / 3600})
+			}
+		}
+		return out
+	}},
+	"container_running": {docker: true, values: func(_ Snapshot, cs []monitor.DockerContainer) []alertSample {
+		var out []alertSample
+		for _, c := range cs {
+			out = append(out, alertSample{c.Name, boolValue(c.State == "running")})
+		}
+		return out
+	}},
+}
+
+func alertMetricNames() []string {
+	names := make([]string, 0, len(alertMetrics))
+	for n := range alertMetrics {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// compiledRule is an AlertRule with defaults filled in.
+type compiledRule struct {
+	AlertRule
+	metric alertMetric
+	clear  float64
+	hold   time.Duration
+}
+
+// breached is the firing condition; cleared is the resolving one.
+func (r *compiledRule) breached(v float64) bool {
+	if r.Op == "<" {
+		return v < r.Threshold
+	}
+	return v > r.Threshold
+}
+
+func (r *compiledRule) cleared(v float64) bool {
+	if r.Op == "<" {
+		return v >= r.clear
+	}
+	return v <= r.clear
+}
+
+func compileRule(r AlertRule) (*compiledRule, error) {
+	c := &compiledRule{AlertRule: r, clear: r.Threshold}
+	if r.Name == "" {
+		return nil, fmt.Errorf("alert rule without a name")
+	}
+	m, ok := alertMetrics[r.Metric]
+	if !ok {
+		return nil, fmt.Errorf("alert %q: unknown metric %q", r.Name, r.Metric)
+	}
+	c.metric = m
+	switch r.Op {
+	case "":
+		c.Op = ">"
+	case ">", "<":
+	default:
+		return nil, fmt.Errorf("alert %q: op must be > or <", r.Name)
+	}
+	if r.Severity == "" {
+		c.Severity = "warning"
+	} else if !containsString(alertSeverities, r.Severity) {
+		return nil, fmt.Errorf("alert %q: severity must be info, warning or critical", r.Name)
+	}
+	if r.Clear != nil {
+		c.clear = *r.Clear
+		if (c.Op == ">" && c.clear > r.Threshold) || (c.Op == "<" && c.clear < r.Threshold) {
+			return nil, fmt.Errorf("alert %q: clear must be on the safe side of threshold", r.Name)
+		}
+	}
+	if r.For != "" {
+		d, err := time.ParseDuration(r.For)
+		if err != nil || d < 0 {
+			return nil, fmt.Errorf("alert %q: bad for %q", r.Name, r.For)
+		}
+		c.hold = d
+	}
+	if r.Match != "" {
+		if _, err := path.Match(r.Match, ""); err != nil {
+			return nil, fmt.Errorf("alert %q: bad match pattern %q", r.Name, r.Match)
+		}
+	}
+	return c, nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// alertEngine evaluates the rules and keeps the alert states. Transitions
+// are broadcast on the "alerts" topic and handed to the notification
+// channels unless the alert is muted.
+type alertEngine struct {
+	rules   []*compiledRule
+	docker  bool
+	in      chan Snapshot
+	h       *hub
+	notify  *notifications
+	windows []*maintenanceWindow
+
+	mu       sync.Mutex
+	active   map[string]*alert
+	resolved []alert // newest last
+	silences []Silence
+}
+
+// alerts is the engine the websocket clients and the API read from.
+var alerts = &alertEngine{active: make(map[string]*alert), notify: &notifications{}}
+
+func (e *alertEngine) configure(rules []AlertRule, h *hub) error {
+	seen := make(map[string]bool)
+	for _, r := range rules {
+		c, err := compileRule(r)
+		if err != nil {
+			return err
+		}
+		if seen[r.Name] {
+			return fmt.Errorf("alert %q: duplicate name", r.Name)
+		}
+		seen[r.Name] = true
+		e.rules = append(e.rules, c)
+		e.docker = e.docker || c.metric.docker
+	}
+	e.h = h
+	e.in = make(chan Snapshot, 4)
+	return nil
+}
+
+func (e *alertEngine) configureMaintenance(windows []MaintenanceWindow) error {
+	for _, w := range windows {
+		c, err := compileMaintenance(w)
+		if err != nil {
+			return err
+		}
+		e.windows = append(e.windows, c)
+	}
+	return nil
+}
+
+func (e *alertEngine) enabled() bool { return len(e.rules) > 0 }
+
+// publish queues a snapshot for evaluation without blocking the broadcaster.
+func (e *alertEngine) publish(snap Snapshot) {
+	select {
+	case e.in <- snap:
+	default:
+	}
+}
+
+func (e *alertEngine) run() {
+	var docker containerCache
+	for snap := range e.in {
+		var containers []monitor.DockerContainer
+		if e.docker {
+			containers = docker.get()
+		}
+		e.evaluate(snap, containers)
+	}
+}
+
+func alertID(rule, instance string) string {
+	if instance == "" {
+		return rule
+	}
+	return rule + ":" + instance
+}
+
+func (r *compiledRule) summary(a *alert) string {
+	subject := r.Metric
+	if a.Instance != "" {
+		subject += " " + a.Instance
+	}
+	return fmt.Sprintf("%s is %s%s (%s %s%s)", subject,
+		strconv.FormatFloat(a.Value, 'f', 2, 64), r.metric.unit,
+		r.Op, strconv.FormatFloat(r.Threshold, 'f', -1, 64), r.metric.unit)
+}
+
+// evaluate runs every rule against one snapshot and announces transitions.
+func (e *alertEngine) evaluate(snap Snapshot, containers []monitor.DockerContainer) {
+	now := snap.Timestamp
+	var changed []alert
+
+	e.mu.Lock()
+	for _, r := range e.rules {
+		seen := make(map[string]bool)
+		for _, s := range r.metric.values(snap, containers) {
+			if r.Match != "" {
+				if ok, _ := path.Match(r.Match, s.instance); !ok {
+					continue
+				}
+			}
+			id := alertID(r.Name, s.instance)
+			seen[id] = true
+			a := e.active[id]
+
+			if a == nil {
+				if !r.breached(s.value) {
+					continue
+				}
+				a = &alert{
+					ID: id, Rule: r.Name, Metric: r.Metric, Instance: s.instance,
+					Severity: r.Severity, State: alertPending, Threshold: r.Threshold, Since: now,
+				}
+				e.active[id] = a
+			}
+			a.Value = s.value
+			a.Summary = r.summary(a)
+
+			switch a.State {
+			case alertPending:
+				if !r.breached(s.value) {
+					changed = append(changed, e.endLocked(a, alertInactive, now))
+					continue
+				}
+				if time.Duration(now-a.Since)*time.Millisecond >= r.hold {
+					a.State = alertFiring
+					a.FiredAt = now
+					changed = append(changed, *a)
+				} else if a.Since == now {
+					changed = append(changed, *a) // 刚进入 pending
+				}
+			case alertFiring:
+				if r.cleared(s.value) {
+					changed = append(changed, e.endLocked(a, alertResolved, now))
+				}
+			}
+		}
+
+		// 实例没了（容器删了、磁盘卸了）也算恢复
+		for id, a := range e.active {
+			if a.Rule != r.Name || seen[id] {
+				continue
+			}
+			state := alertResolved
+			if a.State == alertPending {
+				state = alertInactive
+			}
+			changed = append(changed, e.endLocked(a, state, now))
+		}
+	}
+	for i := range changed {
+		changed[i].Muted = e.mutedLocked(&changed[i], now)
+	}
+	e.mu.Unlock()
+
+	for _, a := range changed {
+		e.h.broadcast("alerts", wsMessage{Type: "alert", Payload: a})
+		if a.Muted == "" {
+			e.notify.send(a)
+		}
+	}
+}
+
+// mutedLocked says why a's notifications are off, or "".
+func (e *alertEngine) mutedLocked(a *alert, now int64) string {
+	if a.AckedAt != 0 {
+		return "acknowledged"
+	}
+	for i := range e.silences {
+		if s := &e.silences[i]; s.active(now) && s.matches(a) {
+			return "silence " + s.ID
+		}
+	}
+	t := time.UnixMilli(now)
+	for _, w := range e.windows {
+		if w.matches(a) {
+			if ok, _ := w.activeAt(t); ok {
+				return "maintenance " + w.Name
+			}
+		}
+	}
+	return ""
+}
+
+// endLocked takes a out of the active set in the given final state.
+func (e *alertEngine) endLocked(a *alert, state string, now int64) alert {
+	delete(e.active, a.ID)
+	a.State = state
+	if state == alertResolved {
+		a.ResolvedAt = now
+		e.resolved = append(e.resolved, *a)
+		if len(e.resolved) > alertResolvedKeep {
+			e.resolved = e.resolved[len(e.resolved)-alertResolvedKeep:]
+		}
+	}
+	return *a
+}
+
+// list returns the pending and firing alerts, firing and most severe first.
+func (e *alertEngine) list() []alert {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	now := time.Now().UnixMilli()
+	out := make([]alert, 0, len(e.active))
+	for _, a := range e.active {
+		c := *a
+		c.Muted = e.mutedLocked(a, now)
+		out = append(out, c)
+	}
+	rank := func(a alert) int {
+		r := 0
+		for i, s := range alertSeverities {
+			if s == a.Severity {
+				r = i
+			}
+		}
+		if a.State == alertFiring {
+			r += len(alertSeverities)
+		}
+		return r
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if ri, rj := rank(out[i]), rank(out[j]); ri != rj {
+			return ri > rj
+		}
+		return out[i].Since < out[j].Since
+	})
+	return out
+}
+
+// recentlyResolved returns resolved alerts, newest first.
+func (e *alertEngine) recentlyResolved() []alert {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	out := make([]alert, len(e.resolved))
+	for i, a := range e.resolved {
+		out[len(out)-1-i] = a
+	}
+	return out
+}
+
+func (e *alertEngine) ruleList() []AlertRule {
+	out := make([]AlertRule, 0, len(e.rules))
+	for _, r := range e.rules {
+		out = append(out, r.AlertRule)
+	}
+	return out
+}
+
+var (
+	errNoAlert   = errors.New("no such active alert")
+	errNotFiring = errors.New("only firing alerts can be acknowledged")
+	errNoSilence = errors.New("no such silence")
+)
+
+// ack marks a firing alert as acknowledged: no more notifications for it,
+// including its resolution. The change is broadcast like a transition.
+func (e *alertEngine) ack(id, comment string) (alert, error) {
+	e.mu.Lock()
+	a := e.active[id]
+	if a == nil {
+		e.mu.Unlock()
+		return alert{}, errNoAlert
+	}
+	if a.State != alertFiring {
+		e.mu.Unlock()
+		return alert{}, errNotFiring
+	}
+	if a.AckedAt == 0 {
+		a.AckedAt = time.Now().UnixMilli()
+	}
+	a.AckComment = comment
+	out := *a
+	out.Muted = e.mutedLocked(a, out.AckedAt)
+	e.mu.Unlock()
+
+	if e.h != nil {
+		e.h.broadcast("alerts", wsMessage{Type: "alert", Payload: out})
+	}
+	return out, nil
+}
+
+func (e *alertEngine) addSilence(req silenceRequest) (Silence, error) {
+	now := time.Now().UnixMilli()
+	s, err := newSilence(req, now)
+	if err != nil {
+		return s, err
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.pruneSilencesLocked(now)
+	e.silences = append(e.silences, s)
+	return s, nil
+}
+
+func (e *alertEngine) deleteSilence(id string) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for i, s := range e.silences {
+		if s.ID == id {
+			e.silences = append(e.silences[:i], e.silences[i+1:]...)
+			return nil
+		}
+	}
+	return errNoSilence
+}
+
+// silenceList returns the current and future silences, soonest end first.
+func (e *alertEngine) silenceList() []Silence {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.pruneSilencesLocked(time.Now().UnixMilli())
+	out := append([]Silence{}, e.silences...)
+	sort.Slice(out, func(i, j int) bool { return out[i].EndsAt < out[j].EndsAt })
+	return out
+}
+
+func (e *alertEngine) pruneSilencesLocked(now int64) {
+	kept := e.silences[:0]
+	for _, s := range e.silences {
+		if s.EndsAt > now {
+			kept = append(kept, s)
+		}
+	}
+	e.silences = kept
+}
+
+func (e *alertEngine) maintenanceList() []maintenanceStatus {
+	now := time.Now()
+	out := make([]maintenanceStatus, 0, len(e.windows))
+	for _, w := range e.windows {
+		st := maintenanceStatus{MaintenanceWindow: w.MaintenanceWindow}
+		if ok, end := w.activeAt(now); ok {
+			st.Active, st.EndsAt = true, end.UnixMilli()
+		}
+		out = append(out, st)
+	}
+	return out
+}
@@ -0,0 +1,186 @@
+// Copyright (C) 2025 Russell Li (xiaoxinmm)
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"sysmon/monitor"
+)
+
+// alertRecorder is a dashboard that keeps the alert messages it gets.
+type alertRecorder struct {
+	h   *hub
+	mu  sync.Mutex
+	got []alert
+}
+
+func (r *alertRecorder) send(_ uint64, msgType string, _ int, data []byte) error {
+	if msgType == "alert" {
+		var msg struct{ Payload alert }
+		json.Unmarshal(data, &msg)
+		r.mu.Lock()
+		r.got = append(r.got, msg.Payload)
+		r.mu.Unlock()
+	}
+	return nil
+}
+
+func (r *alertRecorder) shutdown(string) {}
+func (r *alertRecorder) close()          {}
+
+// transitions returns what was announced since the last call, as
+// "id state" strings.
+func (r *alertRecorder) transitions() string {
+	r.h.drain()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var out []string
+	for _, a := range r.got {
+		out = append(out, a.ID+" "+a.State)
+	}
+	r.got = nil
+	return strings.Join(out, ", ")
+}
+
+func testEngine(t *testing.T, rules ...AlertRule) (*alertEngine, *alertRecorder) {
+	t.Helper()
+	e := &alertEngine{active: make(map[string]*alert), notify: &notifications{}}
+	h := newHub()
+	if err := e.configure(rules, h); err != nil {
+		t.Fatal(err)
+	}
+	rec := &alertRecorder{h: h}
+	h.add(newClient(rec, httptest.NewRequest("GET", "/ws", nil), jsonCodec, clientLimits{}))
+	return e, rec
+}
+
+func TestAlertStates(t *testing.T) {
+	clearAt := 80.0
+	e, rec := testEngine(t, AlertRule{Name: "hot", Metric: "cpu", Threshold: 90, Clear: &clearAt, For: "2m", Severity: "critical"})
+	t0 := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, step := range []struct {
+		at    time.Duration
+		cpu   float64
+		want  string // transitions announced
+		state string // of the active alert, "" for none
+	}{
+		{0, 50, "", ""},
+		{10 * time.Second, 95, "hot pending", alertPending},
+		{time.Minute, 96, "", alertPending},
+		// 没撑到 for 就回落：作废，不算恢复
+		{90 * time.Second, 85, "hot inactive", ""},
+		{2 * time.Minute, 95, "hot pending", alertPending},
+		{3*time.Minute + 59*time.Second, 99, "", alertPending},
+		{4 * time.Minute, 91, "hot firing", alertFiring},
+		// 低于阈值但还没到 clear，继续 firing
+		{5 * time.Minute, 85, "", alertFiring},
+		{6 * time.Minute, 80.5, "", alertFiring},
+		{7 * time.Minute, 80, "hot resolved", ""},
+		{8 * time.Minute, 85, "", ""}, // 没过阈值，不会重新 pending
+	} {
+		snap := Snapshot{Timestamp: t0.Add(step.at).UnixMilli()}
+		snap.setSection("cpu", monitor.CPUInfo{AvgUsage: step.cpu})
+		e.evaluate(snap, nil)
+		if got := rec.transitions(); got != step.want {
+			t.Errorf("%s cpu %v: announced %q, want %q", step.at, step.cpu, got, step.want)
+		}
+		state := ""
+		if a := e.active["hot"]; a != nil {
+			state = a.State
+		}
+		if state != step.state {
+			t.Errorf("%s cpu %v: state %q, want %q", step.at, step.cpu, state, step.state)
+		}
+	}
+
+	resolved := e.recentlyResolved()
+	if len(resolved) != 1 {
+		t.Fatalf("%d resolved alerts, want 1", len(resolved))
+	}
+	if a := resolved[0]; a.Since != t0.Add(2*time.Minute).UnixMilli() || a.FiredAt != t0.Add(4*time.Minute).UnixMilli() ||
+		a.ResolvedAt != t0.Add(7*time.Minute).UnixMilli() || a.Value != 80 || a.Severity != "critical" {
+		t.Errorf("resolved %+v", a)
+	}
+}
+
+// TestAlertInstances has one alert per mountpoint, below-threshold rules
+// and instances that go away.
+func TestAlertInstances(t *testing.T) {
+	e, rec := testEngine(t,
+		AlertRule{Name: "full", Metric: "disk", Match: "/var*", Threshold: 90},
+		AlertRule{Name: "idle", Metric: "cpu", Op: "<", Threshold: 5, For: "1m"},
+	)
+	t0 := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	tick := func(at time.Duration, cpu float64, disks ...monitor.DiskInfo) string {
+		snap := Snapshot{Timestamp: t0.Add(at).UnixMilli()}
+		snap.setSection("cpu", monitor.CPUInfo{AvgUsage: cpu})
+		snap.setSection("disks", disks)
+		e.evaluate(snap, nil)
+		return rec.transitions()
+	}
+	root := monitor.DiskInfo{Mountpoint: "/", UsedPercent: 99}
+	varFull := monitor.DiskInfo{Mountpoint: "/var", UsedPercent: 95}
+	varLog := monitor.DiskInfo{Mountpoint: "/var/log", UsedPercent: 50}
+
+	// 没有 for 立刻 firing；/ 不在 match 里
+	if got := tick(0, 50, root, varFull, varLog); got != "full:/var firing" {
+		t.Errorf("first tick: %q", got)
+	}
+	if got := tick(10*time.Second, 2, root, varFull, varLog); got != "idle pending" {
+		t.Errorf("cpu below: %q", got)
+	}
+	if got := tick(70*time.Second, 1, root, varFull, varLog); got != "idle firing" {
+		t.Errorf("cpu below for 1m: %q", got)
+	}
+	if n := len(e.list()); n != 2 {
+		t.Errorf("%d active alerts, want 2", n)
+	}
+	// /var 卸掉了：算恢复
+	if got := tick(80*time.Second, 1, root, varLog); got != "full:/var resolved" {
+		t.Errorf("unmounted: %q", got)
+	}
+	if got := tick(90*time.Second, 5); got != "idle resolved" {
+		t.Errorf("cpu back at threshold: %q", got)
+	}
+}
+
+func TestCompileRule(t *testing.T) {
+	above, below := 95.0, 3.0
+	for _, bad := range []AlertRule{
+		{Metric: "cpu", Threshold: 90},
+		{Name: "x", Metric: "gpu", Threshold: 90},
+		{Name: "x", Metric: "cpu", Op: ">=", Threshold: 90},
+		{Name: "x", Metric: "cpu", Threshold: 90, Clear: &above},
+		{Name: "x", Metric: "cpu", Op: "<", Threshold: 5, Clear: &below},
+		{Name: "x", Metric: "cpu", Threshold: 90, For: "soon"},
+		{Name: "x", Metric: "cpu", Threshold: 90, Severity: "page"},
+		{Name: "x", Metric: "disk", Threshold: 90, Match: "["},
+	} {
+		if _, err := compileRule(bad); err == nil {
+			t.Errorf("%+v accepted", bad)
+		}
+	}
+	e := &alertEngine{}
+	if err := e.configure([]AlertRule{{Name: "a", Metric: "cpu"}, {Name: "a", Metric: "memory"}}, nil); err == nil {
+		t.Error("duplicate rule names accepted")
+	}
+}
@@ -0,0 +1,275 @@
+// Copyright (C) 2025 Russell Li (xiaoxinmm)
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"sysmon/monitor"
+)
+
+// Anomaly detection. Every sample the broadcaster collects (idle ones
+// too) updates an exponentially weighted mean and variance per series;
+// a sample's score is how many standard deviations it lies from the mean
+// before it was added. At startup the series are seeded from the raw
+// points in the history store. Scores are served by the API, pushed on
+// the "anomalies" topic when the set of anomalous series changes, and
+// can be alerted on with the "anomaly" metric. See docs/alerts.md.
+
+const (
+	// 样本太少时均值和方差都不可信，不打分
+	anomalyWarmup = 30
+	// 百分比类指标的标准差下限（百分点），省得一条平线上 0.1 的抖动就算异常
+	anomalyMinStdPercent = 1.0
+	// 速率类指标的下限：1 KiB/s，或均值的 5%
+	anomalyMinStdRate = 1024.0
+	// 连续这么多个样本回到阈值的这个比例以内才算恢复，免得来回跳
+	anomalyClear = 0.66
+	anomalyCalm  = 5
+	// 启动时从历史里回放这么多个窗口；再早的点权重已经不到 5%
+	anomalySeedWindows = 3
+)
+
+// anomalyScore is one series' latest score.
+type anomalyScore struct {
+	ID        string  `json:"id"` // metric, or metric:instance
+	Metric    string  `json:"metric"`
+	Instance  string  `json:"instance,omitempty"`
+	Value     float64 `json:"value"`
+	Mean      float64 `json:"mean"`
+	StdDev    float64 `json:"stddev"`
+	Score     float64 `json:"score"` // signed z-score
+	Anomalous bool    `json:"anomalous"`
+	Since     int64   `json:"since,omitempty"` // unix ms, while anomalous
+}
+
+type ewmaSeries struct {
+	rate     bool // bytes/s rather than %
+	mean     float64
+	variance float64
+	samples  int
+	calm     int   // samples back to normal while anomalous
+	last     int64 // unix ms
+	score    anomalyScore
+}
+
+// observe scores v against the series so far, then folds it in. The
+// weight of a sample depends on the time since the last one, so idle
+// (slow) and active (fast) sampling weigh an hour of history the same.
+func (s *ewmaSeries) observe(v float64, now int64, window time.Duration, threshold float64) {
+	if s.samples == 0 {
+		s.mean, s.last = v, now
+		s.samples = 1
+		return
+	}
+	std := math.Sqrt(s.variance)
+	floor := anomalyMinStdPercent
+	if s.rate {
+		floor = math.Max(anomalyMinStdRate, 0.05*math.Abs(s.mean))
+	}
+	z := (v - s.mean) / math.Max(std, floor)
+
+	s.score.Value, s.score.Mean, s.score.StdDev, s.score.Score = v, s.mean, std, z
+	switch {
+	case s.samples < anomalyWarmup:
+	case math.Abs(z) >= threshold:
+		s.calm = 0
+		if !s.score.Anomalous {
+			s.score.Anomalous, s.score.Since = true, now
+		}
+	case s.score.Anomalous && math.Abs(z) < threshold*anomalyClear:
+		if s.calm++; s.calm >= anomalyCalm {
+			s.score.Anomalous, s.score.Since = false, 0
+		}
+	}
+
+	dt := time.Duration(now-s.last) * time.Millisecond
+	alpha := 1 - math.Exp(-float64(dt)/float64(window))
+	// 离群点只按阈值处的值计入，一次突发不会把均值和方差拉歪
+	diff := v - s.mean
+	if s.samples >= anomalyWarmup {
+		limit := threshold * math.Max(std, floor)
+		diff = math.Max(-limit, math.Min(limit, diff))
+	}
+	incr := alpha * diff
+	s.mean += incr
+	s.variance = (1 - alpha) * (s.variance + diff*incr)
+	s.samples++
+	s.last = now
+}
+
+// anomalyDetector keeps the series. The zero value is disabled.
+type anomalyDetector struct {
+	window    time.Duration
+	threshold float64
+	h         *hub
+
+	mu     sync.Mutex
+	series map[string]*ewmaSeries
+}
+
+// anomalies is the detector the broadcaster feeds.
+var anomalies = &anomalyDetector{}
+
+func (d *anomalyDetector) configure(windowSeconds int, threshold float64, h *hub) {
+	if windowSeconds <= 0 {
+		return
+	}
+	if threshold <= 0 {
+		threshold = 3
+	}
+	d.window = time.Duration(windowSeconds) * time.Second
+	d.threshold = threshold
+	d.h = h
+	d.series = make(map[string]*ewmaSeries)
+}
+
+func (d *anomalyDetector) enabled() bool { return d.window > 0 }
+
+// observe feeds one snapshot in. Idle snapshots carry every section it
+// scores, so the series keep learning while nobody is watching.
+func (d *anomalyDetector) observe(snap Snapshot) {
+	if !d.enabled() {
+		return
+	}
+	now := snap.Timestamp
+	d.mu.Lock()
+	before := d.anomalousLocked()
+	put := func(metric, instance string, rate bool, v float64) {
+		d.seriesLocked(metric, instance, rate).observe(v, now, d.window, d.threshold)
+	}
+
+	if snap.has("cpu") {
+		put("cpu", "", false, snap.CPU.AvgUsage)
+	}
+	if snap.has("memory") {
+		put("memory", "", false, snap.Memory.UsedPercent)
+	}
+	if snap.Memory.SwapTotal > 0 {
+		put("swap", "", false, snap.Memory.SwapPercent)
+	}
+	for _, disk := range snap.Disks {
+		put("disk", disk.Mountpoint, false, disk.UsedPercent)
+	}
+	for _, n := range snap.Network {
+		put("net_recv", n.Name, true, n.RecvRate)
+		put("net_send", n.Name, true, n.SendRate)
+	}
+
+	// 网卡、磁盘没了，过了一个窗口就忘掉
+	for id, s := range d.series {
+		if time.Duration(now-s.last)*time.Millisecond > d.window {
+			delete(d.series, id)
+		}
+	}
+	after := d.anomalousLocked()
+	var scores []anomalyScore
+	if before != after {
+		scores = d.scoresLocked()
+	}
+	d.mu.Unlock()
+
+	if scores != nil && d.h != nil {
+		d.h.broadcast("anomalies", wsMessage{Type: "anomalies", Payload: scores})
+	}
+}
+
+func (d *anomalyDetector) seriesLocked(metric, instance string, rate bool) *ewmaSeries {
+	id := alertID(metric, instance)
+	s := d.series[id]
+	if s == nil {
+		s = &ewmaSeries{rate: rate, score: anomalyScore{ID: id, Metric: metric, Instance: instance}}
+		d.series[id] = s
+	}
+	return s
+}
+
+// seed replays the raw points the history store has from the last
+// anomalySeedWindows windows before now, so after a restart the series
+// pick up where they left off instead of warming up from scratch. The
+// history metrics are the ones observe scores, under the same names.
+func (d *anomalyDetector) seed(now int64) {
+	if !d.enabled() {
+		return
+	}
+	from := now - anomalySeedWindows*d.window.Milliseconds()
+	hist := monitor.QueryHistory([]string{"cpu", "memory", "swap", "disk", "net_recv", "net_send"}, nil, from, now, 0)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, h := range hist {
+		instance := h.Labels["mountpoint"]
+		rate := strings.HasPrefix(h.Metric, "net_")
+		if rate {
+			instance = h.Labels["interface"]
+		}
+		s := d.seriesLocked(h.Metric, instance, rate)
+		for i, t := range h.T {
+			s.observe(h.V[i], t, d.window, d.threshold)
+		}
+	}
+	// 一个窗口都没数据的（拔掉的网卡），observe 反正也会删掉
+	for id, s := range d.series {
+		if time.Duration(now-s.last)*time.Millisecond > d.window {
+			delete(d.series, id)
+		}
+	}
+}
+
+// anomalousLocked is the ids of the anomalous series, as one comparable string.
+func (d *anomalyDetector) anomalousLocked() string {
+	var ids []string
+	for id, s := range d.series {
+		if s.score.Anomalous {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	key := ""
+	for _, id := range ids {
+		key += id + "\x00"
+	}
+	return key
+}
+
+func (d *anomalyDetector) scoresLocked() []anomalyScore {
+	out := make([]anomalyScore, 0, len(d.series))
+	for _, s := range d.series {
+		if s.samples > anomalyWarmup {
+			out = append(out, s.score)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if ai, aj := math.Abs(out[i].Score), math.Abs(out[j].Score); ai != aj {
+			return ai > aj
+		}
+		return out[i].ID < out[j].ID
+	})
+	return out
+}
+
+// scores returns every warmed-up series, most unusual first.
+func (d *anomalyDetector) scores() []anomalyScore {
+	if !d.enabled() {
+		return []anomalyScore{}
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.scoresLocked()
+}
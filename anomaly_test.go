@@ -0,0 +1,83 @@
+// Copyright (C) 2025 Russell Li (xiaoxinmm)
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"sysmon/monitor"
+)
+
+// TestAnomalySeed restarts the detector on a store that already has half
+// an hour of samples: it scores the next one right away, like the one
+// that had been running.
+func TestAnomalySeed(t *testing.T) {
+	// 过去的时间，不和别的测试记下的"现在"的点混在一起
+	now := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC).UnixMilli()
+	const step = 10 * 1000
+	nic := monitor.Labels{"interface": "seed0"}
+	running := &anomalyDetector{}
+	running.configure(600, 3, nil)
+	for t := now - 175*step; t < now; t += step {
+		i := (t - now) / step
+		snap := Snapshot{Timestamp: t}
+		snap.setSection("cpu", monitor.CPUInfo{AvgUsage: 20 + float64(i%3)})
+		snap.setSection("network", []monitor.NetInfo{{Name: "seed0", RecvRate: 50000 + float64(i%5)*1000}})
+		samples := []monitor.Sample{
+			{Metric: "cpu", Value: snap.CPU.AvgUsage},
+			{Metric: "net_recv", Labels: nic, Value: snap.Network[0].RecvRate},
+		}
+		if t < now-90*step {
+			// 一刻钟前拔掉的盘：超过一个窗口没数据，不再要
+			samples = append(samples, monitor.Sample{Metric: "disk", Labels: monitor.Labels{"mountpoint": "/gone"}, Value: 40})
+			snap.setSection("disks", []monitor.DiskInfo{{Mountpoint: "/gone", UsedPercent: 40}})
+		}
+		monitor.Record(t, samples)
+		running.observe(snap)
+	}
+
+	d := &anomalyDetector{}
+	d.configure(600, 3, nil)
+	d.seed(now)
+	if _, ok := d.series["disk:/gone"]; ok {
+		t.Error("seeded a series with nothing in the last window")
+	}
+	for _, id := range []string{"cpu", "net_recv:seed0"} {
+		s, want := d.series[id], running.series[id]
+		if s == nil {
+			t.Fatalf("%s not seeded", id)
+		}
+		if s.rate != want.rate || s.samples != want.samples || s.last != want.last ||
+			math.Abs(s.mean-want.mean) > 1e-9 || math.Abs(s.variance-want.variance) > 1e-6 {
+			t.Errorf("%s seeded as %+v, want %+v", id, *s, *want)
+		}
+	}
+
+	spike := Snapshot{Timestamp: now}
+	spike.setSection("cpu", monitor.CPUInfo{AvgUsage: 95})
+	d.observe(spike)
+	if s := d.series["cpu"].score; !s.Anomalous || s.Since != now {
+		t.Errorf("spike right after the restart: %+v", s)
+	}
+
+	off := &anomalyDetector{}
+	off.seed(now)
+	if off.series != nil {
+		t.Error("a disabled detector was seeded")
+	}
+}
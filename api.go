@@ -0,0 +1,571 @@
+// Copyright (C) 2025 Russell Li (xiaoxinmm)
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"sysmon/monitor"
+)
+
+// REST API under /api/v1/. See docs/api.md.
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	if w.Header().Get("Content-Type") == "" {
+		w.Header().Set("Content-Type", "application/json")
+	}
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, apiError{Error: msg})
+}
+
+// apiAuth is authRequired for API clients: a 401 instead of a redirect.
+func apiAuth(password string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !isAuthenticated(r, password) {
+			writeError(w, http.StatusUnauthorized, "unauthorized")
+			return
+		}
+		next(w, r)
+	}
+}
+
+// snapshotCache stops a script polling the API in a loop from running a
+// full collect() on every request; anything younger than one refresh
+// interval is served as is.
+type snapshotCache struct {
+	mu     sync.Mutex
+	maxAge time.Duration
+	at     time.Time
+	snap   Snapshot
+}
+
+func (sc *snapshotCache) get(maxProcesses int) Snapshot {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if time.Since(sc.at) > sc.maxAge {
+		sc.snap = collect(maxProcesses)
+		sc.at = time.Now()
+	}
+	return sc.snap
+}
+
+// snapshotSection returns one section of a snapshot by its JSON name, if
+// its collector is on and this snapshot has it.
+func snapshotSection(snap Snapshot, name string) (interface{}, bool) {
+	if !snap.has(name) {
+		return nil, false
+	}
+	if v, ok := snap.Extra[name]; ok {
+		return v, true
+	}
+	return builtinSection(snap, name)
+}
+
+// builtinSection returns one of the typed fields of a snapshot.
+func builtinSection(snap Snapshot, name string) (interface{}, bool) {
+	switch name {
+	case "system":
+		return snap.System, true
+	case "cpu":
+		return snap.CPU, true
+	case "memory":
+		return snap.Memory, true
+	case "disks":
+		return snap.Disks, true
+	case "network":
+		return snap.Network, true
+	case "load":
+		return snap.Load, true
+	case "processes":
+		return snap.Processes, true
+	}
+	return nil, false
+}
+
+// parseTime accepts unix seconds or RFC 3339.
+func parseTime(s string) (time.Time, error) {
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(n, 0), nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+// parseRange reads the from/to query parameters; missing ends are open.
+func parseRange(r *http.Request) (from, to time.Time, err error) {
+	q := r.URL.Query()
+	if v := q.Get("from"); v != "" {
+		if from, err = parseTime(v); err != nil {
+			return
+		}
+	}
+	if v := q.Get("to"); v != "" {
+		if to, err = parseTime(v); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// historyLabels are the labels ?<label>= filters series on.
+var historyLabels = []string{"core", "mountpoint", "interface", "container", "pid", "name", "source"}
+
+// historyStep parses ?resolution=: raw (the default) or the step of a
+// rollup tier.
+func historyStep(v string) (time.Duration, bool) {
+	if v == "" || v == "raw" {
+		return 0, true
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return 0, false
+	}
+	for _, tier := range monitor.HistoryTiers() {
+		if tier.Step == d && d > 0 {
+			return d, true
+		}
+	}
+	return 0, false
+}
+
+func filterHistory(points []monitor.HistoryPoint, from, to time.Time) []monitor.HistoryPoint {
+	out := make([]monitor.HistoryPoint, 0, len(points))
+	for _, p := range points {
+		if !from.IsZero() && p.Timestamp < from.Unix() {
+			continue
+		}
+		if !to.IsZero() && p.Timestamp > to.Unix() {
+			continue
+		}
+		out = append(out, p)
+	}
+	return out
+}
+
+// queryWindow parses ?start= and ?end=: end defaults to now, start to an
+// hour before end. On error it has written the response.
+func queryWindow(w http.ResponseWriter, q url.Values, now time.Time) (start, end time.Time, ok bool) {
+	end = now
+	var err error
+	if v := q.Get("end"); v != "" {
+		if end, err = parseTime(v); err != nil {
+			writeError(w, http.StatusBadRequest, "end must be unix seconds or RFC 3339")
+			return start, end, false
+		}
+	}
+	if v := q.Get("start"); v != "" {
+		if start, err = parseTime(v); err != nil {
+			writeError(w, http.StatusBadRequest, "start must be unix seconds or RFC 3339")
+			return start, end, false
+		}
+	} else {
+		start = end.Add(-time.Hour)
+	}
+	return start, end, true
+}
+
+// handleQuery runs a range query: /api/v1/query?select=cpu&select=disk{mountpoint="/"}
+// &start=...&end=...&step=5m&agg=max. end defaults to now, start to an
+// hour before end, step to about 600 points.
+func handleQuery(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	now := time.Now()
+	rq := monitor.RangeQuery{Agg: q.Get("agg")}
+	for _, s := range q["select"] {
+		sel, err := monitor.ParseSelector(s)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		rq.Selectors = append(rq.Selectors, sel)
+	}
+	if len(rq.Selectors) == 0 {
+		writeError(w, http.StatusBadRequest, "select is required, e.g. select=cpu or select=disk{mountpoint=\"/\"}")
+		return
+	}
+	start, end, ok := queryWindow(w, q, now)
+	if !ok {
+		return
+	}
+	rq.Start, rq.End = start.UnixMilli(), end.UnixMilli()
+	if v := q.Get("step"); v != "" && v != "auto" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			// 也接受纯数字秒
+			n, nerr := strconv.Atoi(v)
+			if nerr != nil || n <= 0 {
+				writeError(w, http.StatusBadRequest, "step must be a duration like 30s or 5m, or seconds")
+				return
+			}
+			d = time.Duration(n) * time.Second
+		}
+		rq.Step = d
+	}
+	res, err := monitor.QueryRange(rq, now)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+// handleTopProcesses answers which processes used the most between start
+// and end, from the process history.
+func handleTopProcesses(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	now := time.Now()
+	start, end, ok := queryWindow(w, q, now)
+	if !ok {
+		return
+	}
+	by := q.Get("by")
+	if by == "" {
+		by = "cpu"
+	}
+	limit := 10
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			writeError(w, http.StatusBadRequest, "limit must be a non-negative integer")
+			return
+		}
+		limit = n
+	}
+	res, err := monitor.TopProcesses(start.UnixMilli(), end.UnixMilli(), by, limit, now)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+// processLess returns the ascending order for ?sort= and whether that
+// column is descending by default (usage columns are, pid/name aren't).
+func processLess(field string) (less func(a, b monitor.ProcessInfo) bool, desc bool, ok bool) {
+	switch field {
+	case "", "cpu":
+		return func(a, b monitor.ProcessInfo) bool { return a.CPU < b.CPU }, true, true
+	case "mem":
+		return func(a, b monitor.ProcessInfo) bool { return a.Mem < b.Mem }, true, true
+	case "pid":
+		return func(a, b monitor.ProcessInfo) bool { return a.PID < b.PID }, false, true
+	case "name":
+		return func(a, b monitor.ProcessInfo) bool { return a.Name < b.Name }, false, true
+	}
+	return nil, false, false
+}
+
+func handleProcesses(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	less, desc, ok := processLess(q.Get("sort"))
+	if !ok {
+		writeError(w, http.StatusBadRequest, "sort must be one of cpu, mem, pid, name")
+		return
+	}
+	switch q.Get("order") {
+	case "":
+	case "asc":
+		desc = false
+	case "desc":
+		desc = true
+	default:
+		writeError(w, http.StatusBadRequest, "order must be asc or desc")
+		return
+	}
+	limit := 0
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			writeError(w, http.StatusBadRequest, "bad limit")
+			return
+		}
+		limit = n
+	}
+	name := strings.ToLower(q.Get("name"))
+	status := q.Get("status")
+	var minCPU float64
+	if v := q.Get("minCpu"); v != "" {
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "bad minCpu")
+			return
+		}
+		minCPU = f
+	}
+
+	all := monitor.GetAllProcesses()
+	procs := make([]monitor.ProcessInfo, 0, len(all))
+	for _, p := range all {
+		if name != "" && !strings.Contains(strings.ToLower(p.Name), name) {
+			continue
+		}
+		if status != "" && p.Status != status {
+			continue
+		}
+		if p.CPU < minCPU {
+			continue
+		}
+		procs = append(procs, p)
+	}
+	sort.SliceStable(procs, func(i, j int) bool {
+		if desc {
+			return less(procs[j], procs[i])
+		}
+		return less(procs[i], procs[j])
+	})
+	if limit > 0 && len(procs) > limit {
+		procs = procs[:limit]
+	}
+	writeJSON(w, http.StatusOK, procs)
+}
+
+// ackRequest is the optional body of POST /api/v1/alerts/ack.
+type ackRequest struct {
+	Comment string `json:"comment,omitempty"`
+}
+
+type alertsResponse struct {
+	Active   []alert `json:"active"`   // pending and firing
+	Resolved []alert `json:"resolved"` // most recent first
+}
+
+// apiMethods lists the methods path accepts. Almost everything is read-only.
+func apiMethods(path string) []string {
+	switch {
+	case path == "notifications/test", path == "alerts/ack", path == "history/import":
+		return []string{http.MethodPost}
+	case path == "silences":
+		return []string{http.MethodGet, http.MethodPost}
+	case strings.HasPrefix(path, "silences/"):
+		return []string{http.MethodDelete}
+	}
+	return []string{http.MethodGet}
+}
+
+// readJSON decodes a small request body into v. An empty body leaves v alone.
+func readJSON(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(v)
+	if err != nil && err != io.EOF {
+		writeError(w, http.StatusBadRequest, "bad JSON body: "+err.Error())
+		return false
+	}
+	return true
+}
+
+// sameOrigin rejects writes a browser makes on behalf of some other site
+// (the login cookie would go along). Scripts don't send Origin.
+func sameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && u.Host == r.Host
+}
+
+// handleAPIv1 routes everything under /api/v1/.
+func handleAPIv1(cfg Config) http.HandlerFunc {
+	cache := &snapshotCache{maxAge: time.Duration(cfg.RefreshInterval) * time.Millisecond}
+
+	return apiAuth(cfg.Password, func(w http.ResponseWriter, r *http.Request) {
+		path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/v1"), "/")
+		if methods := apiMethods(path); !containsString(methods, r.Method) {
+			w.Header().Set("Allow", strings.Join(methods, ", "))
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		if r.Method != http.MethodGet && !sameOrigin(r) {
+			writeError(w, http.StatusForbidden, "cross-origin request")
+			return
+		}
+
+		switch {
+		case path == "":
+			writeJSON(w, http.StatusOK, map[string]interface{}{
+				"version": "v1",
+				"endpoints": []string{
+					"/api/v1/snapshot",
+					"/api/v1/snapshot/{section}",
+					"/api/v1/collectors",
+					"/api/v1/history",
+					"/api/v1/history/series",
+					"/api/v1/history/processes",
+					"/api/v1/history/export",
+					"POST /api/v1/history/import",
+					"/api/v1/query",
+					"/api/v1/processes",
+					"/api/v1/containers",
+					"/api/v1/alerts",
+					"/api/v1/alerts/rules",
+					"POST /api/v1/alerts/ack",
+					"/api/v1/silences",
+					"/api/v1/maintenance",
+					"/api/v1/anomalies",
+					"/api/v1/forecast",
+					"/api/v1/notifications",
+					"POST /api/v1/notifications/test",
+				},
+			})
+
+		case path == "snapshot":
+			writeJSON(w, http.StatusOK, cache.get(cfg.MaxProcesses))
+
+		case strings.HasPrefix(path, "snapshot/"):
+			section, ok := snapshotSection(cache.get(cfg.MaxProcesses), strings.TrimPrefix(path, "snapshot/"))
+			if !ok {
+				writeError(w, http.StatusNotFound, "unknown section, or its collector is off")
+				return
+			}
+			writeJSON(w, http.StatusOK, section)
+
+		case path == "collectors":
+			writeJSON(w, http.StatusOK, collectors.status())
+
+		case path == "history":
+			from, to, err := parseRange(r)
+			if err != nil {
+				writeError(w, http.StatusBadRequest, "from/to must be unix seconds or RFC 3339")
+				return
+			}
+			q := r.URL.Query()
+			if q.Get("metric") == "" {
+				writeJSON(w, http.StatusOK, filterHistory(monitor.GetHistory(), from, to))
+				return
+			}
+			match := monitor.Labels{}
+			for _, l := range historyLabels {
+				if v := q.Get(l); v != "" {
+					match[l] = v
+				}
+			}
+			var fromMs, toMs int64
+			if !from.IsZero() {
+				fromMs = from.UnixMilli()
+			}
+			if !to.IsZero() {
+				toMs = to.UnixMilli()
+			}
+			step, ok := historyStep(q.Get("resolution"))
+			if !ok {
+				writeError(w, http.StatusBadRequest, "resolution must be raw, 1m or 1h")
+				return
+			}
+			writeJSON(w, http.StatusOK, monitor.QueryHistory(strings.Split(q.Get("metric"), ","), match, fromMs, toMs, step))
+
+		case path == "history/processes":
+			handleTopProcesses(w, r)
+
+		case path == "history/export":
+			handleHistoryExport(w, r)
+
+		case path == "history/import":
+			handleHistoryImport(w, r)
+
+		case path == "history/series":
+			writeJSON(w, http.StatusOK, monitor.HistorySeries())
+
+		case path == "query":
+			handleQuery(w, r)
+
+		case path == "processes":
+			handleProcesses(w, r)
+
+		case path == "containers":
+			containers := monitor.GetDockerContainers()
+			if containers == nil {
+				containers = []monitor.DockerContainer{}
+			}
+			writeJSON(w, http.StatusOK, containers)
+
+		case path == "alerts":
+			writeJSON(w, http.StatusOK, alertsResponse{Active: alerts.list(), Resolved: alerts.recentlyResolved()})
+
+		case path == "alerts/rules":
+			writeJSON(w, http.StatusOK, alerts.ruleList())
+
+		case path == "alerts/ack":
+			var req ackRequest
+			if !readJSON(w, r, &req) {
+				return
+			}
+			a, err := alerts.ack(r.URL.Query().Get("id"), req.Comment)
+			switch err {
+			case nil:
+				writeJSON(w, http.StatusOK, a)
+			case errNoAlert:
+				writeError(w, http.StatusNotFound, err.Error())
+			default:
+				writeError(w, http.StatusConflict, err.Error())
+			}
+
+		case path == "silences" && r.Method == http.MethodGet:
+			writeJSON(w, http.StatusOK, alerts.silenceList())
+
+		case path == "silences":
+			var req silenceRequest
+			if !readJSON(w, r, &req) {
+				return
+			}
+			s, err := alerts.addSilence(req)
+			if err != nil {
+				writeError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			writeJSON(w, http.StatusCreated, s)
+
+		case strings.HasPrefix(path, "silences/"):
+			if err := alerts.deleteSilence(strings.TrimPrefix(path, "silences/")); err != nil {
+				writeError(w, http.StatusNotFound, err.Error())
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+
+		case path == "maintenance":
+			writeJSON(w, http.StatusOK, alerts.maintenanceList())
+
+		case path == "forecast":
+			writeJSON(w, http.StatusOK, forecasts.list())
+
+		case path == "anomalies":
+			writeJSON(w, http.StatusOK, anomalies.scores())
+
+		case path == "notifications":
+			writeJSON(w, http.StatusOK, alerts.notify.list())
+
+		case path == "notifications/test":
+			results, ok := alerts.notify.test(r.URL.Query().Get("channel"))
+			if !ok {
+				writeError(w, http.StatusNotFound, "no such notification channel")
+				return
+			}
+			writeJSON(w, http.StatusOK, results)
+
+		default:
+			writeError(w, http.StatusNotFound, "not found")
+		}
+	})
+}
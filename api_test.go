@@ -0,0 +1,67 @@
+// Copyright (C) 2025 Russell Li (xiaoxinmm)
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// TestAPIRouter checks what the router decides before any handler runs:
+// the method, the origin of writes, unknown paths and the login.
+func TestAPIRouter(t *testing.T) {
+	api := handleAPIv1(Config{RefreshInterval: 1000})
+	for _, tc := range []struct {
+		method, path, origin string
+		code                 int
+		allow, err           string
+	}{
+		{"GET", "/api/v1/", "", http.StatusOK, "", ""},
+		{"GET", "/api/v1/nope", "", http.StatusNotFound, "", "not found"},
+		{"GET", "/api/v1/collectors/", "", http.StatusOK, "", ""},
+		{"POST", "/api/v1/anomalies", "", http.StatusMethodNotAllowed, "GET", "method not allowed"},
+		{"GET", "/api/v1/alerts/ack", "", http.StatusMethodNotAllowed, "POST", "method not allowed"},
+		{"PUT", "/api/v1/silences", "", http.StatusMethodNotAllowed, "GET, POST", "method not allowed"},
+		{"GET", "/api/v1/silences/abc", "", http.StatusMethodNotAllowed, "DELETE", "method not allowed"},
+		// 别的站点借浏览器的 cookie 来写：拒绝；读不管
+		{"POST", "/api/v1/alerts/ack?id=nope", "http://evil.example", http.StatusForbidden, "", "cross-origin request"},
+		{"DELETE", "/api/v1/silences/nope", "http://evil.example", http.StatusForbidden, "", "cross-origin request"},
+		{"POST", "/api/v1/alerts/ack?id=nope", "http://example.com", http.StatusNotFound, "", ""},
+		{"POST", "/api/v1/alerts/ack?id=nope", "", http.StatusNotFound, "", ""},
+		{"GET", "/api/v1/silences", "http://evil.example", http.StatusOK, "", ""},
+	} {
+		r := httptest.NewRequest(tc.method, tc.path, nil) // Host 是 example.com
+		if tc.origin != "" {
+			r.Header.Set("Origin", tc.origin)
+		}
+		w := httptest.NewRecorder()
+		api(w, r)
+		var body apiError
+		json.Unmarshal(w.Body.Bytes(), &body)
+		if w.Code != tc.code || w.Header().Get("Allow") != tc.allow || (tc.err != "" && body.Error != tc.err) {
+			t.Errorf("%s %s (Origin %q): %d, Allow %q, %s", tc.method, tc.path, tc.origin, w.Code, w.Header().Get("Allow"), strings.TrimSpace(w.Body.String()))
+		}
+	}
+
+	w := httptest.NewRecorder()
+	handleAPIv1(Config{RefreshInterval: 1000, Password: "pw"})(w, httptest.NewRequest("GET", "/api/v1/collectors", nil))
+	if w.Code != http.StatusUnauthorized || !strings.Contains(w.Body.String(), `"unauthorized"`) {
+		t.Errorf("no login: %d %s", w.Code, w.Body)
+	}
+}
@@ -0,0 +1,181 @@
+// Copyright (C) 2025 Russell Li (xiaoxinmm)
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"strconv"
+	"time"
+
+	"sysmon/monitor"
+)
+
+// collectIdle takes what background work (history, anomaly detection)
+// needs while nobody is watching: everything but the process walk, the
+// system info and the CPU model lookup. Disabled collectors stay off here
+// too.
+func collectIdle() Snapshot {
+	snap := Snapshot{Timestamp: time.Now().UnixMilli()}
+	if collectors.on("cpu") {
+		snap.setSection("cpu", monitor.GetCPUUsage())
+	}
+	if collectors.on("memory") {
+		snap.setSection("memory", monitor.GetMemInfo())
+	}
+	if collectors.on("disks") {
+		snap.setSection("disks", monitor.GetDiskInfo())
+	}
+	if collectors.on("network") {
+		snap.setSection("network", monitor.GetNetInfo())
+	}
+	if collectors.on("load") {
+		snap.setSection("load", monitor.GetLoadInfo())
+	}
+	return snap
+}
+
+// recordHistory stores a snapshot's values in the history store. The
+// sections of collectors that are off are skipped.
+func recordHistory(snap Snapshot) {
+	var samples []monitor.Sample
+	if snap.has("cpu") {
+		samples = append(samples, monitor.Sample{Metric: "cpu", Value: snap.CPU.AvgUsage})
+	}
+	if snap.has("memory") {
+		samples = append(samples, monitor.Sample{Metric: "memory", Value: snap.Memory.UsedPercent})
+	}
+	if snap.has("memory") && snap.Memory.SwapTotal > 0 {
+		samples = append(samples, monitor.Sample{Metric: "swap", Value: snap.Memory.SwapPercent})
+	}
+	for i, u := range snap.CPU.Usage {
+		samples = append(samples, monitor.Sample{Metric: "cpu_core", Labels: monitor.Labels{"core": strconv.Itoa(i)}, Value: u})
+	}
+	if snap.has("load") {
+		samples = append(samples,
+			monitor.Sample{Metric: "load1", Value: snap.Load.Load1},
+			monitor.Sample{Metric: "load5", Value: snap.Load.Load5},
+			monitor.Sample{Metric: "load15", Value: snap.Load.Load15})
+	}
+	for _, d := range snap.Disks {
+		samples = append(samples, monitor.Sample{Metric: "disk", Labels: monitor.Labels{"mountpoint": d.Mountpoint}, Value: d.UsedPercent})
+	}
+	for _, n := range snap.Network {
+		l := monitor.Labels{"interface": n.Name}
+		samples = append(samples,
+			monitor.Sample{Metric: "net_recv", Labels: l, Value: n.RecvRate},
+			monitor.Sample{Metric: "net_send", Labels: l, Value: n.SendRate})
+	}
+	monitor.Record(snap.Timestamp, samples)
+}
+
+// recordContainers stores the running containers' CPU and memory.
+func recordContainers(t int64, containers []monitor.DockerContainer) {
+	var samples []monitor.Sample
+	for _, c := range containers {
+		if c.State != "running" {
+			continue
+		}
+		l := monitor.Labels{"container": c.Name}
+		samples = append(samples,
+			monitor.Sample{Metric: "container_cpu", Labels: l, Value: c.CPUPct},
+			monitor.Sample{Metric: "container_memory", Labels: l, Value: float64(c.MemUsage)})
+	}
+	if len(samples) > 0 {
+		monitor.Record(t, samples)
+	}
+}
+
+// snapshotSink gets every full snapshot the broadcaster collects (output
+// writers, the alert engine). publish must not block.
+type snapshotSink interface {
+	publish(snap Snapshot)
+}
+
+// runBroadcaster collects and pushes snapshots every RefreshInterval while
+// clients are connected. With no clients it drops to collectIdle every
+// IdleInterval, and switches back as soon as the hub reports a connection.
+// Sinks want full snapshots, so with any configured it never idles.
+// The hub writes to clients on its own goroutine, so a slow one never
+// holds up history, anomalies or the sinks.
+func runBroadcaster(cfg Config, h *hub, sinks []snapshotSink) {
+	active := time.Duration(cfg.RefreshInterval) * time.Millisecond
+	idle := time.Duration(cfg.IdleInterval) * time.Millisecond
+	if idle < active {
+		idle = active
+	}
+
+	timer := time.NewTimer(active)
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+		case <-h.wake:
+			// the /ws handler has just sent a fresh snapshot itself, so
+			// don't collect again right away; just get back on the fast clock
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+			timer.Reset(active)
+			continue
+		}
+
+		if h.count() == 0 && len(sinks) == 0 {
+			snap := collectIdle()
+			recordHistory(snap)
+			anomalies.observe(snap)
+			timer.Reset(idle)
+			continue
+		}
+
+		snap := collect(cfg.MaxProcesses)
+		recordHistory(snap)
+		anomalies.observe(snap)
+		h.broadcastSnapshot(snap)
+		for _, sink := range sinks {
+			sink.publish(snap)
+		}
+		timer.Reset(active)
+	}
+}
+
+// runDockerPoller records container stats every 5s, and pushes them while
+// someone is connected. Listing containers means one Docker API call per
+// container, so nobody watching means every idle interval instead.
+func runDockerPoller(h *hub, idle time.Duration) {
+	const every = 5 * time.Second
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+	idleTicks := max(1, int(idle/every))
+	ticks := 0
+	for now := range ticker.C {
+		watched := h.count() > 0
+		ticks++
+		if !watched && ticks < idleTicks {
+			continue
+		}
+		ticks = 0
+		containers := monitor.GetDockerContainers()
+		if containers == nil {
+			continue
+		}
+		recordContainers(now.UnixMilli(), containers)
+		if watched {
+			h.broadcast("docker", wsMessage{Type: "docker", Payload: containers})
+		}
+	}
+}
@@ -0,0 +1,141 @@
+// Copyright (C) 2025 Russell Li (xiaoxinmm)
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"sysmon/monitor"
+
+	"github.com/gorilla/websocket"
+)
+
+// TestIdleSnapshotFeedsHistory checks nobody watching only costs the
+// process walk: every other series is still recorded.
+func TestIdleSnapshotFeedsHistory(t *testing.T) {
+	snap := collectIdle()
+	for _, name := range []string{"cpu", "memory", "disks", "network", "load"} {
+		if !snap.has(name) {
+			t.Errorf("idle snapshot has no %s", name)
+		}
+	}
+	for _, name := range []string{"processes", "system"} {
+		if snap.has(name) {
+			t.Errorf("idle snapshot has %s", name)
+		}
+	}
+	if len(snap.CPU.Usage) == 0 {
+		t.Error("idle snapshot has no per-core usage")
+	}
+
+	recordHistory(snap)
+	recorded := make(map[string]bool)
+	for _, s := range monitor.HistorySeries() {
+		recorded[s.Metric] = true
+	}
+	for _, m := range []string{"cpu", "memory", "cpu_core", "load1", "load15"} {
+		if !recorded[m] {
+			t.Errorf("idle snapshot didn't record %s", m)
+		}
+	}
+}
+
+// drain waits until the hub has delivered everything broadcast so far.
+func (h *hub) drain() {
+	for {
+		h.qmu.Lock()
+		idle := len(h.queue) == 0 && h.snap == nil && !h.delivering
+		h.qmu.Unlock()
+		if idle {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// TestStalledClientDropped is a dashboard that stops reading. While the
+// hub is stuck writing to it, alerts and anomalies still broadcast
+// without waiting, and once a write times out the client is dropped.
+func TestStalledClientDropped(t *testing.T) {
+	saved := clientWriteTimeout
+	clientWriteTimeout = time.Second
+	t.Cleanup(func() { clientWriteTimeout = saved })
+
+	h := newHub()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		h.add(newClient(wsTransport{conn}, r, jsonCodec, clientLimits{minInterval: time.Second, maxProcs: 10}))
+	}))
+	defer srv.Close()
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close() // 连上了但从不读
+	for h.count() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// 推到 TCP 窗口满、投递卡在写上（一直拿着 hub.mu）为止
+	snap := collectIdle()
+	snap.setSection("processes", make([]monitor.ProcessInfo, 5000))
+	deadline := time.Now().Add(5 * time.Second)
+	for held := 0; held < 10; {
+		if time.Now().After(deadline) {
+			t.Fatal("the client never stalled")
+		}
+		h.broadcastSnapshot(snap)
+		if h.mu.TryLock() {
+			h.mu.Unlock()
+			held = 0
+		} else {
+			held++
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	e := &alertEngine{active: make(map[string]*alert), notify: &notifications{}}
+	if err := e.configure([]AlertRule{{Name: "hot", Metric: "cpu", Threshold: 90}}, h); err != nil {
+		t.Fatal(err)
+	}
+	hot := Snapshot{Timestamp: time.Now().UnixMilli()}
+	hot.setSection("cpu", monitor.CPUInfo{AvgUsage: 99})
+	start := time.Now()
+	e.evaluate(hot, nil)
+	h.broadcast("anomalies", wsMessage{Type: "anomalies", Payload: []anomalyScore{}})
+	if took := time.Since(start); took > 100*time.Millisecond {
+		t.Errorf("alert evaluation waited %s behind a stalled client", took)
+	}
+	if a := e.active["hot"]; a == nil || a.State != alertFiring {
+		t.Errorf("alert %+v, want firing", a)
+	}
+
+	deadline = time.Now().Add(10 * time.Second)
+	for h.count() > 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("stalled client was never dropped")
+		}
+		h.broadcastSnapshot(snap)
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,453 @@
+// Copyright (C) 2025 Russell Li (xiaoxinmm)
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"sysmon/monitor"
+
+	"github.com/gorilla/websocket"
+)
+
+// Control protocol: JSON text frames sent by the client on /ws.
+//
+//	{"type":"subscribe","topics":["cpu","memory"]}  replace the topic set
+//	{"type":"config","interval":5000,"maxProcesses":10}
+//	{"type":"pause"} / {"type":"resume"}
+//	{"type":"resync"}                               delta mode only
+//
+// The same settings can be given up front as query parameters:
+// /ws?topics=cpu,memory&interval=5000&procs=10. After every change the
+// server answers with a "settings" message holding the effective values.
+
+var allTopics = []string{"cpu", "memory", "disks", "network", "processes", "docker", "history", "alerts", "anomalies"}
+
+// topicKeys maps snapshot topics to the snapshot fields they cover.
+// "system" and "timestamp" are always sent.
+var topicKeys = map[string][]string{
+	"cpu":       {"cpu", "load"},
+	"memory":    {"memory"},
+	"disks":     {"disks"},
+	"network":   {"network"},
+	"processes": {"processes"},
+}
+
+// clientLimits are the server-side bounds for per-client settings.
+type clientLimits struct {
+	minInterval time.Duration // 不能比服务端刷新更快
+	maxProcs    int
+}
+
+const maxClientInterval = time.Minute
+
+// transport is how messages reach a client: a websocket, or an SSE
+// response. id is the hub event id (0 for messages that aren't
+// broadcasts) and msgType the message's "type", for transports that
+// label their frames.
+type transport interface {
+	send(id uint64, msgType string, frame int, data []byte) error
+	// shutdown tells the client the server is going away, then closes.
+	shutdown(reason string)
+	close()
+}
+
+// clientWriteTimeout bounds one write to a client. A client that stops
+// reading fills its TCP window; past this its write fails and the hub
+// drops it, instead of holding up everyone else.
+var clientWriteTimeout = 10 * time.Second
+
+type wsTransport struct {
+	conn *websocket.Conn
+}
+
+func (t wsTransport) send(_ uint64, _ string, frame int, data []byte) error {
+	t.conn.SetWriteDeadline(time.Now().Add(clientWriteTimeout))
+	return t.conn.WriteMessage(frame, data)
+}
+
+func (t wsTransport) shutdown(reason string) {
+	t.conn.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseGoingAway, reason),
+		time.Now().Add(time.Second))
+	t.conn.Close()
+}
+
+func (t wsTransport) close() { t.conn.Close() }
+
+// client is one dashboard connection. The mutex serialises writes and
+// guards everything below it.
+type client struct {
+	out    transport
+	codec  *codec
+	limits clientLimits
+
+	mu       sync.Mutex
+	delta    *deltaState     // nil = 每次推完整快照（旧协议）
+	topics   map[string]bool // nil = 全部
+	interval time.Duration   // 0 = 跟随服务端
+	maxProcs int             // 0 = 服务端上限
+	paused   bool
+	history  []string // history 消息要哪些指标的序列；nil = 旧的 CPU/内存格式
+	lastSent time.Time
+}
+
+type clientSettings struct {
+	Topics       []string `json:"topics"`
+	Interval     int      `json:"interval"`
+	MaxProcesses int      `json:"maxProcesses"`
+	Paused       bool     `json:"paused"`
+	History      []string `json:"history,omitempty"`
+}
+
+func newClient(out transport, r *http.Request, cd *codec, limits clientLimits) *client {
+	c := &client{out: out, codec: cd, limits: limits}
+	q := r.URL.Query()
+	if q.Get("mode") == "delta" {
+		c.delta = &deltaState{}
+	}
+	if v := q.Get("topics"); v != "" {
+		c.setTopicsLocked(strings.Split(v, ","))
+	}
+	if n, err := strconv.Atoi(q.Get("interval")); err == nil {
+		c.setIntervalLocked(n)
+	}
+	if v := q.Get("history"); v != "" {
+		c.setHistoryLocked(strings.Split(v, ","))
+	}
+	if n, err := strconv.Atoi(q.Get("procs")); err == nil {
+		c.setMaxProcsLocked(n)
+	}
+	return c
+}
+
+func (c *client) setTopicsLocked(topics []string) {
+	c.topics = make(map[string]bool)
+	for _, t := range topics {
+		t = strings.TrimSpace(t)
+		for _, known := range allTopics {
+			if t == known {
+				c.topics[t] = true
+			}
+		}
+	}
+}
+
+func (c *client) setIntervalLocked(ms int) {
+	d := time.Duration(ms) * time.Millisecond
+	if d <= 0 {
+		c.interval = 0
+		return
+	}
+	if d < c.limits.minInterval {
+		d = c.limits.minInterval
+	}
+	if d > maxClientInterval {
+		d = maxClientInterval
+	}
+	c.interval = d
+}
+
+func (c *client) setMaxProcsLocked(n int) {
+	if n < 0 || n > c.limits.maxProcs {
+		n = 0
+	}
+	c.maxProcs = n
+}
+
+func (c *client) wantsLocked(topic string) bool {
+	return c.topics == nil || c.topics[topic]
+}
+
+func (c *client) settingsLocked() clientSettings {
+	s := clientSettings{Paused: c.paused, MaxProcesses: c.limits.maxProcs, Interval: int(c.limits.minInterval.Milliseconds())}
+	for _, t := range allTopics {
+		if c.wantsLocked(t) {
+			s.Topics = append(s.Topics, t)
+		}
+	}
+	if c.interval > 0 {
+		s.Interval = int(c.interval.Milliseconds())
+	}
+	if c.maxProcs > 0 {
+		s.MaxProcesses = c.maxProcs
+	}
+	s.History = c.history
+	return s
+}
+
+// viewLocked returns the part of gen this client subscribed to. gen is
+// shared with other clients, so it is copied shallowly, never modified.
+func (c *client) viewLocked(gen map[string]interface{}) map[string]interface{} {
+	view := make(map[string]interface{}, len(gen))
+	for k, v := range gen {
+		view[k] = v
+	}
+	for topic, keys := range topicKeys {
+		if c.wantsLocked(topic) {
+			continue
+		}
+		for _, k := range keys {
+			delete(view, k)
+		}
+	}
+	if procs, ok := view["processes"].([]interface{}); ok && c.maxProcs > 0 && len(procs) > c.maxProcs {
+		view["processes"] = procs[:c.maxProcs]
+	}
+	return view
+}
+
+func (c *client) sendLocked(msg wsMessage) error {
+	data, err := c.codec.marshal(msg)
+	if err != nil {
+		return err
+	}
+	return c.out.send(0, msg.Type, c.codec.frame, data)
+}
+
+func (c *client) send(msg wsMessage) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.sendLocked(msg)
+}
+
+// sendTopic sends a pre-encoded broadcast if the client wants topic.
+func (c *client) sendTopic(id uint64, topic string, enc *encodedMessage) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.paused || !c.wantsLocked(topic) {
+		return nil
+	}
+	data, err := enc.bytes(c.codec)
+	if err != nil {
+		return err
+	}
+	return c.out.send(id, enc.msg.Type, c.codec.frame, data)
+}
+
+// sendSnapshot pushes one tick to the client, unless it is paused or its
+// own interval hasn't elapsed yet. Unfiltered legacy clients share the
+// pre-encoded full message; everyone else gets their view of gen (the
+// generic form of the snapshot), as a delta if they asked for one.
+func (c *client) sendSnapshot(id uint64, gen map[string]interface{}, full *encodedMessage, now time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.paused {
+		return nil
+	}
+	// 允许半个服务端周期的误差，不然 ticker 抖一下就会多等一轮
+	if c.interval > 0 && now.Sub(c.lastSent) < c.interval-c.limits.minInterval/2 {
+		return nil
+	}
+
+	var data []byte
+	var err error
+	msgType := "snapshot"
+	switch {
+	case c.delta != nil:
+		msg := c.delta.next(c.viewLocked(gen))
+		msgType = msg.Type
+		data, err = c.codec.marshal(msg)
+	case c.topics != nil || c.maxProcs > 0:
+		data, err = c.codec.marshal(wsMessage{Type: "snapshot", Payload: c.viewLocked(gen)})
+	default:
+		data, err = full.bytes(c.codec)
+	}
+	if err != nil {
+		return err
+	}
+	c.lastSent = now
+	return c.out.send(id, msgType, c.codec.frame, data)
+}
+
+// setHistoryLocked picks the metrics the history message carries as
+// series; "*" is all of them, an empty list goes back to the old format.
+func (c *client) setHistoryLocked(metrics []string) {
+	c.history = nil
+	for _, m := range metrics {
+		if m = strings.TrimSpace(m); m != "" {
+			c.history = append(c.history, m)
+		}
+	}
+}
+
+func (c *client) sendHistoryLocked() error {
+	if !c.wantsLocked("history") {
+		return nil
+	}
+	if c.history != nil {
+		return c.sendLocked(wsMessage{Type: "history", Payload: monitor.QueryHistory(c.history, nil, 0, 0, 0)})
+	}
+	history := monitor.GetHistory()
+	if len(history) == 0 {
+		return nil
+	}
+	return c.sendLocked(wsMessage{Type: "history", Payload: history})
+}
+
+// sendAlertsLocked sends the pending and firing alerts as one list; after
+// that the client follows along with alert messages.
+func (c *client) sendAlertsLocked() error {
+	if !c.wantsLocked("alerts") || !alerts.enabled() {
+		return nil
+	}
+	return c.sendLocked(wsMessage{Type: "alerts", Payload: alerts.list()})
+}
+
+// sendAnomaliesLocked sends the current anomaly scores; after that the
+// client gets a new list whenever a series turns anomalous or normal.
+func (c *client) sendAnomaliesLocked() error {
+	if !c.wantsLocked("anomalies") || !anomalies.enabled() {
+		return nil
+	}
+	return c.sendLocked(wsMessage{Type: "anomalies", Payload: anomalies.scores()})
+}
+
+// sendInitial sends what a client gets on connect: a fresh snapshot, the
+// history buffer, the current alerts and anomaly scores.
+func (c *client) sendInitial(maxProcesses int) {
+	snap := collect(maxProcesses)
+	if gen, err := toGeneric(snap); err == nil {
+		full := snapshotMessage(snap, gen)
+		c.sendSnapshot(0, gen, full, time.Now())
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.sendHistoryLocked()
+	c.sendAlertsLocked()
+	c.sendAnomaliesLocked()
+}
+
+type controlMessage struct {
+	Type         string   `json:"type"`
+	Topics       []string `json:"topics"`
+	Interval     *int     `json:"interval"`
+	MaxProcesses *int     `json:"maxProcesses"`
+	Metrics      []string `json:"metrics"` // history
+}
+
+// handleControl applies one control message and sends the reply.
+func (c *client) handleControl(msg controlMessage) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch msg.Type {
+	case "resync":
+		if c.delta == nil {
+			return nil
+		}
+		if kf, ok := c.delta.keyframe(); ok {
+			return c.sendLocked(kf)
+		}
+		return nil
+	case "subscribe":
+		hadHistory, hadAlerts, hadAnomalies := c.wantsLocked("history"), c.wantsLocked("alerts"), c.wantsLocked("anomalies")
+		c.setTopicsLocked(msg.Topics)
+		if !hadHistory {
+			if err := c.sendHistoryLocked(); err != nil {
+				return err
+			}
+		}
+		if !hadAlerts {
+			if err := c.sendAlertsLocked(); err != nil {
+				return err
+			}
+		}
+		if !hadAnomalies {
+			if err := c.sendAnomaliesLocked(); err != nil {
+				return err
+			}
+		}
+	case "config":
+		if msg.Interval != nil {
+			c.setIntervalLocked(*msg.Interval)
+		}
+		if msg.MaxProcesses != nil {
+			c.setMaxProcsLocked(*msg.MaxProcesses)
+		}
+	case "history":
+		c.setHistoryLocked(msg.Metrics)
+		if err := c.sendHistoryLocked(); err != nil {
+			return err
+		}
+	case "pause":
+		c.paused = true
+	case "resume":
+		c.paused = false
+		c.lastSent = time.Time{} // 下一轮立即推送
+	default:
+		return nil
+	}
+	return c.sendLocked(wsMessage{Type: "settings", Payload: c.settingsLocked()})
+}
+
+// readLoop 处理 websocket 客户端发来的控制消息。
+// 控制消息不管协商了哪种编码，一律是 JSON 文本帧。
+func (c *client) readLoop(conn *websocket.Conn) {
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		var msg controlMessage
+		if json.Unmarshal(data, &msg) != nil {
+			continue
+		}
+		if err := c.handleControl(msg); err != nil {
+			log.Printf("ws: %s failed: %v", msg.Type, err)
+			return
+		}
+	}
+}
+
+// handleWebSocket serves /ws: it takes a slot from limit, upgrades with
+// the negotiated codec and sends the initial messages; readLoop then
+// runs until the dashboard goes away.
+func handleWebSocket(cfg Config, h *hub, limit *connLimiter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !isAuthenticated(r, cfg.Password) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		release, reason := limit.acquire(clientIP(r))
+		if release == nil {
+			rejectWebSocket(w, r, reason)
+			return
+		}
+		cd, hdr := negotiateCodec(r)
+		conn, err := upgrader.Upgrade(w, r, hdr)
+		if err != nil {
+			release()
+			log.Printf("websocket upgrade error: %v", err)
+			return
+		}
+		conn.SetReadLimit(int64(cfg.MaxMessageSize))
+		c := newClient(wsTransport{conn}, r, cd, cfg.clientLimits())
+		h.add(c)
+		c.sendInitial(cfg.MaxProcesses)
+
+		go func() {
+			defer release()
+			defer h.remove(c)
+			c.readLoop(conn)
+		}()
+	}
+}
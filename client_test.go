@@ -0,0 +1,143 @@
+// Copyright (C) 2025 Russell Li (xiaoxinmm)
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"sysmon/monitor"
+
+	"github.com/gorilla/websocket"
+)
+
+// TestClientSubscriptions is a dashboard on /ws that picks its topics,
+// process count and interval, pauses and resumes, and only ever gets
+// what it asked for.
+func TestClientSubscriptions(t *testing.T) {
+	h := newHub()
+	cfg := Config{RefreshInterval: 1000, MaxProcesses: 10, MaxMessageSize: 4096}
+	srv := httptest.NewServer(handleWebSocket(cfg, h, newConnLimiter("dashboard connections", 0, 0)))
+	defer srv.Close()
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/ws?topics=cpu,docker&procs=2", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	read := func() (string, json.RawMessage) {
+		t.Helper()
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		var msg struct {
+			Type    string          `json:"type"`
+			Payload json.RawMessage `json:"payload"`
+		}
+		if err := conn.ReadJSON(&msg); err != nil {
+			t.Fatal(err)
+		}
+		return msg.Type, msg.Payload
+	}
+	sections := func(payload json.RawMessage) map[string]json.RawMessage {
+		t.Helper()
+		var m map[string]json.RawMessage
+		if err := json.Unmarshal(payload, &m); err != nil {
+			t.Fatal(err)
+		}
+		return m
+	}
+	control := func(msg string) clientSettings {
+		t.Helper()
+		if err := conn.WriteMessage(websocket.TextMessage, []byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+		typ, payload := read()
+		if typ != "settings" {
+			t.Fatalf("%s: got %s before the settings", msg, typ)
+		}
+		var s clientSettings
+		json.Unmarshal(payload, &s)
+		return s
+	}
+
+	typ, payload := read()
+	if s := sections(payload); typ != "snapshot" || s["cpu"] == nil || s["load"] == nil || s["memory"] != nil || s["processes"] != nil {
+		t.Errorf("initial %s with %v, want cpu and load only", typ, keys(s))
+	}
+
+	snap := collectIdle()
+	snap.setSection("processes", make([]monitor.ProcessInfo, 5))
+	h.broadcast("alerts", wsMessage{Type: "alert", Payload: alert{}})
+	h.broadcast("docker", wsMessage{Type: "docker", Payload: []interface{}{}})
+	h.broadcastSnapshot(snap)
+	if typ, _ := read(); typ != "docker" {
+		t.Errorf("got %s, want docker (alerts not subscribed)", typ)
+	}
+	if typ, payload := read(); typ != "snapshot" || sections(payload)["memory"] != nil {
+		t.Errorf("got %s, want a snapshot without memory", typ)
+	}
+
+	// 换成只要进程：最多 2 个，cpu 和 docker 都不再推
+	if s := control(`{"type":"subscribe","topics":["processes"]}`); !reflect.DeepEqual(s.Topics, []string{"processes"}) || s.MaxProcesses != 2 {
+		t.Errorf("settings after subscribe %+v", s)
+	}
+	h.broadcast("docker", wsMessage{Type: "docker", Payload: []interface{}{}})
+	h.broadcastSnapshot(snap)
+	typ, payload = read()
+	s := sections(payload)
+	var procs []monitor.ProcessInfo
+	json.Unmarshal(s["processes"], &procs)
+	if typ != "snapshot" || s["cpu"] != nil || len(procs) != 2 {
+		t.Errorf("got %s with %v and %d processes, want processes only, 2 of them", typ, keys(s), len(procs))
+	}
+
+	// 暂停期间什么都不推；恢复后 5 秒的间隔里只推一次
+	if s := control(`{"type":"config","interval":5000}`); s.Interval != 5000 {
+		t.Errorf("interval %d, want 5000", s.Interval)
+	}
+	if s := control(`{"type":"pause"}`); !s.Paused {
+		t.Error("not paused")
+	}
+	h.broadcastSnapshot(snap)
+	h.drain()
+	if s := control(`{"type":"resume"}`); s.Paused {
+		t.Error("still paused")
+	}
+	for i := 0; i < 3; i++ {
+		h.broadcastSnapshot(snap)
+		h.drain()
+	}
+	if err := conn.WriteMessage(websocket.TextMessage, []byte(`{"type":"config","maxProcesses":1}`)); err != nil {
+		t.Fatal(err)
+	}
+	if typ, _ := read(); typ != "snapshot" {
+		t.Errorf("got %s after resuming, want a snapshot", typ)
+	}
+	if typ, _ := read(); typ != "settings" {
+		t.Errorf("got %s, want settings (one snapshot per interval)", typ)
+	}
+}
+
+func keys(m map[string]json.RawMessage) []string {
+	var out []string
+	for k := range m {
+		out = append(out, k)
+	}
+	return out
+}
@@ -0,0 +1,110 @@
+// Copyright (C) 2025 Russell Li (xiaoxinmm)
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/gorilla/websocket"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// codec is a wire encoding for /ws messages, picked per connection through
+// Sec-WebSocket-Protocol. Field names are the json tags in every encoding,
+// so a decoded MessagePack or CBOR message looks exactly like the JSON one.
+type codec struct {
+	name        string
+	subprotocol string
+	frame       int // websocket.TextMessage / BinaryMessage
+	marshal     func(v interface{}) ([]byte, error)
+}
+
+var jsonCodec = &codec{
+	name:        "json",
+	subprotocol: "sysmon.json",
+	frame:       websocket.TextMessage,
+	marshal:     json.Marshal,
+}
+
+var msgpackCodec = &codec{
+	name:        "msgpack",
+	subprotocol: "sysmon.msgpack",
+	frame:       websocket.BinaryMessage,
+	marshal: func(v interface{}) ([]byte, error) {
+		var buf bytes.Buffer
+		enc := msgpack.NewEncoder(&buf)
+		enc.SetCustomStructTag("json")
+		enc.UseCompactInts(true)
+		enc.UseCompactFloats(true)
+		if err := enc.Encode(v); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	},
+}
+
+// cborEnc 用最短浮点编码，数值无损
+var cborEnc, _ = cbor.EncOptions{ShortestFloat: cbor.ShortestFloat16}.EncMode()
+
+var cborCodec = &codec{
+	name:        "cbor",
+	subprotocol: "sysmon.cbor",
+	frame:       websocket.BinaryMessage,
+	marshal:     cborEnc.Marshal,
+}
+
+var codecs = []*codec{jsonCodec, msgpackCodec, cborCodec}
+
+// negotiateCodec picks the first subprotocol offered by the client that we
+// support, honouring the client's order. No match (or no header) is JSON.
+// The returned header must be passed to Upgrade so the choice is echoed.
+func negotiateCodec(r *http.Request) (*codec, http.Header) {
+	for _, offered := range websocket.Subprotocols(r) {
+		for _, c := range codecs {
+			if strings.EqualFold(offered, c.subprotocol) {
+				return c, http.Header{"Sec-Websocket-Protocol": {c.subprotocol}}
+			}
+		}
+	}
+	return jsonCodec, nil
+}
+
+// encodedMessage caches the encodings of one broadcast message, so each
+// codec marshals it at most once per tick.
+type encodedMessage struct {
+	msg   wsMessage
+	cache map[*codec][]byte
+}
+
+func newEncodedMessage(msg wsMessage) *encodedMessage {
+	return &encodedMessage{msg: msg, cache: make(map[*codec][]byte)}
+}
+
+func (e *encodedMessage) bytes(c *codec) ([]byte, error) {
+	if data, ok := e.cache[c]; ok {
+		return data, nil
+	}
+	data, err := c.marshal(e.msg)
+	if err != nil {
+		return nil, err
+	}
+	e.cache[c] = data
+	return data, nil
+}
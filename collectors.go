@@ -0,0 +1,226 @@
+// Copyright (C) 2025 Russell Li (xiaoxinmm)
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"sysmon/monitor"
+)
+
+// Snapshot sections come from the collectors registered in the monitor
+// package (monitor/collector.go). disableCollectors turns some off; the
+// built-in ones fill Snapshot's typed fields, the others go into Extra,
+// and either way a section that wasn't collected is left out of the JSON.
+// GET /api/v1/collectors lists them.
+
+// collectorSet is the enabled collectors and how each one last went.
+type collectorSet struct {
+	enabled  []monitor.Collector
+	disabled map[string]bool
+
+	mu     sync.Mutex
+	errors map[string]collectorError
+}
+
+type collectorError struct {
+	msg string
+	at  int64 // unix ms
+}
+
+// CollectorStatus is one entry of GET /api/v1/collectors.
+type CollectorStatus struct {
+	Name      string `json:"name"`
+	Builtin   bool   `json:"builtin"`
+	Enabled   bool   `json:"enabled"`
+	Error     string `json:"error,omitempty"` // 最近一次采集失败的原因
+	ErrorTime int64  `json:"errorTime,omitempty"`
+}
+
+var collectors = newCollectorSet(nil)
+
+func newCollectorSet(disable []string) *collectorSet {
+	cs := &collectorSet{disabled: make(map[string]bool), errors: make(map[string]collectorError)}
+	known := make(map[string]bool)
+	for _, c := range monitor.Collectors() {
+		known[c.Name()] = true
+	}
+	for _, name := range disable {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if !known[name] {
+			log.Printf("disableCollectors: no collector named %q", name)
+			continue
+		}
+		cs.disabled[name] = true
+	}
+	for _, c := range monitor.Collectors() {
+		if !cs.disabled[c.Name()] {
+			cs.enabled = append(cs.enabled, c)
+		}
+	}
+	return cs
+}
+
+// on reports whether the collector called name is enabled.
+func (cs *collectorSet) on(name string) bool {
+	return !cs.disabled[name]
+}
+
+// collect fills snap from every enabled collector. Asking for no
+// processes leaves the process walk out altogether, and the section with it.
+func (cs *collectorSet) collect(snap *Snapshot, opts monitor.CollectOptions) {
+	for _, c := range cs.enabled {
+		if c.Name() == "processes" && opts.MaxProcesses <= 0 {
+			continue
+		}
+		v, err := c.Collect(opts)
+		cs.report(c.Name(), err)
+		if err == nil {
+			snap.setSection(c.Name(), v)
+		}
+	}
+}
+
+// report records a collector's result. Errors are logged when they
+// change, not on every tick.
+func (cs *collectorSet) report(name string, err error) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	prev, failing := cs.errors[name]
+	if err == nil {
+		if failing {
+			log.Printf("collector %s: ok again", name)
+			delete(cs.errors, name)
+		}
+		return
+	}
+	if !failing || prev.msg != err.Error() {
+		log.Printf("collector %s: %v", name, err)
+	}
+	cs.errors[name] = collectorError{msg: err.Error(), at: time.Now().UnixMilli()}
+}
+
+func (cs *collectorSet) status() []CollectorStatus {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	var out []CollectorStatus
+	for _, c := range monitor.Collectors() {
+		st := CollectorStatus{Name: c.Name(), Builtin: monitor.IsBuiltin(c.Name()), Enabled: cs.on(c.Name())}
+		if e, ok := cs.errors[c.Name()]; ok {
+			st.Error, st.ErrorTime = e.msg, e.at
+		}
+		out = append(out, st)
+	}
+	return out
+}
+
+// setSection stores one collector's output in the snapshot.
+func (s *Snapshot) setSection(name string, v interface{}) {
+	if monitor.IsBuiltin(name) {
+		switch v := v.(type) {
+		case monitor.SystemInfo:
+			s.System = v
+		case monitor.CPUInfo:
+			s.CPU = v
+		case monitor.MemInfo:
+			s.Memory = v
+		case []monitor.DiskInfo:
+			s.Disks = v
+		case []monitor.NetInfo:
+			s.Network = v
+		case monitor.LoadInfo:
+			s.Load = v
+		case []monitor.ProcessInfo:
+			s.Processes = v
+		}
+	} else {
+		if s.Extra == nil {
+			s.Extra = make(map[string]interface{})
+		}
+		s.Extra[name] = v
+	}
+	s.sections = append(s.sections, name)
+}
+
+// has reports whether the snapshot has the section called name. Code that
+// reads the typed fields checks this first: a built-in section that is off
+// is just its zero value there.
+func (s Snapshot) has(name string) bool {
+	for _, n := range s.sections {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// complete reports whether the snapshot has exactly the built-in sections,
+// in which case it encodes as the plain struct.
+func (s Snapshot) complete() bool {
+	if len(s.Extra) > 0 {
+		return false
+	}
+	for _, name := range []string{"system", "cpu", "memory", "disks", "network", "load", "processes"} {
+		if !s.has(name) {
+			return false
+		}
+	}
+	return true
+}
+
+// MarshalJSON leaves out the sections that weren't collected and adds the
+// ones from Extra.
+func (s Snapshot) MarshalJSON() ([]byte, error) {
+	type plain Snapshot
+	data, err := json.Marshal(plain(s))
+	if err != nil || s.complete() {
+		return data, err
+	}
+	var obj map[string]json.RawMessage
+	if err := json.Unmarshal(data, &obj); err != nil {
+		return nil, err
+	}
+	for k := range obj {
+		if k != "timestamp" && !s.has(k) {
+			delete(obj, k)
+		}
+	}
+	for k, v := range s.Extra {
+		b, err := json.Marshal(v)
+		if err != nil {
+			return nil, err
+		}
+		obj[k] = b
+	}
+	return json.Marshal(obj)
+}
+
+// snapshotMessage is the broadcast form of snap; gen is snap as
+// toGeneric returns it. The binary codecs don't know MarshalJSON, so a
+// snapshot with sections missing or extra goes out as gen.
+func snapshotMessage(snap Snapshot, gen map[string]interface{}) *encodedMessage {
+	if snap.complete() {
+		return newEncodedMessage(wsMessage{Type: "snapshot", Payload: snap})
+	}
+	return newEncodedMessage(wsMessage{Type: "snapshot", Payload: gen})
+}
@@ -0,0 +1,82 @@
+// Copyright (C) 2025 Russell Li (xiaoxinmm)
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestDisabledSectionsNotExported checks a snapshot with only cpu gives
+// no metrics, lines or host attributes for the other built-in sections.
+func TestDisabledSectionsNotExported(t *testing.T) {
+	full := collect(3)
+	snap := Snapshot{Timestamp: full.Timestamp}
+	snap.setSection("cpu", full.CPU)
+
+	m := buildMetrics(snap, nil, newHub())
+	for _, f := range m.families {
+		for _, prefix := range []string{"sysmon_system_info", "sysmon_uptime", "sysmon_memory", "sysmon_swap", "sysmon_load", "sysmon_disk", "sysmon_network", "sysmon_process"} {
+			if strings.HasPrefix(f.name, prefix) {
+				t.Errorf("metrics: %s without its section", f.name)
+			}
+		}
+	}
+	if m.byName["sysmon_cpu_usage_avg_percent"] == nil {
+		t.Error("metrics: cpu missing")
+	}
+
+	// 没有 system，host 取自系统，和 Graphite 一样
+	hostname, _ := os.Hostname()
+	influx := string(newInfluxFormat(OutputConfig{}).lines(snap))
+	if !strings.HasPrefix(influx, "sysmon_cpu,host="+hostname+" usage_avg=") {
+		t.Errorf("influx: %q", influx)
+	}
+	for _, bad := range []string{"sysmon_system", "sysmon_mem", "sysmon_load"} {
+		if strings.Contains(influx, bad) {
+			t.Errorf("influx has %q:\n%s", bad, influx)
+		}
+	}
+	if withHost := string(influxFormat{prefix: "sysmon", host: "web-1"}.lines(snap)); !strings.HasPrefix(withHost, "sysmon_cpu,host=web-1 ") {
+		t.Errorf("influx with host set: %q", withHost)
+	}
+
+	g, err := newGraphite(OutputConfig{URL: "localhost:2003"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range strings.Split(strings.TrimSpace(string(g.lines(snap))), "\n") {
+		path := strings.Fields(line)[0]
+		if !strings.Contains(path, ".cpu.") || strings.HasPrefix(path, "sysmon.root.") {
+			t.Errorf("graphite: %s", line)
+		}
+	}
+
+	req := otlpFromMetrics(m, nil, time.Now(), time.Now())
+	if attrs := req.ResourceMetrics[0].Resource.Attributes; len(attrs) != 1 || attrs[0].Key != "service.name" {
+		t.Errorf("otlp resource: %+v", attrs)
+	}
+
+	// and with everything on, the sections are all there
+	m = buildMetrics(full, nil, newHub())
+	for _, name := range []string{"sysmon_system_info", "sysmon_uptime_seconds", "sysmon_memory_total_bytes", "sysmon_load1"} {
+		if m.byName[name] == nil {
+			t.Errorf("full snapshot: no %s", name)
+		}
+	}
+}
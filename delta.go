@@ -0,0 +1,196 @@
+// Copyright (C) 2025 Russell Li (xiaoxinmm)
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+)
+
+// Delta protocol (opt-in with /ws?mode=delta):
+//
+//	{"type":"snapshot","seq":N,"payload":{...full snapshot...}}
+//	{"type":"delta","seq":N+1,"payload":{"base":N,"set":{...},"procs":{...}}}
+//
+// "set" is a JSON merge patch (RFC 7386) against the previous snapshot:
+// objects merge recursively, null deletes a key, anything else replaces.
+// So a client can't tell a null value from a missing key; nothing in the
+// snapshot needs it to.
+// Processes are keyed by PID instead: "procs.upsert" holds new or changed
+// entries and "procs.remove" the PIDs that went away.
+//
+// A client whose seq doesn't match "base" sends {"type":"resync"} and gets
+// a full snapshot back. The server also sends a full snapshot every
+// keyframeEvery ticks so a client can never drift for long.
+
+const keyframeEvery = 60
+
+type deltaPayload struct {
+	Base  uint64                 `json:"base"`
+	Set   map[string]interface{} `json:"set,omitempty"`
+	Procs *procDelta             `json:"procs,omitempty"`
+}
+
+type procDelta struct {
+	Upsert []interface{} `json:"upsert,omitempty"`
+	Remove []int64       `json:"remove,omitempty"`
+}
+
+// deltaState tracks what a single client has seen.
+type deltaState struct {
+	seq      uint64
+	base     map[string]interface{} // 客户端当前持有的快照，只读共享
+	sinceKey int
+}
+
+// next returns the message that moves the client from its base to cur.
+func (d *deltaState) next(cur map[string]interface{}) wsMessage {
+	d.seq++
+	if d.base == nil || d.sinceKey >= keyframeEvery {
+		d.base = cur
+		d.sinceKey = 0
+		return wsMessage{Type: "snapshot", Seq: d.seq, Payload: cur}
+	}
+	p := diffSnapshot(d.base, cur)
+	p.Base = d.seq - 1
+	d.base = cur
+	d.sinceKey++
+	return wsMessage{Type: "delta", Seq: d.seq, Payload: p}
+}
+
+// keyframe returns the client's current base as a full snapshot without
+// advancing seq, so the following delta still applies.
+func (d *deltaState) keyframe() (wsMessage, bool) {
+	if d.base == nil {
+		return wsMessage{}, false
+	}
+	d.sinceKey = 0
+	return wsMessage{Type: "snapshot", Seq: d.seq, Payload: d.base}, true
+}
+
+// toGeneric converts a snapshot into the map form it has on the wire.
+func toGeneric(snap Snapshot) (map[string]interface{}, error) {
+	data, err := json.Marshal(snap)
+	if err != nil {
+		return nil, err
+	}
+	var gen map[string]interface{}
+	if err := json.Unmarshal(data, &gen); err != nil {
+		return nil, err
+	}
+	return gen, nil
+}
+
+// diffSnapshot returns the delta from prev to cur. Processes go by PID
+// when both sides have a list; when the section comes, goes or is null
+// the merge patch carries it whole.
+func diffSnapshot(prev, cur map[string]interface{}) deltaPayload {
+	p := deltaPayload{}
+
+	var skip []string
+	prevProcs, prevOK := prev["processes"].([]interface{})
+	curProcs, curOK := cur["processes"].([]interface{})
+	if prevOK && curOK {
+		p.Procs = diffProcesses(prevProcs, curProcs)
+		skip = append(skip, "processes")
+	}
+
+	set := diffObjects(prev, cur, skip...)
+	if len(set) > 0 {
+		p.Set = set
+	}
+	return p
+}
+
+// diffObjects returns a merge patch turning prev into cur. Keys listed in
+// skip are left out; the caller diffs them some other way.
+func diffObjects(prev, cur map[string]interface{}, skip ...string) map[string]interface{} {
+	patch := make(map[string]interface{})
+	skipped := func(k string) bool {
+		for _, s := range skip {
+			if s == k {
+				return true
+			}
+		}
+		return false
+	}
+	for k, cv := range cur {
+		if skipped(k) {
+			continue
+		}
+		pv, ok := prev[k]
+		if ok && reflect.DeepEqual(pv, cv) {
+			continue
+		}
+		pm, pIsMap := pv.(map[string]interface{})
+		cm, cIsMap := cv.(map[string]interface{})
+		if ok && pIsMap && cIsMap {
+			if sub := diffObjects(pm, cm); len(sub) > 0 {
+				patch[k] = sub
+			}
+			continue
+		}
+		patch[k] = cv
+	}
+	for k := range prev {
+		if skipped(k) {
+			continue
+		}
+		if _, ok := cur[k]; !ok {
+			patch[k] = nil
+		}
+	}
+	return patch
+}
+
+func diffProcesses(prev, cur []interface{}) *procDelta {
+	byPID := func(list []interface{}) map[int64]interface{} {
+		m := make(map[int64]interface{}, len(list))
+		for _, item := range list {
+			obj, ok := item.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			pid, _ := obj["pid"].(float64)
+			m[int64(pid)] = item
+		}
+		return m
+	}
+	pm := byPID(prev)
+	cm := byPID(cur)
+
+	d := &procDelta{}
+	for _, item := range cur {
+		obj, ok := item.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		pid, _ := obj["pid"].(float64)
+		if old, ok := pm[int64(pid)]; ok && reflect.DeepEqual(old, item) {
+			continue
+		}
+		d.Upsert = append(d.Upsert, item)
+	}
+	for pid := range pm {
+		if _, ok := cm[pid]; !ok {
+			d.Remove = append(d.Remove, pid)
+		}
+	}
+	if len(d.Upsert) == 0 && len(d.Remove) == 0 {
+		return nil
+	}
+	return d
+}
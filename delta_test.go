@@ -0,0 +1,259 @@
+// Copyright (C) 2025 Russell Li (xiaoxinmm)
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// deltaClient does what applyDelta and mergePatch in web/js/app.js do,
+// on the JSON as it goes over the wire.
+type deltaClient struct {
+	seq     uint64
+	state   map[string]interface{}
+	resyncs int
+}
+
+func (c *deltaClient) receive(t *testing.T, msg wsMessage, resync func() wsMessage) {
+	t.Helper()
+	data, err := json.Marshal(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m struct {
+		Type    string          `json:"type"`
+		Seq     uint64          `json:"seq"`
+		Payload json.RawMessage `json:"payload"`
+	}
+	if err := json.Unmarshal(data, &m); err != nil {
+		t.Fatal(err)
+	}
+	switch m.Type {
+	case "snapshot":
+		c.state = nil
+		json.Unmarshal(m.Payload, &c.state)
+		c.seq = m.Seq
+	case "delta":
+		var d struct {
+			Base  uint64                 `json:"base"`
+			Set   map[string]interface{} `json:"set"`
+			Procs *struct {
+				Upsert []map[string]interface{} `json:"upsert"`
+				Remove []float64                `json:"remove"`
+			} `json:"procs"`
+		}
+		if err := json.Unmarshal(m.Payload, &d); err != nil {
+			t.Fatal(err)
+		}
+		if c.state == nil || d.Base != c.seq {
+			c.resyncs++
+			c.receive(t, resync(), resync)
+			return
+		}
+		if d.Set != nil {
+			c.state = mergePatch(c.state, d.Set).(map[string]interface{})
+		}
+		if d.Procs != nil {
+			var order []float64
+			byPID := make(map[float64]interface{})
+			list, _ := c.state["processes"].([]interface{})
+			for _, p := range list {
+				pid := p.(map[string]interface{})["pid"].(float64)
+				order = append(order, pid)
+				byPID[pid] = p
+			}
+			for _, pid := range d.Procs.Remove {
+				delete(byPID, pid)
+			}
+			for _, p := range d.Procs.Upsert {
+				pid := p["pid"].(float64)
+				if _, ok := byPID[pid]; !ok {
+					order = append(order, pid)
+				}
+				byPID[pid] = p
+			}
+			procs := []interface{}{}
+			for _, pid := range order {
+				if p, ok := byPID[pid]; ok {
+					procs = append(procs, p)
+					delete(byPID, pid)
+				}
+			}
+			c.state["processes"] = procs
+		}
+		c.seq = m.Seq
+	default:
+		t.Fatalf("unexpected %s message", m.Type)
+	}
+}
+
+func mergePatch(target, patch interface{}) interface{} {
+	pm, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	tm, ok := target.(map[string]interface{})
+	if !ok {
+		tm = make(map[string]interface{})
+	}
+	for k, v := range pm {
+		if v == nil {
+			delete(tm, k)
+		} else {
+			tm[k] = mergePatch(tm[k], v)
+		}
+	}
+	return tm
+}
+
+// comparable drops null values from objects, which a merge patch can't
+// tell from missing keys, and sorts processes by PID: the dashboard
+// sorts them itself.
+func comparable(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		out := make(map[string]interface{})
+		for k, x := range v {
+			if x != nil {
+				out[k] = comparable(x)
+			}
+		}
+		if procs, ok := out["processes"].([]interface{}); ok {
+			sort.Slice(procs, func(i, j int) bool {
+				return procs[i].(map[string]interface{})["pid"].(float64) < procs[j].(map[string]interface{})["pid"].(float64)
+			})
+		}
+		return out
+	case []interface{}:
+		out := make([]interface{}, len(v))
+		for i, x := range v {
+			out[i] = comparable(x)
+		}
+		return out
+	}
+	return v
+}
+
+func parseGeneric(t *testing.T, s string) map[string]interface{} {
+	t.Helper()
+	var m map[string]interface{}
+	if err := json.Unmarshal([]byte(s), &m); err != nil {
+		t.Fatalf("%s: %v", s, err)
+	}
+	return m
+}
+
+func TestDeltaRoundTrip(t *testing.T) {
+	for _, tc := range []struct {
+		name, prev, next string
+	}{
+		{"unchanged", `{"cpu":{"avgUsage":5,"usage":[1,2]}}`, `{"cpu":{"avgUsage":5,"usage":[1,2]}}`},
+		{"nested value", `{"cpu":{"avgUsage":5,"cores":4},"timestamp":1}`, `{"cpu":{"avgUsage":7,"cores":4},"timestamp":2}`},
+		{"nested removal", `{"memory":{"total":8,"swap":{"total":2,"used":1}}}`, `{"memory":{"total":8,"swap":{"total":2}}}`},
+		{"whole object removed", `{"memory":{"swap":{"total":2}},"cpu":{}}`, `{"memory":{},"cpu":{}}`},
+		{"section goes", `{"cpu":{"avgUsage":5},"load":{"load1":1}}`, `{"cpu":{"avgUsage":5}}`},
+		{"section comes", `{"cpu":{"avgUsage":5}}`, `{"cpu":{"avgUsage":5},"load":{"load1":1}}`},
+		{"value to null", `{"disks":[{"mountpoint":"/"}],"cpu":{"model":"x"}}`, `{"disks":null,"cpu":{"model":null}}`},
+		{"null to value", `{"disks":null,"cpu":{"model":null}}`, `{"disks":[{"mountpoint":"/"}],"cpu":{"model":"x"}}`},
+		{"null to object", `{"extra":null}`, `{"extra":{"a":{"b":1}}}`},
+		{"object to scalar and back", `{"a":{"b":1},"c":3}`, `{"a":2,"c":{"d":[null,1]}}`},
+		{"array replaced", `{"cpu":{"usage":[1,2,3,4]},"disks":[{"m":"/"},{"m":"/boot"}]}`, `{"cpu":{"usage":[1,2]},"disks":[{"m":"/boot","used":3}]}`},
+		{"array of objects changes inside", `{"network":[{"name":"eth0","rate":1}]}`, `{"network":[{"name":"eth0","rate":2}]}`},
+		{"process churn",
+			`{"processes":[{"pid":1,"name":"init","cpu":0},{"pid":20,"name":"sh","cpu":1},{"pid":30,"name":"vi","cpu":2}]}`,
+			`{"processes":[{"pid":40,"name":"cc","cpu":90},{"pid":1,"name":"init","cpu":0},{"pid":30,"name":"vi","cpu":5}]}`},
+		{"pid reused",
+			`{"processes":[{"pid":7,"name":"old","cpu":3,"status":"S"}]}`,
+			`{"processes":[{"pid":7,"name":"new","cpu":3,"status":"R"}]}`},
+		{"all processes gone", `{"processes":[{"pid":1,"name":"a"}]}`, `{"processes":[]}`},
+		{"processes unsubscribed", `{"processes":[{"pid":1,"name":"a"}],"cpu":{}}`, `{"cpu":{}}`},
+		{"processes subscribed", `{"cpu":{}}`, `{"processes":[{"pid":1,"name":"a"}],"cpu":{}}`},
+		{"processes null", `{"processes":[{"pid":1,"name":"a"}]}`, `{"processes":null}`},
+		{"processes from null", `{"processes":null}`, `{"processes":[{"pid":1,"name":"a"}]}`},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			prev, next := parseGeneric(t, tc.prev), parseGeneric(t, tc.next)
+			d := &deltaState{}
+			c := &deltaClient{}
+			noResync := func() wsMessage { t.Fatal("client had to resync"); return wsMessage{} }
+			c.receive(t, d.next(prev), noResync)
+			msg := d.next(next)
+			if msg.Type != "delta" {
+				t.Fatalf("second message is a %s", msg.Type)
+			}
+			if tc.prev == tc.next {
+				if p := msg.Payload.(deltaPayload); p.Set != nil || p.Procs != nil {
+					t.Errorf("delta for no change: %+v", p)
+				}
+			}
+			c.receive(t, msg, noResync)
+			if got, want := comparable(c.state), comparable(parseGeneric(t, tc.next)); !reflect.DeepEqual(got, want) {
+				t.Errorf("applied delta\n got %v\nwant %v", got, want)
+			}
+		})
+	}
+}
+
+// TestDeltaSequence runs a client through keyframes, a lost message and
+// the resync that follows.
+func TestDeltaSequence(t *testing.T) {
+	d := &deltaState{}
+	c := &deltaClient{}
+	resync := func() wsMessage {
+		kf, ok := d.keyframe()
+		if !ok {
+			t.Fatal("no keyframe to resync to")
+		}
+		return kf
+	}
+	tick := func(i int) map[string]interface{} {
+		procs := []interface{}{}
+		for pid := i; pid < i+3; pid++ {
+			procs = append(procs, map[string]interface{}{"pid": float64(pid), "cpu": float64(i)})
+		}
+		return map[string]interface{}{"timestamp": float64(i), "processes": procs}
+	}
+
+	var seqs []uint64
+	types := make(map[string]int)
+	for i := 1; i <= 2*keyframeEvery+5; i++ {
+		msg := d.next(tick(i))
+		types[msg.Type]++
+		seqs = append(seqs, msg.Seq)
+		if i == 10 {
+			continue // 丢了一条
+		}
+		c.receive(t, msg, resync)
+		if got, want := comparable(c.state), comparable(tick(i)); !reflect.DeepEqual(got, want) {
+			t.Fatalf("tick %d: client has %v, want %v", i, got, want)
+		}
+	}
+	// 第一帧，然后 resync 重新计数，再过 keyframeEvery 个 delta 一帧
+	if types["snapshot"] != 2 {
+		t.Errorf("%d full snapshots, want 2", types["snapshot"])
+	}
+	if c.resyncs != 1 {
+		t.Errorf("%d resyncs, want 1 for the lost message", c.resyncs)
+	}
+	for i, seq := range seqs {
+		if seq != uint64(i+1) {
+			t.Fatalf("seq %v, want 1, 2, 3, ...", seqs)
+		}
+	}
+}
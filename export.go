@@ -0,0 +1,387 @@
+// Copyright (C) 2025 Russell Li (xiaoxinmm)
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"sysmon/monitor"
+)
+
+// History export and import. The store goes out as one row per point,
+// (time, metric, labels, step, value, min, max), in CSV, newline-delimited
+// JSON or Parquet (parquet.go), and comes back in the same way, from
+// GET /api/v1/history/export, POST /api/v1/history/import and
+// `sysmon history export|import` (historycmd.go). See docs/api.md.
+
+var historyFormats = []string{"csv", "ndjson", "parquet"}
+
+// 导入的文件最大这么多
+const maxImportSize = 256 << 20
+
+// historyRow is one exported point. Raw points have step 0 and min = max
+// = value; rollup buckets have the bucket start as time, the average as
+// value.
+type historyRow struct {
+	Time   int64          `json:"time"` // unix ms
+	Metric string         `json:"metric"`
+	Labels monitor.Labels `json:"labels"`
+	Step   int64          `json:"step"` // seconds
+	Value  float64        `json:"value"`
+	Min    float64        `json:"min"`
+	Max    float64        `json:"max"`
+}
+
+// labelsJSON is the labels as a JSON object, {} when there are none.
+func (r historyRow) labelsJSON() []byte {
+	if len(r.Labels) == 0 {
+		return []byte("{}")
+	}
+	b, _ := json.Marshal(r.Labels)
+	return b
+}
+
+func historyRows(series []monitor.Series) []historyRow {
+	var rows []historyRow
+	for _, s := range series {
+		for i, t := range s.T {
+			row := historyRow{Time: t, Metric: s.Metric, Labels: s.Labels, Step: s.Step, Value: s.V[i], Min: s.V[i], Max: s.V[i]}
+			if s.Step > 0 {
+				row.Min, row.Max = s.Min[i], s.Max[i]
+			}
+			rows = append(rows, row)
+		}
+	}
+	return rows
+}
+
+// historySeries groups rows back into series, by metric, labels and step.
+func historySeries(rows []historyRow) []monitor.Series {
+	byKey := make(map[string]*monitor.Series)
+	var keys []string
+	for _, r := range rows {
+		key := r.Metric + "\x00" + string(r.labelsJSON()) + "\x00" + strconv.FormatInt(r.Step, 10)
+		s := byKey[key]
+		if s == nil {
+			s = &monitor.Series{Metric: r.Metric, Labels: r.Labels, Step: r.Step}
+			byKey[key] = s
+			keys = append(keys, key)
+		}
+		s.T = append(s.T, r.Time)
+		s.V = append(s.V, r.Value)
+		if r.Step > 0 {
+			s.Min = append(s.Min, r.Min)
+			s.Max = append(s.Max, r.Max)
+		}
+	}
+	out := make([]monitor.Series, 0, len(keys))
+	for _, key := range keys {
+		out = append(out, *byKey[key])
+	}
+	return out
+}
+
+func historyContentType(format string) string {
+	switch format {
+	case "ndjson":
+		return "application/x-ndjson"
+	case "parquet":
+		return "application/vnd.apache.parquet"
+	}
+	return "text/csv; charset=utf-8"
+}
+
+var csvHeader = []string{"time", "metric", "labels", "step", "value", "min", "max"}
+
+func writeHistoryRows(w io.Writer, format string, rows []historyRow) error {
+	switch format {
+	case "parquet":
+		return writeParquet(w, rows)
+	case "ndjson":
+		bw := bufio.NewWriter(w)
+		enc := json.NewEncoder(bw)
+		for _, r := range rows {
+			if r.Labels == nil {
+				r.Labels = monitor.Labels{}
+			}
+			if err := enc.Encode(r); err != nil {
+				return err
+			}
+		}
+		return bw.Flush()
+	}
+	cw := csv.NewWriter(w)
+	cw.Write(csvHeader)
+	num := func(v float64) string { return strconv.FormatFloat(v, 'g', -1, 64) }
+	for _, r := range rows {
+		cw.Write([]string{
+			time.UnixMilli(r.Time).UTC().Format("2006-01-02T15:04:05.000Z"),
+			r.Metric,
+			string(r.labelsJSON()),
+			strconv.FormatInt(r.Step, 10),
+			num(r.Value), num(r.Min), num(r.Max),
+		})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// sniffHistoryFormat guesses the format of an import from its first bytes.
+func sniffHistoryFormat(data []byte) string {
+	switch {
+	case bytes.HasPrefix(data, []byte(parquetMagic)):
+		return "parquet"
+	case bytes.HasPrefix(bytes.TrimLeft(data, " \t\r\n"), []byte("{")):
+		return "ndjson"
+	}
+	return "csv"
+}
+
+// readHistoryRows parses an import. min and max default to the value, so
+// files from elsewhere only need time, metric and value.
+func readHistoryRows(data []byte, format string) ([]historyRow, error) {
+	switch format {
+	case "parquet":
+		return readParquet(data)
+	case "ndjson":
+		var rows []historyRow
+		dec := json.NewDecoder(bytes.NewReader(data))
+		for line := 1; ; line++ {
+			// min 和 max 用指针，才分得清没给和给了 0
+			var r struct {
+				Time   int64          `json:"time"`
+				Metric string         `json:"metric"`
+				Labels monitor.Labels `json:"labels"`
+				Step   int64          `json:"step"`
+				Value  float64        `json:"value"`
+				Min    *float64       `json:"min"`
+				Max    *float64       `json:"max"`
+			}
+			if err := dec.Decode(&r); err == io.EOF {
+				return rows, nil
+			} else if err != nil {
+				return nil, fmt.Errorf("record %d: %v", line, err)
+			}
+			if r.Metric == "" {
+				return nil, fmt.Errorf("record %d: no metric", line)
+			}
+			if _, err := checkRowTime(r.Time); err != nil {
+				return nil, fmt.Errorf("record %d: %v", line, err)
+			}
+			row := historyRow{Time: r.Time, Metric: r.Metric, Labels: r.Labels, Step: r.Step, Value: r.Value, Min: r.Value, Max: r.Value}
+			if r.Min != nil {
+				row.Min = *r.Min
+			}
+			if r.Max != nil {
+				row.Max = *r.Max
+			}
+			rows = append(rows, row)
+		}
+	case "csv":
+	default:
+		return nil, fmt.Errorf("format must be one of %s", strings.Join(historyFormats, ", "))
+	}
+
+	cr := csv.NewReader(bytes.NewReader(data))
+	header, err := cr.Read()
+	if err != nil {
+		return nil, errors.New("csv: no header")
+	}
+	col := make(map[string]int)
+	for i, name := range header {
+		col[strings.TrimSpace(strings.ToLower(name))] = i
+	}
+	for _, name := range []string{"time", "metric", "value"} {
+		if _, ok := col[name]; !ok {
+			return nil, fmt.Errorf("csv: no %s column", name)
+		}
+	}
+	field := func(rec []string, name string) string {
+		if i, ok := col[name]; ok && i < len(rec) {
+			return strings.TrimSpace(rec[i])
+		}
+		return ""
+	}
+	var rows []historyRow
+	for line := 2; ; line++ {
+		rec, err := cr.Read()
+		if err == io.EOF {
+			return rows, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("csv: %v", err)
+		}
+		r := historyRow{Metric: field(rec, "metric")}
+		bad := func(what string) error { return fmt.Errorf("csv line %d: bad %s", line, what) }
+		if r.Time, err = parseRowTime(field(rec, "time")); err == errRowSeconds {
+			return nil, fmt.Errorf("csv line %d: %v", line, err)
+		} else if err != nil {
+			return nil, bad("time")
+		}
+		if r.Metric == "" {
+			return nil, bad("metric")
+		}
+		if l := field(rec, "labels"); l != "" {
+			if err := json.Unmarshal([]byte(l), &r.Labels); err != nil {
+				return nil, bad("labels")
+			}
+		}
+		if s := field(rec, "step"); s != "" {
+			if r.Step, err = strconv.ParseInt(s, 10, 64); err != nil {
+				return nil, bad("step")
+			}
+		}
+		if r.Value, err = strconv.ParseFloat(field(rec, "value"), 64); err != nil {
+			return nil, bad("value")
+		}
+		r.Min, r.Max = r.Value, r.Value
+		if s := field(rec, "min"); s != "" {
+			if r.Min, err = strconv.ParseFloat(s, 64); err != nil {
+				return nil, bad("min")
+			}
+		}
+		if s := field(rec, "max"); s != "" {
+			if r.Max, err = strconv.ParseFloat(s, 64); err != nil {
+				return nil, bad("max")
+			}
+		}
+		rows = append(rows, r)
+	}
+}
+
+// minRowTime is the smallest bare number taken as a time: unix ms for
+// March 1973. Anything smaller is much more likely unix seconds (what
+// the query parameters take), which would land in 1970 and be skipped.
+const minRowTime = 1e11
+
+var errRowSeconds = errors.New("time must be unix ms or RFC 3339, not unix seconds")
+
+// parseRowTime takes unix ms or RFC 3339.
+func parseRowTime(s string) (int64, error) {
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return checkRowTime(n)
+	}
+	t, err := time.Parse(time.RFC3339Nano, s)
+	return t.UnixMilli(), err
+}
+
+func checkRowTime(ms int64) (int64, error) {
+	if ms < minRowTime {
+		return 0, errRowSeconds
+	}
+	return ms, nil
+}
+
+// handleHistoryExport writes the selected series as a file download.
+func handleHistoryExport(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	format := q.Get("format")
+	if format == "" {
+		format = "csv"
+	}
+	if !containsString(historyFormats, format) {
+		writeError(w, http.StatusBadRequest, "format must be one of "+strings.Join(historyFormats, ", "))
+		return
+	}
+	selects := q["select"]
+	if len(selects) == 0 {
+		selects = []string{"*"}
+	}
+	var sels []monitor.Selector
+	for _, s := range selects {
+		sel, err := monitor.ParseSelector(s)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		sels = append(sels, sel)
+	}
+	var from, to int64
+	for _, p := range []struct {
+		name string
+		dst  *int64
+	}{{"start", &from}, {"end", &to}} {
+		if v := q.Get(p.name); v != "" {
+			t, err := parseTime(v)
+			if err != nil {
+				writeError(w, http.StatusBadRequest, p.name+" must be unix seconds or RFC 3339")
+				return
+			}
+			*p.dst = t.UnixMilli()
+		}
+	}
+	if to == 0 {
+		to = math.MaxInt64
+	}
+	step, ok := historyStep(q.Get("resolution"))
+	if !ok {
+		writeError(w, http.StatusBadRequest, "resolution must be raw, 1m or 1h")
+		return
+	}
+	rows := historyRows(monitor.SelectHistory(sels, from, to, step))
+	sort.SliceStable(rows, func(i, j int) bool { return rows[i].Time < rows[j].Time })
+	// 先写进内存：中途出错还能回一个干净的 500，而不是半个文件
+	var buf bytes.Buffer
+	if err := writeHistoryRows(&buf, format, rows); err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", historyContentType(format))
+	w.Header().Set("Content-Disposition", `attachment; filename="sysmon-history.`+format+`"`)
+	w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+	buf.WriteTo(w)
+}
+
+// handleHistoryImport adds an exported file to the store.
+func handleHistoryImport(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxImportSize))
+	if err != nil {
+		writeError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("file larger than %d MiB", maxImportSize>>20))
+		return
+	}
+	format := q.Get("format")
+	if format == "" {
+		format = sniffHistoryFormat(data)
+	}
+	rows, err := readHistoryRows(data, format)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	var extra monitor.Labels
+	if v := q.Get("source"); v != "" {
+		extra = monitor.Labels{"source": v}
+	}
+	stats, err := monitor.ImportHistory(historySeries(rows), extra)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, stats)
+}
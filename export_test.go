@@ -0,0 +1,218 @@
+// Copyright (C) 2025 Russell Li (xiaoxinmm)
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"sysmon/monitor"
+)
+
+// testSeries has raw points, rollups whose min and max differ from the
+// average, labels and none, and text that needs quoting in CSV.
+func testSeries() []monitor.Series {
+	return []monitor.Series{
+		{Metric: "cpu", T: []int64{1735689600000, 1735689601000, 1735689602500}, V: []float64{12.5, 0, 99.99}},
+		{Metric: "disk", Labels: monitor.Labels{"mountpoint": "/var/lib/docker"}, T: []int64{1735689600000}, V: []float64{63.1}},
+		{Metric: "net_recv", Labels: monitor.Labels{"interface": `eth0,"x"`}, Step: 60,
+			T: []int64{1735689600000, 1735689660000}, V: []float64{1024.5, 2048}, Min: []float64{0, 1}, Max: []float64{4096, 1e12}},
+		{Metric: "process_cpu", Labels: monitor.Labels{"name": "進程 名", "pid": "42"}, Step: 3600,
+			T: []int64{1735686000000}, V: []float64{-1.5}, Min: []float64{-3}, Max: []float64{0}},
+	}
+}
+
+// normalize makes empty labels nil, as a file can't tell {} from none.
+func normalize(series []monitor.Series) []monitor.Series {
+	out := append([]monitor.Series(nil), series...)
+	for i := range out {
+		if len(out[i].Labels) == 0 {
+			out[i].Labels = nil
+		}
+	}
+	return out
+}
+
+func TestHistoryExportRoundTrip(t *testing.T) {
+	want := testSeries()
+	for _, format := range historyFormats {
+		t.Run(format, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := writeHistoryRows(&buf, format, historyRows(want)); err != nil {
+				t.Fatal(err)
+			}
+			if got := sniffHistoryFormat(buf.Bytes()); got != format {
+				t.Errorf("sniffed as %s", got)
+			}
+			rows, err := readHistoryRows(buf.Bytes(), format)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := normalize(historySeries(rows)); !reflect.DeepEqual(got, normalize(want)) {
+				t.Errorf("round trip\n got %+v\nwant %+v", got, want)
+			}
+		})
+	}
+}
+
+// TestNDJSONMinMax is files from elsewhere: min and max may be missing,
+// which means the value, or 0, which is 0.
+func TestNDJSONMinMax(t *testing.T) {
+	rows, err := readHistoryRows([]byte(`{"time":1735689600000,"metric":"a","value":5}
+{"time":1735689660000,"metric":"a","step":60,"value":5,"min":0,"max":7}
+{"time":1735689720000,"metric":"a","step":60,"value":5,"max":7}
+`), "ndjson")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := [][2]float64{{5, 5}, {0, 7}, {5, 7}}
+	for i, r := range rows {
+		if [2]float64{r.Min, r.Max} != want[i] {
+			t.Errorf("row %d: min %v max %v, want %v", i, r.Min, r.Max, want[i])
+		}
+	}
+}
+
+func TestCSVImportMinimal(t *testing.T) {
+	rows, err := readHistoryRows([]byte("Metric,Time,Value\ncpu,2025-01-01T00:00:00Z,3.5\ncpu,1735689601000,4\n"), "csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 2 || rows[0].Time != 1735689600000 || rows[1].Time != 1735689601000 || rows[0].Min != 3.5 || rows[1].Max != 4 {
+		t.Errorf("rows %+v", rows)
+	}
+	for _, bad := range []string{
+		"time,value\n1,2\n",
+		"time,metric,value\nyesterday,cpu,1\n",
+		"time,metric,value\n1735689600000,cpu,lots\n",
+		"time,metric,value,labels\n1735689600000,cpu,1,not json\n",
+	} {
+		if _, err := readHistoryRows([]byte(bad), "csv"); err == nil {
+			t.Errorf("accepted %q", bad)
+		}
+	}
+
+	// 裸数字是毫秒；像秒的直接报错，不悄悄导进 1970 年
+	for format, data := range map[string]string{
+		"csv":    "time,metric,value\n1735689600,cpu,1\n",
+		"ndjson": `{"time":1735689600,"metric":"cpu","value":1}`,
+	} {
+		if _, err := readHistoryRows([]byte(data), format); err == nil || !strings.Contains(err.Error(), "unix seconds") {
+			t.Errorf("%s with unix seconds: %v", format, err)
+		}
+	}
+}
+
+// TestParquetLayout reads the footer back with the Thrift decoder and
+// checks what other readers rely on: magic at both ends, the row count
+// and the schema.
+func TestParquetLayout(t *testing.T) {
+	rows := historyRows(testSeries())
+	var buf bytes.Buffer
+	if err := writeParquet(&buf, rows); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	n := len(data)
+	if string(data[:4]) != parquetMagic || string(data[n-4:]) != parquetMagic {
+		t.Fatal("no PAR1 at both ends")
+	}
+	metaLen := int(binary.LittleEndian.Uint32(data[n-8:]))
+	meta, err := readThriftStruct(bytes.NewReader(data[n-8-metaLen : n-8]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if numRows, _ := meta[3].(int64); numRows != int64(len(rows)) {
+		t.Errorf("num_rows %d, want %d", numRows, len(rows))
+	}
+	schema, _ := meta[2].([]interface{})
+	var names []string
+	for _, el := range schema[1:] {
+		name, _ := el.(tstruct)[4].([]byte)
+		names = append(names, string(name))
+	}
+	if strings.Join(names, ",") != "time,metric,labels,step,value,min,max" {
+		t.Errorf("schema %v", names)
+	}
+
+	// 截断、改坏的文件要报错，不能读出半截
+	for _, bad := range [][]byte{data[:n-1], data[:n/2], append([]byte("PAR1"), data[n-8:]...)} {
+		if _, err := readParquet(bad); err == nil {
+			t.Errorf("read a damaged file of %d bytes", len(bad))
+		}
+	}
+}
+
+// TestParquetHostile is footers no writer makes: structs nested a million
+// deep must be an error, not a stack overflow, and rows need a metric.
+func TestParquetHostile(t *testing.T) {
+	nested := bytes.Repeat([]byte{0x1c}, 1<<20) // field 1, struct, over and over
+	if _, err := readThriftStruct(bytes.NewReader(nested)); err != errThriftDepth {
+		t.Errorf("nested structs: %v", err)
+	}
+	lists := bytes.Repeat([]byte{0x19, 0x19}, 1<<20) // field 1, list of one list, ...
+	if _, err := readThriftStruct(bytes.NewReader(lists)); err != errThriftDepth {
+		t.Errorf("nested lists: %v", err)
+	}
+	var file bytes.Buffer
+	file.WriteString(parquetMagic)
+	file.Write(nested)
+	binary.Write(&file, binary.LittleEndian, uint32(len(nested)))
+	file.WriteString(parquetMagic)
+	if _, err := readParquet(file.Bytes()); err == nil {
+		t.Error("read a file with nested footer")
+	}
+
+	rows := historyRows(testSeries())
+	rows[1].Metric = ""
+	var buf bytes.Buffer
+	if err := writeParquet(&buf, rows); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readParquet(buf.Bytes()); err == nil || !strings.Contains(err.Error(), "row 2: no metric") {
+		t.Errorf("row without a metric: %v", err)
+	}
+}
+
+// TestHistoryExportFailure has a value NDJSON can't hold: the download
+// fails as a whole with a JSON error, not as half a file.
+func TestHistoryExportFailure(t *testing.T) {
+	at := time.Date(2025, 1, 3, 0, 0, 0, 0, time.UTC).UnixMilli()
+	monitor.Record(at, []monitor.Sample{{Metric: "export_probe", Value: 1}})
+	monitor.Record(at+1000, []monitor.Sample{{Metric: "export_probe", Value: math.NaN()}})
+
+	get := func(format string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handleHistoryExport(w, httptest.NewRequest("GET", "/api/v1/history/export?select=export_probe&resolution=raw&format="+format, nil))
+		return w
+	}
+	w := get("ndjson")
+	if w.Code != http.StatusInternalServerError || w.Header().Get("Content-Disposition") != "" || !strings.HasPrefix(w.Body.String(), "{\"error\"") {
+		t.Errorf("ndjson with NaN: %d %v\n%s", w.Code, w.Header(), w.Body)
+	}
+	w = get("csv")
+	if w.Code != http.StatusOK || w.Header().Get("Content-Length") != strconv.Itoa(w.Body.Len()) || strings.Count(w.Body.String(), "export_probe") != 2 {
+		t.Errorf("csv: %d %v\n%s", w.Code, w.Header(), w.Body)
+	}
+}
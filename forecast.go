@@ -0,0 +1,273 @@
+// Copyright (C) 2025 Russell Li (xiaoxinmm)
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"sysmon/monitor"
+)
+
+// Capacity forecasting. Once a minute, independent of the broadcaster,
+// the used space of every filesystem, memory and swap is sampled; a least
+// squares line over the last forecastWindow seconds gives the growth rate
+// and, when it is growing steadily, the time until the free space runs
+// out. The snapshot carries that as fullIn; the API has the details.
+// At startup the window is seeded from the history store. See
+// docs/api.md.
+
+const (
+	forecastEvery = time.Minute
+	// 样本少于这么多或跨度太短就不预测
+	forecastMinSamples = 10
+	forecastMinSpan    = 10 * time.Minute
+	// 拟合得太差（比如日志轮转让曲线成了锯齿）就不报
+	forecastMinR2 = 0.5
+	// 一年以后才满的就当不会满
+	forecastHorizon = 365 * 24 * time.Hour
+)
+
+// forecast is one series' trend, as GET /api/v1/forecast returns it.
+type forecast struct {
+	ID       string  `json:"id"` // disk:<mountpoint>, memory, swap
+	Kind     string  `json:"kind"`
+	Instance string  `json:"instance,omitempty"`
+	Used     uint64  `json:"used"`
+	Free     uint64  `json:"free"` // what is left to fill: free space, available memory
+	Total    uint64  `json:"total"`
+	Rate     float64 `json:"rate"`             // bytes per second, negative when shrinking
+	R2       float64 `json:"r2"`               // goodness of fit, 0..1
+	FullIn   int64   `json:"fullIn,omitempty"` // seconds; omitted when not filling up
+	FullAt   int64   `json:"fullAt,omitempty"` // unix ms
+	Samples  int     `json:"samples"`
+	Span     int64   `json:"span"` // seconds covered by the samples
+}
+
+type capacitySample struct {
+	at   int64 // unix ms
+	used float64
+}
+
+type capacitySeries struct {
+	samples []capacitySample // oldest first
+	last    forecast
+}
+
+// fit runs a least squares line through the samples and fills in the
+// trend fields of f.
+func (s *capacitySeries) fit(f *forecast, now int64) {
+	f.Samples = len(s.samples)
+	if f.Samples == 0 {
+		return
+	}
+	f.Span = (now - s.samples[0].at) / 1000
+	if f.Samples < forecastMinSamples || time.Duration(f.Span)*time.Second < forecastMinSpan {
+		return
+	}
+	// 时间以秒为单位，相对第一个样本，免得平方和溢出精度
+	t0 := s.samples[0].at
+	var n, sx, sy, sxx, sxy, syy float64
+	for _, p := range s.samples {
+		x := float64(p.at-t0) / 1000
+		n++
+		sx += x
+		sy += p.used
+		sxx += x * x
+		sxy += x * p.used
+		syy += p.used * p.used
+	}
+	vx := n*sxx - sx*sx
+	vy := n*syy - sy*sy
+	if vx == 0 {
+		return
+	}
+	f.Rate = (n*sxy - sx*sy) / vx
+	if vy > 0 {
+		r := (n*sxy - sx*sy) / math.Sqrt(vx*vy)
+		f.R2 = r * r
+	} else {
+		f.R2 = 1 // 一条平线，拟合完美，但不会满
+	}
+	if f.Rate <= 0 || f.R2 < forecastMinR2 {
+		return
+	}
+	in := time.Duration(float64(f.Free) / f.Rate * float64(time.Second))
+	if in > forecastHorizon {
+		return
+	}
+	f.FullIn = int64(in / time.Second)
+	f.FullAt = now + in.Milliseconds()
+}
+
+// forecaster samples capacity and keeps the trends. The zero value is
+// disabled.
+type forecaster struct {
+	window time.Duration
+
+	mu     sync.Mutex
+	series map[string]*capacitySeries
+}
+
+// forecasts is the forecaster collect reads from.
+var forecasts = &forecaster{}
+
+func (f *forecaster) configure(windowSeconds int) {
+	if windowSeconds <= 0 {
+		return
+	}
+	f.window = time.Duration(windowSeconds) * time.Second
+	f.series = make(map[string]*capacitySeries)
+}
+
+func (f *forecaster) enabled() bool { return f.window > 0 }
+
+func (f *forecaster) run() {
+	f.seed(time.Now().UnixMilli(), monitor.GetMemInfo(), monitor.GetDiskInfo())
+	ticker := time.NewTicker(forecastEvery)
+	defer ticker.Stop()
+	for range ticker.C {
+		f.sample(time.Now().UnixMilli(), monitor.GetMemInfo(), monitor.GetDiskInfo())
+	}
+}
+
+// seed fills the windows from the history store's 1-minute rollups, then
+// takes the first sample, so after a restart the trend covers the whole
+// window again instead of waiting forecastMinSpan for a first guess. The
+// rollups only go back a day. History has used percentages; each is
+// turned into bytes with what a percentage point is worth now, so the
+// seeded points line up with the samples that follow.
+func (f *forecaster) seed(now int64, m monitor.MemInfo, disks []monitor.DiskInfo) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	perPoint := make(map[string]float64)
+	// 内存的百分比是 gopsutil 的 used，和这里的 total - available 不完全一样，按现在的比例折算
+	if m.Total > 0 && m.UsedPercent > 0 {
+		perPoint["memory"] = float64(m.Total-m.Available) / m.UsedPercent
+	}
+	if m.SwapTotal > 0 && m.SwapPercent > 0 {
+		perPoint["swap"] = float64(m.SwapUsed) / m.SwapPercent
+	}
+	for _, d := range disks {
+		if d.UsedPercent > 0 {
+			perPoint[alertID("disk", d.Mountpoint)] = float64(d.Used) / d.UsedPercent
+		}
+	}
+	for _, h := range monitor.QueryHistory([]string{"memory", "swap", "disk"}, nil, now-f.window.Milliseconds(), now, time.Minute) {
+		id := alertID(h.Metric, h.Labels["mountpoint"])
+		k, ok := perPoint[id]
+		if !ok {
+			continue
+		}
+		s := &capacitySeries{}
+		for i, t := range h.T {
+			s.samples = append(s.samples, capacitySample{at: t, used: h.V[i] * k})
+		}
+		f.series[id] = s
+	}
+	f.sampleLocked(now, m, disks)
+}
+
+func (f *forecaster) sample(now int64, m monitor.MemInfo, disks []monitor.DiskInfo) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.sampleLocked(now, m, disks)
+}
+
+func (f *forecaster) sampleLocked(now int64, m monitor.MemInfo, disks []monitor.DiskInfo) {
+	put := func(kind, instance string, used, free, total uint64) {
+		id := alertID(kind, instance)
+		s := f.series[id]
+		if s == nil {
+			s = &capacitySeries{}
+			f.series[id] = s
+		}
+		s.samples = append(s.samples, capacitySample{at: now, used: float64(used)})
+		cut := 0
+		for cut < len(s.samples) && time.Duration(now-s.samples[cut].at)*time.Millisecond > f.window {
+			cut++
+		}
+		s.samples = s.samples[cut:]
+		s.last = forecast{ID: id, Kind: kind, Instance: instance, Used: used, Free: free, Total: total}
+		s.fit(&s.last, now)
+	}
+
+	// 内存看 available：cache 能让出来，不算"用掉"
+	if m.Total > 0 {
+		put("memory", "", m.Total-m.Available, m.Available, m.Total)
+	}
+	if m.SwapTotal > 0 {
+		put("swap", "", m.SwapUsed, m.SwapTotal-m.SwapUsed, m.SwapTotal)
+	}
+	for _, d := range disks {
+		put("disk", d.Mountpoint, d.Used, d.Free, d.Total)
+	}
+
+	// 卸载掉的盘，一个窗口没见就忘掉
+	for id, s := range f.series {
+		if time.Duration(now-s.samples[len(s.samples)-1].at)*time.Millisecond > f.window {
+			delete(f.series, id)
+		}
+	}
+}
+
+// list returns every series, soonest full first, then by id.
+func (f *forecaster) list() []forecast {
+	out := []forecast{}
+	if !f.enabled() {
+		return out
+	}
+	f.mu.Lock()
+	for _, s := range f.series {
+		out = append(out, s.last)
+	}
+	f.mu.Unlock()
+	sort.Slice(out, func(i, j int) bool {
+		a, b := out[i].FullIn, out[j].FullIn
+		if (a > 0) != (b > 0) {
+			return a > 0
+		}
+		if a != b {
+			return a < b
+		}
+		return out[i].ID < out[j].ID
+	})
+	return out
+}
+
+// annotate fills in fullIn on the snapshot's memory and disks. It is as
+// of the last sample, so it only changes once a minute and doesn't make
+// every delta carry the disks.
+func (f *forecaster) annotate(snap *Snapshot) {
+	if !f.enabled() {
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	fullIn := func(id string) int64 {
+		if s := f.series[id]; s != nil {
+			return s.last.FullIn
+		}
+		return 0
+	}
+	snap.Memory.FullIn = fullIn("memory")
+	snap.Memory.SwapFullIn = fullIn("swap")
+	for i := range snap.Disks {
+		snap.Disks[i].FullIn = fullIn(alertID("disk", snap.Disks[i].Mountpoint))
+	}
+}
@@ -0,0 +1,64 @@
+// Copyright (C) 2025 Russell Li (xiaoxinmm)
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"sysmon/monitor"
+)
+
+// TestForecastSeed restarts the forecaster on a store where a disk has
+// been filling up for two hours: the first sample already has the trend.
+func TestForecastSeed(t *testing.T) {
+	now := time.Date(2025, 1, 2, 12, 0, 0, 0, time.UTC).UnixMilli()
+	const step = 10 * 1000
+	start := now - 2*time.Hour.Milliseconds()
+	// 两小时从 40% 涨到 50%，100 GB 的盘
+	for t := start; t < now; t += step {
+		pct := 40 + 10*float64(t-start)/float64(now-start)
+		monitor.Record(t, []monitor.Sample{
+			{Metric: "disk", Labels: monitor.Labels{"mountpoint": "/seedvar"}, Value: pct},
+			{Metric: "disk", Labels: monitor.Labels{"mountpoint": "/seedgone"}, Value: 10},
+		})
+	}
+	disks := []monitor.DiskInfo{{Mountpoint: "/seedvar", Total: 105e9, Used: 50e9, Free: 50e9, UsedPercent: 50}}
+
+	f := &forecaster{}
+	f.configure(86400)
+	f.seed(now, monitor.MemInfo{}, disks)
+	got := f.list()
+	if len(got) != 1 {
+		t.Fatalf("forecasts %+v, want /seedvar only", got)
+	}
+	fc := got[0]
+	wantRate := 10e9 / 7200.0
+	if fc.ID != "disk:/seedvar" || fc.Samples < 110 || fc.Span < 7000 || math.Abs(fc.Rate-wantRate) > wantRate*0.02 || fc.R2 < 0.99 {
+		t.Errorf("seeded forecast %+v, want about %.0f B/s over two hours", fc, wantRate)
+	}
+	if in := time.Duration(fc.FullIn) * time.Second; in < 9*time.Hour || in > 11*time.Hour {
+		t.Errorf("full in %s, want about 10h", in)
+	}
+
+	cold := &forecaster{}
+	cold.configure(86400)
+	cold.sample(now, monitor.MemInfo{}, disks)
+	if fc := cold.list()[0]; fc.Samples != 1 || fc.FullIn != 0 {
+		t.Errorf("cold start %+v", fc)
+	}
+}
@@ -0,0 +1,200 @@
+// Copyright (C) 2025 Russell Li (xiaoxinmm)
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// `sysmon history export|import`: a client for the export and import API
+// of a running sysmon.
+
+const historyUsage = `usage:
+  sysmon history export [flags] [-o file]
+  sysmon history import [flags] file
+
+Run "sysmon history export -h" or "sysmon history import -h" for flags.
+`
+
+// stringsFlag collects a repeated flag.
+type stringsFlag []string
+
+func (f *stringsFlag) String() string     { return strings.Join(*f, " ") }
+func (f *stringsFlag) Set(v string) error { *f = append(*f, v); return nil }
+
+// runHistoryCommand runs the subcommand in args and returns the exit code.
+func runHistoryCommand(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprint(os.Stderr, historyUsage)
+		return 2
+	}
+	fs := flag.NewFlagSet("sysmon history "+args[0], flag.ContinueOnError)
+	server := fs.String("server", envOr("SYSMON_SERVER", "http://localhost:8888"), "sysmon to talk to (env SYSMON_SERVER)")
+	token := fs.String("token", os.Getenv("SYSMON_TOKEN"), "API token from POST /login, when a password is set (env SYSMON_TOKEN)")
+	format := fs.String("format", "", "csv, ndjson or parquet; default from the file name, else csv (export) or sniffed (import)")
+
+	var err error
+	switch args[0] {
+	case "export":
+		var selects stringsFlag
+		fs.Var(&selects, "select", "series selector, repeatable, e.g. cpu or disk{mountpoint=\"/\"}; default all")
+		start := fs.String("start", "", "start of the range, unix seconds or RFC 3339; default the oldest point")
+		end := fs.String("end", "", "end of the range; default now")
+		resolution := fs.String("resolution", "raw", "raw, 1m or 1h")
+		out := fs.String("o", "-", "output file, - for stdout")
+		if fs.Parse(args[1:]) != nil {
+			return 2
+		}
+		q := url.Values{"select": selects, "resolution": {*resolution}, "format": {formatFor(*format, *out, "csv")}}
+		if *start != "" {
+			q.Set("start", *start)
+		}
+		if *end != "" {
+			q.Set("end", *end)
+		}
+		err = historyExport(*server, *token, q, *out)
+	case "import":
+		source := fs.String("source", "", "add the label source=<this> to every imported series, to keep them apart from this host's")
+		if fs.Parse(args[1:]) != nil {
+			return 2
+		}
+		if fs.NArg() != 1 {
+			fmt.Fprint(os.Stderr, historyUsage)
+			return 2
+		}
+		q := url.Values{}
+		if f := formatFor(*format, fs.Arg(0), ""); f != "" {
+			q.Set("format", f)
+		}
+		if *source != "" {
+			q.Set("source", *source)
+		}
+		err = historyImport(*server, *token, q, fs.Arg(0))
+	default:
+		fmt.Fprint(os.Stderr, historyUsage)
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "sysmon history:", err)
+		return 1
+	}
+	return 0
+}
+
+func envOr(name, def string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return def
+}
+
+// formatFor is the -format flag, else the file's extension, else def.
+func formatFor(flagValue, file, def string) string {
+	if flagValue != "" {
+		return flagValue
+	}
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".csv":
+		return "csv"
+	case ".ndjson", ".jsonl":
+		return "ndjson"
+	case ".parquet":
+		return "parquet"
+	}
+	return def
+}
+
+func historyRequest(method, server, token, path string, q url.Values, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequest(method, strings.TrimRight(server, "/")+"/api/v1/history/"+path+"?"+q.Encode(), body)
+	if err != nil {
+		return nil, err
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		var e struct {
+			Error string `json:"error"`
+		}
+		json.NewDecoder(io.LimitReader(resp.Body, 4096)).Decode(&e)
+		if e.Error == "" {
+			e.Error = resp.Status
+		}
+		return nil, errors.New(e.Error)
+	}
+	return resp, nil
+}
+
+func historyExport(server, token string, q url.Values, out string) error {
+	resp, err := historyRequest(http.MethodGet, server, token, "export", q, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if out == "-" {
+		_, err = io.Copy(os.Stdout, resp.Body)
+		return err
+	}
+	f, err := os.Create(out)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(f, resp.Body); err != nil {
+		f.Close()
+		os.Remove(out)
+		return err
+	}
+	return f.Close()
+}
+
+func historyImport(server, token string, q url.Values, file string) error {
+	in := os.Stdin
+	if file != "-" {
+		f, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+	resp, err := historyRequest(http.MethodPost, server, token, "import", q, in)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	var stats struct {
+		Series, Points, Skipped int
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&stats); err != nil {
+		return err
+	}
+	fmt.Printf("imported %d points into %d series, skipped %d\n", stats.Points, stats.Series, stats.Skipped)
+	return nil
+}
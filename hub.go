@@ -0,0 +1,257 @@
+// Copyright (C) 2025 Russell Li (xiaoxinmm)
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+var upgrader = websocket.Upgrader{
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+type wsMessage struct {
+	Type    string      `json:"type"`
+	Seq     uint64      `json:"seq,omitempty"`
+	Payload interface{} `json:"payload"`
+}
+
+// replayEvents is how many broadcasts the hub keeps for SSE clients that
+// reconnect with Last-Event-ID. At the default 1.5s refresh that is a
+// little over a minute and a half of snapshots.
+const replayEvents = 64
+
+// hubEvent is one broadcast, kept for replay. Everything in it is read-only
+// once recorded; the encoding cache is only touched under hub.mu.
+type hubEvent struct {
+	id    uint64
+	topic string // "snapshot" or a broadcast topic
+	at    time.Time
+	gen   map[string]interface{} // snapshots only
+	enc   *encodedMessage
+}
+
+type hub struct {
+	mu      sync.Mutex
+	clients map[*client]bool
+	// n is len(clients), readable without mu: the collection loop checks
+	// it every tick and must not wait behind a slow write
+	n       atomic.Int64
+	wake    chan struct{} // 第一个客户端连上时通知采集循环
+	lastID  uint64
+	recent  []hubEvent
+	closing string // 非空表示正在关闭，新连接直接打发走
+
+	// Broadcasts wait here for the delivery goroutine, so whoever
+	// broadcasts (the collection loop, the alert engine) never waits on
+	// a client write. Topic messages keep their order; of the snapshots
+	// only the latest is kept.
+	qmu        sync.Mutex
+	queue      []queuedBroadcast
+	snap       *Snapshot
+	delivering bool
+	ready      chan struct{}
+}
+
+type queuedBroadcast struct {
+	topic string
+	msg   wsMessage
+}
+
+func newHub() *hub {
+	h := &hub{
+		clients: make(map[*client]bool),
+		wake:    make(chan struct{}, 1),
+		ready:   make(chan struct{}, 1),
+	}
+	go h.deliver()
+	return h
+}
+
+func (h *hub) add(c *client) {
+	h.addResume(c, 0)
+}
+
+// addResume registers c and, if lastID is still in the replay buffer, sends
+// it every broadcast it missed. Both happen under the hub lock so nothing
+// can slip in between. It reports whether the replay covered the gap; if
+// not, the caller has to send a fresh snapshot.
+func (h *hub) addResume(c *client, lastID uint64) bool {
+	h.mu.Lock()
+	if h.closing != "" {
+		h.mu.Unlock()
+		c.mu.Lock()
+		c.out.shutdown(h.closing)
+		c.mu.Unlock()
+		return true
+	}
+	h.clients[c] = true
+	h.n.Store(int64(len(h.clients)))
+	first := len(h.clients) == 1
+	resumed := false
+	if lastID > 0 && len(h.recent) > 0 && h.recent[0].id <= lastID+1 && lastID <= h.lastID {
+		resumed = true
+		for _, ev := range h.recent {
+			if ev.id <= lastID {
+				continue
+			}
+			if err := h.sendEventLocked(c, ev); err != nil {
+				resumed = false
+				break
+			}
+		}
+	}
+	h.mu.Unlock()
+	if first {
+		select {
+		case h.wake <- struct{}{}:
+		default:
+		}
+	}
+	return resumed
+}
+
+func (h *hub) count() int {
+	return int(h.n.Load())
+}
+
+func (h *hub) remove(c *client) {
+	h.mu.Lock()
+	delete(h.clients, c)
+	h.n.Store(int64(len(h.clients)))
+	h.mu.Unlock()
+	c.out.close()
+}
+
+// shutdown says goodbye to every client and refuses new ones.
+func (h *hub) shutdown(reason string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.closing = reason
+	for c := range h.clients {
+		c.mu.Lock()
+		c.out.shutdown(reason)
+		c.mu.Unlock()
+		delete(h.clients, c)
+	}
+	h.n.Store(0)
+}
+
+func (h *hub) sendEventLocked(c *client, ev hubEvent) error {
+	if ev.topic == "snapshot" {
+		return c.sendSnapshot(ev.id, ev.gen, ev.enc, ev.at)
+	}
+	return c.sendTopic(ev.id, ev.topic, ev.enc)
+}
+
+// publishLocked records ev for replay and sends it to every client,
+// dropping the ones whose transport failed.
+func (h *hub) publishLocked(ev hubEvent) {
+	h.recent = append(h.recent, ev)
+	if len(h.recent) > replayEvents {
+		h.recent = append(h.recent[:0:0], h.recent[len(h.recent)-replayEvents:]...)
+	}
+	for c := range h.clients {
+		if err := h.sendEventLocked(c, ev); err != nil {
+			c.out.close()
+			delete(h.clients, c)
+		}
+	}
+	h.n.Store(int64(len(h.clients)))
+}
+
+// broadcast queues msg for every client subscribed to topic.
+func (h *hub) broadcast(topic string, msg wsMessage) {
+	h.qmu.Lock()
+	h.queue = append(h.queue, queuedBroadcast{topic, msg})
+	h.qmu.Unlock()
+	h.signal()
+}
+
+// broadcastSnapshot queues snap for the clients, replacing one that
+// hasn't gone out yet: they only want the latest.
+func (h *hub) broadcastSnapshot(snap Snapshot) {
+	if h.count() == 0 {
+		return
+	}
+	h.qmu.Lock()
+	h.snap = &snap
+	h.qmu.Unlock()
+	h.signal()
+}
+
+func (h *hub) signal() {
+	select {
+	case h.ready <- struct{}{}:
+	default:
+	}
+}
+
+// deliver sends what is queued, one broadcast at a time under the hub
+// lock. A stalled client holds it up for at most clientWriteTimeout per
+// write before it is dropped.
+func (h *hub) deliver() {
+	for range h.ready {
+		for {
+			h.qmu.Lock()
+			queue, snap := h.queue, h.snap
+			h.queue, h.snap = nil, nil
+			h.delivering = len(queue) > 0 || snap != nil
+			h.qmu.Unlock()
+			if !h.delivering {
+				break
+			}
+			for _, m := range queue {
+				h.mu.Lock()
+				h.lastID++
+				h.publishLocked(hubEvent{id: h.lastID, topic: m.topic, at: time.Now(), enc: newEncodedMessage(m.msg)})
+				h.mu.Unlock()
+			}
+			if snap != nil {
+				h.sendSnapshot(*snap)
+			}
+		}
+	}
+}
+
+// sendSnapshot sends snap to every client in the protocol mode and with
+// the subscriptions it asked for. The full-snapshot encodings and the
+// generic tree used for filtering and diffing are built once per tick.
+func (h *hub) sendSnapshot(snap Snapshot) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.clients) == 0 {
+		return
+	}
+
+	gen, err := toGeneric(snap)
+	if err != nil {
+		return
+	}
+	h.lastID++
+	h.publishLocked(hubEvent{
+		id:    h.lastID,
+		topic: "snapshot",
+		at:    time.Now(),
+		gen:   gen,
+		enc:   snapshotMessage(snap, gen),
+	})
+}
@@ -0,0 +1,108 @@
+// Copyright (C) 2025 Russell Li (xiaoxinmm)
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// 超限后建议客户端多久再试
+const limitRetryAfter = 10 * time.Second
+
+// connLimiter caps concurrent connections globally and per client IP.
+// sysmon has a single login, so the IP is the closest thing to a user.
+// A zero limit means no limit.
+type connLimiter struct {
+	name   string
+	global int
+	perIP  int
+
+	mu    sync.Mutex
+	total int
+	byIP  map[string]int
+}
+
+func newConnLimiter(name string, global, perIP int) *connLimiter {
+	return &connLimiter{name: name, global: global, perIP: perIP, byIP: make(map[string]int)}
+}
+
+// clientIP is the address the connection comes from. X-Forwarded-For is
+// not trusted: anyone could set it to dodge the per-IP cap.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// acquire takes a slot for ip. On success the caller must call release
+// exactly once; otherwise reason says which cap was hit.
+func (l *connLimiter) acquire(ip string) (release func(), reason string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.global > 0 && l.total >= l.global {
+		return nil, "too many " + l.name
+	}
+	if l.perIP > 0 && l.byIP[ip] >= l.perIP {
+		return nil, "too many " + l.name + " from " + ip
+	}
+	l.total++
+	l.byIP[ip]++
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			l.total--
+			if l.byIP[ip]--; l.byIP[ip] <= 0 {
+				delete(l.byIP, ip)
+			}
+		})
+	}, ""
+}
+
+// rejectHTTP answers a plain HTTP request (SSE) that is over the limit.
+func rejectHTTP(w http.ResponseWriter, reason string) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(limitRetryAfter.Seconds())))
+	http.Error(w, reason, http.StatusTooManyRequests)
+}
+
+// rejectWebSocket answers a websocket request that is over the limit.
+// Browsers don't expose the status of a failed handshake, so the
+// connection is upgraded and closed straight away with 1013 (try again
+// later) and the reason; non-upgrade requests get a 429.
+func rejectWebSocket(w http.ResponseWriter, r *http.Request, reason string) {
+	if !websocket.IsWebSocketUpgrade(r) {
+		rejectHTTP(w, reason)
+		return
+	}
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	conn.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseTryAgainLater, reason),
+		time.Now().Add(time.Second))
+	conn.Close()
+}
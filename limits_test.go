@@ -0,0 +1,143 @@
+// Copyright (C) 2025 Russell Li (xiaoxinmm)
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestConnLimiter(t *testing.T) {
+	l := newConnLimiter("dashboard connections", 3, 2)
+	a1, _ := l.acquire("10.0.0.1")
+	a2, _ := l.acquire("10.0.0.1")
+	if a1 == nil || a2 == nil {
+		t.Fatal("refused the first two from one IP")
+	}
+	if release, reason := l.acquire("10.0.0.1"); release != nil || reason != "too many dashboard connections from 10.0.0.1" {
+		t.Errorf("third from one IP: %q", reason)
+	}
+	b, _ := l.acquire("10.0.0.2")
+	if b == nil {
+		t.Fatal("refused another IP")
+	}
+	if release, reason := l.acquire("10.0.0.3"); release != nil || reason != "too many dashboard connections" {
+		t.Errorf("fourth in all: %q", reason)
+	}
+
+	// 重复 release 只算一次
+	a1()
+	a1()
+	if release, _ := l.acquire("10.0.0.3"); release == nil {
+		t.Error("released slot not reused")
+	}
+	if release, _ := l.acquire("10.0.0.3"); release != nil {
+		t.Error("a double release freed two slots")
+	}
+}
+
+// TestConnLimitsRefuse fills the dashboard limit with a websocket and an
+// SSE stream, as /ws and /api/stream share it: the next of either kind
+// is turned away, a websocket with close code 1013 and SSE with a 429.
+// Once one leaves, a new dashboard gets in.
+func TestConnLimitsRefuse(t *testing.T) {
+	h := newHub()
+	cfg := Config{RefreshInterval: 1000, MaxProcesses: 5, MaxMessageSize: 4096}
+	dashboards := newConnLimiter("dashboard connections", 2, 0)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ws", handleWebSocket(cfg, h, dashboards))
+	mux.HandleFunc("/api/stream", handleStream(cfg, h, dashboards))
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+	wsURL := "ws" + strings.TrimPrefix(srv.URL, "http") + "/ws"
+
+	dial := func() (*websocket.Conn, error) {
+		conn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, _, err = conn.ReadMessage()
+		return conn, err
+	}
+	first, err := dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	next, hangUp := openStream(t, srv.URL+"/api/stream", "")
+	defer hangUp()
+	next()
+
+	conn, err := dial()
+	conn.Close()
+	var ce *websocket.CloseError
+	if !errors.As(err, &ce) || ce.Code != websocket.CloseTryAgainLater || ce.Text != "too many dashboard connections" {
+		t.Errorf("third dashboard on /ws: %v, want close 1013", err)
+	}
+	for _, path := range []string{"/api/stream", "/ws"} {
+		resp, err := http.Get(srv.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusTooManyRequests || resp.Header.Get("Retry-After") != "10" || !strings.Contains(string(body), "too many dashboard connections") {
+			t.Errorf("third dashboard on %s: %d, Retry-After %q, %s", path, resp.StatusCode, resp.Header.Get("Retry-After"), body)
+		}
+	}
+
+	// 走了一个就能再进一个
+	first.Close()
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		conn, err := dial()
+		conn.Close()
+		if err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("slot never freed: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// TestConnLimitsPerIP is the per-IP cap over HTTP: every test request
+// comes from 127.0.0.1, so the second one is refused and told why.
+func TestConnLimitsPerIP(t *testing.T) {
+	h := newHub()
+	srv := httptest.NewServer(handleStream(Config{RefreshInterval: 1000, MaxProcesses: 5}, h, newConnLimiter("dashboard connections", 0, 1)))
+	defer srv.Close()
+	next, hangUp := openStream(t, srv.URL, "")
+	defer hangUp()
+	next()
+
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusTooManyRequests || !strings.Contains(string(body), "too many dashboard connections from 127.0.0.1") {
+		t.Errorf("second from one IP: %d %s", resp.StatusCode, body)
+	}
+}
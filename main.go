@@ -16,6 +16,7 @@
 package main
 
 import (
+	"context"
 	"crypto/hmac"
 	"crypto/rand"
 	"crypto/sha256"
@@ -30,12 +31,9 @@ import (
 	"os"
 	"strconv"
 	"strings"
-	"sync"
 	"time"
 
 	"sysmon/monitor"
-
-	"github.com/gorilla/websocket"
 )
 
 // TODO: 支持 TOML 配置
@@ -49,6 +47,61 @@ type Config struct {
 	HistoryDuration int    `json:"historyDuration"` // seconds
 	EnableShell     bool   `json:"enableShell"`
 	ShellPassword   string `json:"shell_password"` // 终端独立密码
+	IdleInterval    int    `json:"idleInterval"`   // milliseconds, 没有客户端时的采样间隔
+	ShutdownTimeout int    `json:"shutdownTimeout"` // seconds
+
+	// history on disk, off unless dataDir is set
+	DataDir        string `json:"dataDir"`
+	HistoryMaxSize int    `json:"historyMaxSize"` // MiB, 0 = no cap
+	HistoryMaxAge  int    `json:"historyMaxAge"`  // seconds, 0 = no cap
+
+	// 连接数上限，0 表示不限
+	MaxClients      int `json:"maxClients"`      // dashboards, /ws + /api/stream
+	MaxClientsPerIP int `json:"maxClientsPerIP"`
+	MaxShells       int `json:"maxShells"`
+	MaxShellsPerIP  int `json:"maxShellsPerIP"`
+	MaxMessageSize  int `json:"maxMessageSize"` // bytes, incoming websocket frames
+
+	// Prometheus /metrics
+	MetricsToken        string   `json:"metricsToken"`
+	MetricsAllow        []string `json:"metricsAllow"`        // IPs or CIDRs
+	MetricsTopProcesses int      `json:"metricsTopProcesses"` // 0 = 不导出进程
+
+	// OTLP push, off unless otlpEndpoint is set
+	OTLPEndpoint string            `json:"otlpEndpoint"`
+	OTLPProtocol string            `json:"otlpProtocol"` // http/protobuf, http/json, grpc
+	OTLPInterval int               `json:"otlpInterval"` // milliseconds
+	OTLPHeaders  map[string]string `json:"otlpHeaders"`
+	OTLPBuffer   int               `json:"otlpBuffer"` // batches kept while the collector is down
+
+	// InfluxDB / Graphite writers, config file only
+	Outputs []OutputConfig `json:"outputs"`
+
+	// anomaly scores: EWMA over anomalyWindow seconds, flagged past anomalyThreshold σ
+	AnomalyWindow    int     `json:"anomalyWindow"` // 0 = off
+	AnomalyThreshold float64 `json:"anomalyThreshold"`
+
+	// disk/memory trend for "full in", seconds of samples to fit; 0 = off
+	ForecastWindow int `json:"forecastWindow"`
+
+	// snapshot sections to leave out, by collector name: system, cpu, memory, ...
+	DisableCollectors []string `json:"disableCollectors"`
+
+	// top processes recorded into history every processHistoryInterval seconds; 0 = off
+	ProcessHistoryInterval int `json:"processHistoryInterval"`
+	ProcessHistoryTop      int `json:"processHistoryTop"` // by each of cpu, memory and io
+
+	// alert rules and where to send them, config file only
+	Alerts        []AlertRule         `json:"alerts"`
+	Notifications []ChannelConfig     `json:"notifications"`
+	Maintenance   []MaintenanceWindow `json:"maintenance"` // recurring windows with notifications muted
+}
+
+func (c Config) clientLimits() clientLimits {
+	return clientLimits{
+		minInterval: time.Duration(c.RefreshInterval) * time.Millisecond,
+		maxProcs:    c.MaxProcesses,
+	}
 }
 
 // ShellEnabled returns true only when shell is explicitly enabled AND shell_password is set.
@@ -58,11 +111,27 @@ func (c Config) ShellEnabled() bool {
 
 func defaultConfig() Config {
 	return Config{
-		Port:            8888,
-		RefreshInterval: 1500,
-		MaxProcesses:    50,
-		Password:        "",
-		HistoryDuration: 3600,
+		Port:                   8888,
+		RefreshInterval:        1500,
+		MaxProcesses:           50,
+		Password:               "",
+		HistoryDuration:        3600,
+		IdleInterval:           10000,
+		ShutdownTimeout:        10,
+		HistoryMaxSize:         64,
+		MaxClients:             256,
+		MaxClientsPerIP:        16,
+		MaxShells:              8,
+		MaxShellsPerIP:         4,
+		MaxMessageSize:         64 * 1024,
+		OTLPProtocol:           otlpHTTPProtobuf,
+		OTLPInterval:           30000,
+		OTLPBuffer:             120,
+		AnomalyWindow:          3600,
+		AnomalyThreshold:       3,
+		ForecastWindow:         86400,
+		ProcessHistoryInterval: 10,
+		ProcessHistoryTop:      5,
 	}
 }
 
@@ -104,6 +173,65 @@ func loadConfig(path string) Config {
 			cfg.HistoryDuration = n
 		}
 	}
+	if v := os.Getenv("SYSMON_IDLE_INTERVAL"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil {
+			cfg.IdleInterval = n
+		}
+	}
+	if v := os.Getenv("SYSMON_SHUTDOWN_TIMEOUT"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil {
+			cfg.ShutdownTimeout = n
+		}
+	}
+	if v := os.Getenv("SYSMON_DATA_DIR"); v != "" {
+		cfg.DataDir = v
+	}
+	if v := os.Getenv("SYSMON_METRICS_TOKEN"); v != "" {
+		cfg.MetricsToken = v
+	}
+	if v := os.Getenv("SYSMON_METRICS_ALLOW"); v != "" {
+		cfg.MetricsAllow = strings.Split(v, ",")
+	}
+	if v := os.Getenv("SYSMON_DISABLE_COLLECTORS"); v != "" {
+		cfg.DisableCollectors = strings.Split(v, ",")
+	}
+	if v := os.Getenv("SYSMON_OTLP_ENDPOINT"); v != "" {
+		cfg.OTLPEndpoint = v
+	}
+	if v := os.Getenv("SYSMON_OTLP_PROTOCOL"); v != "" {
+		cfg.OTLPProtocol = v
+	}
+	if v := os.Getenv("SYSMON_OTLP_HEADERS"); v != "" {
+		// k1=v1,k2=v2, like OTEL_EXPORTER_OTLP_HEADERS
+		cfg.OTLPHeaders = make(map[string]string)
+		for _, kv := range strings.Split(v, ",") {
+			if k, v, ok := strings.Cut(kv, "="); ok {
+				cfg.OTLPHeaders[strings.TrimSpace(k)] = strings.TrimSpace(v)
+			}
+		}
+	}
+	for env, dst := range map[string]*int{
+		"SYSMON_HISTORY_MAX_SIZE":    &cfg.HistoryMaxSize,
+		"SYSMON_HISTORY_MAX_AGE":     &cfg.HistoryMaxAge,
+		"SYSMON_MAX_CLIENTS":         &cfg.MaxClients,
+		"SYSMON_MAX_CLIENTS_PER_IP":  &cfg.MaxClientsPerIP,
+		"SYSMON_MAX_SHELLS":          &cfg.MaxShells,
+		"SYSMON_MAX_SHELLS_PER_IP":   &cfg.MaxShellsPerIP,
+		"SYSMON_MAX_MESSAGE_SIZE":    &cfg.MaxMessageSize,
+		"SYSMON_METRICS_TOP_PROCS":   &cfg.MetricsTopProcesses,
+		"SYSMON_OTLP_INTERVAL":       &cfg.OTLPInterval,
+		"SYSMON_OTLP_BUFFER":         &cfg.OTLPBuffer,
+		"SYSMON_ANOMALY_WINDOW":      &cfg.AnomalyWindow,
+		"SYSMON_FORECAST_WINDOW":     &cfg.ForecastWindow,
+		"SYSMON_PROCESS_HISTORY":     &cfg.ProcessHistoryInterval,
+		"SYSMON_PROCESS_HISTORY_TOP": &cfg.ProcessHistoryTop,
+	} {
+		if v := os.Getenv(env); v != "" {
+			if n, err := strconv.Atoi(v); err == nil {
+				*dst = n
+			}
+		}
+	}
 
 	return cfg
 }
@@ -186,6 +314,10 @@ func isAuthenticated(r *http.Request, password string) bool {
 	if t := r.URL.Query().Get("token"); t != "" {
 		return validateToken(t, password)
 	}
+	// check Authorization: Bearer <token>, for scripts
+	if t, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		return validateToken(t, password)
+	}
 	// check cookie
 	if c, err := r.Cookie("sysmon_token"); err == nil {
 		return validateToken(c.Value, password)
@@ -255,49 +387,6 @@ document.getElementById('f').onsubmit=async function(e){
 //go:embed web
 var webFS embed.FS
 
-var upgrader = websocket.Upgrader{
-	CheckOrigin: func(r *http.Request) bool { return true },
-}
-
-type hub struct {
-	mu      sync.Mutex
-	clients map[*websocket.Conn]bool
-}
-
-func newHub() *hub {
-	return &hub{clients: make(map[*websocket.Conn]bool)}
-}
-
-func (h *hub) add(conn *websocket.Conn) {
-	h.mu.Lock()
-	h.clients[conn] = true
-	h.mu.Unlock()
-}
-
-func (h *hub) remove(conn *websocket.Conn) {
-	h.mu.Lock()
-	delete(h.clients, conn)
-	h.mu.Unlock()
-	conn.Close()
-}
-
-func (h *hub) broadcast(data []byte) {
-	h.mu.Lock()
-	defer h.mu.Unlock()
-	for conn := range h.clients {
-		err := conn.WriteMessage(websocket.TextMessage, data)
-		if err != nil {
-			conn.Close()
-			delete(h.clients, conn)
-		}
-	}
-}
-
-type wsMessage struct {
-	Type    string      `json:"type"`
-	Payload interface{} `json:"payload"`
-}
-
 type Snapshot struct {
 	Timestamp int64                `json:"timestamp"`
 	System    monitor.SystemInfo   `json:"system"`
@@ -307,33 +396,52 @@ type Snapshot struct {
 	Network   []monitor.NetInfo    `json:"network"`
 	Load      monitor.LoadInfo     `json:"load"`
 	Processes []monitor.ProcessInfo `json:"processes"`
+
+	// sections from collectors outside the monitor package, by name
+	Extra    map[string]interface{} `json:"-"`
+	sections []string               // 这次采到的 section
 }
 
 func collect(maxProcesses int) Snapshot {
-	return Snapshot{
-		Timestamp: time.Now().UnixMilli(),
-		System:    monitor.GetSystemInfo(),
-		CPU:       monitor.GetCPUInfo(),
-		Memory:    monitor.GetMemInfo(),
-		Disks:     monitor.GetDiskInfo(),
-		Network:   monitor.GetNetInfo(),
-		Load:      monitor.GetLoadInfo(),
-		Processes: monitor.GetProcesses(maxProcesses),
-	}
+	snap := Snapshot{Timestamp: time.Now().UnixMilli()}
+	collectors.collect(&snap, monitor.CollectOptions{MaxProcesses: maxProcesses})
+	forecasts.annotate(&snap)
+	return snap
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "history" {
+		os.Exit(runHistoryCommand(os.Args[2:]))
+	}
+
 	configPath := flag.String("config", "", "path to config file")
+	printOpenAPI := flag.Bool("openapi", false, "print the OpenAPI document and exit")
 	flag.Parse()
 
+	if *printOpenAPI {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(openAPIDoc())
+		return
+	}
+
 	cfg := loadConfig(*configPath)
 
 	initAuthSecret()
-
-	// 设置 history 容量
-	monitor.SetHistoryCapacity(cfg.HistoryDuration)
+	collectors = newCollectorSet(cfg.DisableCollectors)
+
+	// 原始点保留多久，汇总档位各有各的
+	monitor.SetHistoryRetention(time.Duration(cfg.HistoryDuration) * time.Second)
+	if cfg.DataDir != "" {
+		maxAge := time.Duration(cfg.HistoryMaxAge) * time.Second
+		if err := monitor.OpenHistory(cfg.DataDir, int64(cfg.HistoryMaxSize)<<20, maxAge); err != nil {
+			log.Fatalf("history: %v", err)
+		}
+		onShutdown("history", func(context.Context) { monitor.CloseHistory() })
+	}
 
 	h := newHub()
+	dashboards := newConnLimiter("dashboard connections", cfg.MaxClients, cfg.MaxClientsPerIP)
 
 	webContent, err := fs.Sub(webFS, "web")
 	if err != nil {
@@ -370,44 +478,23 @@ func main() {
 		fileServer.ServeHTTP(w, r)
 	}))
 
-	http.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
-		if !isAuthenticated(r, cfg.Password) {
-			http.Error(w, "unauthorized", 401)
-			return
-		}
-		conn, err := upgrader.Upgrade(w, r, nil)
-		if err != nil {
-			log.Printf("websocket upgrade error: %v", err)
-			return
-		}
-		h.add(conn)
-
-		snap := collect(cfg.MaxProcesses)
-		initMsg := wsMessage{Type: "snapshot", Payload: snap}
-		data, _ := json.Marshal(initMsg)
-		conn.WriteMessage(websocket.TextMessage, data)
-
-		// Send history
-		history := monitor.GetHistory()
-		if len(history) > 0 {
-			histMsg := wsMessage{Type: "history", Payload: history}
-			data, _ := json.Marshal(histMsg)
-			conn.WriteMessage(websocket.TextMessage, data)
-		}
+	http.HandleFunc("/ws", handleWebSocket(cfg, h, dashboards))
 
-		go func() {
-			defer h.remove(conn)
-			for {
-				_, _, err := conn.ReadMessage()
-				if err != nil {
-					break
-				}
-			}
-		}()
-	})
+	// REST API
+	http.HandleFunc("/api/v1/", handleAPIv1(cfg))
+
+	// machine-readable API description
+	http.HandleFunc("/api/openapi.json", handleOpenAPI)
+	http.HandleFunc("/api/schema/", handleSchema)
+
+	// Prometheus exporter, with its own auth
+	http.HandleFunc("/metrics", handleMetrics(cfg, h))
+
+	// SSE alternative to /ws, for proxies that break websockets
+	http.HandleFunc("/api/stream", handleStream(cfg, h, dashboards))
 
 	// shell websocket endpoint
-	http.HandleFunc("/ws/shell", handleShell(cfg))
+	http.HandleFunc("/ws/shell", handleShell(cfg, newConnLimiter("shell sessions", cfg.MaxShells, cfg.MaxShellsPerIP)))
 
 	// shell status API — lets frontend know if shell is available
 	http.HandleFunc("/api/shell-status", authRequired(cfg.Password, func(w http.ResponseWriter, r *http.Request) {
@@ -443,45 +530,55 @@ func main() {
 		json.NewEncoder(w).Encode(map[string]string{"shell_token": token})
 	}))
 
-	// background broadcaster
-	go func() {
-		ticker := time.NewTicker(time.Duration(cfg.RefreshInterval) * time.Millisecond)
-		defer ticker.Stop()
-		for range ticker.C {
-			snap := collect(cfg.MaxProcesses)
-			// record history
-			monitor.RecordHistory(snap.CPU.AvgUsage, snap.Memory.UsedPercent)
-
-			msg := wsMessage{Type: "snapshot", Payload: snap}
-			data, err := json.Marshal(msg)
-			if err != nil {
-				continue
-			}
-			h.broadcast(data)
-		}
-	}()
-
-	// docker stats, less frequent
-	go func() {
-		ticker := time.NewTicker(5 * time.Second)
-		defer ticker.Stop()
-		for range ticker.C {
-			containers := monitor.GetDockerContainers()
-			if containers == nil {
-				continue
-			}
-			msg := wsMessage{Type: "docker", Payload: containers}
-			data, err := json.Marshal(msg)
-			if err != nil {
-				continue
-			}
-			h.broadcast(data)
+	var sinks []snapshotSink
+	outs, err := newOutputs(cfg.Outputs)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(outs) > 0 {
+		outs.start()
+		sinks = append(sinks, outs)
+	}
+	anomalies.configure(cfg.AnomalyWindow, cfg.AnomalyThreshold, h)
+	anomalies.seed(time.Now().UnixMilli())
+	forecasts.configure(cfg.ForecastWindow)
+	if forecasts.enabled() {
+		go forecasts.run()
+	}
+	if err := alerts.configure(cfg.Alerts, h); err != nil {
+		log.Fatal(err)
+	}
+	if err := alerts.configureMaintenance(cfg.Maintenance); err != nil {
+		log.Fatal(err)
+	}
+	hostname, _ := os.Hostname()
+	if alerts.notify, err = newNotifications(cfg.Notifications, hostname); err != nil {
+		log.Fatal(err)
+	}
+	alerts.notify.start()
+	if alerts.enabled() {
+		go alerts.run()
+		sinks = append(sinks, alerts)
+	}
+
+	if cfg.ProcessHistoryInterval > 0 && cfg.ProcessHistoryTop > 0 {
+		go runProcessHistory(time.Duration(cfg.ProcessHistoryInterval)*time.Second, cfg.ProcessHistoryTop)
+	}
+
+	// background collection; slows down when nobody is watching
+	go runBroadcaster(cfg, h, sinks)
+	go runDockerPoller(h, time.Duration(cfg.IdleInterval)*time.Millisecond)
+
+	if cfg.OTLPEndpoint != "" {
+		exp, err := newOTLPExporter(cfg)
+		if err != nil {
+			log.Fatal(err)
 		}
-	}()
+		log.Printf("pushing metrics to %s (%s) every %dms", exp.url, cfg.OTLPProtocol, cfg.OTLPInterval)
+		go runOTLPExporter(cfg, h, exp)
+	}
 
 	addr := fmt.Sprintf(":%d", cfg.Port)
 	log.Printf("sysmon listening on http://0.0.0.0%s", addr)
-	if err := http.ListenAndServe(addr, nil); err != nil {
-		log.Fatal(err)
-	}
+	serve(&http.Server{Addr: addr}, h, time.Duration(cfg.ShutdownTimeout)*time.Second)
 }
@@ -0,0 +1,296 @@
+// Copyright (C) 2025 Russell Li (xiaoxinmm)
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"sysmon/monitor"
+)
+
+// Prometheus exporter. The text format is simple enough that pulling in
+// client_golang for it isn't worth it. See docs/metrics.md.
+
+// maxMetricsProcesses caps metricsTopProcesses: every process is its own
+// series and PIDs churn, so this is what keeps cardinality bounded.
+const maxMetricsProcesses = 100
+
+// metricsProcesses is how many top processes /metrics and OTLP export.
+func metricsProcesses(cfg Config) int {
+	return max(0, min(cfg.MetricsTopProcesses, maxMetricsProcesses))
+}
+
+const (
+	promContentType        = "text/plain; version=0.0.4; charset=utf-8"
+	openMetricsContentType = "application/openmetrics-text; version=1.0.0; charset=utf-8"
+)
+
+type metricSample struct {
+	labels []string // name, value, name, value...
+	value  float64
+}
+
+type metricFamily struct {
+	name    string
+	help    string
+	typ     string // gauge or counter
+	samples []metricSample
+}
+
+// metricSet builds the exposition in the order metrics are added.
+type metricSet struct {
+	families []*metricFamily
+	byName   map[string]*metricFamily
+}
+
+func newMetricSet() *metricSet {
+	return &metricSet{byName: make(map[string]*metricFamily)}
+}
+
+func (m *metricSet) add(name, typ, help string, value float64, labels ...string) {
+	f := m.byName[name]
+	if f == nil {
+		f = &metricFamily{name: name, help: help, typ: typ}
+		m.byName[name] = f
+		m.families = append(m.families, f)
+	}
+	f.samples = append(f.samples, metricSample{labels: labels, value: value})
+}
+
+func (m *metricSet) gauge(name, help string, value float64, labels ...string) {
+	m.add(name, "gauge", help, value, labels...)
+}
+
+// counter names end in _total, as both formats want for the samples.
+func (m *metricSet) counter(name, help string, value float64, labels ...string) {
+	m.add(name, "counter", help, value, labels...)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatValue(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// write renders the Prometheus text format, or OpenMetrics, where counter
+// families are declared without the _total suffix and the body ends in # EOF.
+func (m *metricSet) write(w *bufio.Writer, openMetrics bool) {
+	for _, f := range m.families {
+		family := f.name
+		if openMetrics && f.typ == "counter" {
+			family = strings.TrimSuffix(family, "_total")
+		}
+		w.WriteString("# HELP " + family + " " + f.help + "\n")
+		w.WriteString("# TYPE " + family + " " + f.typ + "\n")
+		for _, s := range f.samples {
+			w.WriteString(f.name)
+			if len(s.labels) > 0 {
+				w.WriteByte('{')
+				for i := 0; i+1 < len(s.labels); i += 2 {
+					if i > 0 {
+						w.WriteByte(',')
+					}
+					w.WriteString(s.labels[i] + `="` + labelEscaper.Replace(s.labels[i+1]) + `"`)
+				}
+				w.WriteByte('}')
+			}
+			w.WriteString(" " + formatValue(s.value) + "\n")
+		}
+	}
+	if openMetrics {
+		w.WriteString("# EOF\n")
+	}
+}
+
+// containerCache keeps scrapes from hitting the Docker API (one call per
+// container) more often than the dashboard poller does.
+type containerCache struct {
+	mu         sync.Mutex
+	at         time.Time
+	containers []monitor.DockerContainer
+}
+
+func (cc *containerCache) get() []monitor.DockerContainer {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	if time.Since(cc.at) > 5*time.Second {
+		cc.containers = monitor.GetDockerContainers()
+		cc.at = time.Now()
+	}
+	return cc.containers
+}
+
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// buildMetrics turns one snapshot into metric families. Sections the
+// snapshot doesn't have (disabled collectors) have no metrics at all.
+func buildMetrics(snap Snapshot, containers []monitor.DockerContainer, h *hub) *metricSet {
+	m := newMetricSet()
+
+	if snap.has("system") {
+		s := snap.System
+		m.gauge("sysmon_system_info", "Host information, always 1.", 1,
+			"hostname", s.Hostname, "os", s.OS, "platform", s.Platform, "kernel", s.Kernel, "arch", s.Arch)
+		m.gauge("sysmon_uptime_seconds", "Host uptime in seconds.", float64(s.Uptime))
+	}
+
+	if snap.has("cpu") {
+		m.gauge("sysmon_cpu_cores", "Physical CPU cores.", float64(snap.CPU.Cores))
+		m.gauge("sysmon_cpu_threads", "Logical CPUs.", float64(snap.CPU.Threads))
+		for i, u := range snap.CPU.Usage {
+			m.gauge("sysmon_cpu_usage_percent", "CPU usage per logical CPU since the previous sample.", u, "cpu", strconv.Itoa(i))
+		}
+		m.gauge("sysmon_cpu_usage_avg_percent", "Average CPU usage over all logical CPUs.", snap.CPU.AvgUsage)
+	}
+
+	if snap.has("memory") {
+		mem := snap.Memory
+		m.gauge("sysmon_memory_total_bytes", "Total physical memory.", float64(mem.Total))
+		m.gauge("sysmon_memory_used_bytes", "Used physical memory.", float64(mem.Used))
+		m.gauge("sysmon_memory_available_bytes", "Memory available for new processes.", float64(mem.Available))
+		m.gauge("sysmon_memory_used_percent", "Used physical memory in percent.", mem.UsedPercent)
+		m.gauge("sysmon_swap_total_bytes", "Total swap.", float64(mem.SwapTotal))
+		m.gauge("sysmon_swap_used_bytes", "Used swap.", float64(mem.SwapUsed))
+	}
+
+	for _, d := range snap.Disks {
+		labels := []string{"device", d.Device, "mountpoint", d.Mountpoint, "fstype", d.Fstype}
+		m.gauge("sysmon_disk_total_bytes", "Filesystem size.", float64(d.Total), labels...)
+		m.gauge("sysmon_disk_used_bytes", "Filesystem space used.", float64(d.Used), labels...)
+		m.gauge("sysmon_disk_free_bytes", "Filesystem space free.", float64(d.Free), labels...)
+	}
+
+	for _, n := range snap.Network {
+		m.counter("sysmon_network_sent_bytes_total", "Bytes sent per interface.", float64(n.BytesSent), "interface", n.Name)
+		m.counter("sysmon_network_received_bytes_total", "Bytes received per interface.", float64(n.BytesRecv), "interface", n.Name)
+	}
+
+	if snap.has("load") {
+		m.gauge("sysmon_load1", "1-minute load average.", snap.Load.Load1)
+		m.gauge("sysmon_load5", "5-minute load average.", snap.Load.Load5)
+		m.gauge("sysmon_load15", "15-minute load average.", snap.Load.Load15)
+	}
+
+	for _, p := range snap.Processes {
+		pid := strconv.Itoa(int(p.PID))
+		m.gauge("sysmon_process_cpu_percent", "CPU usage of the top processes.", p.CPU, "pid", pid, "name", p.Name)
+		m.gauge("sysmon_process_memory_percent", "Memory usage of the top processes.", float64(p.Mem), "pid", pid, "name", p.Name)
+	}
+
+	for _, c := range containers {
+		labels := []string{"id", c.ID[:min(12, len(c.ID))], "name", c.Name, "image", c.Image}
+		m.gauge("sysmon_container_running", "1 if the container is running.", boolValue(c.State == "running"), labels...)
+		m.gauge("sysmon_container_cpu_percent", "Container CPU usage.", c.CPUPct, labels...)
+		m.gauge("sysmon_container_memory_usage_bytes", "Container memory usage.", float64(c.MemUsage), labels...)
+		m.gauge("sysmon_container_memory_limit_bytes", "Container memory limit.", float64(c.MemLimit), labels...)
+	}
+
+	m.gauge("sysmon_clients", "Connected dashboard clients.", float64(h.count()))
+	m.gauge("sysmon_shell_sessions", "Open shell sessions.", float64(shells.count()))
+	return m
+}
+
+// metricsAuth decides who may scrape. With neither metricsToken nor
+// metricsAllow set, /metrics uses the normal sysmon login like everything
+// else; otherwise a matching bearer token or an allowed IP is enough.
+type metricsAuth struct {
+	password string
+	token    string
+	allow    []*net.IPNet
+}
+
+func newMetricsAuth(cfg Config) metricsAuth {
+	a := metricsAuth{password: cfg.Password, token: cfg.MetricsToken}
+	for _, s := range cfg.MetricsAllow {
+		s = strings.TrimSpace(s)
+		if !strings.Contains(s, "/") {
+			if strings.Contains(s, ":") {
+				s += "/128"
+			} else {
+				s += "/32"
+			}
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			log.Fatalf("metricsAllow: bad address %q", s)
+		}
+		a.allow = append(a.allow, n)
+	}
+	return a
+}
+
+func (a metricsAuth) ok(r *http.Request) bool {
+	if a.token == "" && len(a.allow) == 0 {
+		return isAuthenticated(r, a.password)
+	}
+	if a.token != "" {
+		if t, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok &&
+			subtle.ConstantTimeCompare([]byte(t), []byte(a.token)) == 1 {
+			return true
+		}
+	}
+	if ip := net.ParseIP(clientIP(r)); ip != nil {
+		for _, n := range a.allow {
+			if n.Contains(ip) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// handleMetrics serves /metrics.
+func handleMetrics(cfg Config, h *hub) http.HandlerFunc {
+	auth := newMetricsAuth(cfg)
+	snaps := &snapshotCache{maxAge: time.Duration(cfg.RefreshInterval) * time.Millisecond}
+	var docker containerCache
+	topN := metricsProcesses(cfg)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !auth.ok(r) {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="sysmon metrics"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		// collect() already sorts processes by CPU and keeps the top topN
+		snap := snaps.get(topN)
+		m := buildMetrics(snap, docker.get(), h)
+
+		openMetrics := strings.Contains(r.Header.Get("Accept"), "application/openmetrics-text")
+		if openMetrics {
+			w.Header().Set("Content-Type", openMetricsContentType)
+		} else {
+			w.Header().Set("Content-Type", promContentType)
+		}
+		bw := bufio.NewWriter(w)
+		m.write(bw, openMetrics)
+		bw.Flush()
+	}
+}
@@ -0,0 +1,191 @@
+// Copyright (C) 2025 Russell Li (xiaoxinmm)
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"sysmon/monitor"
+)
+
+func TestMetricsExposition(t *testing.T) {
+	m := newMetricSet()
+	m.gauge("sysmon_load1", "1-minute load average.", 0.5)
+	m.gauge("sysmon_disk_free_bytes", "Filesystem space free.", 1e12, "mountpoint", `C:\data "x"`+"\nnext")
+	m.gauge("sysmon_disk_free_bytes", "Filesystem space free.", 0, "mountpoint", "/")
+	m.counter("sysmon_network_sent_bytes_total", "Bytes sent per interface.", 123456789, "interface", "eth0")
+
+	render := func(openMetrics bool) string {
+		var buf bytes.Buffer
+		w := bufio.NewWriter(&buf)
+		m.write(w, openMetrics)
+		w.Flush()
+		return buf.String()
+	}
+	want := `# HELP sysmon_load1 1-minute load average.
+# TYPE sysmon_load1 gauge
+sysmon_load1 0.5
+# HELP sysmon_disk_free_bytes Filesystem space free.
+# TYPE sysmon_disk_free_bytes gauge
+sysmon_disk_free_bytes{mountpoint="C:\\data \"x\"\nnext"} 1e+12
+sysmon_disk_free_bytes{mountpoint="/"} 0
+`
+	if got := render(false); got != want+`# HELP sysmon_network_sent_bytes_total Bytes sent per interface.
+# TYPE sysmon_network_sent_bytes_total counter
+sysmon_network_sent_bytes_total{interface="eth0"} 1.23456789e+08
+` {
+		t.Errorf("text format:\n%s", got)
+	}
+	// OpenMetrics 的计数器族名不带 _total，样本带；最后是 # EOF
+	if got := render(true); got != want+`# HELP sysmon_network_sent_bytes Bytes sent per interface.
+# TYPE sysmon_network_sent_bytes counter
+sysmon_network_sent_bytes_total{interface="eth0"} 1.23456789e+08
+# EOF
+` {
+		t.Errorf("OpenMetrics:\n%s", got)
+	}
+}
+
+func TestMetricsAuth(t *testing.T) {
+	a := newMetricsAuth(Config{MetricsToken: "s3cret", MetricsAllow: []string{"10.0.0.0/8", "192.168.1.5", "::1"}})
+	for _, tc := range []struct {
+		remote, auth string
+		ok           bool
+	}{
+		{"192.0.2.1:1234", "", false},
+		{"192.0.2.1:1234", "Bearer s3cret", true},
+		{"192.0.2.1:1234", "Bearer s3cret2", false},
+		{"192.0.2.1:1234", "Bearer ", false},
+		{"192.0.2.1:1234", "s3cret", false},
+		{"10.20.30.40:1234", "", true},
+		{"11.0.0.1:1234", "", false},
+		{"192.168.1.5:1234", "", true},
+		{"192.168.1.6:1234", "", false},
+		{"[::1]:1234", "", true},
+		{"[::2]:1234", "", false},
+		{"10.1.1.1:1234", "Bearer wrong", true}, // IP 在名单里就够了
+	} {
+		r := httptest.NewRequest("GET", "/metrics", nil)
+		r.RemoteAddr = tc.remote
+		if tc.auth != "" {
+			r.Header.Set("Authorization", tc.auth)
+		}
+		if got := a.ok(r); got != tc.ok {
+			t.Errorf("%s %q: ok %v, want %v", tc.remote, tc.auth, got, tc.ok)
+		}
+	}
+
+	// 两个都没配，就是普通登录
+	login := newMetricsAuth(Config{Password: "pw"})
+	r := httptest.NewRequest("GET", "/metrics", nil)
+	r.RemoteAddr = "10.1.1.1:1234"
+	if login.ok(r) {
+		t.Error("no token and no allowlist let an anonymous scrape through")
+	}
+}
+
+// TestMetricsHandler scrapes /metrics: rejected without credentials,
+// OpenMetrics when asked for, and the process series capped.
+func TestMetricsHandler(t *testing.T) {
+	scrape := func(cfg Config, accept string) *httptest.ResponseRecorder {
+		cfg.RefreshInterval = 1000
+		cfg.MetricsToken = "s3cret"
+		r := httptest.NewRequest("GET", "/metrics", nil)
+		r.Header.Set("Authorization", "Bearer s3cret")
+		if accept != "" {
+			r.Header.Set("Accept", accept)
+		}
+		w := httptest.NewRecorder()
+		handleMetrics(cfg, newHub())(w, r)
+		return w
+	}
+	pids := func(body string) int {
+		seen := make(map[string]bool)
+		for _, line := range strings.Split(body, "\n") {
+			if strings.HasPrefix(line, "sysmon_process_cpu_percent{") {
+				seen[line] = true
+			}
+		}
+		return len(seen)
+	}
+
+	w := httptest.NewRecorder()
+	handleMetrics(Config{MetricsToken: "s3cret"}, newHub())(w, httptest.NewRequest("GET", "/metrics", nil))
+	if w.Code != http.StatusUnauthorized || w.Header().Get("WWW-Authenticate") == "" {
+		t.Errorf("no token: %d, WWW-Authenticate %q", w.Code, w.Header().Get("WWW-Authenticate"))
+	}
+
+	w = scrape(Config{}, "")
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != promContentType || strings.Contains(w.Body.String(), "# EOF") {
+		t.Errorf("text: %d %s", w.Code, w.Header().Get("Content-Type"))
+	}
+	if n := pids(w.Body.String()); n != 0 {
+		t.Errorf("%d processes exported without metricsTopProcesses", n)
+	}
+	w = scrape(Config{}, "application/openmetrics-text; version=1.0.0")
+	if w.Header().Get("Content-Type") != openMetricsContentType || !strings.HasSuffix(w.Body.String(), "# EOF\n") {
+		t.Errorf("openmetrics: %s, ends %q", w.Header().Get("Content-Type"), w.Body.String()[max(0, w.Body.Len()-20):])
+	}
+
+	if n := pids(scrape(Config{MetricsTopProcesses: 2}, "").Body.String()); n < 1 || n > 2 {
+		t.Errorf("metricsTopProcesses 2: %d processes", n)
+	}
+	if n := pids(scrape(Config{MetricsTopProcesses: 5000}, "").Body.String()); n > maxMetricsProcesses {
+		t.Errorf("metricsTopProcesses 5000: %d processes", n)
+	}
+	if n := pids(scrape(Config{MetricsTopProcesses: -1}, "").Body.String()); n != 0 {
+		t.Errorf("metricsTopProcesses -1: %d processes", n)
+	}
+	for in, want := range map[int]int{-1: 0, 0: 0, 7: 7, maxMetricsProcesses: maxMetricsProcesses, 5000: maxMetricsProcesses} {
+		if got := metricsProcesses(Config{MetricsTopProcesses: in}); got != want {
+			t.Errorf("metricsProcesses(%d) = %d, want %d", in, got, want)
+		}
+	}
+}
+
+// TestMetricsSkipsProcessWalk checks a scrape with process metrics off
+// never runs the processes collector, which reads every process.
+func TestMetricsSkipsProcessWalk(t *testing.T) {
+	walks := 0
+	procs := monitor.CollectorFunc("processes", func() (interface{}, error) {
+		walks++
+		return []monitor.ProcessInfo{{PID: 1, Name: "init"}}, nil
+	})
+	saved := collectors
+	collectors = &collectorSet{enabled: []monitor.Collector{procs}, disabled: map[string]bool{}, errors: map[string]collectorError{}}
+	t.Cleanup(func() { collectors = saved })
+
+	for _, tc := range []struct {
+		top, walks int
+	}{{0, 0}, {-5, 0}, {3, 1}} {
+		walks = 0
+		r := httptest.NewRequest("GET", "/metrics", nil)
+		r.Header.Set("Authorization", "Bearer s3cret")
+		w := httptest.NewRecorder()
+		handleMetrics(Config{RefreshInterval: 1000, MetricsToken: "s3cret", MetricsTopProcesses: tc.top}, newHub())(w, r)
+		if w.Code != http.StatusOK || walks != tc.walks {
+			t.Errorf("metricsTopProcesses %d: %d, %d process walks, want %d", tc.top, w.Code, walks, tc.walks)
+		}
+	}
+	if collect(0).has("processes") {
+		t.Error("collect(0) has a processes section")
+	}
+}
@@ -0,0 +1,406 @@
+// Copyright (C) 2025 Russell Li (xiaoxinmm)
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package monitor
+
+import (
+	"math"
+	"math/bits"
+)
+
+// Compressed storage for the history store, after Facebook's Gorilla
+// paper: timestamps as delta-of-delta, values XORed with the previous
+// value of their column, both packed into a bit stream. A regular
+// one-second series costs about one bit per timestamp, and values that
+// repeat or change little a few bits each, against 16 bytes per point as
+// plain slices.
+//
+// Points go into chunks of chunkPoints; a chunkRing keeps the chunks of
+// one series oldest first, in a circular buffer, so trimming old data
+// frees whole chunks instead of leaving the start of a slice behind.
+
+const chunkPoints = 120
+
+// chunk is one sealed or filling block of points.
+type chunk struct {
+	b           []byte
+	n           int
+	first, last int64 // unix ms
+}
+
+// chunkRing holds the points of one series with cols values per point,
+// oldest first. Points must be appended in time order.
+type chunkRing struct {
+	cols  int
+	buf   []*chunk // circular, oldest at head
+	head  int
+	n     int
+	from  int64 // points before this are trimmed but still in the oldest chunk
+	app   chunkAppender
+	bytes int // b of the sealed chunks
+}
+
+// chunkAppender is the encoder state for the newest chunk.
+type chunkAppender struct {
+	nbits int // bits used in c.b
+	delta int64
+	vals  []uint64
+	lead  []uint8 // leading and trailing zeros of the last stored XOR
+	trail []uint8
+}
+
+func newChunkRing(cols int) *chunkRing {
+	return &chunkRing{
+		cols: cols,
+		app: chunkAppender{
+			vals:  make([]uint64, cols),
+			lead:  make([]uint8, cols),
+			trail: make([]uint8, cols),
+		},
+	}
+}
+
+func (r *chunkRing) at(i int) *chunk {
+	return r.buf[(r.head+i)%len(r.buf)]
+}
+
+func (r *chunkRing) empty() bool {
+	return r.n == 0
+}
+
+// last is the newest point's time; only valid when not empty.
+func (r *chunkRing) last() int64 {
+	return r.at(r.n - 1).last
+}
+
+// first is the oldest point's time; only valid when not empty.
+func (r *chunkRing) first() int64 {
+	c := r.at(0)
+	if c.first >= r.from {
+		return c.first
+	}
+	first := c.last
+	r.each(r.from, c.last, func(t int64, _ []float64) bool {
+		first = t
+		return false
+	})
+	return first
+}
+
+// len counts the points.
+func (r *chunkRing) len() int {
+	total := 0
+	for i := 0; i < r.n; i++ {
+		total += r.at(i).n
+	}
+	if r.n > 0 && r.at(0).first < r.from {
+		// 最老的一块有一部分已经过期了，解码数一下
+		c := r.at(0)
+		hidden := 0
+		it := chunkIter{vals: make([]uint64, r.cols), lead: make([]uint8, r.cols), trail: make([]uint8, r.cols)}
+		it.reset(c)
+		for it.next() && it.t < r.from {
+			hidden++
+		}
+		total -= hidden
+	}
+	return total
+}
+
+// size is about how many bytes the ring takes, headers included.
+func (r *chunkRing) size() int {
+	const chunkHeader = 8 + 8 + 8 + 8 + 8 + 8 // 切片头、n、first、last、指针
+	s := r.bytes + r.n*chunkHeader + len(r.buf)*8
+	if r.n > 0 {
+		s += cap(r.at(r.n - 1).b)
+	}
+	return s
+}
+
+func (r *chunkRing) append(t int64, vs ...float64) {
+	if r.n == 0 || r.at(r.n-1).n == chunkPoints {
+		r.seal()
+		if r.n == len(r.buf) {
+			// 满了就翻倍，把环摆正
+			grown := make([]*chunk, max(4, 2*len(r.buf)))
+			for i := 0; i < r.n; i++ {
+				grown[i] = r.at(i)
+			}
+			r.buf, r.head = grown, 0
+		}
+		r.buf[(r.head+r.n)%len(r.buf)] = &chunk{b: make([]byte, 0, 16+8*r.cols), first: t}
+		r.n++
+		r.app.nbits = 0
+	}
+	c := r.at(r.n - 1)
+	a := &r.app
+	if c.n == 0 {
+		// 第一个点的时间就是 c.first，值原样写
+		for i, v := range vs {
+			a.vals[i] = math.Float64bits(v)
+			a.lead[i] = 0xff
+			a.writeBits(c, a.vals[i], 64)
+		}
+		a.delta = 0
+	} else {
+		delta := t - c.last
+		a.writeDoD(c, delta-a.delta)
+		a.delta = delta
+		for i, v := range vs {
+			a.writeXOR(c, i, math.Float64bits(v))
+		}
+	}
+	c.last = t
+	c.n++
+}
+
+// seal trims the newest chunk's buffer to its size once it is full.
+func (r *chunkRing) seal() {
+	if r.n == 0 {
+		return
+	}
+	c := r.at(r.n - 1)
+	c.b = append([]byte(nil), c.b...)
+	r.bytes += len(c.b)
+}
+
+// trim hides the points before cutoff and frees the chunks that hold only
+// those.
+func (r *chunkRing) trim(cutoff int64) {
+	if cutoff <= r.from {
+		return
+	}
+	r.from = cutoff
+	for r.n > 0 && r.at(0).last < cutoff {
+		c := r.at(0)
+		if r.n > 1 {
+			r.bytes -= len(c.b)
+		} else {
+			r.app.nbits = 0
+		}
+		r.buf[r.head] = nil
+		r.head = (r.head + 1) % len(r.buf)
+		r.n--
+	}
+}
+
+// each calls fn with the points from..to (inclusive) until it returns
+// false. vs is reused between calls.
+func (r *chunkRing) each(from, to int64, fn func(t int64, vs []float64) bool) {
+	from = max(from, r.from)
+	vs := make([]float64, r.cols)
+	it := chunkIter{vals: make([]uint64, r.cols), lead: make([]uint8, r.cols), trail: make([]uint8, r.cols)}
+	for i := 0; i < r.n; i++ {
+		c := r.at(i)
+		if c.last < from {
+			continue
+		}
+		if c.first > to {
+			return
+		}
+		it.reset(c)
+		for it.next() {
+			if it.t < from {
+				continue
+			}
+			if it.t > to {
+				return
+			}
+			for k, v := range it.vals {
+				vs[k] = math.Float64frombits(v)
+			}
+			if !fn(it.t, vs) {
+				return
+			}
+		}
+	}
+}
+
+// view copies the chunks holding points from..to, so they can be decoded
+// after the history lock is released. Sealed chunks don't change; the one
+// being filled does, so its bytes are copied.
+func (r *chunkRing) view(from, to int64) *chunkRing {
+	v := &chunkRing{cols: r.cols, from: r.from}
+	for i := 0; i < r.n; i++ {
+		c := r.at(i)
+		if c.last < max(from, r.from) {
+			continue
+		}
+		if c.first > to {
+			break
+		}
+		cc := *c
+		if i == r.n-1 {
+			cc.b = append([]byte(nil), c.b...)
+		}
+		v.buf = append(v.buf, &cc)
+	}
+	v.n = len(v.buf)
+	return v
+}
+
+// columns decodes the points from..to (inclusive) into a time slice and
+// one slice per value column.
+func (r *chunkRing) columns(from, to int64) ([]int64, [][]float64) {
+	var ts []int64
+	cols := make([][]float64, r.cols)
+	r.each(from, to, func(t int64, vs []float64) bool {
+		ts = append(ts, t)
+		for k, v := range vs {
+			cols[k] = append(cols[k], v)
+		}
+		return true
+	})
+	return ts, cols
+}
+
+func (a *chunkAppender) writeBits(c *chunk, v uint64, n int) {
+	for n > 0 {
+		if a.nbits%8 == 0 {
+			c.b = append(c.b, 0)
+		}
+		free := 8 - a.nbits%8
+		k := min(free, n)
+		// 取 v 剩下的最高 k 位放进当前字节
+		part := byte(v>>(n-k)) & byte(1<<k-1)
+		c.b[len(c.b)-1] |= part << (free - k)
+		a.nbits += k
+		n -= k
+	}
+}
+
+// 时间戳的二阶差分：0 -> '0'，小的用短码，其余 64 位原样
+var dodBuckets = []struct {
+	prefix           uint64
+	prefixBits, bits int
+}{
+	{0b10, 2, 7},
+	{0b110, 3, 9},
+	{0b1110, 4, 12},
+}
+
+func (a *chunkAppender) writeDoD(c *chunk, dod int64) {
+	if dod == 0 {
+		a.writeBits(c, 0, 1)
+		return
+	}
+	for _, b := range dodBuckets {
+		if -(1<<(b.bits-1)) <= dod && dod < 1<<(b.bits-1) {
+			a.writeBits(c, b.prefix, b.prefixBits)
+			a.writeBits(c, uint64(dod), b.bits)
+			return
+		}
+	}
+	a.writeBits(c, 0b1111, 4)
+	a.writeBits(c, uint64(dod), 64)
+}
+
+func (a *chunkAppender) writeXOR(c *chunk, col int, v uint64) {
+	x := v ^ a.vals[col]
+	a.vals[col] = v
+	if x == 0 {
+		a.writeBits(c, 0, 1)
+		return
+	}
+	lead := uint8(min(bits.LeadingZeros64(x), 31))
+	trail := uint8(bits.TrailingZeros64(x))
+	// 落在上一个窗口里就沿用它，只写中间的有效位
+	if a.lead[col] != 0xff && lead >= a.lead[col] && trail >= a.trail[col] {
+		a.writeBits(c, 0b10, 2)
+		a.writeBits(c, x>>a.trail[col], 64-int(a.lead[col])-int(a.trail[col]))
+		return
+	}
+	a.lead[col], a.trail[col] = lead, trail
+	sig := 64 - int(lead) - int(trail)
+	a.writeBits(c, 0b11, 2)
+	a.writeBits(c, uint64(lead), 5)
+	a.writeBits(c, uint64(sig%64), 6) // 64 写成 0
+	a.writeBits(c, x>>trail, sig)
+}
+
+// chunkIter decodes one chunk.
+type chunkIter struct {
+	b     []byte
+	pos   int // bits read
+	n, i  int
+	t     int64
+	delta int64
+	vals  []uint64
+	lead  []uint8
+	trail []uint8
+}
+
+func (it *chunkIter) reset(c *chunk) {
+	it.b, it.n, it.pos, it.i, it.t = c.b, c.n, 0, 0, c.first
+}
+
+func (it *chunkIter) readBits(n int) uint64 {
+	var v uint64
+	for n > 0 {
+		avail := 8 - it.pos%8
+		k := min(avail, n)
+		part := uint64(it.b[it.pos/8]>>(avail-k)) & (1<<k - 1)
+		v = v<<k | part
+		it.pos += k
+		n -= k
+	}
+	return v
+}
+
+func (it *chunkIter) next() bool {
+	if it.i == it.n {
+		return false
+	}
+	if it.i == 0 {
+		for k := range it.vals {
+			it.vals[k] = it.readBits(64)
+		}
+		it.delta = 0
+		it.i++
+		return true
+	}
+	var dod int64
+	if it.readBits(1) == 1 {
+		n := 64
+		for _, b := range dodBuckets {
+			if it.readBits(1) == 0 {
+				n = b.bits
+				break
+			}
+		}
+		u := it.readBits(n)
+		// 符号扩展
+		dod = int64(u<<(64-n)) >> (64 - n)
+	}
+	it.delta += dod
+	it.t += it.delta
+	for k := range it.vals {
+		if it.readBits(1) == 0 {
+			continue
+		}
+		if it.readBits(1) == 1 {
+			it.lead[k] = uint8(it.readBits(5))
+			sig := uint8(it.readBits(6))
+			if sig == 0 {
+				sig = 64
+			}
+			it.trail[k] = 64 - it.lead[k] - sig
+		}
+		sig := 64 - int(it.lead[k]) - int(it.trail[k])
+		it.vals[k] ^= it.readBits(sig) << it.trail[k]
+	}
+	it.i++
+	return true
+}
@@ -0,0 +1,242 @@
+// Copyright (C) 2025 Russell Li (xiaoxinmm)
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package monitor
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+// roundTrip appends the points to a fresh ring and checks every one
+// decodes back bit for bit, through each and through columns.
+func roundTrip(t *testing.T, ts []int64, vals [][]float64) *chunkRing {
+	t.Helper()
+	r := newChunkRing(len(vals[0]))
+	for i := range ts {
+		r.append(ts[i], vals[i]...)
+	}
+	if got := r.len(); got != len(ts) {
+		t.Fatalf("len = %d, want %d", got, len(ts))
+	}
+	i := 0
+	r.each(math.MinInt64, math.MaxInt64, func(tm int64, vs []float64) bool {
+		if tm != ts[i] {
+			t.Fatalf("point %d: time %d, want %d", i, tm, ts[i])
+		}
+		for k, v := range vs {
+			if math.Float64bits(v) != math.Float64bits(vals[i][k]) {
+				t.Fatalf("point %d col %d: %v (%#x), want %v (%#x)", i, k, v, math.Float64bits(v), vals[i][k], math.Float64bits(vals[i][k]))
+			}
+		}
+		i++
+		return true
+	})
+	if i != len(ts) {
+		t.Fatalf("decoded %d points, want %d", i, len(ts))
+	}
+	gotTs, gotCols := r.columns(math.MinInt64, math.MaxInt64)
+	for i := range ts {
+		if gotTs[i] != ts[i] {
+			t.Fatalf("columns: point %d time %d, want %d", i, gotTs[i], ts[i])
+		}
+		for k := range gotCols {
+			if math.Float64bits(gotCols[k][i]) != math.Float64bits(vals[i][k]) {
+				t.Fatalf("columns: point %d col %d: %v, want %v", i, k, gotCols[k][i], vals[i][k])
+			}
+		}
+	}
+	return r
+}
+
+func TestChunkRoundTrip(t *testing.T) {
+	const start = 1735689600000                     // 2025-01-01 UTC
+	odd := math.Float64frombits(0x7ff8dead0000beef) // 另一种 NaN，位模式也要原样回来
+	specials := []float64{
+		0, math.Copysign(0, -1), math.NaN(), odd, math.Inf(1), math.Inf(-1),
+		math.MaxFloat64, -math.MaxFloat64, math.SmallestNonzeroFloat64, 1, 1, math.NaN(), 0.1, 0.30000000000000004,
+	}
+
+	t.Run("special values", func(t *testing.T) {
+		var ts []int64
+		var vals [][]float64
+		for i, v := range specials {
+			ts = append(ts, start+int64(i)*1000)
+			// 三列错开，让每列的 XOR 窗口都不一样
+			vals = append(vals, []float64{v, specials[(i+5)%len(specials)], float64(i)})
+		}
+		roundTrip(t, ts, vals)
+	})
+
+	t.Run("equal timestamps", func(t *testing.T) {
+		ts := []int64{start, start, start, start + 1000, start + 1000, start + 2000, start + 2000}
+		vals := make([][]float64, len(ts))
+		for i := range vals {
+			vals[i] = []float64{float64(i)}
+		}
+		roundTrip(t, ts, vals)
+	})
+
+	t.Run("large gaps", func(t *testing.T) {
+		// 每个二阶差分的编码桶都走一遍，包括 64 位的
+		gaps := []int64{1000, 1000, 1001, 999, 1000 + 63, 1000 - 64, 1000 + 255, 1000 - 256, 1000 + 2047, 1000 - 2048,
+			1000 + 2048, 86400 * 1000, 1000, 30 * 86400 * 1000, 0, 1, 1 << 40, 1000}
+		ts := []int64{0, start}
+		for _, g := range gaps {
+			ts = append(ts, ts[len(ts)-1]+g)
+		}
+		ts = append(ts, math.MaxInt64)
+		vals := make([][]float64, len(ts))
+		for i := range vals {
+			vals[i] = []float64{specials[i%len(specials)]}
+		}
+		roundTrip(t, ts, vals)
+	})
+
+	t.Run("chunk rollover", func(t *testing.T) {
+		rng := rand.New(rand.NewSource(1))
+		n := 5*chunkPoints + 7
+		ts := make([]int64, n)
+		vals := make([][]float64, n)
+		for i := range ts {
+			ts[i] = start + int64(i)*1000 + rng.Int63n(7) - 3
+			if i%chunkPoints == 0 && i > 0 {
+				ts[i] = ts[i-1] // 新块的第一个点和上一块的最后一个点同一时刻
+			}
+			vals[i] = []float64{rng.Float64() * 100, specials[i%len(specials)], float64(i / 60)}
+		}
+		r := roundTrip(t, ts, vals)
+		if r.n != 6 {
+			t.Errorf("%d chunks, want 6", r.n)
+		}
+
+		// a window across a chunk boundary, and trimming into a chunk
+		from, to := ts[chunkPoints-3], ts[chunkPoints+2]
+		gotTs, _ := r.columns(from, to)
+		want := 0
+		for _, tm := range ts {
+			if tm >= from && tm <= to {
+				want++
+			}
+		}
+		if len(gotTs) != want {
+			t.Errorf("window: %d points, want %d", len(gotTs), want)
+		}
+		r.trim(ts[2*chunkPoints+10])
+		if r.n != 4 {
+			t.Errorf("after trim: %d chunks, want 4", r.n)
+		}
+		if got := r.len(); got != n-(2*chunkPoints+10) {
+			t.Errorf("after trim: len %d, want %d", got, n-(2*chunkPoints+10))
+		}
+		if r.first() != ts[2*chunkPoints+10] {
+			t.Errorf("after trim: first %d, want %d", r.first(), ts[2*chunkPoints+10])
+		}
+	})
+}
+
+// The benchmarks run a day of one-second points shaped like what the
+// collectors record. bytes/sample is the ring's size over the points in
+// it; plain slices take 16 per point.
+
+type benchSignal struct {
+	name   string
+	jitter int64 // ms
+	cols   int
+	value  func(rng *rand.Rand, i int) float64
+}
+
+var benchSignals = []benchSignal{
+	{"constant", 0, 1, func(*rand.Rand, int) float64 { return 0 }},
+	{"constant_jittery_clock", 3, 1, func(*rand.Rand, int) float64 { return 0 }},
+	{"disk_slow_growth", 3, 1, func(_ *rand.Rand, i int) float64 { return 61 + float64(i/600)*0.01 }},
+	{"load_2_decimals", 3, 1, func(rng *rand.Rand, _ int) float64 {
+		return math.Round((0.8+rng.Float64()*0.4)*100) / 100
+	}},
+	{"cpu_noisy", 3, 1, func(rng *rand.Rand, _ int) float64 { return rng.Float64() * 100 }},
+	{"net_random_walk", 3, 1, nil}, // 见 points
+	{"rollup_min_avg_max", 0, 3, func(rng *rand.Rand, _ int) float64 { return rng.Float64() * 100 }},
+}
+
+// points generates n points of sig.
+func (sig benchSignal) points(n int) ([]int64, [][]float64) {
+	rng := rand.New(rand.NewSource(1))
+	start := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC).UnixMilli()
+	walk := 5e6
+	ts := make([]int64, n)
+	vals := make([][]float64, n)
+	for i := range ts {
+		ts[i] = start + int64(i)*1000
+		if sig.jitter > 0 {
+			ts[i] += rng.Int63n(2*sig.jitter+1) - sig.jitter
+		}
+		vals[i] = make([]float64, sig.cols)
+		for k := range vals[i] {
+			if sig.value == nil {
+				walk = math.Abs(walk + rng.NormFloat64()*1e5)
+				vals[i][k] = walk
+			} else {
+				vals[i][k] = sig.value(rng, i)
+			}
+		}
+	}
+	return ts, vals
+}
+
+const benchPoints = 86400
+
+func BenchmarkChunkAppend(b *testing.B) {
+	for _, sig := range benchSignals {
+		b.Run(sig.name, func(b *testing.B) {
+			ts, vals := sig.points(benchPoints)
+			var r *chunkRing
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				r = newChunkRing(sig.cols)
+				for j := range ts {
+					r.append(ts[j], vals[j]...)
+				}
+			}
+			b.ReportMetric(float64(r.size())/benchPoints, "bytes/sample")
+			b.ReportMetric(float64(b.Elapsed().Nanoseconds())/float64(b.N)/benchPoints, "ns/sample")
+		})
+	}
+}
+
+func BenchmarkChunkDecode(b *testing.B) {
+	for _, sig := range benchSignals {
+		b.Run(sig.name, func(b *testing.B) {
+			ts, vals := sig.points(benchPoints)
+			r := newChunkRing(sig.cols)
+			for j := range ts {
+				r.append(ts[j], vals[j]...)
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				n := 0
+				r.each(0, math.MaxInt64, func(int64, []float64) bool {
+					n++
+					return true
+				})
+				if n != benchPoints {
+					b.Fatalf("decoded %d points", n)
+				}
+			}
+			b.ReportMetric(float64(b.Elapsed().Nanoseconds())/float64(b.N)/benchPoints, "ns/sample")
+		})
+	}
+}
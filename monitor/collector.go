@@ -0,0 +1,113 @@
+// Copyright (C) 2025 Russell Li (xiaoxinmm)
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package monitor
+
+import (
+	"fmt"
+	"sync"
+)
+
+// A Collector contributes one named section to every snapshot. The
+// built-in ones (system, cpu, memory, disks, network, load, processes)
+// are registered here; other packages add theirs with Register from an
+// init function, and the section shows up in the snapshot under Name,
+// as whatever Collect returns marshalled to JSON.
+type Collector interface {
+	// Name is the section's key in the snapshot: short, lower case,
+	// unique.
+	Name() string
+	// Collect takes one sample. It is called once per snapshot, possibly
+	// from several goroutines at once. On error the section is left out
+	// of that snapshot.
+	Collect(opts CollectOptions) (interface{}, error)
+}
+
+// CollectOptions are the per-snapshot settings a collector may honour.
+type CollectOptions struct {
+	MaxProcesses int // processes: keep the top this many by CPU
+}
+
+// CollectorFunc adapts a function to a Collector that ignores the options.
+func CollectorFunc(name string, fn func() (interface{}, error)) Collector {
+	return funcCollector{name, fn}
+}
+
+type funcCollector struct {
+	name string
+	fn   func() (interface{}, error)
+}
+
+func (c funcCollector) Name() string                                { return c.name }
+func (c funcCollector) Collect(CollectOptions) (interface{}, error) { return c.fn() }
+
+var (
+	collectorsMu sync.RWMutex
+	collectors   []Collector
+	builtins     = make(map[string]bool)
+)
+
+// Register adds a collector. Like http.Handle it panics on an empty or
+// duplicate name, since that is a programming error.
+func Register(c Collector) {
+	collectorsMu.Lock()
+	defer collectorsMu.Unlock()
+	name := c.Name()
+	if name == "" || name == "timestamp" {
+		panic(fmt.Sprintf("monitor: invalid collector name %q", name))
+	}
+	for _, have := range collectors {
+		if have.Name() == name {
+			panic("monitor: collector " + name + " registered twice")
+		}
+	}
+	collectors = append(collectors, c)
+}
+
+// Collectors returns the registered collectors, built-in ones first, then
+// the others in the order they were registered.
+func Collectors() []Collector {
+	collectorsMu.RLock()
+	defer collectorsMu.RUnlock()
+	return append([]Collector(nil), collectors...)
+}
+
+// IsBuiltin reports whether name is one of this package's collectors.
+func IsBuiltin(name string) bool {
+	return builtins[name]
+}
+
+func init() {
+	for _, c := range []Collector{
+		CollectorFunc("system", func() (interface{}, error) { return GetSystemInfo(), nil }),
+		CollectorFunc("cpu", func() (interface{}, error) { return GetCPUInfo(), nil }),
+		CollectorFunc("memory", func() (interface{}, error) { return GetMemInfo(), nil }),
+		CollectorFunc("disks", func() (interface{}, error) { return GetDiskInfo(), nil }),
+		CollectorFunc("network", func() (interface{}, error) { return GetNetInfo(), nil }),
+		CollectorFunc("load", func() (interface{}, error) { return GetLoadInfo(), nil }),
+		processCollector{},
+	} {
+		Register(c)
+		builtins[c.Name()] = true
+	}
+}
+
+type processCollector struct{}
+
+func (processCollector) Name() string { return "processes" }
+
+func (processCollector) Collect(opts CollectOptions) (interface{}, error) {
+	return GetProcesses(opts.MaxProcesses), nil
+}
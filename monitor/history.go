@@ -0,0 +1,522 @@
+// Copyright (C) 2025 Russell Li (xiaoxinmm)
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package monitor
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// History store. Every value the collectors produce is kept as a series,
+// named by metric and labels (core, mountpoint, interface, container), so
+// the dashboard can redraw any chart after a reload. Each series keeps its
+// raw points for the raw retention, and rolls them up into min/avg/max per
+// minute and per hour (rollupTiers) that are kept longer. Points are kept
+// compressed in chunks (chunk.go). The store is mirrored to disk when
+// OpenHistory has been called (historyfile.go).
+
+// Labels tell the series of one metric apart, e.g. {"mountpoint": "/"}.
+type Labels map[string]string
+
+// Sample is one value to record.
+type Sample struct {
+	Metric string
+	Labels Labels
+	Value  float64
+}
+
+// Series is one metric's points, oldest first, as parallel columns. Raw
+// points only have V; rollups have the average in V, plus Min and Max,
+// with T the start of each Step-long bucket.
+type Series struct {
+	Metric string    `json:"metric"`
+	Labels Labels    `json:"labels,omitempty"`
+	Step   int64     `json:"step,omitempty"` // seconds per rollup point; 0 for raw points
+	T      []int64   `json:"t"`              // unix ms
+	V      []float64 `json:"v"`
+	Min    []float64 `json:"min,omitempty"`
+	Max    []float64 `json:"max,omitempty"`
+}
+
+// SeriesInfo describes a stored series without its points.
+type SeriesInfo struct {
+	Metric string `json:"metric"`
+	Labels Labels `json:"labels,omitempty"`
+	Points int    `json:"points"` // raw points
+	First  int64  `json:"first"`  // unix ms, oldest point of any resolution
+	Last   int64  `json:"last"`
+}
+
+// HistoryTier is one resolution the store keeps. Step 0 is the raw points.
+type HistoryTier struct {
+	Step      time.Duration
+	Retention time.Duration
+}
+
+// rollupTiers are the downsampled resolutions, finest first.
+var rollupTiers = []HistoryTier{
+	{Step: time.Minute, Retention: 24 * time.Hour},
+	{Step: time.Hour, Retention: 30 * 24 * time.Hour},
+}
+
+type series struct {
+	metric string
+	labels Labels
+	raw    *chunkRing
+	tiers  []*rollup // one per rollupTiers entry
+	fileID uint64    // id in the history file, 0 until it is written there
+	// perPID is a process series labelled with a pid. Pids come and go, so
+	// these are dropped with their raw points; the per-name series keep
+	// the rollups.
+	perPID bool
+}
+
+func newSeries(metric string, labels Labels) *series {
+	s := &series{metric: metric, labels: labels, raw: newChunkRing(1), tiers: make([]*rollup, len(rollupTiers))}
+	s.perPID = isProcessMetric(metric) && labels["pid"] != ""
+	for i, tier := range rollupTiers {
+		s.tiers[i] = &rollup{step: tier.Step.Milliseconds(), ring: newChunkRing(3)}
+	}
+	return s
+}
+
+func (s *series) add(t int64, v float64) {
+	s.raw.append(t, v)
+	if s.perPID {
+		return
+	}
+	for _, r := range s.tiers {
+		r.add(t, v)
+	}
+}
+
+// trim drops points older than the retentions before now, and reports
+// whether anything is left.
+func (s *series) trim(now int64) bool {
+	s.raw.trim(now - histRetention.Milliseconds())
+	if s.perPID && s.raw.empty() {
+		return false
+	}
+	left := !s.raw.empty()
+	for i, r := range s.tiers {
+		// 原始点都过期了，说明早就没有新数据，没满的桶也收掉
+		if s.raw.empty() && r.n > 0 {
+			r.close()
+		}
+		r.ring.trim(now - rollupTiers[i].Retention.Milliseconds())
+		left = left || !r.ring.empty()
+	}
+	return left
+}
+
+// cut drops every point, raw or rolled up, before cutoff, and reports
+// whether anything is left.
+func (s *series) cut(cutoff int64) bool {
+	s.raw.trim(cutoff)
+	left := !s.raw.empty()
+	for _, r := range s.tiers {
+		r.ring.trim(cutoff)
+		left = left || !r.ring.empty()
+	}
+	return left
+}
+
+func (s *series) first() int64 {
+	first := int64(0)
+	if !s.raw.empty() {
+		first = s.raw.first()
+	}
+	for _, r := range s.tiers {
+		if !r.ring.empty() && (first == 0 || r.ring.first() < first) {
+			first = r.ring.first()
+		}
+	}
+	return first
+}
+
+func (s *series) last() int64 {
+	if !s.raw.empty() {
+		return s.raw.last()
+	}
+	last := int64(0)
+	for _, r := range s.tiers {
+		if !r.ring.empty() {
+			last = max(last, r.ring.last())
+		}
+	}
+	return last
+}
+
+// rollup is one tier of a series: closed buckets, min, avg and max in
+// ring, plus the one being filled.
+type rollup struct {
+	step int64 // ms
+	ring *chunkRing
+
+	start  int64 // open bucket
+	n      int
+	sum    float64
+	lo, hi float64
+	saved  int64 // last bucket written to the history file
+}
+
+func (r *rollup) add(t int64, v float64) {
+	start := t - t%r.step
+	if r.n > 0 && start != r.start {
+		r.close()
+	}
+	if r.n == 0 {
+		r.start, r.sum, r.lo, r.hi = start, 0, v, v
+	}
+	r.n++
+	r.sum += v
+	r.lo = min(r.lo, v)
+	r.hi = max(r.hi, v)
+}
+
+func (r *rollup) close() {
+	// 重启后回放原始点会再关一次已经存过的桶，跳过
+	if r.ring.empty() || r.start > r.ring.last() {
+		// 浮点求和的误差可能让平均值略出 [min, max]
+		r.ring.append(r.start, r.lo, max(r.lo, min(r.hi, r.sum/float64(r.n))), r.hi)
+	}
+	r.n = 0
+}
+
+// seriesKey is metric{k=v,...} with the labels sorted.
+func seriesKey(metric string, labels Labels) string {
+	if len(labels) == 0 {
+		return metric
+	}
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	b.WriteString(metric)
+	b.WriteByte('{')
+	for i, k := range keys {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(k + "=" + labels[k])
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+// matches reports whether every label in want has that value.
+func (l Labels) matches(want Labels) bool {
+	for k, v := range want {
+		if l[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+var (
+	histMu        sync.Mutex
+	histSeries    = make(map[string]*series)
+	histRetention = time.Hour
+)
+
+// SetHistoryRetention sets how long raw points are kept. The rollups keep
+// their own retention.
+func SetHistoryRetention(d time.Duration) {
+	histMu.Lock()
+	defer histMu.Unlock()
+	histRetention = d
+}
+
+// HistoryTiers returns the resolutions the store keeps, raw first.
+func HistoryTiers() []HistoryTier {
+	histMu.Lock()
+	defer histMu.Unlock()
+	return append([]HistoryTier{{Retention: histRetention}}, rollupTiers...)
+}
+
+// Record stores one collection's samples, all taken at t (unix ms).
+func Record(t int64, samples []Sample) {
+	histMu.Lock()
+	defer histMu.Unlock()
+	recorded := recordLocked(t, samples)
+	if histFile != nil {
+		histFile.appendLocked(t, samples, recorded)
+	}
+}
+
+func recordLocked(t int64, samples []Sample) []*series {
+	recorded := make([]*series, 0, len(samples))
+	for _, smp := range samples {
+		key := seriesKey(smp.Metric, smp.Labels)
+		s := histSeries[key]
+		if s == nil {
+			s = newSeries(smp.Metric, smp.Labels)
+			histSeries[key] = s
+		}
+		s.add(t, smp.Value)
+		recorded = append(recorded, s)
+	}
+	// 网卡、磁盘、容器没了，所有精度的点都过期后删掉
+	for key, s := range histSeries {
+		if !s.trim(t) {
+			delete(histSeries, key)
+		}
+	}
+	return recorded
+}
+
+// QueryHistory returns the series of the given metrics (all when empty)
+// whose labels include match, with the points from..to (unix ms, 0 for
+// open ends), sorted by metric and labels. step picks the resolution: 0
+// for raw points, or the Step of one of the rollup tiers.
+func QueryHistory(metrics []string, match Labels, from, to int64, step time.Duration) []Series {
+	return selectHistory(func(s *series) bool {
+		return (len(metrics) == 0 || containsMetric(metrics, s.metric)) && s.labels.matches(match)
+	}, from, to, step)
+}
+
+// SelectHistory is QueryHistory for the series any of sels matches.
+func SelectHistory(sels []Selector, from, to int64, step time.Duration) []Series {
+	return selectHistory(func(s *series) bool {
+		for _, sel := range sels {
+			if sel.matches(s) {
+				return true
+			}
+		}
+		return false
+	}, from, to, step)
+}
+
+func selectHistory(match func(*series) bool, from, to int64, step time.Duration) []Series {
+	tier := -1
+	for i, rt := range rollupTiers {
+		if rt.Step == step {
+			tier = i
+		}
+	}
+	if to <= 0 {
+		to = math.MaxInt64
+	}
+	histMu.Lock()
+	keys := make([]string, 0, len(histSeries))
+	for key, s := range histSeries {
+		if match(s) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	slices := make([]seriesSlice, len(keys))
+	for i, key := range keys {
+		slices[i] = histSeries[key].slice(tier, from, to)
+	}
+	histMu.Unlock()
+
+	// 解码放在锁外，导出整个库也不挡住采集
+	out := make([]Series, 0, len(slices))
+	for _, sl := range slices {
+		if ser := sl.decode(from, to); len(ser.T) > 0 {
+			out = append(out, ser)
+		}
+	}
+	return out
+}
+
+// seriesSlice is the chunks of one resolution of a series that hold the
+// points a query wants. It is taken under histMu and decoded after.
+type seriesSlice struct {
+	metric string
+	labels Labels
+	step   int64 // ms per point, 0 for raw
+	ring   *chunkRing
+}
+
+// slice copies the chunks of the raw points (tier -1) or a rollup tier
+// that hold the points from..to.
+func (s *series) slice(tier int, from, to int64) seriesSlice {
+	if tier < 0 {
+		return seriesSlice{metric: s.metric, labels: s.labels, ring: s.raw.view(from, to)}
+	}
+	r := s.tiers[tier]
+	return seriesSlice{metric: s.metric, labels: s.labels, step: r.step, ring: r.ring.view(from, to)}
+}
+
+// decode returns the points from..to.
+func (sl seriesSlice) decode(from, to int64) Series {
+	out := Series{Metric: sl.metric, Labels: sl.labels}
+	ts, cols := sl.ring.columns(from, to)
+	if sl.step == 0 {
+		out.T, out.V = ts, cols[0]
+		return out
+	}
+	out.Step = sl.step / 1000
+	out.T, out.Min, out.V, out.Max = ts, cols[0], cols[1], cols[2]
+	return out
+}
+
+// ImportStats says what ImportHistory did.
+type ImportStats struct {
+	Series  int `json:"series"`
+	Points  int `json:"points"`
+	Skipped int `json:"skipped"` // already covered, too old to keep, or of a step the store doesn't keep
+}
+
+// ImportHistory adds points to the store, e.g. from an export of another
+// instance. A series takes the labels in extra on top of its own. Points
+// must be newer than what their series (and resolution) already holds,
+// so importing the same file twice doesn't double it. Raw points are
+// rolled up like recorded ones, then everything is trimmed to the usual
+// retentions; with a history file, the store is rewritten to it.
+func ImportHistory(in []Series, extra Labels) (ImportStats, error) {
+	var stats ImportStats
+	// 粗的档位先来：原始点汇总出的桶要是已经导入过，关桶时就会跳过
+	in = append([]Series(nil), in...)
+	sort.SliceStable(in, func(i, j int) bool { return in[i].Step > in[j].Step })
+
+	now := time.Now().UnixMilli()
+	histMu.Lock()
+	touched := make(map[string]*series)
+	for _, ser := range in {
+		if len(ser.T) != len(ser.V) || ser.Step > 0 && (len(ser.Min) != len(ser.T) || len(ser.Max) != len(ser.T)) {
+			histMu.Unlock()
+			return stats, fmt.Errorf("%s: columns of different lengths", ser.Metric)
+		}
+		labels := Labels{}
+		for k, v := range ser.Labels {
+			labels[k] = v
+		}
+		for k, v := range extra {
+			labels[k] = v
+		}
+		if len(labels) == 0 {
+			labels = nil
+		}
+		key := seriesKey(ser.Metric, labels)
+		s := histSeries[key]
+		if s == nil {
+			s = newSeries(ser.Metric, labels)
+		}
+		// 原始点过了原始保留期也还能汇总，最长的档位都放不下才算太旧
+		ring, cutoff := s.raw, now-rollupTiers[len(rollupTiers)-1].Retention.Milliseconds()
+		if ser.Step > 0 {
+			ring = nil
+			for i, rt := range rollupTiers {
+				if rt.Step == time.Duration(ser.Step)*time.Second {
+					ring, cutoff = s.tiers[i].ring, now-rt.Retention.Milliseconds()
+				}
+			}
+		}
+		order := make([]int, len(ser.T))
+		for i := range order {
+			order[i] = i
+		}
+		sort.SliceStable(order, func(a, b int) bool { return ser.T[order[a]] < ser.T[order[b]] })
+		n := 0
+		for _, i := range order {
+			t := ser.T[i]
+			if ring == nil || t < cutoff || !ring.empty() && t <= ring.last() {
+				stats.Skipped++
+				continue
+			}
+			if ser.Step > 0 {
+				ring.append(t, ser.Min[i], ser.V[i], ser.Max[i])
+			} else {
+				s.add(t, ser.V[i])
+			}
+			n++
+		}
+		if n > 0 {
+			histSeries[key] = s
+			touched[key] = s
+			stats.Points += n
+		}
+	}
+	for key, s := range touched {
+		if !s.trim(now) {
+			delete(histSeries, key)
+		}
+	}
+	stats.Series = len(touched)
+	hf := histFile
+	histMu.Unlock()
+
+	if hf != nil {
+		hf.mu.Lock()
+		defer hf.mu.Unlock()
+		if hf.f != nil {
+			if err := hf.compactLocked(); err != nil {
+				return stats, err
+			}
+		}
+	}
+	return stats, nil
+}
+
+func containsMetric(metrics []string, m string) bool {
+	for _, x := range metrics {
+		if x == m || x == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// HistorySeries lists the stored series, sorted by metric and labels.
+func HistorySeries() []SeriesInfo {
+	histMu.Lock()
+	defer histMu.Unlock()
+	keys := make([]string, 0, len(histSeries))
+	for key := range histSeries {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	out := make([]SeriesInfo, 0, len(keys))
+	for _, key := range keys {
+		s := histSeries[key]
+		out = append(out, SeriesInfo{Metric: s.metric, Labels: s.labels, Points: s.raw.len(), First: s.first(), Last: s.last()})
+	}
+	return out
+}
+
+// GetHistory returns CPU average and memory percent in the old combined
+// form, for clients that don't ask for series.
+func GetHistory() []HistoryPoint {
+	histMu.Lock()
+	defer histMu.Unlock()
+	cpu, mem := histSeries["cpu"], histSeries["memory"]
+	if cpu == nil || mem == nil {
+		return []HistoryPoint{}
+	}
+	memAt := make(map[int64]float64)
+	mem.raw.each(0, math.MaxInt64, func(t int64, vs []float64) bool {
+		memAt[t] = vs[0]
+		return true
+	})
+	out := []HistoryPoint{}
+	cpu.raw.each(0, math.MaxInt64, func(t int64, vs []float64) bool {
+		if m, ok := memAt[t]; ok {
+			out = append(out, HistoryPoint{Timestamp: t / 1000, CPUAvg: vs[0], MemPercent: m})
+		}
+		return true
+	})
+	return out
+}
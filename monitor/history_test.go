@@ -0,0 +1,180 @@
+// Copyright (C) 2025 Russell Li (xiaoxinmm)
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package monitor
+
+import (
+	"math"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// freshHistory gives the test an empty store with raw retention d.
+func freshHistory(t *testing.T, d time.Duration) {
+	t.Helper()
+	histMu.Lock()
+	saved, savedRetention := histSeries, histRetention
+	histSeries, histRetention = make(map[string]*series), d
+	histMu.Unlock()
+	t.Cleanup(func() {
+		histMu.Lock()
+		histSeries, histRetention = saved, savedRetention
+		histMu.Unlock()
+	})
+}
+
+func TestProcessSeriesExpire(t *testing.T) {
+	freshHistory(t, time.Minute)
+	t0 := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	cpu := ProcessMetrics["cpu"]
+	for i := 0; i < 6; i++ {
+		// 两个同名进程，加上按名字的合计，和 runProcessHistory 记的一样
+		Record(t0.Add(time.Duration(i)*10*time.Second).UnixMilli(), []Sample{
+			{Metric: cpu, Labels: Labels{"pid": "1", "name": "cc1"}, Value: 10},
+			{Metric: cpu, Labels: Labels{"pid": "2", "name": "cc1"}, Value: 20},
+			{Metric: cpu, Labels: Labels{"name": "cc1"}, Value: 30},
+		})
+	}
+
+	res, err := TopProcesses(t0.UnixMilli(), t0.Add(time.Minute).UnixMilli(), "cpu", 0, t0.Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Resolution != "raw" || len(res.Processes) != 2 || res.Processes[0].PID != 2 || res.Processes[0].CPU.Avg != 20 {
+		t.Errorf("raw: %+v", res)
+	}
+
+	// ten minutes on the pids' raw points have expired and their series
+	// are gone; the per-name one still has its minute rollup
+	later := t0.Add(10 * time.Minute)
+	Record(later.UnixMilli(), []Sample{{Metric: "cpu", Value: 1}})
+	for _, s := range HistorySeries() {
+		if s.Labels["pid"] != "" {
+			t.Errorf("series %s %v outlived its raw points", s.Metric, s.Labels)
+		}
+	}
+	res, err = TopProcesses(t0.UnixMilli(), t0.Add(time.Minute).UnixMilli(), "cpu", 0, later)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Resolution != "1m" || len(res.Processes) != 1 {
+		t.Fatalf("rollup: %+v", res)
+	}
+	if p := res.Processes[0]; p.PID != 0 || p.Name != "cc1" || p.CPU.Avg != 30 || p.CPU.Max != 30 {
+		t.Errorf("rollup: %+v", p)
+	}
+}
+
+// TestQueryWindowed checks decoding only the queried window gives what
+// decoding everything did, across the raw/rollup seam and with buckets
+// that start before the window.
+func TestQueryWindowed(t *testing.T) {
+	freshHistory(t, time.Hour)
+	t0 := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 3*3600/5; i++ {
+		at := t0.Add(time.Duration(i) * 5 * time.Second)
+		Record(at.UnixMilli(), []Sample{{Metric: "cpu", Value: float64(i % 97)}})
+	}
+	now := t0.Add(3 * time.Hour)
+	sel, _ := ParseSelector("cpu")
+	for _, q := range []RangeQuery{
+		{Start: t0.Add(10 * time.Minute).UnixMilli(), End: now.UnixMilli()},
+		{Start: t0.Add(95*time.Minute + 7*time.Second).UnixMilli(), End: t0.Add(150 * time.Minute).UnixMilli(), Step: time.Hour},
+		{Start: t0.Add(150 * time.Minute).UnixMilli(), End: t0.Add(170 * time.Minute).UnixMilli(), Agg: "max"},
+		{Start: t0.Add(-time.Hour).UnixMilli(), End: t0.Add(30 * time.Minute).UnixMilli(), Step: 7 * time.Minute, Agg: "p95"},
+	} {
+		q.Selectors = []Selector{sel}
+		got, err := QueryRange(q, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got.Series) != 1 || len(got.Series[0].T) == 0 {
+			t.Fatalf("%+v: no points", q)
+		}
+		// 对照：整条序列解码
+		histMu.Lock()
+		tier := pickTier(append([]HistoryTier{{Retention: histRetention}}, rollupTiers...), q.Start, now)
+		full := histSeries["cpu"].view(tier, 0, math.MaxInt64)
+		histMu.Unlock()
+		ts, vs, los, his := full.merged()
+		want := aggregate(ts, vs, los, his, q.Start, q.End, got.Step*1000, got.Agg)
+		if !reflect.DeepEqual(got.Series[0].T, want.T) || !reflect.DeepEqual(got.Series[0].V, want.V) {
+			t.Errorf("%s..%s step %ds: windowed\n%v %v\nfull\n%v %v", time.UnixMilli(q.Start).UTC(), time.UnixMilli(q.End).UTC(), got.Step,
+				got.Series[0].T, got.Series[0].V, want.T, want.V)
+		}
+	}
+}
+
+// TestQueryDuringRecord runs queries while points are being recorded;
+// with -race it checks the decoding outside histMu only reads copies.
+func TestQueryDuringRecord(t *testing.T) {
+	freshHistory(t, time.Hour)
+	t0 := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	sel, _ := ParseSelector("cpu")
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 2000; i++ {
+			Record(t0.Add(time.Duration(i)*time.Second).UnixMilli(), []Sample{{Metric: "cpu", Value: float64(i)}})
+		}
+	}()
+	for {
+		select {
+		case <-done:
+			return
+		default:
+		}
+		if _, err := QueryRange(RangeQuery{Selectors: []Selector{sel}, Start: t0.UnixMilli(), End: t0.Add(time.Hour).UnixMilli()}, t0.Add(time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// TestSelectDuringRecord reads raw points and rollups while points are
+// being recorded: every read is a consistent prefix, and with -race it
+// checks the decoding outside histMu only reads copies.
+func TestSelectDuringRecord(t *testing.T) {
+	freshHistory(t, time.Hour)
+	t0 := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 2000; i++ {
+			Record(t0.Add(time.Duration(i)*time.Second).UnixMilli(), []Sample{{Metric: "cpu", Value: float64(i)}})
+		}
+	}()
+	for {
+		select {
+		case <-done:
+			return
+		default:
+		}
+		for _, s := range QueryHistory([]string{"cpu"}, nil, 0, 0, 0) {
+			for i, tm := range s.T {
+				if tm != t0.Add(time.Duration(i)*time.Second).UnixMilli() || s.V[i] != float64(i) {
+					t.Fatalf("raw point %d: %d %v", i, tm, s.V[i])
+				}
+			}
+		}
+		for _, s := range QueryHistory([]string{"cpu"}, nil, 0, 0, time.Minute) {
+			for i, tm := range s.T {
+				if tm != t0.Add(time.Duration(i)*time.Minute).UnixMilli() || s.Min[i] != float64(60*i) {
+					t.Fatalf("rollup %d: %d min %v", i, tm, s.Min[i])
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,594 @@
+// Copyright (C) 2025 Russell Li (xiaoxinmm)
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package monitor
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// On-disk history. The store is mirrored to <dataDir>/history.log, an
+// append-only log of records:
+//
+//	uint32 length | uint32 CRC-32C of the payload | payload
+//
+// A payload is a series definition (kind 1: id, metric, labels), the raw
+// points recorded at one time (kind 2: t, then id and value per sample),
+// or closed rollup buckets of one series (kind 3: id, step, then t, min,
+// avg and max per bucket). Appends are buffered and written every
+// histFlushEvery; a crash loses at most that much, and a torn last record
+// is cut off on the next start. Compaction rewrites the file from memory
+// into a temp file and renames it over the log, dropping what is past the
+// size and age caps.
+
+const (
+	histFileName = "history.log"
+	histMagic    = "SYSMONH1"
+
+	histRecSeries = 1
+	histRecPoints = 2
+	histRecRollup = 3
+
+	histFlushEvery   = 10 * time.Second
+	histCompactEvery = time.Hour
+	// 文件比上次压缩后大了这么多（且翻倍）才压缩
+	histCompactMin = 1 << 20
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+type historyFile struct {
+	path     string
+	maxBytes int64
+	maxAge   time.Duration
+
+	// guarded by histMu: what Record appended since the last flush
+	pending bytes.Buffer
+	nextID  uint64
+
+	mu        sync.Mutex // serialises flush, compact and close
+	f         *os.File
+	size      int64
+	base      int64 // size right after the last compaction
+	compacted time.Time
+	done      chan struct{}
+}
+
+var histFile *historyFile
+
+// OpenHistory loads the history kept in dir, then keeps writing to it.
+// maxBytes and maxAge cap the file (and what is kept in memory); 0 means
+// no cap. Call CloseHistory on exit to write the last points.
+func OpenHistory(dir string, maxBytes int64, maxAge time.Duration) error {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	hf := &historyFile{path: filepath.Join(dir, histFileName), maxBytes: maxBytes, maxAge: maxAge, done: make(chan struct{})}
+	n, err := hf.load()
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		log.Printf("history: loaded %d points from %s", n, hf.path)
+	}
+	histMu.Lock()
+	histFile = hf
+	histMu.Unlock()
+	hf.mu.Lock()
+	err = hf.compactLocked()
+	hf.mu.Unlock()
+	if err != nil {
+		histMu.Lock()
+		histFile = nil
+		histMu.Unlock()
+		return err
+	}
+	go hf.run()
+	return nil
+}
+
+// CloseHistory writes what is still buffered and closes the file.
+func CloseHistory() {
+	histMu.Lock()
+	hf := histFile
+	histMu.Unlock()
+	if hf == nil {
+		return
+	}
+	close(hf.done)
+	hf.mu.Lock()
+	defer hf.mu.Unlock()
+	if err := hf.flushLocked(); err != nil {
+		log.Printf("history: %v", err)
+	}
+	hf.f.Close()
+	hf.f = nil
+	histMu.Lock()
+	histFile = nil
+	histMu.Unlock()
+}
+
+func (hf *historyFile) run() {
+	ticker := time.NewTicker(histFlushEvery)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-hf.done:
+			return
+		case <-ticker.C:
+		}
+		hf.mu.Lock()
+		if hf.f == nil {
+			hf.mu.Unlock()
+			return
+		}
+		err := hf.flushLocked()
+		if err == nil && hf.needsCompaction() {
+			err = hf.compactLocked()
+		}
+		hf.mu.Unlock()
+		if err != nil {
+			log.Printf("history: %v", err)
+		}
+	}
+}
+
+func (hf *historyFile) needsCompaction() bool {
+	if hf.maxBytes > 0 && hf.size > hf.maxBytes {
+		return true
+	}
+	if hf.size > 2*hf.base && hf.size-hf.base > histCompactMin {
+		return true
+	}
+	return time.Since(hf.compacted) > histCompactEvery
+}
+
+func (hf *historyFile) flushLocked() error {
+	histMu.Lock()
+	data := append([]byte(nil), hf.pending.Bytes()...)
+	hf.pending.Reset()
+	histMu.Unlock()
+	if len(data) == 0 {
+		return nil
+	}
+	if _, err := hf.f.Write(data); err != nil {
+		return err
+	}
+	hf.size += int64(len(data))
+	return hf.f.Sync()
+}
+
+// compactLocked rewrites the file from the store. The store is trimmed to
+// the caps first, so what is in memory and on disk stay the same.
+func (hf *historyFile) compactLocked() error {
+	histMu.Lock()
+	hf.trimLocked(time.Now())
+	data := hf.encodeLocked()
+	hf.pending.Reset()
+	histMu.Unlock()
+
+	tmp := hf.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(data); err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, hf.path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("compact: %w", err)
+	}
+	// 目录也要落盘，rename 才算数
+	if d, err := os.Open(filepath.Dir(hf.path)); err == nil {
+		d.Sync()
+		d.Close()
+	}
+
+	if hf.f != nil {
+		hf.f.Close()
+	}
+	if hf.f, err = os.OpenFile(hf.path, os.O_WRONLY|os.O_APPEND, 0o644); err != nil {
+		return err
+	}
+	hf.size, hf.base, hf.compacted = int64(len(data)), int64(len(data)), time.Now()
+	return nil
+}
+
+// trimLocked drops points past maxAge, then the oldest points until the
+// encoded store fits in three quarters of maxBytes, leaving room to grow
+// before the next compaction.
+func (hf *historyFile) trimLocked(now time.Time) {
+	var cutoff int64
+	if hf.maxAge > 0 {
+		cutoff = now.Add(-hf.maxAge).UnixMilli()
+	}
+	if hf.maxBytes > 0 {
+		// 每个时刻一条记录：头 8 字节 + 类型 1 + t 最多 10，每个样本 id 约 2 + 值 8
+		perTime := make(map[int64]int64)
+		for _, s := range histSeries {
+			s.raw.each(0, math.MaxInt64, func(t int64, _ []float64) bool {
+				perTime[t] += 10
+				return true
+			})
+			// 汇总桶：t 最多 10 + 三个值 24
+			for _, r := range s.tiers {
+				r.ring.each(0, math.MaxInt64, func(t int64, _ []float64) bool {
+					perTime[t] += 34
+					return true
+				})
+			}
+		}
+		times := make([]int64, 0, len(perTime))
+		for t := range perTime {
+			times = append(times, t)
+		}
+		sort.Slice(times, func(i, j int) bool { return times[i] > times[j] })
+		budget := hf.maxBytes * 3 / 4
+		for _, t := range times {
+			budget -= perTime[t] + 19
+			if budget < 0 {
+				cutoff = max(cutoff, t+1)
+				break
+			}
+		}
+	}
+	if cutoff == 0 {
+		return
+	}
+	for key, s := range histSeries {
+		if !s.cut(cutoff) {
+			delete(histSeries, key)
+		}
+	}
+}
+
+// encodeLocked writes the whole store as a fresh file, numbering the
+// series from 1.
+func (hf *historyFile) encodeLocked() []byte {
+	var out bytes.Buffer
+	out.WriteString(histMagic)
+	keys := make([]string, 0, len(histSeries))
+	for key := range histSeries {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	hf.nextID = 0
+	byTime := make(map[int64][]histSample)
+	for _, key := range keys {
+		s := histSeries[key]
+		hf.defineLocked(&out, s)
+		for _, r := range s.tiers {
+			r.saved = 0
+			hf.saveRollupLocked(&out, s, r)
+		}
+		s.raw.each(0, math.MaxInt64, func(t int64, vs []float64) bool {
+			byTime[t] = append(byTime[t], histSample{s.fileID, vs[0]})
+			return true
+		})
+	}
+	times := make([]int64, 0, len(byTime))
+	for t := range byTime {
+		times = append(times, t)
+	}
+	sort.Slice(times, func(i, j int) bool { return times[i] < times[j] })
+	for _, t := range times {
+		writeRecord(&out, encodePoints(t, byTime[t]))
+	}
+	return out.Bytes()
+}
+
+type histSample struct {
+	id uint64
+	v  float64
+}
+
+// defineLocked gives s an id in the current file and writes its definition.
+func (hf *historyFile) defineLocked(out *bytes.Buffer, s *series) {
+	hf.nextID++
+	s.fileID = hf.nextID
+	p := []byte{histRecSeries}
+	p = binary.AppendUvarint(p, s.fileID)
+	p = appendString(p, s.metric)
+	keys := make([]string, 0, len(s.labels))
+	for k := range s.labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	p = binary.AppendUvarint(p, uint64(len(keys)))
+	for _, k := range keys {
+		p = appendString(p, k)
+		p = appendString(p, s.labels[k])
+	}
+	writeRecord(out, p)
+}
+
+// appendLocked logs one Record call, and the rollup buckets that closed
+// since the last one. recorded are the series of samples, in order. Series
+// new to the file are defined first.
+func (hf *historyFile) appendLocked(t int64, samples []Sample, recorded []*series) {
+	logged := make([]histSample, 0, len(recorded))
+	for i, s := range recorded {
+		if s.fileID == 0 {
+			hf.defineLocked(&hf.pending, s)
+		}
+		logged = append(logged, histSample{s.fileID, samples[i].Value})
+	}
+	writeRecord(&hf.pending, encodePoints(t, logged))
+	for _, s := range histSeries {
+		for _, r := range s.tiers {
+			if !r.ring.empty() && r.ring.last() > r.saved {
+				if s.fileID == 0 {
+					hf.defineLocked(&hf.pending, s)
+				}
+				hf.saveRollupLocked(&hf.pending, s, r)
+			}
+		}
+	}
+}
+
+// saveRollupLocked writes r's buckets after r.saved.
+func (hf *historyFile) saveRollupLocked(out *bytes.Buffer, s *series, r *rollup) {
+	ts, cols := r.ring.columns(r.saved+1, math.MaxInt64)
+	if len(ts) == 0 {
+		return
+	}
+	p := make([]byte, 0, 16+len(ts)*34)
+	p = append(p, histRecRollup)
+	p = binary.AppendUvarint(p, s.fileID)
+	p = binary.AppendUvarint(p, uint64(r.step/1000))
+	p = binary.AppendUvarint(p, uint64(len(ts)))
+	for i, t := range ts {
+		p = binary.AppendVarint(p, t)
+		for _, col := range cols {
+			p = binary.LittleEndian.AppendUint64(p, math.Float64bits(col[i]))
+		}
+	}
+	writeRecord(out, p)
+	r.saved = ts[len(ts)-1]
+}
+
+func encodePoints(t int64, samples []histSample) []byte {
+	p := make([]byte, 0, 12+len(samples)*10)
+	p = append(p, histRecPoints)
+	p = binary.AppendVarint(p, t)
+	p = binary.AppendUvarint(p, uint64(len(samples)))
+	for _, smp := range samples {
+		p = binary.AppendUvarint(p, smp.id)
+		p = binary.LittleEndian.AppendUint64(p, math.Float64bits(smp.v))
+	}
+	return p
+}
+
+func appendString(p []byte, s string) []byte {
+	p = binary.AppendUvarint(p, uint64(len(s)))
+	return append(p, s...)
+}
+
+func writeRecord(out *bytes.Buffer, payload []byte) {
+	var hdr [8]byte
+	binary.LittleEndian.PutUint32(hdr[0:], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(hdr[4:], crc32.Checksum(payload, crcTable))
+	out.Write(hdr[:])
+	out.Write(payload)
+}
+
+var errBadRecord = errors.New("bad record")
+
+// load replays the log into the store and returns the number of points
+// read. A torn or corrupt tail is logged and ignored; compaction right
+// after drops it from the file.
+func (hf *historyFile) load() (int, error) {
+	data, err := os.ReadFile(hf.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	if !bytes.HasPrefix(data, []byte(histMagic)) {
+		// 不认识的文件别覆盖掉，挪开
+		bad := hf.path + ".bad"
+		log.Printf("history: %s is not a history file, moving it to %s", hf.path, bad)
+		return 0, os.Rename(hf.path, bad)
+	}
+	var cutoff int64
+	if hf.maxAge > 0 {
+		cutoff = time.Now().Add(-hf.maxAge).UnixMilli()
+	}
+
+	histMu.Lock()
+	defer histMu.Unlock()
+	defs := make(map[uint64]Sample)
+	points := 0
+	off := len(histMagic)
+	for off < len(data) {
+		if len(data)-off < 8 {
+			err = io.ErrUnexpectedEOF
+			break
+		}
+		n := int(binary.LittleEndian.Uint32(data[off:]))
+		sum := binary.LittleEndian.Uint32(data[off+4:])
+		if n > len(data)-off-8 {
+			err = io.ErrUnexpectedEOF
+			break
+		}
+		p := data[off+8 : off+8+n]
+		if crc32.Checksum(p, crcTable) != sum {
+			err = errBadRecord
+			break
+		}
+		var k int
+		if k, err = replayRecord(p, defs, cutoff); err != nil {
+			break
+		}
+		points += k
+		off += 8 + n
+	}
+	if err != nil {
+		log.Printf("history: %s: %v at offset %d of %d, dropping the rest", hf.path, err, off, len(data))
+	}
+	return points, nil
+}
+
+// replayRecord applies one record; histMu is held.
+func replayRecord(p []byte, defs map[uint64]Sample, cutoff int64) (int, error) {
+	// 崩溃后补零的尾巴读出来是长度 0、CRC 0 的记录，校验能过
+	if len(p) == 0 {
+		return 0, errBadRecord
+	}
+	r := bytes.NewReader(p[1:])
+	switch p[0] {
+	case histRecSeries:
+		id, err := binary.ReadUvarint(r)
+		if err != nil {
+			return 0, errBadRecord
+		}
+		def := Sample{}
+		if def.Metric, err = readString(r); err != nil {
+			return 0, err
+		}
+		n, err := binary.ReadUvarint(r)
+		if err != nil || n > uint64(r.Len()) {
+			return 0, errBadRecord
+		}
+		if n > 0 {
+			def.Labels = make(Labels, n)
+		}
+		for i := uint64(0); i < n; i++ {
+			k, err := readString(r)
+			if err != nil {
+				return 0, err
+			}
+			v, err := readString(r)
+			if err != nil {
+				return 0, err
+			}
+			def.Labels[k] = v
+		}
+		defs[id] = def
+		return 0, nil
+	case histRecPoints:
+		t, err := binary.ReadVarint(r)
+		if err != nil {
+			return 0, errBadRecord
+		}
+		n, err := binary.ReadUvarint(r)
+		if err != nil || n > uint64(r.Len()) {
+			return 0, errBadRecord
+		}
+		samples := make([]Sample, 0, n)
+		var buf [8]byte
+		for i := uint64(0); i < n; i++ {
+			id, err := binary.ReadUvarint(r)
+			if err != nil {
+				return 0, errBadRecord
+			}
+			if _, err := io.ReadFull(r, buf[:]); err != nil {
+				return 0, errBadRecord
+			}
+			def, ok := defs[id]
+			if !ok {
+				return 0, fmt.Errorf("undefined series %d", id)
+			}
+			def.Value = math.Float64frombits(binary.LittleEndian.Uint64(buf[:]))
+			samples = append(samples, def)
+		}
+		if t < cutoff {
+			return 0, nil
+		}
+		recordLocked(t, samples)
+		return len(samples), nil
+	case histRecRollup:
+		id, err := binary.ReadUvarint(r)
+		if err != nil {
+			return 0, errBadRecord
+		}
+		def, ok := defs[id]
+		if !ok {
+			return 0, fmt.Errorf("undefined series %d", id)
+		}
+		step, err := binary.ReadUvarint(r)
+		if err != nil {
+			return 0, errBadRecord
+		}
+		n, err := binary.ReadUvarint(r)
+		if err != nil || n > uint64(r.Len()) {
+			return 0, errBadRecord
+		}
+		key := seriesKey(def.Metric, def.Labels)
+		s := histSeries[key]
+		if s == nil {
+			s = newSeries(def.Metric, def.Labels)
+			histSeries[key] = s
+		}
+		var tier *rollup
+		for i, rt := range rollupTiers {
+			if uint64(rt.Step/time.Second) == step {
+				tier = s.tiers[i]
+			}
+		}
+		var buf [24]byte
+		points := 0
+		for i := uint64(0); i < n; i++ {
+			t, err := binary.ReadVarint(r)
+			if err != nil {
+				return 0, errBadRecord
+			}
+			if _, err := io.ReadFull(r, buf[:]); err != nil {
+				return 0, errBadRecord
+			}
+			// 档位改了就丢掉不认识的；过期的、重复的也跳过
+			if tier == nil || t < cutoff || (!tier.ring.empty() && t <= tier.ring.last()) {
+				continue
+			}
+			tier.ring.append(t,
+				math.Float64frombits(binary.LittleEndian.Uint64(buf[0:])),
+				math.Float64frombits(binary.LittleEndian.Uint64(buf[8:])),
+				math.Float64frombits(binary.LittleEndian.Uint64(buf[16:])))
+			points++
+		}
+		return points, nil
+	}
+	return 0, fmt.Errorf("unknown record kind %d", p[0])
+}
+
+func readString(r *bytes.Reader) (string, error) {
+	n, err := binary.ReadUvarint(r)
+	if err != nil || n > uint64(r.Len()) {
+		return "", errBadRecord
+	}
+	b := make([]byte, n)
+	r.Read(b)
+	return string(b), nil
+}
@@ -0,0 +1,209 @@
+// Copyright (C) 2025 Russell Li (xiaoxinmm)
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package monitor
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// openHistory opens the history in dir for the test and closes it after.
+func openHistory(t *testing.T, dir string, maxBytes int64, maxAge time.Duration) {
+	t.Helper()
+	if err := OpenHistory(dir, maxBytes, maxAge); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(CloseHistory)
+}
+
+// reopen closes the history, empties the store and loads dir again.
+func reopen(t *testing.T, dir string, maxBytes int64, maxAge time.Duration) {
+	t.Helper()
+	CloseHistory()
+	histMu.Lock()
+	histSeries = make(map[string]*series)
+	histMu.Unlock()
+	openHistory(t, dir, maxBytes, maxAge)
+}
+
+// testLog is a history file of one series with n points every step from
+// t0, and where each record ends.
+func testLog(n int, t0 int64, step time.Duration) (data []byte, ends []int) {
+	var out bytes.Buffer
+	out.WriteString(histMagic)
+	hf := &historyFile{}
+	s := newSeries("cpu", nil)
+	hf.defineLocked(&out, s)
+	for i := 0; i < n; i++ {
+		writeRecord(&out, encodePoints(t0+int64(i)*step.Milliseconds(), []histSample{{s.fileID, float64(i)}}))
+		ends = append(ends, out.Len())
+	}
+	return out.Bytes(), ends
+}
+
+// rawPoints is how many raw points the store holds for cpu.
+func rawPoints(t *testing.T) int {
+	t.Helper()
+	for _, s := range HistorySeries() {
+		if s.Metric == "cpu" && len(s.Labels) == 0 {
+			return s.Points
+		}
+	}
+	return 0
+}
+
+func TestHistoryFileRoundTrip(t *testing.T) {
+	freshHistory(t, time.Hour)
+	dir := t.TempDir()
+	openHistory(t, dir, 0, 0)
+	t0 := time.Now().Add(-5 * time.Minute).Truncate(time.Minute)
+	for i := 0; i < 4*60/5; i++ {
+		at := t0.Add(time.Duration(i) * 5 * time.Second).UnixMilli()
+		Record(at, []Sample{
+			{Metric: "cpu", Value: float64(i)},
+			{Metric: "disk", Labels: Labels{"mountpoint": "/"}, Value: 50 + float64(i%7)/3},
+		})
+	}
+	raw := QueryHistory(nil, nil, 0, 0, 0)
+	minutes := QueryHistory(nil, nil, 0, 0, time.Minute)
+	if len(raw) != 2 || len(minutes) != 2 || len(minutes[0].T) != 3 {
+		t.Fatalf("recorded %d raw series, %d rolled up", len(raw), len(minutes))
+	}
+
+	reopen(t, dir, 0, 0)
+	if got := QueryHistory(nil, nil, 0, 0, 0); !reflect.DeepEqual(got, raw) {
+		t.Errorf("raw points after restart\n got %+v\nwant %+v", got, raw)
+	}
+	if got := QueryHistory(nil, nil, 0, 0, time.Minute); !reflect.DeepEqual(got, minutes) {
+		t.Errorf("rollups after restart\n got %+v\nwant %+v", got, minutes)
+	}
+}
+
+// TestHistoryFileTornTail is what a crash leaves at the end of the log:
+// the points before it are kept, and the file is whole again after.
+func TestHistoryFileTornTail(t *testing.T) {
+	t0 := time.Now().Add(-time.Minute).UnixMilli()
+	data, ends := testLog(10, t0, time.Second)
+	for _, tc := range []struct {
+		name string
+		data []byte
+		want int
+	}{
+		{"partial header", append(append([]byte(nil), data...), 5, 0, 0), 10},
+		{"partial record", data[:ends[9]-3], 9},
+		{"length past the end", append(append([]byte(nil), data...), 100, 0, 0, 0, 1, 2, 3, 4, 5, 6), 10},
+		{"zero-filled tail", append(append([]byte(nil), data...), make([]byte, 16)...), 10},
+		{"only zeros", append([]byte(histMagic), make([]byte, 16)...), 0},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			freshHistory(t, time.Hour)
+			dir := t.TempDir()
+			if err := os.WriteFile(filepath.Join(dir, histFileName), tc.data, 0o644); err != nil {
+				t.Fatal(err)
+			}
+			openHistory(t, dir, 0, 0)
+			if got := rawPoints(t); got != tc.want {
+				t.Errorf("loaded %d points, want %d", got, tc.want)
+			}
+			reopen(t, dir, 0, 0)
+			if got := rawPoints(t); got != tc.want {
+				t.Errorf("after compaction: %d points, want %d", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestHistoryFileBadCRC(t *testing.T) {
+	freshHistory(t, time.Hour)
+	data, ends := testLog(5, time.Now().Add(-time.Minute).UnixMilli(), time.Second)
+	// 第三条记录的最后一个字节改坏，后面的都不要了
+	data[ends[2]-1] ^= 0xff
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, histFileName), data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	openHistory(t, dir, 0, 0)
+	if got := rawPoints(t); got != 2 {
+		t.Errorf("loaded %d points, want the 2 before the bad record", got)
+	}
+}
+
+func TestHistoryFileCompaction(t *testing.T) {
+	now := time.Now()
+	t.Run("maxAge", func(t *testing.T) {
+		freshHistory(t, 3*time.Hour)
+		dir := t.TempDir()
+		data, _ := testLog(2*3600/10, now.Add(-2*time.Hour).UnixMilli(), 10*time.Second)
+		if err := os.WriteFile(filepath.Join(dir, histFileName), data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		openHistory(t, dir, 0, time.Hour)
+		cutoff := now.Add(-time.Hour).UnixMilli()
+		for _, s := range HistorySeries() {
+			if s.First < cutoff {
+				t.Errorf("%s kept a point %v older than maxAge", s.Metric, time.Duration(cutoff-s.First)*time.Millisecond)
+			}
+		}
+		if rawPoints(t) == 0 {
+			t.Error("dropped everything")
+		}
+	})
+	t.Run("maxBytes", func(t *testing.T) {
+		freshHistory(t, 3*time.Hour)
+		dir := t.TempDir()
+		openHistory(t, dir, 4096, 0)
+		t0 := now.Add(-time.Hour)
+		for i := 0; i < 1000; i++ {
+			Record(t0.Add(time.Duration(i)*time.Second).UnixMilli(), []Sample{{Metric: "cpu", Value: float64(i)}})
+		}
+		reopen(t, dir, 4096, 0)
+		fi, err := os.Stat(filepath.Join(dir, histFileName))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Size() > 4096 {
+			t.Errorf("file is %d bytes, cap 4096", fi.Size())
+		}
+		raw := QueryHistory([]string{"cpu"}, nil, 0, 0, 0)
+		if len(raw) != 1 || len(raw[0].T) == 0 || len(raw[0].T) == 1000 {
+			t.Fatalf("kept %+v", raw)
+		}
+		// 丢的是最老的点
+		if last := raw[0].T[len(raw[0].T)-1]; last != t0.Add(999*time.Second).UnixMilli() {
+			t.Errorf("newest point %v dropped", time.UnixMilli(last))
+		}
+	})
+}
+
+func TestHistoryFileNotHistory(t *testing.T) {
+	freshHistory(t, time.Hour)
+	dir := t.TempDir()
+	path := filepath.Join(dir, histFileName)
+	if err := os.WriteFile(path, []byte("not a history file\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	openHistory(t, dir, 0, 0)
+	if b, err := os.ReadFile(path + ".bad"); err != nil || string(b) != "not a history file\n" {
+		t.Errorf("moved aside: %q, %v", b, err)
+	}
+	if b, err := os.ReadFile(path); err != nil || !bytes.HasPrefix(b, []byte(histMagic)) {
+		t.Errorf("new log: %q, %v", b, err)
+	}
+}
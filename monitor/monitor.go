@@ -64,6 +64,8 @@ type MemInfo struct {
 	SwapTotal   uint64  `json:"swapTotal"`
 	SwapUsed    uint64  `json:"swapUsed"`
 	SwapPercent float64 `json:"swapPercent"`
+	FullIn      int64   `json:"fullIn,omitempty"`     // seconds until available memory runs out at the current trend
+	SwapFullIn  int64   `json:"swapFullIn,omitempty"` // same for swap
 }
 
 type DiskInfo struct {
@@ -74,6 +76,7 @@ type DiskInfo struct {
 	Used       uint64  `json:"used"`
 	Free       uint64  `json:"free"`
 	UsedPercent float64 `json:"usedPercent"`
+	FullIn     int64   `json:"fullIn,omitempty"` // seconds until full at the current trend
 }
 
 type NetInfo struct {
@@ -99,6 +102,7 @@ type ProcessInfo struct {
 	Status string  `json:"status"`
 }
 
+// HistoryPoint is the old combined CPU/memory history; t is unix seconds.
 type HistoryPoint struct {
 	Timestamp  int64   `json:"t"`
 	CPUAvg     float64 `json:"c"`
@@ -121,44 +125,6 @@ func init() {
 	prevNetData = make(map[string]netSample)
 }
 
-// history ring buffer
-var (
-	histMu       sync.Mutex
-	histBuf      []HistoryPoint
-	histCapacity int = 3600
-)
-
-func SetHistoryCapacity(n int) {
-	histMu.Lock()
-	defer histMu.Unlock()
-	histCapacity = n
-	if len(histBuf) > histCapacity {
-		histBuf = histBuf[len(histBuf)-histCapacity:]
-	}
-}
-
-func RecordHistory(cpuAvg, memPct float64) {
-	histMu.Lock()
-	defer histMu.Unlock()
-	pt := HistoryPoint{
-		Timestamp:  time.Now().Unix(),
-		CPUAvg:     cpuAvg,
-		MemPercent: memPct,
-	}
-	histBuf = append(histBuf, pt)
-	if len(histBuf) > histCapacity {
-		histBuf = histBuf[len(histBuf)-histCapacity:]
-	}
-}
-
-func GetHistory() []HistoryPoint {
-	histMu.Lock()
-	defer histMu.Unlock()
-	cp := make([]HistoryPoint, len(histBuf))
-	copy(cp, histBuf)
-	return cp
-}
-
 func GetSystemInfo() SystemInfo {
 	h, _ := host.Info()
 	info := SystemInfo{
@@ -198,6 +164,23 @@ func GetCPUInfo() CPUInfo {
 	return info
 }
 
+// GetCPUUsage returns the per-core and average CPU usage since the previous
+// call. It skips the model lookup and core counts GetCPUInfo does, for idle
+// sampling.
+func GetCPUUsage() CPUInfo {
+	info := CPUInfo{}
+	percents, err := cpu.Percent(0, true)
+	if err != nil || len(percents) == 0 {
+		return info
+	}
+	info.Usage = percents
+	for _, p := range percents {
+		info.AvgUsage += p
+	}
+	info.AvgUsage /= float64(len(percents))
+	return info
+}
+
 func GetMemInfo() MemInfo {
 	info := MemInfo{}
 	v, err := mem.VirtualMemory()
@@ -449,7 +432,8 @@ func GetDockerContainers() []DockerContainer {
 	return containers
 }
 
-func GetProcesses(limit int) []ProcessInfo {
+// GetAllProcesses returns every process, in no particular order.
+func GetAllProcesses() []ProcessInfo {
 	var procs []ProcessInfo
 	pids, err := process.Processes()
 	if err != nil {
@@ -472,6 +456,15 @@ func GetProcesses(limit int) []ProcessInfo {
 			Status: status,
 		})
 	}
+	return procs
+}
+
+// GetProcesses returns the top limit processes by CPU usage.
+func GetProcesses(limit int) []ProcessInfo {
+	if limit <= 0 {
+		return []ProcessInfo{}
+	}
+	procs := GetAllProcesses()
 	sort.Slice(procs, func(i, j int) bool {
 		return procs[i].CPU > procs[j].CPU
 	})
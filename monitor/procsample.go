@@ -0,0 +1,100 @@
+// Copyright (C) 2025 Russell Li (xiaoxinmm)
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package monitor
+
+import (
+	"time"
+
+	"github.com/shirou/gopsutil/v3/process"
+)
+
+// ProcessSample is one process's usage between two ProcessSampler.Sample
+// calls.
+type ProcessSample struct {
+	PID  int32
+	Name string
+	CPU  float64 // % of one core
+	RSS  uint64  // bytes
+	IO   float64 // bytes/s read and written; 0 when /proc/<pid>/io isn't readable
+}
+
+// ProcessSampler turns the processes' cumulative CPU time and I/O into
+// rates. Unlike ProcessInfo.CPU, which is averaged over the process's
+// whole life, these are what each process used since the last call.
+type ProcessSampler struct {
+	prev map[int32]procCounters
+	at   time.Time
+}
+
+type procCounters struct {
+	created int64 // pid 被复用时靠这个区分
+	name    string
+	cpu     float64 // seconds
+	io      uint64  // bytes
+}
+
+// NewProcessSampler returns a sampler without a baseline.
+func NewProcessSampler() *ProcessSampler {
+	return &ProcessSampler{prev: make(map[int32]procCounters)}
+}
+
+// Sample returns the processes that were also there on the previous call.
+// The first call only takes the baseline and returns nothing.
+func (ps *ProcessSampler) Sample() []ProcessSample {
+	now := time.Now()
+	procs, err := process.Processes()
+	if err != nil {
+		return nil
+	}
+	elapsed := now.Sub(ps.at).Seconds()
+	next := make(map[int32]procCounters, len(procs))
+	var out []ProcessSample
+	for _, p := range procs {
+		created, err := p.CreateTime()
+		if err != nil {
+			continue // 已经退出了
+		}
+		times, err := p.Times()
+		if err != nil {
+			continue
+		}
+		c := procCounters{created: created, cpu: times.User + times.System}
+		if io, err := p.IOCounters(); err == nil {
+			c.io = io.ReadBytes + io.WriteBytes
+		}
+		prev, seen := ps.prev[p.Pid]
+		if seen && prev.created == created {
+			c.name = prev.name
+		} else {
+			seen = false
+			c.name, _ = p.Name()
+		}
+		next[p.Pid] = c
+		if !seen {
+			continue
+		}
+		smp := ProcessSample{PID: p.Pid, Name: c.name, CPU: max(0, (c.cpu-prev.cpu)/elapsed*100)}
+		if c.io >= prev.io {
+			smp.IO = float64(c.io-prev.io) / elapsed
+		}
+		if mi, err := p.MemoryInfo(); err == nil {
+			smp.RSS = mi.RSS
+		}
+		out = append(out, smp)
+	}
+	ps.prev, ps.at = next, now
+	return out
+}
@@ -0,0 +1,528 @@
+// Copyright (C) 2025 Russell Li (xiaoxinmm)
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package monitor
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Range queries over the history store: pick series with selectors, cut
+// start..end into step-long buckets and aggregate each bucket. The data
+// comes from the finest resolution that still reaches back to start; where
+// that has nothing yet (the hour still being rolled up, a fresh install),
+// finer resolutions fill in.
+
+// QueryAggs are the aggregations a range query can apply per bucket.
+var QueryAggs = []string{"avg", "min", "max", "p95", "last", "rate"}
+
+const (
+	// 不指定 step 时大约切成这么多个桶
+	queryAutoPoints = 600
+	queryMaxPoints  = 11000
+)
+
+// Selector picks series: a metric name (a glob, so net_* works) and
+// label matchers, written like cpu_core{core=~"[0-3]"} or
+// disk{mountpoint!="/boot"}.
+type Selector struct {
+	Metric   string
+	Matchers []LabelMatcher
+}
+
+// LabelMatcher is one label condition. Op is =, !=, =~ or !~; regular
+// expressions must match the whole value. A missing label has value "".
+type LabelMatcher struct {
+	Name, Op, Value string
+	re              *regexp.Regexp
+}
+
+func (m LabelMatcher) matches(labels Labels) bool {
+	v := labels[m.Name]
+	switch m.Op {
+	case "=":
+		return v == m.Value
+	case "!=":
+		return v != m.Value
+	case "=~":
+		return m.re.MatchString(v)
+	case "!~":
+		return !m.re.MatchString(v)
+	}
+	return false
+}
+
+func (sel Selector) matches(s *series) bool {
+	if ok, _ := path.Match(sel.Metric, s.metric); !ok {
+		return false
+	}
+	for _, m := range sel.Matchers {
+		if !m.matches(s.labels) {
+			return false
+		}
+	}
+	return true
+}
+
+// ParseSelector parses metric, metric{...} or {...} (any metric).
+func ParseSelector(s string) (Selector, error) {
+	s = strings.TrimSpace(s)
+	name, rest, braces := strings.Cut(s, "{")
+	sel := Selector{Metric: strings.TrimSpace(name)}
+	if sel.Metric == "" {
+		sel.Metric = "*"
+		if !braces {
+			return sel, errors.New("empty selector")
+		}
+	}
+	if _, err := path.Match(sel.Metric, ""); err != nil {
+		return sel, fmt.Errorf("bad metric pattern %q", sel.Metric)
+	}
+	if !braces {
+		return sel, nil
+	}
+	for {
+		rest = strings.TrimLeft(rest, " ")
+		if strings.HasPrefix(rest, "}") {
+			break
+		}
+		i := 0
+		for i < len(rest) && (rest[i] == '_' || 'a' <= rest[i] && rest[i] <= 'z' || 'A' <= rest[i] && rest[i] <= 'Z' || i > 0 && '0' <= rest[i] && rest[i] <= '9') {
+			i++
+		}
+		if i == 0 {
+			return sel, fmt.Errorf("selector %q: expected a label name", s)
+		}
+		m := LabelMatcher{Name: rest[:i]}
+		rest = strings.TrimLeft(rest[i:], " ")
+		for _, op := range []string{"=~", "!~", "!=", "="} {
+			if strings.HasPrefix(rest, op) {
+				m.Op = op
+				break
+			}
+		}
+		if m.Op == "" {
+			return sel, fmt.Errorf("selector %q: expected =, !=, =~ or !~ after %s", s, m.Name)
+		}
+		rest = strings.TrimLeft(rest[len(m.Op):], " ")
+		quoted, err := strconv.QuotedPrefix(rest)
+		if err != nil {
+			return sel, fmt.Errorf("selector %q: %s needs a quoted value", s, m.Name)
+		}
+		m.Value, _ = strconv.Unquote(quoted)
+		if m.Op == "=~" || m.Op == "!~" {
+			if m.re, err = regexp.Compile("^(?:" + m.Value + ")$"); err != nil {
+				return sel, fmt.Errorf("selector %q: %v", s, err)
+			}
+		}
+		sel.Matchers = append(sel.Matchers, m)
+		rest = strings.TrimLeft(rest[len(quoted):], " ")
+		if strings.HasPrefix(rest, ",") {
+			rest = rest[1:]
+		} else if !strings.HasPrefix(rest, "}") {
+			return sel, fmt.Errorf("selector %q: expected , or }", s)
+		}
+	}
+	if strings.TrimSpace(rest[1:]) != "" {
+		return sel, fmt.Errorf("selector %q: trailing text after }", s)
+	}
+	return sel, nil
+}
+
+// RangeQuery asks for selected series between Start and End (unix ms),
+// one Agg value per Step. Step 0 picks one that gives about 600 points.
+type RangeQuery struct {
+	Selectors []Selector
+	Start     int64
+	End       int64
+	Step      time.Duration
+	Agg       string
+}
+
+// RangeResult is the answer to a RangeQuery. Each series has one point per
+// bucket that had data, T being the bucket start.
+type RangeResult struct {
+	Start      int64    `json:"start"` // unix ms
+	End        int64    `json:"end"`
+	Step       int64    `json:"step"`       // seconds
+	Resolution string   `json:"resolution"` // raw, 1m, 1h: the coarsest data the buckets were computed from
+	Agg        string   `json:"agg"`
+	Series     []Series `json:"series"`
+}
+
+// QueryRange runs q.
+func QueryRange(q RangeQuery, now time.Time) (RangeResult, error) {
+	if q.Agg == "" {
+		q.Agg = "avg"
+	}
+	ok := false
+	for _, a := range QueryAggs {
+		ok = ok || a == q.Agg
+	}
+	if !ok {
+		return RangeResult{}, fmt.Errorf("agg must be one of %s", strings.Join(QueryAggs, ", "))
+	}
+	if q.End <= q.Start {
+		return RangeResult{}, errors.New("end must be after start")
+	}
+	span := time.Duration(q.End-q.Start) * time.Millisecond
+	step := q.Step
+	if step <= 0 {
+		step = (span / queryAutoPoints).Round(time.Second)
+	}
+	step = max(step, time.Second)
+
+	histMu.Lock()
+	tiers := append([]HistoryTier{{Retention: histRetention}}, rollupTiers...)
+	tier := pickTier(tiers, q.Start, now)
+	step = max(step, tiers[tier].Step)
+	if span/step > queryMaxPoints {
+		histMu.Unlock()
+		return RangeResult{}, fmt.Errorf("%s / step %s is more than %d points; use a larger step", span, step, queryMaxPoints)
+	}
+	keys := make([]string, 0, len(histSeries))
+	for key, s := range histSeries {
+		for _, sel := range q.Selectors {
+			if sel.matches(s) {
+				keys = append(keys, key)
+				break
+			}
+		}
+	}
+	sort.Strings(keys)
+	// 第一个桶从 step 对齐处开始，比 q.Start 早
+	from := q.Start - q.Start%step.Milliseconds()
+	views := make([]seriesView, len(keys))
+	for i, key := range keys {
+		views[i] = histSeries[key].view(tier, from, q.End)
+	}
+	histMu.Unlock()
+
+	// 解码放在锁外，大查询不挡住采集
+	res := RangeResult{Start: q.Start, End: q.End, Step: int64(step / time.Second), Resolution: tierName(tiers[tier].Step), Agg: q.Agg, Series: []Series{}}
+	for _, v := range views {
+		ts, vs, los, his := v.merged()
+		out := aggregate(ts, vs, los, his, q.Start, q.End, step.Milliseconds(), q.Agg)
+		if len(out.T) > 0 {
+			out.Metric, out.Labels = v.metric, v.labels
+			res.Series = append(res.Series, out)
+		}
+	}
+	return res, nil
+}
+
+// pickTier returns the finest of tiers that reaches back to start. 1%
+// short still counts, so "the last 24 hours" doesn't fall to the hourly
+// tier; when none does, the coarsest.
+func pickTier(tiers []HistoryTier, start int64, now time.Time) int {
+	for i, t := range tiers {
+		if start >= now.Add(-t.Retention-t.Retention/100).UnixMilli() {
+			return i
+		}
+	}
+	return len(tiers) - 1
+}
+
+// seriesView is the part of a series a query reads: the chunks of the
+// resolutions from raw up to the queried tier that overlap the query's
+// window. It is taken under histMu and decoded after.
+type seriesView struct {
+	metric     string
+	labels     Labels
+	start, end int64        // unix ms
+	levels     []*chunkRing // raw, then the rollup tiers
+	steps      []int64      // ms per point of each level, 0 for raw
+	firsts     []int64      // each level's oldest point, math.MaxInt64 when empty
+}
+
+// view copies what merging s down from tier over start..end needs. A
+// rollup point covers step from its time, so those start a step earlier.
+func (s *series) view(tier int, start, end int64) seriesView {
+	v := seriesView{metric: s.metric, labels: s.labels, start: start, end: end}
+	for k := 0; k <= tier; k++ {
+		r, step := s.raw, int64(0)
+		if k > 0 {
+			r, step = s.tiers[k-1].ring, s.tiers[k-1].step
+		}
+		first := int64(math.MaxInt64)
+		if !r.empty() {
+			first = r.first()
+		}
+		v.levels = append(v.levels, r.view(start-step, end))
+		v.steps = append(v.steps, step)
+		v.firsts = append(v.firsts, first)
+	}
+	return v
+}
+
+// level decodes one resolution: 0 is the raw points (their own min and
+// max), then the rollup tiers.
+func (v seriesView) level(k int) (ts []int64, vs, los, his []float64, step int64) {
+	step = v.steps[k]
+	ts, cols := v.levels[k].columns(v.start-step, v.end)
+	if k == 0 {
+		return ts, cols[0], cols[0], cols[0], 0
+	}
+	return ts, cols[1], cols[0], cols[2], step
+}
+
+// merged joins the resolutions from the view's tier down to raw: each
+// one's points that end before the next finer one starts, then the finer
+// one from where it left off.
+func (v seriesView) merged() (ts []int64, vs, los, his []float64) {
+	tier := len(v.levels) - 1
+	if tier == 0 {
+		ts, vs, _, _, _ = v.level(0)
+		return ts, vs, vs, vs
+	}
+	from := int64(math.MinInt64)
+	for k := tier; k >= 0; k-- {
+		t, val, lo, hi, step := v.level(k)
+		next := int64(math.MaxInt64)
+		if k > 0 {
+			next = v.firsts[k-1]
+		}
+		for i := range t {
+			if t[i] < from {
+				continue
+			}
+			if t[i]+step > next {
+				break
+			}
+			ts = append(ts, t[i])
+			vs = append(vs, val[i])
+			los = append(los, lo[i])
+			his = append(his, hi[i])
+		}
+		if len(ts) > 0 {
+			from = ts[len(ts)-1] + step
+		}
+	}
+	return ts, vs, los, his
+}
+
+func tierName(step time.Duration) string {
+	switch {
+	case step == 0:
+		return "raw"
+	case step%time.Hour == 0:
+		return strconv.Itoa(int(step/time.Hour)) + "h"
+	case step%time.Minute == 0:
+		return strconv.Itoa(int(step/time.Minute)) + "m"
+	}
+	return strconv.Itoa(int(step/time.Second)) + "s"
+}
+
+// aggregate buckets the points in start..end. Buckets are aligned to
+// multiples of step, so panning doesn't shift them. vs is what avg, p95,
+// last and rate use; los and his are the bucket minimums and maximums
+// (the values themselves for raw points).
+func aggregate(ts []int64, vs, los, his []float64, start, end, step int64, agg string) Series {
+	var out Series
+	lo := sort.Search(len(ts), func(i int) bool { return ts[i] >= start-start%step })
+	hi := sort.Search(len(ts), func(i int) bool { return ts[i] > end })
+	var buf []float64
+	for i := lo; i < hi; {
+		bucket := ts[i] - ts[i]%step
+		j := i
+		for j < hi && ts[j] < bucket+step {
+			j++
+		}
+		var v float64
+		switch agg {
+		case "avg":
+			for k := i; k < j; k++ {
+				v += vs[k]
+			}
+			v /= float64(j - i)
+		case "min":
+			v = math.Inf(1)
+			for k := i; k < j; k++ {
+				v = math.Min(v, los[k])
+			}
+		case "max":
+			v = math.Inf(-1)
+			for k := i; k < j; k++ {
+				v = math.Max(v, his[k])
+			}
+		case "p95":
+			buf = append(buf[:0], vs[i:j]...)
+			sort.Float64s(buf)
+			// nearest rank
+			v = buf[int(math.Ceil(0.95*float64(len(buf))))-1]
+		case "last":
+			v = vs[j-1]
+		case "rate":
+			// 每秒变化量，从上一个桶的最后一个点算起
+			first := i
+			if i > 0 {
+				first = i - 1
+			}
+			if dt := ts[j-1] - ts[first]; dt > 0 {
+				v = (vs[j-1] - vs[first]) / (float64(dt) / 1000)
+			}
+		}
+		out.T = append(out.T, bucket)
+		out.V = append(out.V, v)
+		i = j
+	}
+	return out
+}
+
+// ProcessMetrics are the history metrics of the top processes, by what
+// TopProcesses ranks them on. Each process has a series labelled pid and
+// name, kept only as long as raw points, and each name one labelled name,
+// summed over its processes, which is what the rollups keep.
+var ProcessMetrics = map[string]string{
+	"cpu":    "process_cpu",    // % of one core
+	"memory": "process_memory", // resident bytes
+	"io":     "process_io",     // bytes/s read and written
+}
+
+func isProcessMetric(m string) bool {
+	for _, pm := range ProcessMetrics {
+		if m == pm {
+			return true
+		}
+	}
+	return false
+}
+
+// ProcessUsage is one process's usage over a range. Ranges answered from
+// the rollups are per name, with no PID.
+type ProcessUsage struct {
+	PID     int32      `json:"pid,omitempty"`
+	Name    string     `json:"name"`
+	CPU     UsageStats `json:"cpu"`
+	Memory  UsageStats `json:"memory"`
+	IO      UsageStats `json:"io"`
+	Samples int        `json:"samples"` // how many of the range's samples it was in
+}
+
+// UsageStats sum up one metric of a process. Avg is over all samples of
+// the range, counting those the process wasn't among the top in as 0.
+type UsageStats struct {
+	Avg float64 `json:"avg"`
+	Max float64 `json:"max"`
+}
+
+// TopProcessesResult is the answer to TopProcesses.
+type TopProcessesResult struct {
+	Start      int64          `json:"start"` // unix ms
+	End        int64          `json:"end"`
+	Resolution string         `json:"resolution"`
+	Samples    int            `json:"samples"` // points in time the range has process data for
+	By         string         `json:"by"`
+	Processes  []ProcessUsage `json:"processes"`
+}
+
+// TopProcesses ranks the recorded processes by their average use of by
+// (cpu, memory or io) between start and end (unix ms), and returns the
+// first limit. From raw points they are processes; from the rollups,
+// process names.
+func TopProcesses(start, end int64, by string, limit int, now time.Time) (TopProcessesResult, error) {
+	if _, ok := ProcessMetrics[by]; !ok {
+		return TopProcessesResult{}, errors.New("by must be cpu, memory or io")
+	}
+	if end <= start {
+		return TopProcessesResult{}, errors.New("end must be after start")
+	}
+	histMu.Lock()
+	tiers := append([]HistoryTier{{Retention: histRetention}}, rollupTiers...)
+	tier := pickTier(tiers, start, now)
+	var views []seriesView
+	for _, s := range histSeries {
+		// 原始精度按进程算，汇总精度只有按名字的序列
+		if isProcessMetric(s.metric) && s.perPID == (tier == 0) {
+			views = append(views, s.view(tier, start, end))
+		}
+	}
+	histMu.Unlock()
+
+	type sums struct {
+		usage        ProcessUsage
+		cpu, mem, io float64
+	}
+	procs := make(map[string]*sums)
+	// 采样时刻：哪个进程都不在前几名的时刻算 0，所以平均要除以全部时刻数
+	samples := make(map[int64]bool)
+	for _, s := range views {
+		var sum *float64
+		var stats *UsageStats
+		key := s.labels["pid"] + " " + s.labels["name"]
+		p := procs[key]
+		if p == nil {
+			pid, _ := strconv.ParseInt(s.labels["pid"], 10, 32)
+			p = &sums{usage: ProcessUsage{PID: int32(pid), Name: s.labels["name"]}}
+		}
+		switch s.metric {
+		case ProcessMetrics["cpu"]:
+			sum, stats = &p.cpu, &p.usage.CPU
+		case ProcessMetrics["memory"]:
+			sum, stats = &p.mem, &p.usage.Memory
+		case ProcessMetrics["io"]:
+			sum, stats = &p.io, &p.usage.IO
+		default:
+			continue
+		}
+		ts, vs, _, his := s.merged()
+		n := 0
+		for i := sort.Search(len(ts), func(i int) bool { return ts[i] >= start }); i < len(ts) && ts[i] <= end; i++ {
+			samples[ts[i]] = true
+			*sum += vs[i]
+			stats.Max = max(stats.Max, his[i])
+			n++
+		}
+		if n > 0 {
+			p.usage.Samples = max(p.usage.Samples, n)
+			procs[key] = p
+		}
+	}
+
+	res := TopProcessesResult{Start: start, End: end, Resolution: tierName(tiers[tier].Step), Samples: len(samples), By: by, Processes: []ProcessUsage{}}
+	for _, p := range procs {
+		n := float64(len(samples))
+		p.usage.CPU.Avg, p.usage.Memory.Avg, p.usage.IO.Avg = p.cpu/n, p.mem/n, p.io/n
+		res.Processes = append(res.Processes, p.usage)
+	}
+	rank := func(u ProcessUsage) float64 {
+		switch by {
+		case "memory":
+			return u.Memory.Avg
+		case "io":
+			return u.IO.Avg
+		}
+		return u.CPU.Avg
+	}
+	sort.Slice(res.Processes, func(i, j int) bool {
+		a, b := res.Processes[i], res.Processes[j]
+		if rank(a) != rank(b) {
+			return rank(a) > rank(b)
+		}
+		return a.PID < b.PID
+	})
+	if limit > 0 && len(res.Processes) > limit {
+		res.Processes = res.Processes[:limit]
+	}
+	return res, nil
+}
@@ -0,0 +1,266 @@
+// Copyright (C) 2025 Russell Li (xiaoxinmm)
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Alert notifications. Every channel in the "notifications" config list
+// gets the firing and resolved alerts whose severity it routes, rendered
+// through its template, with retries. See docs/alerts.md.
+
+// ChannelConfig is one entry of the "notifications" config list. Which
+// fields matter depends on Type.
+type ChannelConfig struct {
+	Name         string   `json:"name"`
+	Type         string   `json:"type"`                 // webhook, email, slack, telegram, dingtalk, feishu
+	Severities   []string `json:"severities,omitempty"` // empty: all
+	SkipResolved bool     `json:"skipResolved,omitempty"`
+	Template     string   `json:"template,omitempty"` // text/template for the message
+	Retries      int      `json:"retries,omitempty"`
+
+	URL    string `json:"url,omitempty"`    // webhook, slack, dingtalk, feishu; telegram API base
+	Secret string `json:"secret,omitempty"` // webhook HMAC key; dingtalk/feishu signing secret
+
+	BotToken string `json:"botToken,omitempty"` // telegram
+	ChatID   string `json:"chatId,omitempty"`
+
+	SMTPHost string   `json:"smtpHost,omitempty"` // host:port; 465 means implicit TLS
+	Username string   `json:"username,omitempty"`
+	Password string   `json:"password,omitempty"`
+	From     string   `json:"from,omitempty"`
+	To       []string `json:"to,omitempty"`
+	Subject  string   `json:"subject,omitempty"` // template too
+}
+
+const (
+	defaultNotifyTemplate = `[{{.State | upper}}] {{.Severity}}: {{.Rule}} on {{.Host}}
+{{.Summary}}{{if .FiredAt}}
+fired {{time .FiredAt}}{{end}}{{if .ResolvedAt}}, resolved {{time .ResolvedAt}}{{end}}`
+	defaultNotifySubject = `[sysmon] {{.State}} {{.Severity}}: {{.Rule}} on {{.Host}}`
+
+	notifyQueue = 64
+)
+
+// notifyRetryDelay is the wait before the first retry; it doubles after.
+var notifyRetryDelay = 2 * time.Second
+
+var notifyFuncs = template.FuncMap{
+	"upper": strings.ToUpper,
+	"time": func(ms int64) string {
+		return time.UnixMilli(ms).Format("2006-01-02 15:04:05 MST")
+	},
+}
+
+// notification is what templates see: the alert plus the host.
+type notification struct {
+	alert
+	Host string `json:"host"`
+	Text string `json:"text"` // rendered template, for webhook receivers
+}
+
+// notifier delivers one rendered notification.
+type notifier interface {
+	notify(n notification) error
+}
+
+type channel struct {
+	cfg     ChannelConfig
+	n       notifier
+	text    *template.Template
+	subject *template.Template
+	queue   chan notification
+}
+
+func (c *channel) routes(a alert) bool {
+	switch a.State {
+	case alertFiring:
+	case alertResolved:
+		if c.cfg.SkipResolved {
+			return false
+		}
+	default:
+		return false
+	}
+	return len(c.cfg.Severities) == 0 || containsString(c.cfg.Severities, a.Severity)
+}
+
+func (c *channel) render(a alert, host string) (notification, error) {
+	n := notification{alert: a, Host: host}
+	var b bytes.Buffer
+	if err := c.text.Execute(&b, n); err != nil {
+		return n, err
+	}
+	n.Text = b.String()
+	return n, nil
+}
+
+// deliver tries once plus cfg.Retries more times, waiting longer each time.
+func (c *channel) deliver(n notification) error {
+	var err error
+	for i := 0; i <= c.cfg.Retries; i++ {
+		if i > 0 {
+			time.Sleep(notifyRetryDelay << (i - 1))
+		}
+		if err = c.n.notify(n); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+func (c *channel) run() {
+	for n := range c.queue {
+		if err := c.deliver(n); err != nil {
+			log.Printf("notify %s: %s %s: %v", c.cfg.Name, n.ID, n.State, err)
+		}
+	}
+}
+
+// notifications fans alert transitions out to the channels.
+type notifications struct {
+	host     string
+	channels []*channel
+}
+
+func newNotifications(configs []ChannelConfig, host string) (*notifications, error) {
+	ns := &notifications{host: host}
+	seen := make(map[string]bool)
+	for _, cfg := range configs {
+		if cfg.Name == "" {
+			cfg.Name = cfg.Type
+		}
+		if seen[cfg.Name] {
+			return nil, fmt.Errorf("notifications: duplicate channel name %q", cfg.Name)
+		}
+		seen[cfg.Name] = true
+		for _, s := range cfg.Severities {
+			if !containsString(alertSeverities, s) {
+				return nil, fmt.Errorf("notifications %q: unknown severity %q", cfg.Name, s)
+			}
+		}
+		switch {
+		case cfg.Retries == 0:
+			cfg.Retries = 3
+		case cfg.Retries < 0:
+			cfg.Retries = 0 // -1: 不重试
+		}
+		if cfg.Template == "" {
+			cfg.Template = defaultNotifyTemplate
+		}
+		if cfg.Subject == "" {
+			cfg.Subject = defaultNotifySubject
+		}
+		c := &channel{cfg: cfg, queue: make(chan notification, notifyQueue)}
+		var err error
+		if c.text, err = template.New("text").Funcs(notifyFuncs).Parse(cfg.Template); err != nil {
+			return nil, fmt.Errorf("notifications %q: template: %w", cfg.Name, err)
+		}
+		if c.subject, err = template.New("subject").Funcs(notifyFuncs).Parse(cfg.Subject); err != nil {
+			return nil, fmt.Errorf("notifications %q: subject: %w", cfg.Name, err)
+		}
+		if c.n, err = newNotifier(c); err != nil {
+			return nil, err
+		}
+		ns.channels = append(ns.channels, c)
+	}
+	return ns, nil
+}
+
+func (ns *notifications) start() {
+	for _, c := range ns.channels {
+		go c.run()
+	}
+}
+
+// send queues a for every channel that routes it. A channel that is
+// retrying a dead endpoint loses new notifications once its queue is full.
+func (ns *notifications) send(a alert) {
+	for _, c := range ns.channels {
+		if !c.routes(a) {
+			continue
+		}
+		n, err := c.render(a, ns.host)
+		if err != nil {
+			log.Printf("notify %s: template: %v", c.cfg.Name, err)
+			continue
+		}
+		select {
+		case c.queue <- n:
+		default:
+			log.Printf("notify %s: queue full, dropping %s %s", c.cfg.Name, a.ID, a.State)
+		}
+	}
+}
+
+// channelInfo is what the API shows of a channel; no secrets.
+type channelInfo struct {
+	Name         string   `json:"name"`
+	Type         string   `json:"type"`
+	Severities   []string `json:"severities"`
+	SkipResolved bool     `json:"skipResolved"`
+}
+
+func (ns *notifications) list() []channelInfo {
+	out := make([]channelInfo, 0, len(ns.channels))
+	for _, c := range ns.channels {
+		sev := c.cfg.Severities
+		if len(sev) == 0 {
+			sev = alertSeverities
+		}
+		out = append(out, channelInfo{Name: c.cfg.Name, Type: c.cfg.Type, Severities: sev, SkipResolved: c.cfg.SkipResolved})
+	}
+	return out
+}
+
+// testResult is one channel's answer to a test notification.
+type testResult struct {
+	Channel string `json:"channel"`
+	OK      bool   `json:"ok"`
+	Error   string `json:"error,omitempty"`
+}
+
+// test sends a made-up firing alert to one channel (or all when name is
+// empty) right away, once, ignoring routing, and reports what happened.
+func (ns *notifications) test(name string) ([]testResult, bool) {
+	now := time.Now().UnixMilli()
+	a := alert{
+		ID: "sysmon-test", Rule: "sysmon-test", Metric: "cpu", Severity: "info", State: alertFiring,
+		Summary: "This is a test notification from sysmon.", Since: now, FiredAt: now,
+	}
+	var results []testResult
+	for _, c := range ns.channels {
+		if name != "" && c.cfg.Name != name {
+			continue
+		}
+		r := testResult{Channel: c.cfg.Name, OK: true}
+		n, err := c.render(a, ns.host)
+		if err == nil {
+			err = c.n.notify(n)
+		}
+		if err != nil {
+			r.OK, r.Error = false, err.Error()
+		}
+		results = append(results, r)
+	}
+	return results, len(results) > 0
+}
@@ -0,0 +1,338 @@
+// Copyright (C) 2025 Russell Li (xiaoxinmm)
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/smtp"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The channel types. Chat webhooks get the rendered text; the generic
+// webhook gets the whole alert as JSON, signed when a secret is set.
+
+const notifyTimeout = 10 * time.Second
+
+func newNotifier(c *channel) (notifier, error) {
+	cfg := c.cfg
+	client := &http.Client{Timeout: notifyTimeout}
+	needURL := func() error {
+		if !strings.HasPrefix(cfg.URL, "http://") && !strings.HasPrefix(cfg.URL, "https://") {
+			return fmt.Errorf("notifications %q: %s needs an http(s) url", cfg.Name, cfg.Type)
+		}
+		return nil
+	}
+	switch cfg.Type {
+	case "webhook":
+		if err := needURL(); err != nil {
+			return nil, err
+		}
+		return &webhookNotifier{url: cfg.URL, secret: cfg.Secret, client: client}, nil
+	case "slack":
+		if err := needURL(); err != nil {
+			return nil, err
+		}
+		return &slackNotifier{url: cfg.URL, client: client}, nil
+	case "telegram":
+		if cfg.BotToken == "" || cfg.ChatID == "" {
+			return nil, fmt.Errorf("notifications %q: telegram needs botToken and chatId", cfg.Name)
+		}
+		base := strings.TrimSuffix(cfg.URL, "/")
+		if base == "" {
+			base = "https://api.telegram.org"
+		}
+		return &telegramNotifier{url: base + "/bot" + cfg.BotToken + "/sendMessage", chatID: cfg.ChatID, client: client}, nil
+	case "dingtalk":
+		if err := needURL(); err != nil {
+			return nil, err
+		}
+		return &dingtalkNotifier{url: cfg.URL, secret: cfg.Secret, client: client}, nil
+	case "feishu":
+		if err := needURL(); err != nil {
+			return nil, err
+		}
+		return &feishuNotifier{url: cfg.URL, secret: cfg.Secret, client: client}, nil
+	case "email":
+		if _, _, err := net.SplitHostPort(cfg.SMTPHost); err != nil {
+			return nil, fmt.Errorf("notifications %q: email needs smtpHost as host:port", cfg.Name)
+		}
+		if cfg.From == "" || len(cfg.To) == 0 {
+			return nil, fmt.Errorf("notifications %q: email needs from and to", cfg.Name)
+		}
+		return &emailNotifier{c: c}, nil
+	}
+	return nil, fmt.Errorf("notifications %q: unknown type %q (webhook, email, slack, telegram, dingtalk, feishu)", cfg.Name, cfg.Type)
+}
+
+func hmacSHA256(key, msg []byte) []byte {
+	m := hmac.New(sha256.New, key)
+	m.Write(msg)
+	return m.Sum(nil)
+}
+
+// postJSON posts v and returns the response body; non-2xx is an error.
+func postJSON(client *http.Client, u string, v interface{}) ([]byte, error) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost, u, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	if resp.StatusCode/100 != 2 {
+		if len(msg) > 512 {
+			msg = msg[:512]
+		}
+		return nil, fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	return msg, nil
+}
+
+// webhookNotifier posts the notification as JSON. With a secret, the
+// receiver can check
+//
+//	X-Sysmon-Signature: sha256=hex(HMAC-SHA256(secret, timestamp + "." + body))
+//
+// where timestamp is the X-Sysmon-Timestamp header (unix seconds).
+type webhookNotifier struct {
+	url    string
+	secret string
+	client *http.Client
+}
+
+func (w *webhookNotifier) notify(n notification) error {
+	body, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, w.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Sysmon-Event", n.State)
+	if w.secret != "" {
+		ts := strconv.FormatInt(time.Now().Unix(), 10)
+		req.Header.Set("X-Sysmon-Timestamp", ts)
+		req.Header.Set("X-Sysmon-Signature", "sha256="+hex.EncodeToString(hmacSHA256([]byte(w.secret), []byte(ts+"."+string(body)))))
+	}
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+// slackNotifier posts to a Slack (or Mattermost, Rocket.Chat, ...)
+// incoming webhook.
+type slackNotifier struct {
+	url    string
+	client *http.Client
+}
+
+func (s *slackNotifier) notify(n notification) error {
+	_, err := postJSON(s.client, s.url, map[string]string{"text": n.Text})
+	return err
+}
+
+type telegramNotifier struct {
+	url    string // .../bot<token>/sendMessage
+	chatID string
+	client *http.Client
+}
+
+func (t *telegramNotifier) notify(n notification) error {
+	body, err := postJSON(t.client, t.url, map[string]string{"chat_id": t.chatID, "text": n.Text})
+	if err != nil {
+		// 错误信息里会带上 URL，别把 bot token 打进日志
+		return fmt.Errorf("telegram: %s", strings.ReplaceAll(err.Error(), t.url, "sendMessage"))
+	}
+	var r struct {
+		OK          bool   `json:"ok"`
+		Description string `json:"description"`
+	}
+	if json.Unmarshal(body, &r) == nil && !r.OK {
+		return fmt.Errorf("telegram: %s", r.Description)
+	}
+	return nil
+}
+
+// dingtalkNotifier posts to a DingTalk robot. With a secret ("加签"), the
+// URL gets timestamp and sign parameters.
+type dingtalkNotifier struct {
+	url    string // https://oapi.dingtalk.com/robot/send?access_token=...
+	secret string
+	client *http.Client
+}
+
+func (d *dingtalkNotifier) notify(n notification) error {
+	u := d.url
+	if d.secret != "" {
+		ts := strconv.FormatInt(time.Now().UnixMilli(), 10)
+		sign := base64.StdEncoding.EncodeToString(hmacSHA256([]byte(d.secret), []byte(ts+"\n"+d.secret)))
+		sep := "?"
+		if strings.Contains(u, "?") {
+			sep = "&"
+		}
+		u += sep + "timestamp=" + ts + "&sign=" + url.QueryEscape(sign)
+	}
+	body, err := postJSON(d.client, u, map[string]interface{}{
+		"msgtype": "text",
+		"text":    map[string]string{"content": n.Text},
+	})
+	if err != nil {
+		return err
+	}
+	var r struct {
+		ErrCode int    `json:"errcode"`
+		ErrMsg  string `json:"errmsg"`
+	}
+	if json.Unmarshal(body, &r) == nil && r.ErrCode != 0 {
+		return fmt.Errorf("dingtalk: %d %s", r.ErrCode, r.ErrMsg)
+	}
+	return nil
+}
+
+// feishuNotifier posts to a Feishu / Lark custom bot. With a secret
+// ("签名校验"), the body carries timestamp and sign.
+type feishuNotifier struct {
+	url    string
+	secret string
+	client *http.Client
+}
+
+func (f *feishuNotifier) notify(n notification) error {
+	msg := map[string]interface{}{
+		"msg_type": "text",
+		"content":  map[string]string{"text": n.Text},
+	}
+	if f.secret != "" {
+		ts := strconv.FormatInt(time.Now().Unix(), 10)
+		msg["timestamp"] = ts
+		msg["sign"] = base64.StdEncoding.EncodeToString(hmacSHA256([]byte(ts+"\n"+f.secret), nil))
+	}
+	body, err := postJSON(f.client, f.url, msg)
+	if err != nil {
+		return err
+	}
+	var r struct {
+		Code int    `json:"code"`
+		Msg  string `json:"msg"`
+	}
+	if json.Unmarshal(body, &r) == nil && r.Code != 0 {
+		return fmt.Errorf("feishu: %d %s", r.Code, r.Msg)
+	}
+	return nil
+}
+
+// emailNotifier sends a plain text mail. Port 465 is implicit TLS;
+// otherwise STARTTLS is used when the server offers it. Credentials are
+// only sent over TLS (or to localhost), as net/smtp's PlainAuth insists.
+type emailNotifier struct {
+	c *channel
+}
+
+func (e *emailNotifier) notify(n notification) error {
+	cfg := e.c.cfg
+	var subject bytes.Buffer
+	if err := e.c.subject.Execute(&subject, n); err != nil {
+		return err
+	}
+	host, port, _ := net.SplitHostPort(cfg.SMTPHost)
+
+	var conn net.Conn
+	var err error
+	dialer := &net.Dialer{Timeout: notifyTimeout}
+	if port == "465" {
+		conn, err = tls.DialWithDialer(dialer, "tcp", cfg.SMTPHost, &tls.Config{ServerName: host})
+	} else {
+		conn, err = dialer.Dial("tcp", cfg.SMTPHost)
+	}
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(3 * notifyTimeout))
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	if ok, _ := c.Extension("STARTTLS"); ok && port != "465" {
+		if err := c.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+	if cfg.Username != "" {
+		if err := c.Auth(smtp.PlainAuth("", cfg.Username, cfg.Password, host)); err != nil {
+			return err
+		}
+	}
+	if err := c.Mail(cfg.From); err != nil {
+		return err
+	}
+	for _, to := range cfg.To {
+		if err := c.Rcpt(to); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", cfg.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(cfg.To, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", strings.TrimSpace(subject.String())))
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\nContent-Type: text/plain; charset=utf-8\r\nContent-Transfer-Encoding: 8bit\r\n\r\n")
+	msg.WriteString(strings.ReplaceAll(n.Text, "\n", "\r\n") + "\r\n")
+	if _, err := w.Write(msg.Bytes()); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
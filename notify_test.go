@@ -0,0 +1,470 @@
+// Copyright (C) 2025 Russell Li (xiaoxinmm)
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Every channel type against a local stand-in: httptest servers for the
+// HTTP ones, a scripted SMTP server on a net.Listener for email.
+
+func init() {
+	notifyRetryDelay = time.Millisecond
+}
+
+func testAlert(state string) alert {
+	a := alert{
+		ID: "cpu", Rule: "cpu", Metric: "cpu", Severity: "critical", State: state,
+		Value: 97.5, Threshold: 90, Summary: "cpu 97.5% > 90%", Since: 1700000000000, FiredAt: 1700000060000,
+	}
+	if state == alertResolved {
+		a.ResolvedAt = 1700000120000
+	}
+	return a
+}
+
+func newTestNotifications(t *testing.T, configs ...ChannelConfig) *notifications {
+	t.Helper()
+	ns, err := newNotifications(configs, "web-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ns
+}
+
+// hookServer records the requests it gets. fail is how many to answer
+// with 500 before succeeding.
+type hookServer struct {
+	*httptest.Server
+	mu   sync.Mutex
+	reqs []*http.Request
+	body [][]byte
+	fail int
+	got  chan struct{}
+}
+
+func newHookServer(t *testing.T, fail int, reply string) *hookServer {
+	hs := &hookServer{fail: fail, got: make(chan struct{}, 16)}
+	hs.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		hs.mu.Lock()
+		defer hs.mu.Unlock()
+		hs.reqs = append(hs.reqs, r)
+		hs.body = append(hs.body, body)
+		if hs.fail > 0 {
+			hs.fail--
+			http.Error(w, "try again", http.StatusInternalServerError)
+			return
+		}
+		io.WriteString(w, reply)
+		hs.got <- struct{}{}
+	}))
+	t.Cleanup(hs.Close)
+	return hs
+}
+
+func (hs *hookServer) wait(t *testing.T, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		select {
+		case <-hs.got:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("only %d of %d notifications arrived", i, n)
+		}
+	}
+}
+
+func TestNotifyRouting(t *testing.T) {
+	ns := newTestNotifications(t,
+		ChannelConfig{Name: "all", Type: "slack", URL: "http://x"},
+		ChannelConfig{Name: "crit", Type: "slack", URL: "http://x", Severities: []string{"critical"}, SkipResolved: true},
+		ChannelConfig{Name: "info", Type: "slack", URL: "http://x", Severities: []string{"info"}},
+	)
+	cases := []struct {
+		state, severity string
+		want            string // channels, in order
+	}{
+		{alertFiring, "critical", "all crit"},
+		{alertResolved, "critical", "all"},
+		{alertPending, "critical", ""},
+		{alertFiring, "info", "all info"},
+		{alertFiring, "warning", "all"},
+	}
+	for _, c := range cases {
+		a := testAlert(c.state)
+		a.Severity = c.severity
+		var got []string
+		for _, ch := range ns.channels {
+			if ch.routes(a) {
+				got = append(got, ch.cfg.Name)
+			}
+		}
+		if strings.Join(got, " ") != c.want {
+			t.Errorf("%s %s went to %v, want %q", c.state, c.severity, got, c.want)
+		}
+	}
+
+	if _, err := newNotifications([]ChannelConfig{{Type: "slack", URL: "http://x", Severities: []string{"fatal"}}}, "h"); err == nil {
+		t.Error("unknown severity accepted")
+	}
+	if _, err := newNotifications([]ChannelConfig{{Type: "slack", URL: "http://x"}, {Type: "slack", URL: "http://y"}}, "h"); err == nil {
+		t.Error("duplicate channel name accepted")
+	}
+}
+
+func TestNotifyTemplates(t *testing.T) {
+	ns := newTestNotifications(t,
+		ChannelConfig{Name: "default", Type: "slack", URL: "http://x"},
+		ChannelConfig{Name: "custom", Type: "slack", URL: "http://x", Template: `{{.State | upper}} {{.Rule}}@{{.Host}} {{printf "%.1f" .Value}}`},
+	)
+	fired, err := ns.channels[0].render(testAlert(alertFiring), ns.host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"[FIRING] critical: cpu on web-1", "cpu 97.5% > 90%", "fired 20"} {
+		if !strings.Contains(fired.Text, want) {
+			t.Errorf("firing text %q lacks %q", fired.Text, want)
+		}
+	}
+	if strings.Contains(fired.Text, "resolved") {
+		t.Errorf("firing text mentions resolved: %q", fired.Text)
+	}
+	resolved, _ := ns.channels[0].render(testAlert(alertResolved), ns.host)
+	if !strings.Contains(resolved.Text, "[RESOLVED]") || !strings.Contains(resolved.Text, ", resolved 20") {
+		t.Errorf("resolved text %q", resolved.Text)
+	}
+	custom, _ := ns.channels[1].render(testAlert(alertFiring), ns.host)
+	if custom.Text != "FIRING cpu@web-1 97.5" {
+		t.Errorf("custom template gave %q", custom.Text)
+	}
+
+	if _, err := newNotifications([]ChannelConfig{{Type: "slack", URL: "http://x", Template: "{{.Nope"}}, "h"); err == nil {
+		t.Error("broken template accepted")
+	}
+}
+
+// TestWebhookFireResolve sends a firing and a resolved alert through the
+// queue and checks the receiver can verify both signatures.
+func TestWebhookFireResolve(t *testing.T) {
+	const secret = "s3cret"
+	hs := newHookServer(t, 0, "")
+	ns := newTestNotifications(t, ChannelConfig{Name: "hook", Type: "webhook", URL: hs.URL, Secret: secret})
+	ns.start()
+	ns.send(testAlert(alertFiring))
+	ns.send(testAlert(alertResolved))
+	hs.wait(t, 2)
+
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+	for i, state := range []string{alertFiring, alertResolved} {
+		r, body := hs.reqs[i], hs.body[i]
+		if ev := r.Header.Get("X-Sysmon-Event"); ev != state {
+			t.Errorf("#%d: X-Sysmon-Event %q, want %q", i, ev, state)
+		}
+		ts := r.Header.Get("X-Sysmon-Timestamp")
+		if sec, err := strconv.ParseInt(ts, 10, 64); err != nil || time.Since(time.Unix(sec, 0)) > time.Minute {
+			t.Errorf("#%d: X-Sysmon-Timestamp %q", i, ts)
+		}
+		// what a receiver does: recompute over timestamp.body, compare in constant time
+		m := hmac.New(sha256.New, []byte(secret))
+		m.Write([]byte(ts + "." + string(body)))
+		want := "sha256=" + hex.EncodeToString(m.Sum(nil))
+		if !hmac.Equal([]byte(r.Header.Get("X-Sysmon-Signature")), []byte(want)) {
+			t.Errorf("#%d: signature %q doesn't verify", i, r.Header.Get("X-Sysmon-Signature"))
+		}
+		var n notification
+		if err := json.Unmarshal(body, &n); err != nil {
+			t.Fatal(err)
+		}
+		if n.State != state || n.Host != "web-1" || n.ID != "cpu" || n.Text == "" {
+			t.Errorf("#%d: body %s", i, body)
+		}
+	}
+
+	// unsigned without a secret
+	plain := newHookServer(t, 0, "")
+	ns = newTestNotifications(t, ChannelConfig{Type: "webhook", URL: plain.URL})
+	if r, _ := ns.test(""); !r[0].OK {
+		t.Fatal(r[0].Error)
+	}
+	if plain.reqs[0].Header.Get("X-Sysmon-Signature") != "" {
+		t.Error("signed without a secret")
+	}
+}
+
+func TestNotifyRetry(t *testing.T) {
+	hs := newHookServer(t, 2, "")
+	ns := newTestNotifications(t, ChannelConfig{Type: "slack", URL: hs.URL, Retries: 3})
+	n, _ := ns.channels[0].render(testAlert(alertFiring), ns.host)
+	if err := ns.channels[0].deliver(n); err != nil {
+		t.Fatalf("gave up after retries: %v", err)
+	}
+	if len(hs.reqs) != 3 {
+		t.Errorf("%d attempts, want 3", len(hs.reqs))
+	}
+
+	// retries: -1 means one attempt only, and the error comes back
+	hs = newHookServer(t, 1, "")
+	ns = newTestNotifications(t, ChannelConfig{Type: "slack", URL: hs.URL, Retries: -1})
+	if err := ns.channels[0].deliver(n); err == nil || !strings.Contains(err.Error(), "500") {
+		t.Errorf("err %v, want the 500", err)
+	}
+	if len(hs.reqs) != 1 {
+		t.Errorf("%d attempts, want 1", len(hs.reqs))
+	}
+}
+
+func TestChatSignatures(t *testing.T) {
+	const secret = "SEC123"
+	t.Run("dingtalk", func(t *testing.T) {
+		hs := newHookServer(t, 0, `{"errcode":0,"errmsg":"ok"}`)
+		ns := newTestNotifications(t, ChannelConfig{Type: "dingtalk", URL: hs.URL + "/robot/send?access_token=tok", Secret: secret})
+		if r, _ := ns.test(""); !r[0].OK {
+			t.Fatal(r[0].Error)
+		}
+		q := hs.reqs[0].URL.Query()
+		if q.Get("access_token") != "tok" {
+			t.Errorf("access_token lost: %s", hs.reqs[0].URL)
+		}
+		m := hmac.New(sha256.New, []byte(secret))
+		m.Write([]byte(q.Get("timestamp") + "\n" + secret))
+		if q.Get("sign") != base64.StdEncoding.EncodeToString(m.Sum(nil)) {
+			t.Errorf("sign %q doesn't verify", q.Get("sign"))
+		}
+		var body struct {
+			Msgtype string `json:"msgtype"`
+			Text    struct {
+				Content string `json:"content"`
+			} `json:"text"`
+		}
+		json.Unmarshal(hs.body[0], &body)
+		if body.Msgtype != "text" || !strings.Contains(body.Text.Content, "sysmon-test") {
+			t.Errorf("body %s", hs.body[0])
+		}
+	})
+	t.Run("dingtalk error", func(t *testing.T) {
+		hs := newHookServer(t, 0, `{"errcode":310000,"errmsg":"sign not match"}`)
+		ns := newTestNotifications(t, ChannelConfig{Type: "dingtalk", URL: hs.URL})
+		if r, _ := ns.test(""); r[0].OK || !strings.Contains(r[0].Error, "310000") {
+			t.Errorf("result %+v", r[0])
+		}
+	})
+	t.Run("feishu", func(t *testing.T) {
+		hs := newHookServer(t, 0, `{"code":0}`)
+		ns := newTestNotifications(t, ChannelConfig{Type: "feishu", URL: hs.URL, Secret: secret})
+		if r, _ := ns.test(""); !r[0].OK {
+			t.Fatal(r[0].Error)
+		}
+		var body struct {
+			Timestamp string `json:"timestamp"`
+			Sign      string `json:"sign"`
+			MsgType   string `json:"msg_type"`
+		}
+		json.Unmarshal(hs.body[0], &body)
+		// 飞书的签名：key 是 timestamp + "\n" + secret，消息为空
+		m := hmac.New(sha256.New, []byte(body.Timestamp+"\n"+secret))
+		if body.Sign != base64.StdEncoding.EncodeToString(m.Sum(nil)) || body.MsgType != "text" {
+			t.Errorf("body %s doesn't verify", hs.body[0])
+		}
+	})
+	t.Run("telegram", func(t *testing.T) {
+		hs := newHookServer(t, 0, `{"ok":false,"description":"chat not found"}`)
+		ns := newTestNotifications(t, ChannelConfig{Type: "telegram", URL: hs.URL, BotToken: "123:abc", ChatID: "42"})
+		r, _ := ns.test("")
+		if r[0].OK || !strings.Contains(r[0].Error, "chat not found") {
+			t.Errorf("result %+v", r[0])
+		}
+		if hs.reqs[0].URL.Path != "/bot123:abc/sendMessage" {
+			t.Errorf("path %s", hs.reqs[0].URL.Path)
+		}
+	})
+	t.Run("telegram token not logged", func(t *testing.T) {
+		hs := newHookServer(t, 1, "")
+		ns := newTestNotifications(t, ChannelConfig{Type: "telegram", URL: hs.URL, BotToken: "123:abc", ChatID: "42"})
+		r, _ := ns.test("")
+		if r[0].OK || strings.Contains(r[0].Error, "123:abc") {
+			t.Errorf("result %+v", r[0])
+		}
+	})
+}
+
+// smtpServer is a scripted SMTP server: enough of RFC 5321 for net/smtp,
+// with AUTH PLAIN. It records each mail.
+type smtpServer struct {
+	ln    net.Listener
+	mu    sync.Mutex
+	mails []smtpMail
+	got   chan struct{}
+	// rejectRcpt makes RCPT TO fail for this many mails
+	rejectRcpt int
+}
+
+type smtpMail struct {
+	auth string // decoded AUTH PLAIN
+	from string
+	to   []string
+	data string
+}
+
+func newSMTPServer(t *testing.T) *smtpServer {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &smtpServer{ln: ln, got: make(chan struct{}, 16)}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *smtpServer) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	reply := func(line string) { io.WriteString(conn, line+"\r\n") }
+	reply("220 stand-in ESMTP")
+	var m smtpMail
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		cmd := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+		switch cmd {
+		case "EHLO", "HELO":
+			reply("250-stand-in")
+			reply("250 AUTH PLAIN")
+		case "AUTH":
+			f := strings.Fields(line)
+			if len(f) != 3 || f[1] != "PLAIN" {
+				reply("504 unsupported")
+				continue
+			}
+			b, _ := base64.StdEncoding.DecodeString(f[2])
+			m.auth = string(b)
+			reply("235 ok")
+		case "MAIL":
+			m.from = strings.TrimSuffix(strings.TrimPrefix(line[len("MAIL FROM:"):], "<"), ">")
+			reply("250 ok")
+		case "RCPT":
+			s.mu.Lock()
+			reject := s.rejectRcpt > 0
+			if reject {
+				s.rejectRcpt--
+			}
+			s.mu.Unlock()
+			if reject {
+				reply("451 try later")
+				continue
+			}
+			m.to = append(m.to, strings.TrimSuffix(strings.TrimPrefix(line[len("RCPT TO:"):], "<"), ">"))
+			reply("250 ok")
+		case "DATA":
+			reply("354 go on")
+			var data strings.Builder
+			for {
+				l, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if l == ".\r\n" {
+					break
+				}
+				data.WriteString(l)
+			}
+			m.data = data.String()
+			s.mu.Lock()
+			s.mails = append(s.mails, m)
+			s.mu.Unlock()
+			s.got <- struct{}{}
+			m = smtpMail{}
+			reply("250 queued")
+		case "RSET":
+			m = smtpMail{}
+			reply("250 ok")
+		case "QUIT":
+			reply("221 bye")
+			return
+		default:
+			reply("502 what")
+		}
+	}
+}
+
+func TestEmailFireResolve(t *testing.T) {
+	srv := newSMTPServer(t)
+	srv.rejectRcpt = 1 // 第一次投递失败，重试后成功
+	ns := newTestNotifications(t, ChannelConfig{
+		Name: "mail", Type: "email", SMTPHost: srv.ln.Addr().String(),
+		Username: "bot", Password: "pw", From: "sysmon@example.com", To: []string{"ops@example.com", "dev@example.com"},
+	})
+	ns.start()
+	ns.send(testAlert(alertFiring))
+	ns.send(testAlert(alertResolved))
+	for i := 0; i < 2; i++ {
+		select {
+		case <-srv.got:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("only %d of 2 mails arrived", i)
+		}
+	}
+
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	for i, state := range []string{alertFiring, alertResolved} {
+		m := srv.mails[i]
+		if m.auth != "\x00bot\x00pw" {
+			t.Errorf("#%d: AUTH PLAIN %q", i, m.auth)
+		}
+		if m.from != "sysmon@example.com" || strings.Join(m.to, ",") != "ops@example.com,dev@example.com" {
+			t.Errorf("#%d: envelope %s -> %v", i, m.from, m.to)
+		}
+		subject := "Subject: [sysmon] " + state + " critical: cpu on web-1\r\n"
+		if !strings.Contains(m.data, subject) {
+			t.Errorf("#%d: no %q in\n%s", i, subject, m.data)
+		}
+		head, body, ok := strings.Cut(m.data, "\r\n\r\n")
+		if !ok || !strings.Contains(head, "Content-Type: text/plain; charset=utf-8") {
+			t.Errorf("#%d: headers\n%s", i, head)
+		}
+		if !strings.Contains(body, "["+strings.ToUpper(state)+"] critical: cpu on web-1\r\ncpu 97.5% > 90%") {
+			t.Errorf("#%d: body\n%s", i, body)
+		}
+	}
+}
@@ -0,0 +1,301 @@
+// Copyright (C) 2025 Russell Li (xiaoxinmm)
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"sysmon/monitor"
+)
+
+// apiVersion is the version of the REST API and message formats in the
+// OpenAPI document. Bump it on breaking changes.
+const apiVersion = "1.0.0"
+
+type apiError struct {
+	Error string `json:"error"`
+}
+
+type loginRequest struct {
+	Password string `json:"password"`
+}
+
+type loginResponse struct {
+	Token string `json:"token"`
+}
+
+func jsonContent(schema jsonSchema) jsonSchema {
+	return jsonSchema{"application/json": jsonSchema{"schema": schema}}
+}
+
+func queryParam(name, description string, schema jsonSchema) jsonSchema {
+	return jsonSchema{"name": name, "in": "query", "description": description, "schema": schema}
+}
+
+// openAPIDoc builds the OpenAPI 3.1 description of the HTTP API. The
+// websocket messages are included under components/schemas as
+// <Type>Message so code generators pick them up too.
+func openAPIDoc() jsonSchema {
+	g := newSchemaGen("#/components/schemas/")
+
+	errResp := func(description string) jsonSchema {
+		return jsonSchema{"description": description, "content": jsonContent(g.of(apiError{}))}
+	}
+	ok := func(description string, v interface{}) jsonSchema {
+		return jsonSchema{"description": description, "content": jsonContent(g.of(v))}
+	}
+	get := func(summary string, params []jsonSchema, resp jsonSchema) jsonSchema {
+		op := jsonSchema{
+			"summary": summary,
+			"responses": jsonSchema{
+				"200": resp,
+				"401": errResp("Not authenticated"),
+			},
+		}
+		if len(params) > 0 {
+			op["parameters"] = params
+		}
+		return jsonSchema{"get": op}
+	}
+	timeParam := jsonSchema{"type": "string", "description": "unix seconds or RFC 3339"}
+
+	var sections []string
+	var sectionSchemas []jsonSchema
+	for _, c := range monitor.Collectors() {
+		sections = append(sections, c.Name())
+		if v, ok := builtinSection(Snapshot{}, c.Name()); ok {
+			sectionSchemas = append(sectionSchemas, g.of(v))
+		}
+	}
+	sectionSchema := jsonSchema{"oneOf": sectionSchemas}
+	if len(sections) > len(sectionSchemas) {
+		// 其他 collector 的 section 没有类型可查
+		sectionSchema = jsonSchema{"anyOf": append(sectionSchemas, jsonSchema{})}
+	}
+
+	paths := jsonSchema{
+		"/api/v1/snapshot": get("Current snapshot", nil, ok("Snapshot", Snapshot{})),
+		"/api/v1/snapshot/{section}": get("One section of the current snapshot", []jsonSchema{
+			{"name": "section", "in": "path", "required": true, "schema": jsonSchema{"enum": sections}},
+		}, jsonSchema{"description": "Section", "content": jsonContent(sectionSchema)}),
+		"/api/v1/collectors": get("Snapshot collectors: which sections there are, which are on, and the last error", nil, ok("Collectors", []CollectorStatus{})),
+		"/api/v1/history": get("History: CPU and memory points, or with metric, any series", []jsonSchema{
+			queryParam("from", "Start of the range", timeParam),
+			queryParam("to", "End of the range", timeParam),
+			queryParam("metric", "Comma-separated metric names (* for all); returns series instead of points", jsonSchema{"type": "string"}),
+			queryParam("resolution", "With metric: raw points, or 1m / 1h min/avg/max rollups", jsonSchema{"enum": []string{"raw", "1m", "1h"}}),
+			queryParam("core", "Only series with this core label", jsonSchema{"type": "string"}),
+			queryParam("mountpoint", "Only series with this mountpoint label", jsonSchema{"type": "string"}),
+			queryParam("interface", "Only series with this interface label", jsonSchema{"type": "string"}),
+			queryParam("container", "Only series with this container label", jsonSchema{"type": "string"}),
+			queryParam("pid", "Only series with this pid label (process_* metrics)", jsonSchema{"type": "string"}),
+			queryParam("name", "Only series with this process name label (process_* metrics)", jsonSchema{"type": "string"}),
+			queryParam("source", "Only series with this source label (imported history)", jsonSchema{"type": "string"}),
+		}, jsonSchema{"description": "History points or series, oldest first", "content": jsonContent(jsonSchema{"oneOf": []jsonSchema{
+			g.of([]monitor.HistoryPoint{}), g.of([]monitor.Series{}),
+		}})}),
+		"/api/v1/query": get("Range query over history: selected series, one aggregated value per step", []jsonSchema{
+			queryParam("select", `Series selector, repeatable: metric (glob), optionally with label matchers, e.g. disk{mountpoint!="/boot"} or cpu_core{core=~"[0-3]"}`, jsonSchema{"type": "string"}),
+			queryParam("start", "Start of the range; default an hour before end", timeParam),
+			queryParam("end", "End of the range; default now", timeParam),
+			queryParam("step", "Bucket width, e.g. 30s, 5m (or seconds); default about 600 points", jsonSchema{"type": "string"}),
+			queryParam("agg", "Aggregation per bucket", jsonSchema{"enum": monitor.QueryAggs}),
+		}, ok("Query result", monitor.RangeResult{})),
+		"/api/v1/history/processes": get("Top processes over a time range, from the process history", []jsonSchema{
+			queryParam("start", "Start of the range; default an hour before end", timeParam),
+			queryParam("end", "End of the range; default now", timeParam),
+			queryParam("by", "What to rank by: average over the range", jsonSchema{"enum": []string{"cpu", "memory", "io"}}),
+			queryParam("limit", "Maximum number of processes; default 10, 0 for all", jsonSchema{"type": "integer", "minimum": 0}),
+		}, ok("Top processes", monitor.TopProcessesResult{})),
+		"/api/v1/history/export": get("Download history as a file, one row per point: time, metric, labels, step, value, min, max", []jsonSchema{
+			queryParam("format", "File format; default csv", jsonSchema{"enum": historyFormats}),
+			queryParam("select", "Series selector, repeatable, as for /api/v1/query; default all series", jsonSchema{"type": "string"}),
+			queryParam("start", "Start of the range; default the oldest point", timeParam),
+			queryParam("end", "End of the range; default now", timeParam),
+			queryParam("resolution", "Raw points, or 1m / 1h min/avg/max rollups", jsonSchema{"enum": []string{"raw", "1m", "1h"}}),
+		}, jsonSchema{"description": "The file", "content": jsonSchema{
+			"text/csv":                       jsonSchema{"schema": jsonSchema{"type": "string"}},
+			"application/x-ndjson":           jsonSchema{"schema": jsonSchema{"type": "string"}},
+			"application/vnd.apache.parquet": jsonSchema{"schema": jsonSchema{"type": "string", "format": "binary"}},
+		}}),
+		"/api/v1/history/import": jsonSchema{"post": jsonSchema{
+			"summary": "Add an exported history file to the store",
+			"parameters": []jsonSchema{
+				queryParam("format", "File format; guessed from the content when missing", jsonSchema{"enum": historyFormats}),
+				queryParam("source", "Add the label source=<this> to every imported series", jsonSchema{"type": "string"}),
+			},
+			"requestBody": jsonSchema{"required": true, "content": jsonSchema{
+				"text/csv":                       jsonSchema{"schema": jsonSchema{"type": "string"}},
+				"application/x-ndjson":           jsonSchema{"schema": jsonSchema{"type": "string"}},
+				"application/vnd.apache.parquet": jsonSchema{"schema": jsonSchema{"type": "string", "format": "binary"}},
+			}},
+			"responses": jsonSchema{
+				"200": ok("What was imported", monitor.ImportStats{}),
+				"400": errResp("The file could not be read"),
+				"401": errResp("Not authenticated"),
+				"413": errResp("The file is larger than 256 MiB"),
+			},
+		}},
+		"/api/v1/history/series": get("Stored history series", nil, ok("Series without points", []monitor.SeriesInfo{})),
+		"/api/v1/processes": get("All processes", []jsonSchema{
+			queryParam("sort", "Sort column", jsonSchema{"enum": []string{"cpu", "mem", "pid", "name"}}),
+			queryParam("order", "Sort order", jsonSchema{"enum": []string{"asc", "desc"}}),
+			queryParam("limit", "Maximum number of processes", jsonSchema{"type": "integer", "minimum": 0}),
+			queryParam("name", "Case-insensitive name substring", jsonSchema{"type": "string"}),
+			queryParam("status", "Exact process status", jsonSchema{"type": "string"}),
+			queryParam("minCpu", "Minimum CPU usage (%)", jsonSchema{"type": "number"}),
+		}, ok("Processes", []monitor.ProcessInfo{})),
+		"/api/v1/containers":   get("Docker containers", nil, ok("Containers", []monitor.DockerContainer{})),
+		"/api/v1/alerts":       get("Active and recently resolved alerts", nil, ok("Alerts", alertsResponse{})),
+		"/api/v1/alerts/rules": get("Configured alert rules", nil, ok("Rules", []AlertRule{})),
+		"/api/v1/alerts/ack": jsonSchema{"post": jsonSchema{
+			"summary": "Acknowledge a firing alert; it sends no more notifications",
+			"parameters": []jsonSchema{
+				{"name": "id", "in": "query", "required": true, "schema": jsonSchema{"type": "string"}},
+			},
+			"requestBody": jsonSchema{"content": jsonContent(g.of(ackRequest{}))},
+			"responses": jsonSchema{
+				"200": ok("The acknowledged alert", alert{}),
+				"401": errResp("Not authenticated"),
+				"404": errResp("No such active alert"),
+				"409": errResp("The alert is not firing"),
+			},
+		}},
+		"/api/v1/silences": jsonSchema{
+			"get": get("Current and upcoming silences", nil, ok("Silences", []Silence{}))["get"],
+			"post": jsonSchema{
+				"summary":     "Create a silence",
+				"requestBody": jsonSchema{"required": true, "content": jsonContent(g.of(silenceRequest{}))},
+				"responses": jsonSchema{
+					"201": ok("The new silence", Silence{}),
+					"400": errResp("Invalid silence"),
+					"401": errResp("Not authenticated"),
+				},
+			},
+		},
+		"/api/v1/silences/{id}": jsonSchema{"delete": jsonSchema{
+			"summary": "Remove a silence",
+			"parameters": []jsonSchema{
+				{"name": "id", "in": "path", "required": true, "schema": jsonSchema{"type": "string"}},
+			},
+			"responses": jsonSchema{
+				"204": jsonSchema{"description": "Removed"},
+				"401": errResp("Not authenticated"),
+				"404": errResp("No such silence"),
+			},
+		}},
+		"/api/v1/maintenance":   get("Maintenance windows and whether they are active", nil, ok("Windows", []maintenanceStatus{})),
+		"/api/v1/forecast":      get("Capacity trends and time until full, soonest first", nil, ok("Forecasts", []forecast{})),
+		"/api/v1/anomalies":     get("Anomaly scores per series, most unusual first", nil, ok("Scores", []anomalyScore{})),
+		"/api/v1/notifications": get("Notification channels", nil, ok("Channels", []channelInfo{})),
+		"/api/v1/notifications/test": jsonSchema{"post": jsonSchema{
+			"summary": "Send a test notification now, once, and report each channel's result",
+			"parameters": []jsonSchema{
+				queryParam("channel", "Channel name; all channels when omitted", jsonSchema{"type": "string"}),
+			},
+			"responses": jsonSchema{
+				"200": ok("Results", []testResult{}),
+				"401": errResp("Not authenticated"),
+				"403": errResp("Cross-origin request"),
+				"404": errResp("No such channel"),
+			},
+		}},
+		"/api/stream": get("Live message stream (Server-Sent Events)", []jsonSchema{
+			{"name": "Last-Event-ID", "in": "header", "schema": jsonSchema{"type": "string"}},
+			queryParam("topics", "Comma-separated topics", jsonSchema{"type": "string"}),
+			queryParam("interval", "Per-client interval (ms)", jsonSchema{"type": "integer"}),
+			queryParam("procs", "Maximum processes per snapshot", jsonSchema{"type": "integer"}),
+			queryParam("mode", "delta for delta mode", jsonSchema{"enum": []string{"delta"}}),
+		}, jsonSchema{
+			"description": "Event stream; each event's data is one websocket message",
+			"content":     jsonSchema{"text/event-stream": jsonSchema{"schema": jsonSchema{"type": "string"}}},
+		}),
+		"/metrics": jsonSchema{"get": jsonSchema{
+			"summary": "Prometheus metrics (text format 0.0.4, or OpenMetrics via Accept)",
+			"responses": jsonSchema{
+				"200": jsonSchema{
+					"description": "Metrics",
+					"content":     jsonSchema{"text/plain": jsonSchema{"schema": jsonSchema{"type": "string"}}},
+				},
+				"401": jsonSchema{"description": "Not authenticated; see metricsToken and metricsAllow"},
+			},
+		}},
+		"/login": jsonSchema{"post": jsonSchema{
+			"summary":     "Exchange the password for a token",
+			"security":    []jsonSchema{},
+			"requestBody": jsonSchema{"required": true, "content": jsonContent(g.of(loginRequest{}))},
+			"responses": jsonSchema{
+				"200": ok("Token, valid for 24 hours", loginResponse{}),
+				"401": jsonSchema{"description": "Wrong password"},
+			},
+		}},
+	}
+
+	var messages []jsonSchema
+	for _, m := range serverMessages {
+		name := strings.ToUpper(m.Type[:1]) + m.Type[1:] + "Message"
+		g.defs[name] = g.wsMessageSchema(m)
+		messages = append(messages, g.ref(name))
+	}
+	g.defs["ServerMessage"] = jsonSchema{"oneOf": messages, "description": "Any message sent on /ws or /api/stream"}
+	g.defs["ControlMessage"] = g.controlSchema()
+
+	return jsonSchema{
+		"openapi": "3.1.0",
+		"info": jsonSchema{
+			"title":       "sysmon",
+			"version":     apiVersion,
+			"description": "System monitor API. Live data is also pushed over the /ws websocket; see ServerMessage and ControlMessage.",
+		},
+		"paths": paths,
+		"components": jsonSchema{
+			"schemas": g.defs,
+			"securitySchemes": jsonSchema{
+				"bearer": jsonSchema{"type": "http", "scheme": "bearer"},
+				"cookie": jsonSchema{"type": "apiKey", "in": "cookie", "name": "sysmon_token"},
+				"query":  jsonSchema{"type": "apiKey", "in": "query", "name": "token"},
+			},
+		},
+		"security": []jsonSchema{{"bearer": []string{}}, {"cookie": []string{}}, {"query": []string{}}},
+	}
+}
+
+// handleOpenAPI serves /api/openapi.json. It describes the API only, no
+// host data, so it is public: code generators can fetch it without a token.
+func handleOpenAPI(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, openAPIDoc())
+}
+
+// handleSchema serves /api/schema/ (the list) and /api/schema/<type>.json.
+func handleSchema(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/api/schema/")
+	if name == "" {
+		index := make(map[string]string)
+		for _, n := range messageSchemaNames() {
+			index[n] = "/api/schema/" + n + ".json"
+		}
+		writeJSON(w, http.StatusOK, index)
+		return
+	}
+	s, ok := messageSchema(strings.TrimSuffix(name, ".json"))
+	if !ok {
+		writeError(w, http.StatusNotFound, "unknown message type")
+		return
+	}
+	w.Header().Set("Content-Type", "application/schema+json")
+	writeJSON(w, http.StatusOK, s)
+}
@@ -0,0 +1,356 @@
+// Copyright (C) 2025 Russell Li (xiaoxinmm)
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// The schemas are generated from the Go types, so these tests check the
+// generator against what encoding/json really produces, and the lists the
+// schemas are built from (serverMessages, the OpenAPI paths) against the
+// code that sends messages and routes requests.
+
+// generic turns v into what json.Unmarshal gives for its encoding.
+func generic(t *testing.T, v interface{}) interface{} {
+	t.Helper()
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out interface{}
+	if err := json.Unmarshal(data, &out); err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+// validator checks JSON values against the subset of JSON Schema that
+// schema.go emits.
+type validator struct {
+	prefix string
+	defs   map[string]interface{}
+}
+
+func (vd validator) check(path string, v interface{}, s map[string]interface{}) []string {
+	if ref, ok := s["$ref"].(string); ok {
+		def, ok := vd.defs[strings.TrimPrefix(ref, vd.prefix)].(map[string]interface{})
+		if !ok {
+			return []string{path + ": dangling $ref " + ref}
+		}
+		return vd.check(path, v, def)
+	}
+	for _, key := range []string{"oneOf", "anyOf"} {
+		alts, ok := s[key].([]interface{})
+		if !ok {
+			continue
+		}
+		var errs []string
+		for _, alt := range alts {
+			e := vd.check(path, v, alt.(map[string]interface{}))
+			if len(e) == 0 {
+				return nil
+			}
+			errs = append(errs, e...)
+		}
+		return append([]string{path + ": matches no " + key}, errs...)
+	}
+	if c, ok := s["const"]; ok && !reflect.DeepEqual(c, v) {
+		return []string{fmt.Sprintf("%s: %v is not %v", path, v, c)}
+	}
+	if enum, ok := s["enum"].([]interface{}); ok {
+		found := false
+		for _, e := range enum {
+			found = found || reflect.DeepEqual(e, v)
+		}
+		if !found {
+			return []string{fmt.Sprintf("%s: %v not in %v", path, v, enum)}
+		}
+	}
+	if typ, ok := s["type"]; ok {
+		var types []interface{}
+		switch typ := typ.(type) {
+		case string:
+			types = []interface{}{typ}
+		case []interface{}:
+			types = typ
+		}
+		match := false
+		for _, want := range types {
+			match = match || jsonType(v, want.(string))
+		}
+		if !match {
+			return []string{fmt.Sprintf("%s: %T is not %v", path, v, typ)}
+		}
+	}
+
+	var errs []string
+	switch v := v.(type) {
+	case map[string]interface{}:
+		props, _ := s["properties"].(map[string]interface{})
+		req, _ := s["required"].([]interface{})
+		for _, r := range req {
+			if _, ok := v[r.(string)]; !ok {
+				errs = append(errs, path+": missing "+r.(string))
+			}
+		}
+		for k, fv := range v {
+			if ps, ok := props[k].(map[string]interface{}); ok {
+				errs = append(errs, vd.check(path+"."+k, fv, ps)...)
+				continue
+			}
+			switch extra := s["additionalProperties"].(type) {
+			case bool:
+				if !extra {
+					errs = append(errs, path+": unexpected field "+k)
+				}
+			case map[string]interface{}:
+				errs = append(errs, vd.check(path+"."+k, fv, extra)...)
+			}
+		}
+	case []interface{}:
+		if items, ok := s["items"].(map[string]interface{}); ok {
+			for i, iv := range v {
+				errs = append(errs, vd.check(path+"["+strconv.Itoa(i)+"]", iv, items)...)
+			}
+		}
+	}
+	return errs
+}
+
+func jsonType(v interface{}, typ string) bool {
+	switch typ {
+	case "object":
+		_, ok := v.(map[string]interface{})
+		return ok
+	case "array":
+		_, ok := v.([]interface{})
+		return ok
+	case "string":
+		_, ok := v.(string)
+		return ok
+	case "boolean":
+		_, ok := v.(bool)
+		return ok
+	case "number":
+		_, ok := v.(float64)
+		return ok
+	case "integer":
+		f, ok := v.(float64)
+		return ok && f == math.Trunc(f)
+	case "null":
+		return v == nil
+	}
+	return false
+}
+
+func messageValidator(t *testing.T, name string) (validator, map[string]interface{}) {
+	t.Helper()
+	s, ok := messageSchema(name)
+	if !ok {
+		t.Fatalf("no schema for %q", name)
+	}
+	g := generic(t, s).(map[string]interface{})
+	defs, _ := g["$defs"].(map[string]interface{})
+	return validator{prefix: "#/$defs/", defs: defs}, g
+}
+
+func TestServerMessagesMatchSchemas(t *testing.T) {
+	live := collect(5)
+	for _, m := range serverMessages {
+		vd, s := messageValidator(t, m.Type)
+		payloads := []interface{}{m.Payload}
+		if m.Alt != nil {
+			payloads = append(payloads, m.Alt)
+		}
+		if m.Type == "snapshot" {
+			// 真实快照，字段都有值，也覆盖 MarshalJSON
+			payloads = append(payloads, live)
+			if gen, err := toGeneric(live); err == nil {
+				payloads = append(payloads, gen)
+			}
+		}
+		for i, p := range payloads {
+			msg := wsMessage{Type: m.Type, Payload: p}
+			if m.HasSeq {
+				msg.Seq = 1
+			}
+			for _, e := range vd.check(fmt.Sprintf("%s#%d", m.Type, i), generic(t, msg), s) {
+				t.Error(e)
+			}
+		}
+	}
+}
+
+func TestSnapshotWithoutSectionsMatchesSchema(t *testing.T) {
+	snap := Snapshot{Timestamp: 1}
+	snap.setSection("cpu", collect(5).CPU)
+	snap.setSection("gpu", map[string]float64{"util": 1})
+	vd, s := messageValidator(t, "snapshot")
+	for _, e := range vd.check("snapshot", generic(t, wsMessage{Type: "snapshot", Payload: snap}), s) {
+		t.Error(e)
+	}
+	got := generic(t, snap).(map[string]interface{})
+	var keys []string
+	for k := range got {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	if strings.Join(keys, ",") != "cpu,gpu,timestamp" {
+		t.Errorf("sections = %v", keys)
+	}
+}
+
+// TestMessageTypesDeclared finds every wsMessage{Type: "..."} in the
+// sources and checks serverMessages has it.
+func TestMessageTypesDeclared(t *testing.T) {
+	declared := make(map[string]bool)
+	for _, m := range serverMessages {
+		declared[m.Type] = true
+	}
+	files, _ := filepath.Glob("*.go")
+	fset := token.NewFileSet()
+	seen := 0
+	for _, file := range files {
+		if strings.HasSuffix(file, "_test.go") {
+			continue
+		}
+		f, err := parser.ParseFile(fset, file, nil, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ast.Inspect(f, func(n ast.Node) bool {
+			lit, ok := n.(*ast.CompositeLit)
+			if !ok {
+				return true
+			}
+			if id, ok := lit.Type.(*ast.Ident); !ok || id.Name != "wsMessage" {
+				return true
+			}
+			for _, elt := range lit.Elts {
+				kv, ok := elt.(*ast.KeyValueExpr)
+				if !ok || kv.Key.(*ast.Ident).Name != "Type" {
+					continue
+				}
+				if bl, ok := kv.Value.(*ast.BasicLit); ok {
+					typ, _ := strconv.Unquote(bl.Value)
+					seen++
+					if !declared[typ] {
+						t.Errorf("%s: message type %q is sent but not in serverMessages", fset.Position(bl.Pos()), typ)
+					}
+				}
+			}
+			return true
+		})
+	}
+	if seen == 0 {
+		t.Fatal("found no wsMessage literals")
+	}
+}
+
+var pathParam = regexp.MustCompile(`\{[^}]+\}`)
+
+func TestAPIPathsDocumented(t *testing.T) {
+	doc := generic(t, openAPIDoc()).(map[string]interface{})
+	paths := doc["paths"].(map[string]interface{})
+
+	// 每个 /api/v1 路径在 OpenAPI 里的方法和 apiMethods 一致
+	for p, item := range paths {
+		if !strings.HasPrefix(p, "/api/v1/") {
+			continue
+		}
+		var documented []string
+		for method := range item.(map[string]interface{}) {
+			documented = append(documented, strings.ToUpper(method))
+		}
+		sort.Strings(documented)
+		route := pathParam.ReplaceAllString(strings.TrimPrefix(p, "/api/v1/"), "x")
+		routed := append([]string(nil), apiMethods(route)...)
+		sort.Strings(routed)
+		if !reflect.DeepEqual(documented, routed) {
+			t.Errorf("%s: documented %v, routed %v", p, documented, routed)
+		}
+	}
+
+	// the index at /api/v1/ lists only documented endpoints, and all of
+	// them apart from ones addressed by id
+	rec := httptest.NewRecorder()
+	handleAPIv1(defaultConfig())(rec, httptest.NewRequest(http.MethodGet, "/api/v1/", nil))
+	var index struct {
+		Endpoints []string `json:"endpoints"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &index); err != nil {
+		t.Fatal(err)
+	}
+	listed := make(map[string]bool)
+	for _, e := range index.Endpoints {
+		p := e[strings.LastIndex(e, " ")+1:]
+		listed[p] = true
+		if _, ok := paths[p]; !ok {
+			t.Errorf("index lists %s, OpenAPI doesn't", e)
+		}
+	}
+	for p := range paths {
+		if strings.HasPrefix(p, "/api/v1/") && !listed[p] && !strings.HasSuffix(p, "{id}") {
+			t.Errorf("OpenAPI has %s, the index doesn't", p)
+		}
+	}
+}
+
+// TestSnapshotEndpointMatchesOpenAPI validates a live /api/v1/snapshot
+// response against its OpenAPI schema.
+func TestSnapshotEndpointMatchesOpenAPI(t *testing.T) {
+	doc := generic(t, openAPIDoc()).(map[string]interface{})
+	defs := doc["components"].(map[string]interface{})["schemas"].(map[string]interface{})
+	vd := validator{prefix: "#/components/schemas/", defs: defs}
+	op := doc["paths"].(map[string]interface{})["/api/v1/snapshot"].(map[string]interface{})["get"].(map[string]interface{})
+	schema := op["responses"].(map[string]interface{})["200"].(map[string]interface{})["content"].(map[string]interface{})["application/json"].(map[string]interface{})["schema"].(map[string]interface{})
+
+	rec := httptest.NewRecorder()
+	handleAPIv1(defaultConfig())(rec, httptest.NewRequest(http.MethodGet, "/api/v1/snapshot", nil))
+	var body interface{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range vd.check("snapshot", body, schema) {
+		t.Error(e)
+	}
+}
+
+func TestSchemaContentType(t *testing.T) {
+	rec := httptest.NewRecorder()
+	handleSchema(rec, httptest.NewRequest(http.MethodGet, "/api/schema/snapshot.json", nil))
+	if ct := rec.Header().Get("Content-Type"); ct != "application/schema+json" {
+		t.Errorf("Content-Type = %q", ct)
+	}
+	if rec.Code != http.StatusOK {
+		t.Errorf("status %d", rec.Code)
+	}
+}
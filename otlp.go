@@ -0,0 +1,361 @@
+// Copyright (C) 2025 Russell Li (xiaoxinmm)
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"sysmon/monitor"
+)
+
+// OTLP metrics push. The same metric families /metrics serves are sent to
+// an OpenTelemetry collector every otlpInterval. Protobuf is hand-encoded
+// (otlp_proto.go) so neither the OTel SDK nor grpc-go is needed.
+// See docs/metrics.md.
+
+const (
+	otlpHTTPProtobuf = "http/protobuf"
+	otlpHTTPJSON     = "http/json"
+	otlpGRPC         = "grpc"
+
+	otlpTimeout    = 10 * time.Second
+	otlpMinBackoff = time.Second
+	otlpMaxBackoff = time.Minute
+)
+
+// The OTLP data model, just the parts sysmon uses. The json tags give the
+// OTLP/JSON encoding: lowerCamelCase names, 64-bit integers as strings.
+
+type otlpRequest struct {
+	ResourceMetrics []otlpResourceMetrics `json:"resourceMetrics"`
+}
+
+type otlpResourceMetrics struct {
+	Resource     otlpResource       `json:"resource"`
+	ScopeMetrics []otlpScopeMetrics `json:"scopeMetrics"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpScopeMetrics struct {
+	Scope   otlpScope    `json:"scope"`
+	Metrics []otlpMetric `json:"metrics"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpKeyValue struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+type otlpAnyValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+type otlpMetric struct {
+	Name        string     `json:"name"`
+	Description string     `json:"description,omitempty"`
+	Gauge       *otlpGauge `json:"gauge,omitempty"`
+	Sum         *otlpSum   `json:"sum,omitempty"`
+}
+
+type otlpGauge struct {
+	DataPoints []otlpDataPoint `json:"dataPoints"`
+}
+
+// 2 = AGGREGATION_TEMPORALITY_CUMULATIVE
+const otlpCumulative = 2
+
+type otlpSum struct {
+	DataPoints             []otlpDataPoint `json:"dataPoints"`
+	AggregationTemporality int             `json:"aggregationTemporality"`
+	IsMonotonic            bool            `json:"isMonotonic"`
+}
+
+type otlpDataPoint struct {
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	StartTimeUnixNano uint64         `json:"startTimeUnixNano,string,omitempty"`
+	TimeUnixNano      uint64         `json:"timeUnixNano,string"`
+	AsDouble          float64        `json:"asDouble"`
+}
+
+func otlpAttrs(kv ...string) []otlpKeyValue {
+	var attrs []otlpKeyValue
+	for i := 0; i+1 < len(kv); i += 2 {
+		attrs = append(attrs, otlpKeyValue{Key: kv[i], Value: otlpAnyValue{StringValue: kv[i+1]}})
+	}
+	return attrs
+}
+
+// otlpResourceFor uses the OpenTelemetry semantic convention names. With
+// s nil (the system collector is off) only service.name is set.
+func otlpResourceFor(s *monitor.SystemInfo) otlpResource {
+	if s == nil {
+		return otlpResource{Attributes: otlpAttrs("service.name", "sysmon")}
+	}
+	return otlpResource{Attributes: otlpAttrs(
+		"service.name", "sysmon",
+		"host.name", s.Hostname,
+		"host.arch", s.Arch,
+		"os.type", s.OS,
+		"os.description", s.Platform,
+		"os.version", s.Kernel,
+	)}
+}
+
+// otlpFromMetrics converts metric families. Counters become cumulative
+// monotonic sums starting at start; everything else is a gauge.
+func otlpFromMetrics(m *metricSet, sys *monitor.SystemInfo, start, now time.Time) otlpRequest {
+	var metrics []otlpMetric
+	for _, f := range m.families {
+		if f.name == "sysmon_system_info" {
+			continue // 已经在 resource 里了
+		}
+		points := make([]otlpDataPoint, 0, len(f.samples))
+		for _, s := range f.samples {
+			p := otlpDataPoint{
+				Attributes:   otlpAttrs(s.labels...),
+				TimeUnixNano: uint64(now.UnixNano()),
+				AsDouble:     s.value,
+			}
+			if f.typ == "counter" {
+				p.StartTimeUnixNano = uint64(start.UnixNano())
+			}
+			points = append(points, p)
+		}
+		om := otlpMetric{Name: f.name, Description: f.help}
+		if f.typ == "counter" {
+			om.Sum = &otlpSum{DataPoints: points, AggregationTemporality: otlpCumulative, IsMonotonic: true}
+		} else {
+			om.Gauge = &otlpGauge{DataPoints: points}
+		}
+		metrics = append(metrics, om)
+	}
+	return otlpRequest{ResourceMetrics: []otlpResourceMetrics{{
+		Resource:     otlpResourceFor(sys),
+		ScopeMetrics: []otlpScopeMetrics{{Scope: otlpScope{Name: "sysmon"}, Metrics: metrics}},
+	}}}
+}
+
+// otlpError is a failed export; retry says whether sending the same batch
+// again later can succeed.
+type otlpError struct {
+	msg        string
+	retry      bool
+	retryAfter time.Duration
+}
+
+func (e *otlpError) Error() string { return e.msg }
+
+// otlpExporter sends encoded batches. Batches that can't be delivered
+// wait in a bounded queue; when it is full the oldest one is dropped.
+type otlpExporter struct {
+	url      string
+	protocol string
+	headers  map[string]string
+	client   *http.Client
+
+	queue   [][]byte
+	max     int
+	dropped int
+}
+
+func newOTLPExporter(cfg Config) (*otlpExporter, error) {
+	e := &otlpExporter{
+		protocol: cfg.OTLPProtocol,
+		headers:  cfg.OTLPHeaders,
+		max:      max(cfg.OTLPBuffer, 1),
+		client:   &http.Client{Timeout: otlpTimeout},
+	}
+	endpoint := strings.TrimSuffix(cfg.OTLPEndpoint, "/")
+	switch e.protocol {
+	case otlpHTTPProtobuf, otlpHTTPJSON:
+		// 和 OTEL_EXPORTER_OTLP_ENDPOINT 一样，只给了 host 就补上路径
+		if !strings.HasSuffix(endpoint, "/v1/metrics") {
+			endpoint += "/v1/metrics"
+		}
+	case otlpGRPC:
+		// net/http only speaks HTTP/2 over TLS (without x/net), which is
+		// what gRPC needs
+		if !strings.HasPrefix(endpoint, "https://") {
+			return nil, errors.New("otlp: grpc needs an https:// endpoint; use http/protobuf (port 4318) for plaintext")
+		}
+		endpoint += otlpGRPCMethod
+		e.client.Transport = &http.Transport{ForceAttemptHTTP2: true}
+	default:
+		return nil, fmt.Errorf("otlp: unknown protocol %q", e.protocol)
+	}
+	e.url = endpoint
+	return e, nil
+}
+
+func (e *otlpExporter) encode(req otlpRequest) []byte {
+	if e.protocol == otlpHTTPJSON {
+		data, _ := json.Marshal(req)
+		return data
+	}
+	return req.marshalProto()
+}
+
+func (e *otlpExporter) push(batch []byte) {
+	if len(e.queue) >= e.max {
+		e.queue = e.queue[1:]
+		e.dropped++
+		if e.dropped == 1 || e.dropped%100 == 0 {
+			log.Printf("otlp: buffer full, %d batches dropped so far", e.dropped)
+		}
+	}
+	e.queue = append(e.queue, batch)
+}
+
+// flush sends queued batches oldest first and stops at the first one that
+// should be retried later, or when ctx is done.
+func (e *otlpExporter) flush(ctx context.Context) *otlpError {
+	for len(e.queue) > 0 {
+		err := e.send(ctx, e.queue[0])
+		if err != nil && err.retry {
+			return err
+		}
+		if err != nil {
+			log.Printf("%v, batch dropped", err)
+		}
+		e.queue = e.queue[1:]
+	}
+	return nil
+}
+
+func (e *otlpExporter) send(ctx context.Context, batch []byte) *otlpError {
+	body := batch
+	contentType := "application/x-protobuf"
+	switch e.protocol {
+	case otlpHTTPJSON:
+		contentType = "application/json"
+	case otlpGRPC:
+		body = grpcFrame(batch)
+		contentType = "application/grpc"
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.url, bytes.NewReader(body))
+	if err != nil {
+		return &otlpError{msg: "otlp: " + err.Error()}
+	}
+	req.Header.Set("Content-Type", contentType)
+	if e.protocol == otlpGRPC {
+		req.Header.Set("TE", "trailers")
+	}
+	for k, v := range e.headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return &otlpError{msg: "otlp: " + err.Error(), retry: true}
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024)) // trailers come after the body
+
+	if e.protocol == otlpGRPC {
+		return grpcStatus(resp)
+	}
+	if resp.StatusCode/100 == 2 {
+		return nil
+	}
+	// OTLP/HTTP: only these are worth retrying
+	oerr := &otlpError{msg: "otlp: " + resp.Status}
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		oerr.retry = true
+		if s, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+			oerr.retryAfter = time.Duration(s) * time.Second
+		}
+	}
+	return oerr
+}
+
+// runOTLPExporter collects every otlpInterval and pushes. While the
+// collector is unreachable it keeps collecting into the buffer and retries
+// with exponential backoff; on shutdown it makes one last attempt, for
+// as long as the shutdown hooks get.
+func runOTLPExporter(cfg Config, h *hub, e *otlpExporter) {
+	start := time.Now()
+	var docker containerCache
+	runCtx, cancelRun := context.WithCancel(context.Background())
+	stop := make(chan context.Context)
+	done := make(chan struct{})
+	onShutdown("otlp", func(ctx context.Context) {
+		cancelRun() // 正在发的那一批别把关机的时间占了
+		select {
+		case stop <- ctx:
+			<-done
+		case <-ctx.Done():
+		}
+	})
+
+	ticker := time.NewTicker(time.Duration(cfg.OTLPInterval) * time.Millisecond)
+	defer ticker.Stop()
+	var retry <-chan time.Time
+	backoff := otlpMinBackoff
+
+	for {
+		select {
+		case <-ticker.C:
+			snap := collect(metricsProcesses(cfg))
+			m := buildMetrics(snap, docker.get(), h)
+			var sys *monitor.SystemInfo
+			if snap.has("system") {
+				sys = &snap.System
+			}
+			e.push(e.encode(otlpFromMetrics(m, sys, start, time.Now())))
+			if retry != nil {
+				continue // 等退避结束再发
+			}
+		case <-retry:
+			retry = nil
+		case ctx := <-stop:
+			if err := e.flush(ctx); err != nil {
+				log.Printf("%v, %d batches lost on shutdown", err, len(e.queue))
+			}
+			close(done)
+			return
+		}
+
+		if err := e.flush(runCtx); err != nil {
+			if runCtx.Err() != nil {
+				continue // 要关了，等 stop
+			}
+			wait := max(backoff, err.retryAfter)
+			log.Printf("%v, retrying in %s (%d batches queued)", err, wait, len(e.queue))
+			retry = time.After(wait)
+			backoff = min(backoff*2, otlpMaxBackoff)
+			continue
+		}
+		backoff = otlpMinBackoff
+	}
+}
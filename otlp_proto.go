@@ -0,0 +1,166 @@
+// Copyright (C) 2025 Russell Li (xiaoxinmm)
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/binary"
+	"math"
+	"net/http"
+	"strconv"
+)
+
+// Protobuf encoding of the OTLP types in otlp.go. Field numbers are from
+// opentelemetry/proto/metrics/v1/metrics.proto and common/v1/common.proto.
+
+const otlpGRPCMethod = "/opentelemetry.proto.collector.metrics.v1.MetricsService/Export"
+
+// pbuf is a minimal protobuf writer: just the wire types OTLP metrics use.
+type pbuf []byte
+
+func (b *pbuf) varint(v uint64) {
+	*b = binary.AppendUvarint(*b, v)
+}
+
+func (b *pbuf) tag(field, wire int) {
+	b.varint(uint64(field)<<3 | uint64(wire))
+}
+
+func (b *pbuf) bytes(field int, v []byte) {
+	b.tag(field, 2)
+	b.varint(uint64(len(v)))
+	*b = append(*b, v...)
+}
+
+func (b *pbuf) string(field int, v string) {
+	if v != "" {
+		b.bytes(field, []byte(v))
+	}
+}
+
+func (b *pbuf) message(field int, encode func(*pbuf)) {
+	var sub pbuf
+	encode(&sub)
+	b.bytes(field, sub)
+}
+
+func (b *pbuf) fixed64(field int, v uint64) {
+	if v != 0 {
+		b.tag(field, 1)
+		*b = binary.LittleEndian.AppendUint64(*b, v)
+	}
+}
+
+func (b *pbuf) double(field int, v float64) {
+	b.tag(field, 1)
+	*b = binary.LittleEndian.AppendUint64(*b, math.Float64bits(v))
+}
+
+func (b *pbuf) uint(field int, v uint64) {
+	if v != 0 {
+		b.tag(field, 0)
+		b.varint(v)
+	}
+}
+
+func encodeKeyValues(b *pbuf, field int, attrs []otlpKeyValue) {
+	for _, kv := range attrs {
+		b.message(field, func(b *pbuf) {
+			b.string(1, kv.Key)
+			b.message(2, func(b *pbuf) { b.string(1, kv.Value.StringValue) })
+		})
+	}
+}
+
+func encodeDataPoints(b *pbuf, points []otlpDataPoint) {
+	for _, p := range points {
+		b.message(1, func(b *pbuf) {
+			b.fixed64(2, p.StartTimeUnixNano)
+			b.fixed64(3, p.TimeUnixNano)
+			b.double(4, p.AsDouble)
+			encodeKeyValues(b, 7, p.Attributes)
+		})
+	}
+}
+
+// marshalProto encodes an ExportMetricsServiceRequest.
+func (r otlpRequest) marshalProto() []byte {
+	var b pbuf
+	for _, rm := range r.ResourceMetrics {
+		b.message(1, func(b *pbuf) {
+			b.message(1, func(b *pbuf) { encodeKeyValues(b, 1, rm.Resource.Attributes) })
+			for _, sm := range rm.ScopeMetrics {
+				b.message(2, func(b *pbuf) {
+					b.message(1, func(b *pbuf) { b.string(1, sm.Scope.Name) })
+					for _, m := range sm.Metrics {
+						b.message(2, func(b *pbuf) {
+							b.string(1, m.Name)
+							b.string(2, m.Description)
+							if m.Gauge != nil {
+								b.message(5, func(b *pbuf) { encodeDataPoints(b, m.Gauge.DataPoints) })
+							}
+							if m.Sum != nil {
+								b.message(7, func(b *pbuf) {
+									encodeDataPoints(b, m.Sum.DataPoints)
+									b.uint(2, uint64(m.Sum.AggregationTemporality))
+									if m.Sum.IsMonotonic {
+										b.uint(3, 1)
+									}
+								})
+							}
+						})
+					}
+				})
+			}
+		})
+	}
+	return b
+}
+
+// grpcFrame wraps a message in the gRPC length-prefixed framing
+// (uncompressed flag, 4-byte big-endian length).
+func grpcFrame(msg []byte) []byte {
+	frame := make([]byte, 5, 5+len(msg))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(msg)))
+	return append(frame, msg...)
+}
+
+// grpcStatus reads grpc-status from the trailers, or from the headers for
+// a trailers-only response. The retryable codes are the ones the OTLP
+// spec lists.
+func grpcStatus(resp *http.Response) *otlpError {
+	if resp.StatusCode != http.StatusOK {
+		return &otlpError{msg: "otlp: grpc: " + resp.Status, retry: resp.StatusCode >= 500}
+	}
+	status := resp.Trailer.Get("Grpc-Status")
+	msg := resp.Trailer.Get("Grpc-Message")
+	if status == "" {
+		status = resp.Header.Get("Grpc-Status")
+		msg = resp.Header.Get("Grpc-Message")
+	}
+	code, err := strconv.Atoi(status)
+	if err != nil {
+		return &otlpError{msg: "otlp: grpc: missing grpc-status", retry: true}
+	}
+	if code == 0 {
+		return nil
+	}
+	oerr := &otlpError{msg: "otlp: grpc status " + status + ": " + msg}
+	switch code {
+	case 1, 4, 8, 10, 11, 14, 15: // CANCELLED, DEADLINE_EXCEEDED, RESOURCE_EXHAUSTED, ABORTED, OUT_OF_RANGE, UNAVAILABLE, DATA_LOSS
+		oerr.retry = true
+	}
+	return oerr
+}
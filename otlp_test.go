@@ -0,0 +1,404 @@
+// Copyright (C) 2025 Russell Li (xiaoxinmm)
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// A stand-in OTLP receiver: a protobuf wire-format reader written from
+// metrics.proto, independent of the encoder in otlp_proto.go.
+
+type pbField struct {
+	num   int
+	wire  int
+	value uint64 // varint and fixed64
+	bytes []byte // length-delimited
+}
+
+func pbFields(b []byte) ([]pbField, error) {
+	var out []pbField
+	for len(b) > 0 {
+		key, n := binary.Uvarint(b)
+		if n <= 0 {
+			return nil, errors.New("bad tag")
+		}
+		b = b[n:]
+		f := pbField{num: int(key >> 3), wire: int(key & 7)}
+		switch f.wire {
+		case 0:
+			f.value, n = binary.Uvarint(b)
+			if n <= 0 {
+				return nil, errors.New("bad varint")
+			}
+			b = b[n:]
+		case 1:
+			if len(b) < 8 {
+				return nil, errors.New("short fixed64")
+			}
+			f.value, b = binary.LittleEndian.Uint64(b), b[8:]
+		case 2:
+			l, n := binary.Uvarint(b)
+			if n <= 0 || uint64(len(b)-n) < l {
+				return nil, errors.New("bad length")
+			}
+			f.bytes, b = b[n:n+int(l)], b[n+int(l):]
+		default:
+			return nil, fmt.Errorf("unexpected wire type %d", f.wire)
+		}
+		out = append(out, f)
+	}
+	return out, nil
+}
+
+// pbDecode walks b's fields; want maps field numbers to wire types, so a
+// field encoded the wrong way fails instead of being misread.
+func pbDecode(t *testing.T, what string, b []byte, want map[int]int, fn func(f pbField)) {
+	t.Helper()
+	fields, err := pbFields(b)
+	if err != nil {
+		t.Fatalf("%s: %v", what, err)
+	}
+	for _, f := range fields {
+		wire, ok := want[f.num]
+		if !ok {
+			t.Errorf("%s: unknown field %d", what, f.num)
+			continue
+		}
+		if wire != f.wire {
+			t.Errorf("%s: field %d has wire type %d, want %d", what, f.num, f.wire, wire)
+			continue
+		}
+		fn(f)
+	}
+}
+
+func decodeKeyValue(t *testing.T, b []byte) otlpKeyValue {
+	var kv otlpKeyValue
+	pbDecode(t, "KeyValue", b, map[int]int{1: 2, 2: 2}, func(f pbField) {
+		if f.num == 1 {
+			kv.Key = string(f.bytes)
+			return
+		}
+		pbDecode(t, "AnyValue", f.bytes, map[int]int{1: 2}, func(f pbField) { kv.Value.StringValue = string(f.bytes) })
+	})
+	return kv
+}
+
+func decodeDataPoints(t *testing.T, f pbField, points *[]otlpDataPoint) {
+	var p otlpDataPoint
+	pbDecode(t, "NumberDataPoint", f.bytes, map[int]int{2: 1, 3: 1, 4: 1, 7: 2}, func(f pbField) {
+		switch f.num {
+		case 2:
+			p.StartTimeUnixNano = f.value
+		case 3:
+			p.TimeUnixNano = f.value
+		case 4:
+			p.AsDouble = math.Float64frombits(f.value)
+		case 7:
+			p.Attributes = append(p.Attributes, decodeKeyValue(t, f.bytes))
+		}
+	})
+	*points = append(*points, p)
+}
+
+// decodeOTLP reads an ExportMetricsServiceRequest.
+func decodeOTLP(t *testing.T, b []byte) otlpRequest {
+	t.Helper()
+	var req otlpRequest
+	pbDecode(t, "ExportMetricsServiceRequest", b, map[int]int{1: 2}, func(f pbField) {
+		var rm otlpResourceMetrics
+		pbDecode(t, "ResourceMetrics", f.bytes, map[int]int{1: 2, 2: 2}, func(f pbField) {
+			if f.num == 1 {
+				pbDecode(t, "Resource", f.bytes, map[int]int{1: 2}, func(f pbField) {
+					rm.Resource.Attributes = append(rm.Resource.Attributes, decodeKeyValue(t, f.bytes))
+				})
+				return
+			}
+			var sm otlpScopeMetrics
+			pbDecode(t, "ScopeMetrics", f.bytes, map[int]int{1: 2, 2: 2}, func(f pbField) {
+				if f.num == 1 {
+					pbDecode(t, "InstrumentationScope", f.bytes, map[int]int{1: 2}, func(f pbField) { sm.Scope.Name = string(f.bytes) })
+					return
+				}
+				var m otlpMetric
+				pbDecode(t, "Metric", f.bytes, map[int]int{1: 2, 2: 2, 5: 2, 7: 2}, func(f pbField) {
+					switch f.num {
+					case 1:
+						m.Name = string(f.bytes)
+					case 2:
+						m.Description = string(f.bytes)
+					case 5:
+						m.Gauge = &otlpGauge{DataPoints: []otlpDataPoint{}}
+						pbDecode(t, "Gauge", f.bytes, map[int]int{1: 2}, func(f pbField) { decodeDataPoints(t, f, &m.Gauge.DataPoints) })
+					case 7:
+						m.Sum = &otlpSum{DataPoints: []otlpDataPoint{}}
+						pbDecode(t, "Sum", f.bytes, map[int]int{1: 2, 2: 0, 3: 0}, func(f pbField) {
+							switch f.num {
+							case 1:
+								decodeDataPoints(t, f, &m.Sum.DataPoints)
+							case 2:
+								m.Sum.AggregationTemporality = int(f.value)
+							case 3:
+								m.Sum.IsMonotonic = f.value == 1
+							}
+						})
+					}
+				})
+				sm.Metrics = append(sm.Metrics, m)
+			})
+			rm.ScopeMetrics = append(rm.ScopeMetrics, sm)
+		})
+		req.ResourceMetrics = append(req.ResourceMetrics, rm)
+	})
+	return req
+}
+
+func sameRequest(t *testing.T, got, want otlpRequest) {
+	t.Helper()
+	if !reflect.DeepEqual(got, want) {
+		g, _ := json.Marshal(got)
+		w, _ := json.Marshal(want)
+		t.Errorf("receiver decoded\n%s\nwant\n%s", g, w)
+	}
+}
+
+// testOTLPRequest is a real export: metrics from a live snapshot, plus a
+// counter, whose start time only sums carry.
+func testOTLPRequest(t *testing.T) otlpRequest {
+	t.Helper()
+	snap := collect(3)
+	m := buildMetrics(snap, nil, newHub())
+	m.counter("sysmon_test_total", "A counter.", 42, "k", "v")
+	start := time.Unix(1700000000, 123)
+	req := otlpFromMetrics(m, &snap.System, start, start.Add(time.Minute))
+	if len(req.ResourceMetrics[0].ScopeMetrics[0].Metrics) < 5 {
+		t.Fatal("too few metrics to be a useful test")
+	}
+	return req
+}
+
+func TestOTLPProtobufRoundTrip(t *testing.T) {
+	req := testOTLPRequest(t)
+	sameRequest(t, decodeOTLP(t, req.marshalProto()), req)
+}
+
+// receiver serves OTLP/HTTP and records what it decoded. status is what
+// the next requests get, first to last; after that 200.
+type receiver struct {
+	t       *testing.T
+	got     []otlpRequest
+	headers []http.Header
+	status  []int
+}
+
+func (rc *receiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	rc.headers = append(rc.headers, r.Header.Clone())
+	if len(rc.status) > 0 {
+		code := rc.status[0]
+		rc.status = rc.status[1:]
+		if code == http.StatusServiceUnavailable {
+			w.Header().Set("Retry-After", "3")
+		}
+		w.WriteHeader(code)
+		return
+	}
+	if r.URL.Path != "/v1/metrics" {
+		rc.t.Errorf("path %s", r.URL.Path)
+	}
+	switch r.Header.Get("Content-Type") {
+	case "application/x-protobuf":
+		rc.got = append(rc.got, decodeOTLP(rc.t, body))
+	case "application/json":
+		var req otlpRequest
+		if err := json.Unmarshal(body, &req); err != nil {
+			rc.t.Error(err)
+		}
+		rc.got = append(rc.got, req)
+	default:
+		rc.t.Errorf("Content-Type %q", r.Header.Get("Content-Type"))
+	}
+}
+
+func TestOTLPHTTP(t *testing.T) {
+	for _, protocol := range []string{otlpHTTPProtobuf, otlpHTTPJSON} {
+		t.Run(protocol, func(t *testing.T) {
+			rc := &receiver{t: t}
+			srv := httptest.NewServer(rc)
+			defer srv.Close()
+			e, err := newOTLPExporter(Config{OTLPEndpoint: srv.URL, OTLPProtocol: protocol, OTLPBuffer: 4,
+				OTLPHeaders: map[string]string{"Authorization": "Bearer abc"}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			req := testOTLPRequest(t)
+			e.push(e.encode(req))
+			if err := e.flush(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			if len(rc.got) != 1 {
+				t.Fatalf("receiver got %d requests", len(rc.got))
+			}
+			sameRequest(t, rc.got[0], req)
+			if h := rc.headers[0].Get("Authorization"); h != "Bearer abc" {
+				t.Errorf("Authorization = %q", h)
+			}
+		})
+	}
+}
+
+func TestOTLPRetry(t *testing.T) {
+	rc := &receiver{t: t, status: []int{http.StatusServiceUnavailable, http.StatusBadRequest}}
+	srv := httptest.NewServer(rc)
+	defer srv.Close()
+	e, _ := newOTLPExporter(Config{OTLPEndpoint: srv.URL, OTLPProtocol: otlpHTTPProtobuf, OTLPBuffer: 2})
+	req := testOTLPRequest(t)
+	for i := 0; i < 3; i++ {
+		e.push(e.encode(req))
+	}
+	if e.dropped != 1 || len(e.queue) != 2 {
+		t.Fatalf("queue %d, dropped %d; want 2, 1", len(e.queue), e.dropped)
+	}
+
+	// 503: keep everything, wait as long as Retry-After says
+	err := e.flush(context.Background())
+	if err == nil || !err.retry || err.retryAfter != 3*time.Second {
+		t.Fatalf("503: %+v", err)
+	}
+	if len(e.queue) != 2 {
+		t.Fatalf("503 lost batches: %d left", len(e.queue))
+	}
+	// 400: that batch can never succeed, so it is dropped and the next goes
+	if err := e.flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(e.queue) != 0 || len(rc.got) != 1 {
+		t.Fatalf("queue %d, delivered %d; want 0, 1", len(e.queue), len(rc.got))
+	}
+}
+
+func TestOTLPFlushBoundedByContext(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer srv.Close()
+	defer close(release)
+	e, _ := newOTLPExporter(Config{OTLPEndpoint: srv.URL, OTLPProtocol: otlpHTTPProtobuf, OTLPBuffer: 4})
+	e.push([]byte{})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err := e.flush(ctx)
+	if err == nil || !err.retry {
+		t.Fatalf("flush against a hung collector: %v", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("flush took %s, past its context", d)
+	}
+	if len(e.queue) != 1 {
+		t.Errorf("batch lost, queue %d", len(e.queue))
+	}
+}
+
+func TestOTLPGRPC(t *testing.T) {
+	want := testOTLPRequest(t)
+	var status []string // grpc-status per request; "" = trailers-only 3
+	var got []otlpRequest
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor != 2 {
+			t.Errorf("HTTP/%d.%d, gRPC needs HTTP/2", r.ProtoMajor, r.ProtoMinor)
+		}
+		if r.URL.Path != otlpGRPCMethod || r.Header.Get("Content-Type") != "application/grpc" || r.Header.Get("TE") != "trailers" {
+			t.Errorf("request %s %q %q", r.URL.Path, r.Header.Get("Content-Type"), r.Header.Get("TE"))
+		}
+		body, _ := io.ReadAll(r.Body)
+		if len(body) < 5 || body[0] != 0 || int(binary.BigEndian.Uint32(body[1:5])) != len(body)-5 {
+			t.Errorf("bad gRPC frame: % x", body[:min(len(body), 5)])
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		got = append(got, decodeOTLP(t, body[5:]))
+
+		code := status[0]
+		status = status[1:]
+		w.Header().Set("Content-Type", "application/grpc")
+		if code == "" {
+			w.Header().Set("Grpc-Status", "3")
+			w.Header().Set("Grpc-Message", "bad request")
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+		w.WriteHeader(http.StatusOK)
+		w.Write(grpcFrame(nil)) // empty ExportMetricsServiceResponse
+		w.Header().Set("Grpc-Status", code)
+		if code != "0" {
+			w.Header().Set("Grpc-Message", "try later")
+		}
+	}))
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	defer srv.Close()
+
+	e, err := newOTLPExporter(Config{OTLPEndpoint: srv.URL, OTLPProtocol: otlpGRPC, OTLPBuffer: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := srv.Client().Transport.(*http.Transport).Clone()
+	tr.ForceAttemptHTTP2 = true
+	e.client.Transport = tr
+
+	// flush only reports errors worth retrying; the others drop the batch
+	for _, c := range []struct {
+		status string
+		retry  bool
+	}{
+		{"14", true}, // UNAVAILABLE in the trailers
+		{"0", false},
+		{"", false}, // INVALID_ARGUMENT, trailers-only
+	} {
+		status = append(status, c.status)
+		e.queue = nil
+		e.push(e.encode(want))
+		err := e.flush(context.Background())
+		if (err != nil) != c.retry || (err != nil && !err.retry) {
+			t.Errorf("status %q: err %v, want retry %v", c.status, err, c.retry)
+		}
+		if c.retry != (len(e.queue) == 1) {
+			t.Errorf("status %q: %d batches queued", c.status, len(e.queue))
+		}
+	}
+	if len(got) != 3 {
+		t.Fatalf("receiver got %d requests", len(got))
+	}
+	for _, g := range got {
+		sameRequest(t, g, want)
+	}
+}
@@ -0,0 +1,358 @@
+// Copyright (C) 2025 Russell Li (xiaoxinmm)
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Output writers send every snapshot the broadcaster collects to an
+// external time-series database. A writer only knows its wire format and
+// how to deliver one batch; batching and spooling are shared. See
+// docs/outputs.md.
+
+// OutputConfig is one entry of the "outputs" config list.
+type OutputConfig struct {
+	Type          string            `json:"type"`          // influx-http, influx-udp, graphite
+	URL           string            `json:"url"`           // write URL for influx-http, host:port otherwise
+	Token         string            `json:"token"`         // influx-http: sent as "Authorization: Token ..."
+	Prefix        string            `json:"prefix"`        // measurement / metric path prefix
+	Tags          map[string]string `json:"tags"`          // added to every line
+	Processes     bool              `json:"processes"`     // also write the top processes
+	BatchSize     int               `json:"batchSize"`     // lines per write
+	FlushInterval int               `json:"flushInterval"` // milliseconds
+	SpoolDir      string            `json:"spoolDir"`      // empty: drop batches that can't be sent
+	SpoolMaxBytes int64             `json:"spoolMaxBytes"`
+}
+
+// outputWriter is one output format plus its transport.
+type outputWriter interface {
+	// lines renders a snapshot, one line per point, each ending in \n.
+	lines(snap Snapshot) []byte
+	// write delivers one batch of lines. A batch the receiver refuses
+	// for its content comes back as a rejectedError.
+	write(batch []byte) error
+	// spools says whether failed writes are detectable (not for UDP).
+	spools() bool
+}
+
+// rejectedError is a write the receiver refused for what the batch holds
+// (an HTTP 4xx other than 408 and 429): sending it again fails the same
+// way. Anything else, network errors and 5xx included, is worth retrying.
+type rejectedError struct{ error }
+
+func isRejected(err error) bool {
+	var r rejectedError
+	return errors.As(err, &r)
+}
+
+func newOutputWriter(oc OutputConfig) (outputWriter, error) {
+	switch oc.Type {
+	case "influx-http":
+		return newInfluxHTTP(oc)
+	case "influx-udp":
+		return newInfluxUDP(oc)
+	case "graphite":
+		return newGraphite(oc)
+	}
+	return nil, fmt.Errorf("output: unknown type %q", oc.Type)
+}
+
+// output batches lines for one writer and spools batches it couldn't send.
+type output struct {
+	name  string
+	w     outputWriter
+	in    chan Snapshot
+	batch int
+	every time.Duration
+	spool *spool
+}
+
+// outputSet is what the broadcaster feeds.
+type outputSet []*output
+
+func newOutputs(configs []OutputConfig) (outputSet, error) {
+	var outs outputSet
+	for _, oc := range configs {
+		w, err := newOutputWriter(oc)
+		if err != nil {
+			return nil, err
+		}
+		o := &output{
+			name:  oc.Type + " " + oc.URL,
+			w:     w,
+			in:    make(chan Snapshot, 16),
+			batch: oc.BatchSize,
+			every: time.Duration(oc.FlushInterval) * time.Millisecond,
+		}
+		if o.batch <= 0 {
+			o.batch = 5000
+		}
+		if o.every <= 0 {
+			o.every = 10 * time.Second
+		}
+		if oc.SpoolDir != "" && w.spools() {
+			h := fnv.New32a()
+			h.Write([]byte(oc.Type + oc.URL))
+			dir := filepath.Join(oc.SpoolDir, fmt.Sprintf("%s-%08x", oc.Type, h.Sum32()))
+			if o.spool, err = newSpool(dir, oc.SpoolMaxBytes); err != nil {
+				return nil, err
+			}
+		}
+		outs = append(outs, o)
+	}
+	return outs, nil
+}
+
+func (outs outputSet) start() {
+	for _, o := range outs {
+		go o.run()
+	}
+}
+
+// publish hands a snapshot to every output without blocking the
+// broadcaster; a writer that has fallen 16 snapshots behind loses some.
+func (outs outputSet) publish(snap Snapshot) {
+	for _, o := range outs {
+		select {
+		case o.in <- snap:
+		default:
+		}
+	}
+}
+
+func (o *output) run() {
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	onShutdown("output "+o.name, func(ctx context.Context) {
+		close(stop)
+		select {
+		case <-done:
+		case <-ctx.Done():
+		}
+	})
+
+	ticker := time.NewTicker(o.every)
+	defer ticker.Stop()
+	var buf bytes.Buffer
+	lines := 0
+	for {
+		select {
+		case snap := <-o.in:
+			b := o.w.lines(snap)
+			buf.Write(b)
+			lines += bytes.Count(b, []byte{'\n'})
+			if lines < o.batch {
+				continue
+			}
+		case <-ticker.C:
+		case <-stop:
+			o.flushOnShutdown(buf.Bytes())
+			close(done)
+			return
+		}
+		o.flush(buf.Bytes())
+		buf.Reset()
+		lines = 0
+	}
+}
+
+// flush sends the spooled batches first (oldest data first), then the
+// current one. Whatever can't be sent goes to the spool, except batches
+// the receiver rejected: those are set aside so they don't hold up the
+// ones behind them.
+func (o *output) flush(batch []byte) {
+	if o.spool != nil {
+		for {
+			name, data, ok := o.spool.oldest()
+			if !ok {
+				break
+			}
+			err := o.w.write(data)
+			if isRejected(err) {
+				log.Printf("output %s: spooled batch %v, moved to %s", o.name, err, o.spool.reject(name))
+				continue
+			}
+			if err != nil {
+				break
+			}
+			o.spool.remove(name)
+		}
+	}
+	if len(batch) == 0 {
+		return
+	}
+	err := o.w.write(batch)
+	if err == nil {
+		return
+	}
+	if isRejected(err) {
+		if o.spool == nil {
+			log.Printf("output %s: batch %v, %d bytes dropped", o.name, err, len(batch))
+			return
+		}
+		log.Printf("output %s: batch %v, kept in %s", o.name, err, o.spool.keepRejected(batch))
+		return
+	}
+	if o.spool == nil {
+		log.Printf("output %s: %v, %d bytes dropped", o.name, err, len(batch))
+		return
+	}
+	if serr := o.spool.add(batch); serr != nil {
+		log.Printf("output %s: %v; spooling failed too: %v", o.name, err, serr)
+		return
+	}
+	log.Printf("output %s: %v, spooled %d bytes", o.name, err, len(batch))
+}
+
+// flushOnShutdown keeps the last batch. With a spool it goes there,
+// which is quick and is sent on the next start; without one it gets one
+// write attempt.
+func (o *output) flushOnShutdown(batch []byte) {
+	if len(batch) == 0 {
+		return
+	}
+	if o.spool == nil {
+		o.flush(batch)
+		return
+	}
+	if err := o.spool.add(batch); err != nil {
+		log.Printf("output %s: spooling on shutdown: %v, %d bytes dropped", o.name, err, len(batch))
+	}
+}
+
+// spool keeps unsent batches as files in dir, named by time so they sort
+// oldest first. Each file is written under a temporary name and renamed,
+// so a crash never leaves half a batch behind. Rejected batches are kept
+// next to them as .rejected, the newest spoolRejectedKeep of them.
+type spool struct {
+	dir string
+	max int64
+}
+
+const spoolRejectedKeep = 16
+
+func newSpool(dir string, max int64) (*spool, error) {
+	if max <= 0 {
+		max = 64 << 20
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("output: spool: %w", err)
+	}
+	return &spool{dir: dir, max: max}, nil
+}
+
+// files lists the files with extension ext, oldest first, and their size.
+func (s *spool) files(ext string) ([]os.DirEntry, int64) {
+	entries, _ := os.ReadDir(s.dir)
+	var files []os.DirEntry
+	var size int64
+	for _, e := range entries {
+		if filepath.Ext(e.Name()) != ext {
+			continue
+		}
+		if info, err := e.Info(); err == nil {
+			size += info.Size()
+		}
+		files = append(files, e)
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Name() < files[j].Name() })
+	return files, size
+}
+
+// write stores batch as a new file with extension ext and returns its path.
+func (s *spool) write(batch []byte, ext string) (string, error) {
+	path := filepath.Join(s.dir, strconv.FormatInt(time.Now().UnixNano(), 10)+ext)
+	if err := os.WriteFile(path+".tmp", batch, 0o600); err != nil {
+		return "", err
+	}
+	return path, os.Rename(path+".tmp", path)
+}
+
+func (s *spool) add(batch []byte) error {
+	if _, err := s.write(batch, ".spool"); err != nil {
+		return err
+	}
+	// 超过上限就丢最旧的
+	files, size := s.files(".spool")
+	for len(files) > 1 && size > s.max {
+		if info, err := files[0].Info(); err == nil {
+			size -= info.Size()
+		}
+		os.Remove(filepath.Join(s.dir, files[0].Name()))
+		files = files[1:]
+	}
+	return nil
+}
+
+func (s *spool) oldest() (name string, data []byte, ok bool) {
+	files, _ := s.files(".spool")
+	if len(files) == 0 {
+		return "", nil, false
+	}
+	name = files[0].Name()
+	data, err := os.ReadFile(filepath.Join(s.dir, name))
+	if err != nil {
+		os.Remove(filepath.Join(s.dir, name))
+		return "", nil, false
+	}
+	return name, data, true
+}
+
+func (s *spool) remove(name string) {
+	os.Remove(filepath.Join(s.dir, name))
+}
+
+// reject renames a spooled batch to .rejected and returns its new path.
+func (s *spool) reject(name string) string {
+	path := filepath.Join(s.dir, strings.TrimSuffix(name, ".spool")+".rejected")
+	if err := os.Rename(filepath.Join(s.dir, name), path); err != nil {
+		// 挪不走也不能让它一直堵在队首
+		os.Remove(filepath.Join(s.dir, name))
+		return "nowhere (" + err.Error() + "), dropped"
+	}
+	s.pruneRejected()
+	return path
+}
+
+// keepRejected stores a batch that was rejected before it was spooled.
+func (s *spool) keepRejected(batch []byte) string {
+	path, err := s.write(batch, ".rejected")
+	if err != nil {
+		return "nowhere (" + err.Error() + "), dropped"
+	}
+	s.pruneRejected()
+	return path
+}
+
+func (s *spool) pruneRejected() {
+	files, _ := s.files(".rejected")
+	for len(files) > spoolRejectedKeep {
+		os.Remove(filepath.Join(s.dir, files[0].Name()))
+		files = files[1:]
+	}
+}
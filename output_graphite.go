@@ -0,0 +1,154 @@
+// Copyright (C) 2025 Russell Li (xiaoxinmm)
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Graphite plaintext protocol over TCP:
+//
+//	sysmon.web1.cpu.usage_avg 12.5 1735689600
+//
+// With tags configured, Graphite 1.1 tagged series are written instead:
+//
+//	sysmon.web1.cpu.usage_avg;dc=eu 12.5 1735689600
+
+// graphite 路径里只留这些字符，其余换成 _
+var graphiteUnsafe = regexp.MustCompile(`[^A-Za-z0-9_-]+`)
+
+func graphiteNode(s string) string {
+	s = strings.Trim(graphiteUnsafe.ReplaceAllString(s, "_"), "_")
+	if s == "" {
+		return "root" // 挂载点 "/"
+	}
+	return s
+}
+
+type graphite struct {
+	prefix    string // may contain {host}
+	tags      string // ";k=v;..." sorted
+	processes bool
+	addr      string
+}
+
+func newGraphite(oc OutputConfig) (*graphite, error) {
+	if _, _, err := net.SplitHostPort(oc.URL); err != nil {
+		return nil, fmt.Errorf("output: graphite needs host:port, got %q", oc.URL)
+	}
+	g := &graphite{prefix: oc.Prefix, processes: oc.Processes, addr: oc.URL}
+	if g.prefix == "" {
+		g.prefix = "sysmon.{host}"
+	}
+	keys := make([]string, 0, len(oc.Tags))
+	for k := range oc.Tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		g.tags += ";" + graphiteNode(k) + "=" + strings.NewReplacer(";", "_", "~", "_", " ", "_").Replace(oc.Tags[k])
+	}
+	return g, nil
+}
+
+func (g *graphite) spools() bool { return true }
+
+func (g *graphite) lines(snap Snapshot) []byte {
+	var b bytes.Buffer
+	host := snap.System.Hostname
+	if !snap.has("system") {
+		host, _ = os.Hostname() // 路径里总得有主机这一级
+	}
+	prefix := strings.ReplaceAll(g.prefix, "{host}", graphiteNode(host))
+	ts := " " + strconv.FormatInt(snap.Timestamp/1000, 10) + "\n"
+	put := func(path string, v float64) {
+		b.WriteString(prefix + "." + path + g.tags + " " + strconv.FormatFloat(v, 'f', -1, 64) + ts)
+	}
+
+	if snap.has("system") {
+		put("uptime", float64(snap.System.Uptime))
+	}
+
+	if snap.has("cpu") {
+		put("cpu.usage_avg", snap.CPU.AvgUsage)
+		put("cpu.cores", float64(snap.CPU.Cores))
+		put("cpu.threads", float64(snap.CPU.Threads))
+		for i, u := range snap.CPU.Usage {
+			put("cpu.cpu"+strconv.Itoa(i)+".usage", u)
+		}
+	}
+
+	if snap.has("memory") {
+		m := snap.Memory
+		put("mem.total", float64(m.Total))
+		put("mem.used", float64(m.Used))
+		put("mem.available", float64(m.Available))
+		put("mem.used_percent", m.UsedPercent)
+		put("mem.swap_total", float64(m.SwapTotal))
+		put("mem.swap_used", float64(m.SwapUsed))
+		put("mem.swap_percent", m.SwapPercent)
+	}
+
+	for _, d := range snap.Disks {
+		p := "disk." + graphiteNode(d.Mountpoint) + "."
+		put(p+"total", float64(d.Total))
+		put(p+"used", float64(d.Used))
+		put(p+"free", float64(d.Free))
+		put(p+"used_percent", d.UsedPercent)
+	}
+
+	for _, n := range snap.Network {
+		p := "net." + graphiteNode(n.Name) + "."
+		put(p+"bytes_sent", float64(n.BytesSent))
+		put(p+"bytes_recv", float64(n.BytesRecv))
+		put(p+"send_rate", n.SendRate)
+		put(p+"recv_rate", n.RecvRate)
+	}
+
+	if snap.has("load") {
+		put("load.load1", snap.Load.Load1)
+		put("load.load5", snap.Load.Load5)
+		put("load.load15", snap.Load.Load15)
+	}
+
+	if g.processes {
+		for _, p := range snap.Processes {
+			node := "process." + graphiteNode(p.Name) + "_" + strconv.Itoa(int(p.PID)) + "."
+			put(node+"cpu", p.CPU)
+			put(node+"mem", float64(p.Mem))
+		}
+	}
+	return b.Bytes()
+}
+
+func (g *graphite) write(batch []byte) error {
+	conn, err := net.DialTimeout("tcp", g.addr, 5*time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	_, err = conn.Write(batch)
+	return err
+}
@@ -0,0 +1,268 @@
+// Copyright (C) 2025 Russell Li (xiaoxinmm)
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// InfluxDB line protocol:
+//
+//	<prefix>_cpu,host=web1 usage_avg=12.5,cores=4i 1735689600000000000
+
+// 单个 UDP 包别超过常见 MTU 太多，大批次拆开发
+const influxUDPPacket = 1400
+
+var (
+	influxKeyEscaper         = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `, "\n", " ")
+	influxMeasurementEscaper = strings.NewReplacer(",", `\,`, " ", `\ `, "\n", " ")
+)
+
+// influxFormat renders snapshots; the transports embed it.
+type influxFormat struct {
+	prefix    string
+	host      string // tags["host"], replaces the hostname
+	tags      string // ",k=v,..." sorted, without host
+	processes bool
+}
+
+func newInfluxFormat(oc OutputConfig) influxFormat {
+	f := influxFormat{prefix: oc.Prefix, processes: oc.Processes}
+	if f.prefix == "" {
+		f.prefix = "sysmon"
+	}
+	keys := make([]string, 0, len(oc.Tags))
+	for k := range oc.Tags {
+		if oc.Tags[k] == "" {
+			continue
+		}
+		if k == "host" {
+			f.host = oc.Tags[k]
+			continue
+		}
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		f.tags += "," + influxKeyEscaper.Replace(k) + "=" + influxKeyEscaper.Replace(oc.Tags[k])
+	}
+	return f
+}
+
+// influxLine builds one line. Fields are name/value pairs; values are
+// float64 or uint64/int (written as integers).
+type influxLine struct {
+	b      *bytes.Buffer
+	fields int
+}
+
+// line starts a line. Tags with an empty value are left out: line
+// protocol rejects them, and with them the whole batch.
+func (f influxFormat) line(b *bytes.Buffer, section, host string, tags ...string) *influxLine {
+	b.WriteString(influxMeasurementEscaper.Replace(f.prefix + "_" + section))
+	if host != "" {
+		b.WriteString(",host=" + influxKeyEscaper.Replace(host))
+	}
+	for i := 0; i+1 < len(tags); i += 2 {
+		if tags[i+1] != "" {
+			b.WriteString("," + tags[i] + "=" + influxKeyEscaper.Replace(tags[i+1]))
+		}
+	}
+	b.WriteString(f.tags)
+	return &influxLine{b: b}
+}
+
+func (l *influxLine) field(name string, v interface{}) *influxLine {
+	if l.fields == 0 {
+		l.b.WriteByte(' ')
+	} else {
+		l.b.WriteByte(',')
+	}
+	l.fields++
+	l.b.WriteString(name + "=")
+	switch v := v.(type) {
+	case float64:
+		l.b.WriteString(strconv.FormatFloat(v, 'f', -1, 64))
+	case uint64:
+		l.b.WriteString(strconv.FormatUint(v, 10) + "i")
+	case int:
+		l.b.WriteString(strconv.Itoa(v) + "i")
+	}
+	return l
+}
+
+func (l *influxLine) end(ts int64) {
+	l.b.WriteString(" " + strconv.FormatInt(ts, 10) + "\n")
+}
+
+func (f influxFormat) lines(snap Snapshot) []byte {
+	var b bytes.Buffer
+	ts := snap.Timestamp * int64(time.Millisecond) // ns
+	host := snap.System.Hostname
+	if !snap.has("system") {
+		host, _ = os.Hostname() // 和 Graphite 一样，不采 system 也带上主机
+	}
+	if f.host != "" {
+		host = f.host
+	}
+
+	if snap.has("system") {
+		f.line(&b, "system", host).field("uptime", snap.System.Uptime).end(ts)
+	}
+
+	if snap.has("cpu") {
+		f.line(&b, "cpu", host).
+			field("usage_avg", snap.CPU.AvgUsage).
+			field("cores", snap.CPU.Cores).
+			field("threads", snap.CPU.Threads).end(ts)
+		for i, u := range snap.CPU.Usage {
+			f.line(&b, "cpu", host, "cpu", "cpu"+strconv.Itoa(i)).field("usage", u).end(ts)
+		}
+	}
+
+	if snap.has("memory") {
+		m := snap.Memory
+		f.line(&b, "mem", host).
+			field("total", m.Total).field("used", m.Used).field("available", m.Available).
+			field("used_percent", m.UsedPercent).
+			field("swap_total", m.SwapTotal).field("swap_used", m.SwapUsed).
+			field("swap_percent", m.SwapPercent).end(ts)
+	}
+
+	for _, d := range snap.Disks {
+		f.line(&b, "disk", host, "device", d.Device, "path", d.Mountpoint, "fstype", d.Fstype).
+			field("total", d.Total).field("used", d.Used).field("free", d.Free).
+			field("used_percent", d.UsedPercent).end(ts)
+	}
+
+	for _, n := range snap.Network {
+		f.line(&b, "net", host, "interface", n.Name).
+			field("bytes_sent", n.BytesSent).field("bytes_recv", n.BytesRecv).
+			field("send_rate", n.SendRate).field("recv_rate", n.RecvRate).end(ts)
+	}
+
+	if snap.has("load") {
+		f.line(&b, "load", host).
+			field("load1", snap.Load.Load1).field("load5", snap.Load.Load5).field("load15", snap.Load.Load15).end(ts)
+	}
+
+	if f.processes {
+		for _, p := range snap.Processes {
+			f.line(&b, "process", host, "name", p.Name, "pid", strconv.Itoa(int(p.PID))).
+				field("cpu", p.CPU).field("mem", float64(p.Mem)).end(ts)
+		}
+	}
+	return b.Bytes()
+}
+
+// influxHTTP posts to a /write (1.x) or /api/v2/write (2.x) URL. The URL
+// carries db/bucket/org; 1.x credentials can go in it as user:pass@.
+type influxHTTP struct {
+	influxFormat
+	url    string
+	token  string
+	client *http.Client
+}
+
+func newInfluxHTTP(oc OutputConfig) (*influxHTTP, error) {
+	if !strings.HasPrefix(oc.URL, "http://") && !strings.HasPrefix(oc.URL, "https://") {
+		return nil, fmt.Errorf("output: influx-http needs an http(s) write URL, got %q", oc.URL)
+	}
+	return &influxHTTP{
+		influxFormat: newInfluxFormat(oc),
+		url:          oc.URL,
+		token:        oc.Token,
+		client:       &http.Client{Timeout: 10 * time.Second},
+	}, nil
+}
+
+func (w *influxHTTP) spools() bool { return true }
+
+func (w *influxHTTP) write(batch []byte) error {
+	req, err := http.NewRequest(http.MethodPost, w.url, bytes.NewReader(batch))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if w.token != "" {
+		req.Header.Set("Authorization", "Token "+w.token)
+	}
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		err := fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(msg))
+		if resp.StatusCode/100 == 4 && resp.StatusCode != http.StatusRequestTimeout && resp.StatusCode != http.StatusTooManyRequests {
+			return rejectedError{fmt.Errorf("rejected: %w", err)}
+		}
+		return err
+	}
+	return nil
+}
+
+// influxUDP sends line protocol datagrams. Loss can't be detected, so
+// nothing is spooled.
+type influxUDP struct {
+	influxFormat
+	addr string
+}
+
+func newInfluxUDP(oc OutputConfig) (*influxUDP, error) {
+	if _, _, err := net.SplitHostPort(oc.URL); err != nil {
+		return nil, fmt.Errorf("output: influx-udp needs host:port, got %q", oc.URL)
+	}
+	return &influxUDP{influxFormat: newInfluxFormat(oc), addr: oc.URL}, nil
+}
+
+func (w *influxUDP) spools() bool { return false }
+
+func (w *influxUDP) write(batch []byte) error {
+	conn, err := net.Dial("udp", w.addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	// 按行切成不超过一个包的块
+	for len(batch) > 0 {
+		n := len(batch)
+		if n > influxUDPPacket {
+			n = bytes.LastIndexByte(batch[:influxUDPPacket], '\n') + 1
+			if n == 0 {
+				n = bytes.IndexByte(batch, '\n') + 1 // 单行就超长，只能整行发
+				if n == 0 {
+					n = len(batch)
+				}
+			}
+		}
+		if _, err := conn.Write(batch[:n]); err != nil {
+			return err
+		}
+		batch = batch[n:]
+	}
+	return nil
+}
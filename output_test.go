@@ -0,0 +1,158 @@
+// Copyright (C) 2025 Russell Li (xiaoxinmm)
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"sysmon/monitor"
+)
+
+// influxStandIn answers each write with status[line] for the batch's
+// first line, 204 when it has none, and records the batches it took.
+type influxStandIn struct {
+	status   map[string]int
+	accepted []string
+}
+
+func (s *influxStandIn) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	line, _, _ := strings.Cut(string(body), "\n")
+	if code, ok := s.status[line]; ok {
+		http.Error(w, `{"error":"nope"}`, code)
+		return
+	}
+	s.accepted = append(s.accepted, line)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func testOutput(t *testing.T, srv *httptest.Server, spooled bool) *output {
+	t.Helper()
+	oc := OutputConfig{Type: "influx-http", URL: srv.URL + "/write?db=x"}
+	if spooled {
+		oc.SpoolDir = t.TempDir()
+	}
+	outs, err := newOutputs([]OutputConfig{oc})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return outs[0]
+}
+
+func TestInfluxErrorClasses(t *testing.T) {
+	for code, rejected := range map[int]bool{
+		400: true, 401: true, 404: true, 413: true,
+		408: false, 429: false, 500: false, 503: false,
+	} {
+		srv := httptest.NewServer(&influxStandIn{status: map[string]int{"a": code}})
+		w, _ := newInfluxHTTP(OutputConfig{URL: srv.URL})
+		err := w.write([]byte("a\n"))
+		if err == nil || isRejected(err) != rejected {
+			t.Errorf("%d: err %v, rejected %v, want %v", code, err, isRejected(err), rejected)
+		}
+		srv.Close()
+	}
+	w, _ := newInfluxHTTP(OutputConfig{URL: "http://127.0.0.1:1/write"})
+	if err := w.write([]byte("a\n")); err == nil || isRejected(err) {
+		t.Errorf("connection refused: %v", err)
+	}
+}
+
+// TestRejectedBatchDoesNotBlockSpool spools three batches while the
+// receiver is down, then has it reject the oldest: the other two still go
+// through, and the rejected one is kept aside.
+func TestRejectedBatchDoesNotBlockSpool(t *testing.T) {
+	db := &influxStandIn{status: map[string]int{"one": 503, "two": 503, "three": 503}}
+	srv := httptest.NewServer(db)
+	defer srv.Close()
+	o := testOutput(t, srv, true)
+
+	for _, b := range []string{"one", "two", "three"} {
+		o.flush([]byte(b + "\n"))
+	}
+	if files, _ := o.spool.files(".spool"); len(files) != 3 {
+		t.Fatalf("%d batches spooled, want 3", len(files))
+	}
+
+	db.status = map[string]int{"one": 400, "four": 422}
+	o.flush([]byte("four\n"))
+	o.flush([]byte("five\n"))
+	if got := strings.Join(db.accepted, " "); got != "two three five" {
+		t.Errorf("accepted %q", got)
+	}
+	if files, _ := o.spool.files(".spool"); len(files) != 0 {
+		t.Errorf("%d batches still spooled", len(files))
+	}
+	rejected, _ := o.spool.files(".rejected")
+	if len(rejected) != 2 {
+		t.Fatalf("%d batches kept as rejected, want 2", len(rejected))
+	}
+	for i, want := range []string{"one\n", "four\n"} {
+		data, _ := os.ReadFile(filepath.Join(o.spool.dir, rejected[i].Name()))
+		if string(data) != want {
+			t.Errorf("rejected #%d holds %q, want %q", i, data, want)
+		}
+	}
+
+	// a 429 is the receiver asking to slow down: keep it spooled
+	db.status = map[string]int{"six": 429}
+	o.flush([]byte("six\n"))
+	if files, _ := o.spool.files(".spool"); len(files) != 1 {
+		t.Errorf("429: %d batches spooled, want 1", len(files))
+	}
+}
+
+func TestRejectedBatchesCapped(t *testing.T) {
+	s, err := newSpool(t.TempDir(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < spoolRejectedKeep+5; i++ {
+		s.keepRejected([]byte("x\n"))
+	}
+	if files, _ := s.files(".rejected"); len(files) != spoolRejectedKeep {
+		t.Errorf("%d rejected batches kept, want %d", len(files), spoolRejectedKeep)
+	}
+}
+
+// TestInfluxEmptyTags is what a receiver would reject: a tag with no
+// value. Those are left out, and host still comes from the OS when the
+// system section is off.
+func TestInfluxEmptyTags(t *testing.T) {
+	var snap Snapshot
+	snap.setSection("disks", []monitor.DiskInfo{{Mountpoint: "/", Total: 10}})
+	snap.setSection("processes", []monitor.ProcessInfo{{PID: 7, CPU: 1}})
+	f := newInfluxFormat(OutputConfig{Tags: map[string]string{"dc": "", "env": "prod"}, Processes: true})
+	out := string(f.lines(snap))
+	hostname, _ := os.Hostname()
+	for _, want := range []string{
+		"sysmon_disk,host=" + hostname + ",path=/,env=prod total=10i",
+		"sysmon_process,host=" + hostname + ",pid=7,env=prod cpu=1,",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("no %q in\n%s", want, out)
+		}
+	}
+	if strings.Contains(out, "=,") || strings.Contains(out, "= ") {
+		t.Errorf("empty tag value in\n%s", out)
+	}
+}
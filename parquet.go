@@ -0,0 +1,509 @@
+// Copyright (C) 2025 Russell Li (xiaoxinmm)
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+// Parquet for history export and import: the columns of historyRow, all
+// required, PLAIN encoded and uncompressed, in one row group with one
+// data page per column. That is the simplest file every reader (pandas,
+// DuckDB, Spark) accepts. Reading takes the same layout back, which is
+// what sysmon writes; dictionary encoding or compression are refused.
+// Field numbers are from parquet-format's parquet.thrift; the metadata is
+// in Thrift's compact protocol.
+
+const parquetMagic = "PAR1"
+
+// 物理类型、converted type、编码等枚举值
+const (
+	pqInt64     = 2
+	pqDouble    = 5
+	pqByteArray = 6
+
+	pqRequired = 0
+
+	pqUTF8            = 0
+	pqTimestampMillis = 9
+
+	pqPlain = 0
+	pqRLE   = 3
+
+	pqDataPage = 0
+)
+
+type parquetColumn struct {
+	name      string
+	typ       int32
+	converted int32 // -1 = none
+}
+
+var parquetColumns = []parquetColumn{
+	{"time", pqInt64, pqTimestampMillis},
+	{"metric", pqByteArray, pqUTF8},
+	{"labels", pqByteArray, pqUTF8}, // JSON object
+	{"step", pqInt64, -1},
+	{"value", pqDouble, -1},
+	{"min", pqDouble, -1},
+	{"max", pqDouble, -1},
+}
+
+// writeParquet writes rows as a Parquet file.
+func writeParquet(w io.Writer, rows []historyRow) error {
+	var out bytes.Buffer
+	out.WriteString(parquetMagic)
+	type chunkInfo struct {
+		offset, size int64
+	}
+	chunks := make([]chunkInfo, len(parquetColumns))
+	for c, col := range parquetColumns {
+		var page []byte
+		for _, r := range rows {
+			switch col.name {
+			case "time":
+				page = binary.LittleEndian.AppendUint64(page, uint64(r.Time))
+			case "metric":
+				page = appendByteArray(page, []byte(r.Metric))
+			case "labels":
+				page = appendByteArray(page, r.labelsJSON())
+			case "step":
+				page = binary.LittleEndian.AppendUint64(page, uint64(r.Step))
+			case "value":
+				page = binary.LittleEndian.AppendUint64(page, math.Float64bits(r.Value))
+			case "min":
+				page = binary.LittleEndian.AppendUint64(page, math.Float64bits(r.Min))
+			case "max":
+				page = binary.LittleEndian.AppendUint64(page, math.Float64bits(r.Max))
+			}
+		}
+		if len(page) > math.MaxInt32 {
+			return errors.New("parquet: too much data for one page")
+		}
+		var hdr tbuf
+		hdr.i32(1, pqDataPage)
+		hdr.i32(2, int32(len(page)))
+		hdr.i32(3, int32(len(page)))
+		hdr.structure(5, func(t *tbuf) {
+			t.i32(1, int32(len(rows)))
+			t.i32(2, pqPlain)
+			t.i32(3, pqRLE)
+			t.i32(4, pqRLE)
+		})
+		hdr.end()
+		chunks[c] = chunkInfo{int64(out.Len()), int64(len(hdr.b) + len(page))}
+		out.Write(hdr.b)
+		out.Write(page)
+	}
+
+	var meta tbuf
+	meta.i32(1, 1)
+	meta.list(2, len(parquetColumns)+1, func(t *tbuf, i int) {
+		if i == 0 {
+			t.binary(4, []byte("schema"))
+			t.i32(5, int32(len(parquetColumns)))
+			return
+		}
+		col := parquetColumns[i-1]
+		t.i32(1, col.typ)
+		t.i32(3, pqRequired)
+		t.binary(4, []byte(col.name))
+		if col.converted >= 0 {
+			t.i32(6, col.converted)
+		}
+	})
+	meta.i64(3, int64(len(rows)))
+	var total int64
+	for _, ch := range chunks {
+		total += ch.size
+	}
+	meta.list(4, 1, func(t *tbuf, _ int) {
+		t.list(1, len(parquetColumns), func(t *tbuf, c int) {
+			col := parquetColumns[c]
+			t.i64(2, chunks[c].offset)
+			t.structure(3, func(t *tbuf) {
+				t.i32(1, col.typ)
+				t.i32List(2, pqPlain)
+				t.binaryList(3, []byte(col.name))
+				t.i32(4, 0) // UNCOMPRESSED
+				t.i64(5, int64(len(rows)))
+				t.i64(6, chunks[c].size)
+				t.i64(7, chunks[c].size)
+				t.i64(9, chunks[c].offset)
+			})
+		})
+		t.i64(2, total)
+		t.i64(3, int64(len(rows)))
+	})
+	meta.binary(6, []byte("sysmon"))
+	meta.end()
+	out.Write(meta.b)
+	out.Write(binary.LittleEndian.AppendUint32(nil, uint32(len(meta.b))))
+	out.WriteString(parquetMagic)
+	_, err := w.Write(out.Bytes())
+	return err
+}
+
+func appendByteArray(b, v []byte) []byte {
+	b = binary.LittleEndian.AppendUint32(b, uint32(len(v)))
+	return append(b, v...)
+}
+
+// readParquet reads rows back from a file written by writeParquet, or any
+// file with the same columns, uncompressed and PLAIN encoded.
+func readParquet(data []byte) ([]historyRow, error) {
+	n := len(data)
+	if n < 12 || string(data[:4]) != parquetMagic || string(data[n-4:]) != parquetMagic {
+		return nil, errors.New("parquet: not a Parquet file")
+	}
+	metaLen := int(binary.LittleEndian.Uint32(data[n-8:]))
+	if metaLen > n-12 {
+		return nil, errors.New("parquet: bad footer")
+	}
+	meta, err := readThriftStruct(bytes.NewReader(data[n-8-metaLen : n-8]))
+	if err != nil {
+		return nil, fmt.Errorf("parquet: metadata: %w", err)
+	}
+
+	// 只认平铺、必填的列
+	schema, _ := meta[2].([]interface{})
+	for _, el := range schema[min(1, len(schema)):] {
+		el, _ := el.(tstruct)
+		if rep, ok := el[3].(int64); ok && rep != pqRequired {
+			return nil, fmt.Errorf("parquet: column %s is not required; only files as sysmon writes them can be imported", el[4])
+		}
+	}
+
+	var rows []historyRow
+	groups, _ := meta[4].([]interface{})
+	for _, g := range groups {
+		g, _ := g.(tstruct)
+		numRows, _ := g[3].(int64)
+		if numRows < 0 || numRows > int64(n) {
+			return nil, errors.New("parquet: bad row count")
+		}
+		base := len(rows)
+		rows = append(rows, make([]historyRow, numRows)...)
+		group := rows[base:]
+		seen := 0
+		cols, _ := g[1].([]interface{})
+		for _, c := range cols {
+			c, _ := c.(tstruct)
+			md, _ := c[3].(tstruct)
+			path, _ := md[3].([]interface{})
+			if len(path) != 1 {
+				continue
+			}
+			nameBytes, _ := path[0].([]byte)
+			name := string(nameBytes)
+			if codec, _ := md[4].(int64); codec != 0 {
+				return nil, fmt.Errorf("parquet: column %s is compressed; only uncompressed files can be imported", name)
+			}
+			offset, _ := md[9].(int64)
+			if offset < 4 || offset >= int64(n-8-metaLen) {
+				return nil, fmt.Errorf("parquet: column %s: bad offset", name)
+			}
+			if err := readParquetColumn(data[offset:n-8-metaLen], name, group); err != nil {
+				return nil, fmt.Errorf("parquet: column %s: %w", name, err)
+			}
+			if name == "time" || name == "metric" || name == "value" {
+				seen++
+			}
+		}
+		if seen < 3 {
+			return nil, errors.New("parquet: needs time, metric and value columns")
+		}
+		for i, r := range group {
+			if r.Metric == "" {
+				return nil, fmt.Errorf("parquet: row %d: no metric", base+i+1)
+			}
+		}
+	}
+	return rows, nil
+}
+
+// readParquetColumn decodes the data pages of one column into rows.
+func readParquetColumn(data []byte, name string, rows []historyRow) error {
+	r := bytes.NewReader(data)
+	done := 0
+	for done < len(rows) {
+		hdr, err := readThriftStruct(r)
+		if err != nil {
+			return err
+		}
+		size, _ := hdr[3].(int64)
+		if size < 0 || size > int64(r.Len()) {
+			return errors.New("bad page size")
+		}
+		page := make([]byte, size)
+		io.ReadFull(r, page)
+		if typ, _ := hdr[1].(int64); typ != pqDataPage {
+			return errors.New("only plain data pages are supported")
+		}
+		dph, _ := hdr[5].(tstruct)
+		count, _ := dph[1].(int64)
+		if enc, _ := dph[2].(int64); enc != pqPlain {
+			return errors.New("only PLAIN encoding is supported")
+		}
+		if count < 0 || done+int(count) > len(rows) {
+			return errors.New("more values than rows")
+		}
+		p := page
+		for i := done; i < done+int(count); i++ {
+			switch name {
+			case "time", "step":
+				if len(p) < 8 {
+					return io.ErrUnexpectedEOF
+				}
+				v := int64(binary.LittleEndian.Uint64(p))
+				if name == "time" {
+					rows[i].Time = v
+				} else {
+					rows[i].Step = v
+				}
+				p = p[8:]
+			case "value", "min", "max":
+				if len(p) < 8 {
+					return io.ErrUnexpectedEOF
+				}
+				v := math.Float64frombits(binary.LittleEndian.Uint64(p))
+				switch name {
+				case "value":
+					rows[i].Value = v
+				case "min":
+					rows[i].Min = v
+				default:
+					rows[i].Max = v
+				}
+				p = p[8:]
+			case "metric", "labels":
+				if len(p) < 4 || int(binary.LittleEndian.Uint32(p)) > len(p)-4 {
+					return io.ErrUnexpectedEOF
+				}
+				l := int(binary.LittleEndian.Uint32(p))
+				v := p[4 : 4+l]
+				if name == "metric" {
+					rows[i].Metric = string(v)
+				} else if l > 0 {
+					if err := json.Unmarshal(v, &rows[i].Labels); err != nil {
+						return err
+					}
+				}
+				p = p[4+l:]
+			default:
+				return nil // 不认识的列不管
+			}
+		}
+		done += int(count)
+	}
+	return nil
+}
+
+// tbuf is a minimal Thrift compact protocol writer: the field types the
+// Parquet metadata uses.
+type tbuf struct {
+	b    []byte
+	last int16 // previous field id of the struct being written
+}
+
+const (
+	tI32    = 5
+	tI64    = 6
+	tBinary = 8
+	tList   = 9
+	tStruct = 12
+)
+
+func (t *tbuf) field(id int16, typ byte) {
+	if d := id - t.last; d > 0 && d <= 15 {
+		t.b = append(t.b, byte(d)<<4|typ)
+	} else {
+		t.b = append(t.b, typ)
+		t.b = binary.AppendVarint(t.b, int64(id))
+	}
+	t.last = id
+}
+
+func (t *tbuf) i32(id int16, v int32) {
+	t.field(id, tI32)
+	t.b = binary.AppendVarint(t.b, int64(v))
+}
+
+func (t *tbuf) i64(id int16, v int64) {
+	t.field(id, tI64)
+	t.b = binary.AppendVarint(t.b, v)
+}
+
+func (t *tbuf) binary(id int16, v []byte) {
+	t.field(id, tBinary)
+	t.b = binary.AppendUvarint(t.b, uint64(len(v)))
+	t.b = append(t.b, v...)
+}
+
+// end closes a struct.
+func (t *tbuf) end() {
+	t.b = append(t.b, 0)
+}
+
+func (t *tbuf) structure(id int16, encode func(*tbuf)) {
+	t.field(id, tStruct)
+	t.nested(encode)
+}
+
+func (t *tbuf) nested(encode func(*tbuf)) {
+	last := t.last
+	t.last = 0
+	encode(t)
+	t.end()
+	t.last = last
+}
+
+func (t *tbuf) listHeader(id int16, n int, elem byte) {
+	t.field(id, tList)
+	if n < 15 {
+		t.b = append(t.b, byte(n)<<4|elem)
+	} else {
+		t.b = append(t.b, 0xf0|elem)
+		t.b = binary.AppendUvarint(t.b, uint64(n))
+	}
+}
+
+// list writes n structs.
+func (t *tbuf) list(id int16, n int, encode func(t *tbuf, i int)) {
+	t.listHeader(id, n, tStruct)
+	for i := 0; i < n; i++ {
+		t.nested(func(t *tbuf) { encode(t, i) })
+	}
+}
+
+func (t *tbuf) i32List(id int16, vs ...int32) {
+	t.listHeader(id, len(vs), tI32)
+	for _, v := range vs {
+		t.b = binary.AppendVarint(t.b, int64(v))
+	}
+}
+
+func (t *tbuf) binaryList(id int16, vs ...[]byte) {
+	t.listHeader(id, len(vs), tBinary)
+	for _, v := range vs {
+		t.b = binary.AppendUvarint(t.b, uint64(len(v)))
+		t.b = append(t.b, v...)
+	}
+}
+
+// tstruct is a decoded Thrift struct: field id to int64, []byte, bool,
+// []interface{} or tstruct.
+type tstruct map[int16]interface{}
+
+// thriftMaxDepth caps how deep structs and lists may nest. Parquet
+// metadata needs about 6; deeper is a damaged or hostile file, and
+// following it would overflow the stack.
+const thriftMaxDepth = 16
+
+var errThriftDepth = errors.New("thrift: nested too deep")
+
+func readThriftStruct(r *bytes.Reader) (tstruct, error) {
+	return readThriftFields(r, 0)
+}
+
+func readThriftFields(r *bytes.Reader, depth int) (tstruct, error) {
+	s := tstruct{}
+	var last int16
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		if b == 0 {
+			return s, nil
+		}
+		typ := b & 0x0f
+		id := last + int16(b>>4)
+		if b>>4 == 0 {
+			v, err := binary.ReadVarint(r)
+			if err != nil {
+				return nil, err
+			}
+			id = int16(v)
+		}
+		last = id
+		if typ == 1 || typ == 2 {
+			s[id] = typ == 1 // 布尔值就在类型里
+			continue
+		}
+		if s[id], err = readThriftValue(r, typ, depth); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func readThriftValue(r *bytes.Reader, typ byte, depth int) (interface{}, error) {
+	if (typ == tList || typ == 10 || typ == tStruct) && depth >= thriftMaxDepth {
+		return nil, errThriftDepth
+	}
+	switch typ {
+	case 1, 2: // 列表里的布尔值占一个字节
+		b, err := r.ReadByte()
+		return b == 1, err
+	case 3:
+		b, err := r.ReadByte()
+		return int64(int8(b)), err
+	case 4, 5, tI64:
+		return binary.ReadVarint(r)
+	case 7:
+		var b [8]byte
+		_, err := io.ReadFull(r, b[:])
+		return math.Float64frombits(binary.LittleEndian.Uint64(b[:])), err
+	case tBinary:
+		n, err := binary.ReadUvarint(r)
+		if err != nil || n > uint64(r.Len()) {
+			return nil, errors.New("bad binary length")
+		}
+		b := make([]byte, n)
+		_, err = io.ReadFull(r, b)
+		return b, err
+	case tList, 10:
+		h, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		n, elem := uint64(h>>4), h&0x0f
+		if n == 15 {
+			if n, err = binary.ReadUvarint(r); err != nil {
+				return nil, err
+			}
+		}
+		if n > uint64(r.Len()) {
+			return nil, errors.New("bad list length")
+		}
+		out := make([]interface{}, n)
+		for i := range out {
+			if out[i], err = readThriftValue(r, elem, depth+1); err != nil {
+				return nil, err
+			}
+		}
+		return out, nil
+	case tStruct:
+		return readThriftFields(r, depth+1)
+	}
+	return nil, fmt.Errorf("unsupported thrift type %d", typ)
+}
@@ -0,0 +1,98 @@
+// Copyright (C) 2025 Russell Li (xiaoxinmm)
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"sort"
+	"strconv"
+	"time"
+
+	"sysmon/monitor"
+)
+
+// Process history. Every processHistoryInterval seconds, whether or not
+// anyone is watching, the top processHistoryTop processes by CPU, by
+// memory and by I/O since the last round are recorded into history as
+// process_cpu, process_memory and process_io, labelled pid and name, so a
+// spike can be attributed afterwards (GET /api/v1/history/processes).
+// Processes that start and exit between two rounds aren't seen.
+//
+// Each round is also recorded per name, summed over that name's processes.
+// Only those series are rolled up: the per-pid ones go once their raw
+// points have expired, so short-lived processes don't pile up a series
+// each for the 30 days of hourly rollups.
+
+func runProcessHistory(every time.Duration, top int) {
+	sampler := monitor.NewProcessSampler()
+	sampler.Sample()
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+	for range ticker.C {
+		procs := topProcesses(sampler.Sample(), top)
+		if len(procs) == 0 {
+			continue
+		}
+		samples := make([]monitor.Sample, 0, 6*len(procs))
+		byName := make(map[string]*monitor.ProcessSample)
+		var names []string
+		for _, p := range procs {
+			samples = append(samples, processSamples(monitor.Labels{"pid": strconv.Itoa(int(p.PID)), "name": p.Name}, p)...)
+			sum := byName[p.Name]
+			if sum == nil {
+				sum = &monitor.ProcessSample{Name: p.Name}
+				byName[p.Name] = sum
+				names = append(names, p.Name)
+			}
+			sum.CPU += p.CPU
+			sum.RSS += p.RSS
+			sum.IO += p.IO
+		}
+		for _, name := range names {
+			samples = append(samples, processSamples(monitor.Labels{"name": name}, *byName[name])...)
+		}
+		monitor.Record(time.Now().UnixMilli(), samples)
+	}
+}
+
+func processSamples(labels monitor.Labels, p monitor.ProcessSample) []monitor.Sample {
+	return []monitor.Sample{
+		{Metric: monitor.ProcessMetrics["cpu"], Labels: labels, Value: p.CPU},
+		{Metric: monitor.ProcessMetrics["memory"], Labels: labels, Value: float64(p.RSS)},
+		{Metric: monitor.ProcessMetrics["io"], Labels: labels, Value: p.IO},
+	}
+}
+
+// topProcesses picks the first n by CPU, by memory and by I/O, in PID
+// order. Idle processes don't make the CPU or I/O lists.
+func topProcesses(procs []monitor.ProcessSample, n int) []monitor.ProcessSample {
+	picked := make(map[int32]monitor.ProcessSample)
+	for _, key := range []func(p monitor.ProcessSample) float64{
+		func(p monitor.ProcessSample) float64 { return p.CPU },
+		func(p monitor.ProcessSample) float64 { return float64(p.RSS) },
+		func(p monitor.ProcessSample) float64 { return p.IO },
+	} {
+		sort.Slice(procs, func(i, j int) bool { return key(procs[i]) > key(procs[j]) })
+		for i := 0; i < n && i < len(procs) && key(procs[i]) > 0; i++ {
+			picked[procs[i].PID] = procs[i]
+		}
+	}
+	out := make([]monitor.ProcessSample, 0, len(picked))
+	for _, p := range picked {
+		out = append(out, p)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].PID < out[j].PID })
+	return out
+}
@@ -0,0 +1,254 @@
+// Copyright (C) 2025 Russell Li (xiaoxinmm)
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+
+	"sysmon/monitor"
+)
+
+// JSON Schemas are generated from the Go types by reflection rather than
+// written by hand, so they can't drift from what encoding/json produces.
+// A field is required unless it is tagged omitempty.
+
+type jsonSchema = map[string]interface{}
+
+// schemaGen collects the named struct types it meets into defs and refers
+// to them as prefix+Name ("#/$defs/" or "#/components/schemas/").
+type schemaGen struct {
+	prefix string
+	defs   map[string]jsonSchema
+}
+
+func newSchemaGen(prefix string) *schemaGen {
+	return &schemaGen{prefix: prefix, defs: make(map[string]jsonSchema)}
+}
+
+func (g *schemaGen) ref(name string) jsonSchema {
+	return jsonSchema{"$ref": g.prefix + name}
+}
+
+func (g *schemaGen) of(v interface{}) jsonSchema {
+	return g.schemaFor(reflect.TypeOf(v))
+}
+
+func (g *schemaGen) schemaFor(t reflect.Type) jsonSchema {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		return jsonSchema{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return jsonSchema{"type": "integer"}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return jsonSchema{"type": "integer", "minimum": 0}
+	case reflect.Float32, reflect.Float64:
+		return jsonSchema{"type": "number"}
+	case reflect.String:
+		return jsonSchema{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return jsonSchema{"type": "string", "contentEncoding": "base64"}
+		}
+		return jsonSchema{"type": []string{"array", "null"}, "items": g.schemaFor(t.Elem())}
+	case reflect.Map:
+		return jsonSchema{"type": "object", "additionalProperties": g.schemaFor(t.Elem())}
+	case reflect.Interface:
+		return jsonSchema{}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return g.structSchema(t)
+		}
+		// 未导出的类型名也用大写开头，生成的客户端代码好看些
+		name := strings.ToUpper(t.Name()[:1]) + t.Name()[1:]
+		if _, ok := g.defs[name]; !ok {
+			g.defs[name] = nil // 占位，防止递归类型死循环
+			g.defs[name] = g.structSchema(t)
+		}
+		return g.ref(name)
+	}
+	return jsonSchema{}
+}
+
+func (g *schemaGen) structSchema(t reflect.Type) jsonSchema {
+	props := jsonSchema{}
+	var required []string
+	g.addFields(t, props, &required)
+	sort.Strings(required)
+	s := jsonSchema{"type": "object", "properties": props, "additionalProperties": false}
+	if len(required) > 0 {
+		s["required"] = required
+	}
+	if t == reflect.TypeOf(Snapshot{}) {
+		// 哪些 section 在由启用的 collector 决定，第三方的 section 什么都可能是
+		s["required"] = []string{"timestamp"}
+		s["additionalProperties"] = jsonSchema{"description": "Section from a collector outside the monitor package; see GET /api/v1/collectors"}
+	}
+	return s
+}
+
+func (g *schemaGen) addFields(t reflect.Type, props jsonSchema, required *[]string) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+		if f.Anonymous && name == "" && f.Type.Kind() == reflect.Struct {
+			g.addFields(f.Type, props, required)
+			continue
+		}
+		if !f.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		props[name] = g.schemaFor(f.Type)
+		if !strings.Contains(opts, "omitempty") {
+			*required = append(*required, name)
+		}
+	}
+}
+
+// wsMessageSchema describes one wsMessage envelope with a typed payload.
+func (g *schemaGen) wsMessageSchema(m messageDef) jsonSchema {
+	payload := g.of(m.Payload)
+	if len(m.Optional) > 0 {
+		// inline a copy of the struct with the optional fields relaxed
+		payload = g.structSchema(reflect.TypeOf(m.Payload))
+		var required []string
+		for _, f := range payload["required"].([]string) {
+			optional := false
+			for _, o := range m.Optional {
+				optional = optional || o == f
+			}
+			if !optional {
+				required = append(required, f)
+			}
+		}
+		payload["required"] = required
+	}
+	if m.Alt != nil {
+		payload = jsonSchema{"oneOf": []jsonSchema{payload, g.of(m.Alt)}}
+	}
+	props := jsonSchema{
+		"type":    jsonSchema{"const": m.Type},
+		"payload": payload,
+	}
+	if m.HasSeq {
+		props["seq"] = jsonSchema{"type": "integer", "minimum": 1}
+	}
+	return jsonSchema{
+		"type":                 "object",
+		"description":          m.Description,
+		"properties":           props,
+		"required":             []string{"payload", "type"},
+		"additionalProperties": false,
+	}
+}
+
+// messageDef is one message on /ws (and /api/stream). Payload is a zero
+// value of the Go type that is actually sent; Optional lists payload
+// fields that may be missing even though the Go type always has them.
+type messageDef struct {
+	Type        string
+	Description string
+	Payload     interface{}
+	HasSeq      bool
+	Optional    []string
+	Alt         interface{} // another payload type the message can carry
+}
+
+// serverMessages lists every message the server sends. Add new message
+// types here so they show up in the schemas.
+var serverMessages = []messageDef{
+	{
+		Type:        "snapshot",
+		Description: "Full system snapshot. Carries seq in delta mode. Sections the client did not subscribe to are left out.",
+		Payload:     Snapshot{},
+		HasSeq:      true,
+		Optional:    []string{"cpu", "load", "memory", "disks", "network", "processes"},
+	},
+	{
+		Type:        "delta",
+		Description: "Changes since the message numbered payload.base (delta mode only).",
+		Payload:     deltaPayload{},
+		HasSeq:      true,
+	},
+	{
+		Type:        "history",
+		Description: "History, sent on connect (and on a history control message). CPU and memory points, or series when the client picked metrics with ?history= or the history control message.",
+		Payload:     []monitor.HistoryPoint{},
+		Alt:         []monitor.Series{},
+	},
+	{Type: "docker", Description: "Docker containers, every 5 seconds.", Payload: []monitor.DockerContainer{}},
+	{Type: "settings", Description: "Effective per-connection settings, reply to a control message.", Payload: clientSettings{}},
+	{Type: "alerts", Description: "Pending and firing alerts, sent on connect (and when alerts is subscribed later).", Payload: []alert{}},
+	{Type: "alert", Description: "An alert changed state: pending, firing, resolved, or inactive (cleared before firing).", Payload: alert{}},
+	{Type: "anomalies", Description: "Anomaly scores, most unusual first. Sent on connect and whenever a series turns anomalous or back to normal.", Payload: []anomalyScore{}},
+	{Type: "shutdown", Description: "The server is going away (SSE only; websockets get a 1001 close frame).", Payload: shutdownNotice{}},
+}
+
+// messageSchema returns a standalone JSON Schema (2020-12) for one server
+// message type, or for "control", the client-to-server messages.
+func messageSchema(name string) (jsonSchema, bool) {
+	g := newSchemaGen("#/$defs/")
+	var s jsonSchema
+	if name == "control" {
+		s = g.controlSchema()
+	} else {
+		for _, m := range serverMessages {
+			if m.Type == name {
+				s = g.wsMessageSchema(m)
+				break
+			}
+		}
+	}
+	if s == nil {
+		return nil, false
+	}
+	s["$schema"] = "https://json-schema.org/draft/2020-12/schema"
+	s["$id"] = "/api/schema/" + name + ".json"
+	s["title"] = name
+	if len(g.defs) > 0 {
+		s["$defs"] = g.defs
+	}
+	return s, true
+}
+
+func (g *schemaGen) controlSchema() jsonSchema {
+	s := g.structSchema(reflect.TypeOf(controlMessage{}))
+	props := s["properties"].(jsonSchema)
+	props["type"] = jsonSchema{"enum": []string{"subscribe", "config", "history", "pause", "resume", "resync"}}
+	props["topics"] = jsonSchema{"type": "array", "items": jsonSchema{"enum": allTopics}}
+	s["required"] = []string{"type"}
+	s["description"] = "Client-to-server control message, always a JSON text frame."
+	return s
+}
+
+func messageSchemaNames() []string {
+	names := []string{"control"}
+	for _, m := range serverMessages {
+		names = append(names, m.Type)
+	}
+	return names
+}
@@ -15,6 +15,66 @@ import (
 
 const shellIdleTimeout = 30 * time.Minute
 
+// shellSession is one running terminal. gorilla allows a single concurrent
+// writer, so everything written to conn goes through write.
+type shellSession struct {
+	conn    *websocket.Conn
+	cmd     *exec.Cmd
+	writeMu sync.Mutex
+}
+
+func (s *shellSession) write(msgType int, data []byte) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	return s.conn.WriteMessage(msgType, data)
+}
+
+// terminate warns the user, closes the websocket and hangs up the shell's
+// process group, the way closing a real terminal would.
+func (s *shellSession) terminate(reason string) {
+	msg, _ := json.Marshal(map[string]string{"type": "notice", "data": reason})
+	s.write(websocket.TextMessage, msg)
+	s.conn.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseGoingAway, reason),
+		time.Now().Add(time.Second))
+	hangupProcessGroup(s.cmd)
+	s.conn.Close()
+}
+
+// shellRegistry tracks live sessions so shutdown can end them.
+type shellRegistry struct {
+	mu       sync.Mutex
+	sessions map[*shellSession]bool
+}
+
+var shells = &shellRegistry{sessions: make(map[*shellSession]bool)}
+
+func (r *shellRegistry) add(s *shellSession) {
+	r.mu.Lock()
+	r.sessions[s] = true
+	r.mu.Unlock()
+}
+
+func (r *shellRegistry) remove(s *shellSession) {
+	r.mu.Lock()
+	delete(r.sessions, s)
+	r.mu.Unlock()
+}
+
+func (r *shellRegistry) count() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.sessions)
+}
+
+func (r *shellRegistry) terminateAll(reason string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for s := range r.sessions {
+		s.terminate(reason)
+	}
+}
+
 // shellMessage is the JSON protocol for text messages on the shell websocket.
 type shellMessage struct {
 	Type string `json:"type"`           // "resize"
@@ -25,7 +85,7 @@ type shellMessage struct {
 // handleShell serves the /ws/shell endpoint.
 // Binary websocket messages carry stdin/stdout bytes.
 // Text websocket messages carry JSON control commands (resize).
-func handleShell(cfg Config) http.HandlerFunc {
+func handleShell(cfg Config, limit *connLimiter) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		// Security: shell must be enabled (enableShell && shell_password set)
 		if !cfg.ShellEnabled() {
@@ -44,12 +104,20 @@ func handleShell(cfg Config) http.HandlerFunc {
 			return
 		}
 
+		release, reason := limit.acquire(clientIP(r))
+		if release == nil {
+			rejectWebSocket(w, r, reason)
+			return
+		}
+		defer release()
+
 		conn, err := upgrader.Upgrade(w, r, nil)
 		if err != nil {
 			log.Printf("shell: websocket upgrade failed: %v", err)
 			return
 		}
 		defer conn.Close()
+		conn.SetReadLimit(int64(cfg.MaxMessageSize))
 
 		// Determine shell
 		shell := os.Getenv("SHELL")
@@ -67,13 +135,18 @@ func handleShell(cfg Config) http.HandlerFunc {
 			return
 		}
 
-		// Cleanup on exit
+		sess := &shellSession{conn: conn, cmd: cmd}
+		shells.add(sess)
+		defer shells.remove(sess)
+
+		// Cleanup on exit. pty.Start makes the shell a session leader, so
+		// killing its process group also takes out background jobs.
 		var closeOnce sync.Once
 		cleanup := func() {
 			closeOnce.Do(func() {
 				ptmx.Close()
 				if cmd.Process != nil {
-					cmd.Process.Kill()
+					killProcessGroup(cmd)
 					cmd.Wait()
 				}
 			})
@@ -105,7 +178,7 @@ func handleShell(cfg Config) http.HandlerFunc {
 					return
 				}
 				if n > 0 {
-					if err := conn.WriteMessage(websocket.BinaryMessage, buf[:n]); err != nil {
+					if err := sess.write(websocket.BinaryMessage, buf[:n]); err != nil {
 						return
 					}
 				}
@@ -146,7 +219,7 @@ func handleShell(cfg Config) http.HandlerFunc {
 			// PTY closed
 		case <-idleTimer.C:
 			log.Printf("shell: session idle timeout, disconnecting")
-			conn.WriteMessage(websocket.TextMessage, []byte(`{"type":"error","data":"session timed out (30min idle)"}`))
+			sess.write(websocket.TextMessage, []byte(`{"type":"error","data":"session timed out (30min idle)"}`))
 		}
 	}
 }
@@ -0,0 +1,19 @@
+//go:build windows
+
+package main
+
+import "os/exec"
+
+// No process groups to signal here; just stop the shell itself.
+
+func hangupProcessGroup(cmd *exec.Cmd) {
+	if cmd.Process != nil {
+		cmd.Process.Kill()
+	}
+}
+
+func killProcessGroup(cmd *exec.Cmd) {
+	if cmd.Process != nil {
+		cmd.Process.Kill()
+	}
+}
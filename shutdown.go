@@ -0,0 +1,146 @@
+// Copyright (C) 2025 Russell Li (xiaoxinmm)
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const shutdownReason = "sysmon is shutting down"
+
+type shutdownNotice struct {
+	Reason string `json:"reason"`
+}
+
+// hookReserve is the part of the shutdown timeout held back for the
+// shutdown hooks, so a slow drain can't starve them: half of it, at most
+// 5s. The hooks get whatever is left once the clients are gone.
+func hookReserve(timeout time.Duration) time.Duration {
+	return min(timeout/2, 5*time.Second)
+}
+
+// shutdown hooks flush state that would otherwise be lost on exit. They
+// run after clients are gone, all at once, and should give up when ctx
+// is done.
+type shutdownHook struct {
+	name string
+	fn   func(ctx context.Context)
+}
+
+var (
+	shutdownMu    sync.Mutex
+	shutdownHooks []shutdownHook
+)
+
+func onShutdown(name string, f func(ctx context.Context)) {
+	shutdownMu.Lock()
+	shutdownHooks = append(shutdownHooks, shutdownHook{name, f})
+	shutdownMu.Unlock()
+}
+
+// runShutdownHooks runs the hooks and waits for them until timeout. It
+// logs the ones that didn't finish and reports whether all did.
+func runShutdownHooks(timeout time.Duration) bool {
+	shutdownMu.Lock()
+	hooks := shutdownHooks
+	shutdownMu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	done := make([]chan struct{}, len(hooks))
+	for i, h := range hooks {
+		done[i] = make(chan struct{})
+		go func(h shutdownHook, done chan struct{}) {
+			defer close(done)
+			h.fn(ctx)
+		}(h, done[i])
+	}
+	ok := true
+	for i, h := range hooks {
+		select {
+		case <-done[i]:
+		case <-ctx.Done():
+			select {
+			case <-done[i]:
+			default:
+				log.Printf("shutdown: %s did not finish within %s", h.name, timeout)
+				ok = false
+			}
+		}
+	}
+	return ok
+}
+
+// serve runs srv until SIGINT/SIGTERM, then shuts down within timeout
+// and exits.
+func serve(srv *http.Server, h *hub, timeout time.Duration) {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	errc := make(chan error, 1)
+	go func() { errc <- srv.ListenAndServe() }()
+
+	select {
+	case err := <-errc:
+		log.Fatal(err)
+	case <-ctx.Done():
+	}
+	stop() // 再按一次 Ctrl-C 直接退出
+	log.Printf("shutting down (timeout %s)", timeout)
+
+	if !shutdownWithin(srv, h, timeout) {
+		os.Exit(1)
+	}
+	log.Printf("bye")
+}
+
+// shutdownWithin shuts down in order: refuse and close dashboard
+// clients, warn and kill shell sessions, stop the HTTP server, run the
+// shutdown hooks. All of it takes at most timeout. Clients get all of
+// it but hookReserve; whoever is still connected then is abandoned. It
+// reports whether every hook finished.
+func shutdownWithin(srv *http.Server, h *hub, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	drain := timeout - hookReserve(timeout)
+
+	drained := make(chan struct{})
+	go func() {
+		defer close(drained)
+		h.shutdown(shutdownReason)
+		shells.terminateAll(shutdownReason)
+
+		sctx, cancel := context.WithTimeout(context.Background(), drain)
+		defer cancel()
+		if err := srv.Shutdown(sctx); err != nil && !errors.Is(err, context.DeadlineExceeded) {
+			log.Printf("shutdown: %v", err)
+		}
+	}()
+
+	select {
+	case <-drained:
+	case <-time.After(drain):
+		log.Printf("shutdown: clients still connected after %s, closing anyway", drain)
+	}
+	return runShutdownHooks(time.Until(deadline))
+}
@@ -0,0 +1,137 @@
+// Copyright (C) 2025 Russell Li (xiaoxinmm)
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func withHooks(t *testing.T, hooks ...shutdownHook) {
+	t.Helper()
+	shutdownMu.Lock()
+	saved := shutdownHooks
+	shutdownHooks = hooks
+	shutdownMu.Unlock()
+	t.Cleanup(func() {
+		shutdownMu.Lock()
+		shutdownHooks = saved
+		shutdownMu.Unlock()
+	})
+}
+
+func TestShutdownHooksRunConcurrently(t *testing.T) {
+	var ran atomic.Int32
+	slow := func(ctx context.Context) {
+		select {
+		case <-time.After(100 * time.Millisecond):
+			ran.Add(1)
+		case <-ctx.Done():
+		}
+	}
+	withHooks(t, shutdownHook{"a", slow}, shutdownHook{"b", slow}, shutdownHook{"c", slow})
+	start := time.Now()
+	if !runShutdownHooks(time.Second) {
+		t.Fatal("hooks reported unfinished")
+	}
+	if ran.Load() != 3 {
+		t.Errorf("%d hooks finished", ran.Load())
+	}
+	if d := time.Since(start); d > 250*time.Millisecond {
+		t.Errorf("took %s, hooks ran one after another", d)
+	}
+}
+
+func TestShutdownHookDeadline(t *testing.T) {
+	var sawDeadline atomic.Bool
+	block := make(chan struct{})
+	defer close(block)
+	withHooks(t,
+		shutdownHook{"polite", func(ctx context.Context) {
+			<-ctx.Done()
+			sawDeadline.Store(true)
+		}},
+		shutdownHook{"stuck", func(context.Context) { <-block }},
+	)
+	start := time.Now()
+	if runShutdownHooks(50 * time.Millisecond) {
+		t.Fatal("a stuck hook counted as finished")
+	}
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Errorf("waited %s for a stuck hook", d)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if !sawDeadline.Load() {
+		t.Error("hook context wasn't cancelled at the deadline")
+	}
+}
+
+// TestShutdownWithinTimeout has a request that never finishes and a hook
+// that never returns: sysmon still exits within the configured timeout,
+// and the hooks get the time the drain didn't use.
+func TestShutdownWithinTimeout(t *testing.T) {
+	const timeout = 400 * time.Millisecond
+	for _, stuck := range []bool{false, true} {
+		block := make(chan struct{})
+		srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+			w.(http.Flusher).Flush()
+			<-block
+		}))
+		srv.Start()
+		if stuck {
+			resp, err := http.Get(srv.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+		}
+
+		var budget atomic.Int64
+		withHooks(t,
+			shutdownHook{"flush", func(ctx context.Context) {
+				d, _ := ctx.Deadline()
+				budget.Store(int64(time.Until(d)))
+			}},
+			shutdownHook{"hung", func(ctx context.Context) { <-ctx.Done(); <-block }},
+		)
+		start := time.Now()
+		if shutdownWithin(srv.Config, newHub(), timeout) {
+			t.Error("a hung hook counted as finished")
+		}
+		took := time.Since(start)
+		close(block)
+		srv.Close()
+
+		if took > timeout+50*time.Millisecond {
+			t.Errorf("stuck request %v: shutdown took %s, timeout %s", stuck, took, timeout)
+		}
+		got := time.Duration(budget.Load())
+		switch {
+		case stuck && (got < hookReserve(timeout)-20*time.Millisecond || got > hookReserve(timeout)):
+			t.Errorf("hooks got %s after a slow drain, want about %s", got, hookReserve(timeout))
+		case !stuck && got < timeout-50*time.Millisecond:
+			t.Errorf("hooks got %s after a quick drain, want about %s", got, timeout)
+		}
+	}
+	if hookReserve(30*time.Second) != 5*time.Second || hookReserve(4*time.Second) != 2*time.Second {
+		t.Error("hookReserve isn't half the timeout, at most 5s")
+	}
+}
@@ -0,0 +1,259 @@
+// Copyright (C) 2025 Russell Li (xiaoxinmm)
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Muting notifications. An alert can be acknowledged while it fires,
+// silenced by a matcher for a time range, or fall in a recurring
+// maintenance window. In all three cases it is still evaluated, recorded
+// and shown; only its notifications are dropped. See docs/alerts.md.
+
+// alertMatcher picks alerts. Rule and Instance are globs; empty fields
+// match anything.
+type alertMatcher struct {
+	Rule     string `json:"rule,omitempty"`
+	Instance string `json:"instance,omitempty"`
+	Severity string `json:"severity,omitempty"`
+}
+
+func (m alertMatcher) validate() error {
+	for _, p := range []string{m.Rule, m.Instance} {
+		if _, err := path.Match(p, ""); err != nil {
+			return fmt.Errorf("bad pattern %q", p)
+		}
+	}
+	if m.Severity != "" && !containsString(alertSeverities, m.Severity) {
+		return fmt.Errorf("severity must be info, warning or critical")
+	}
+	return nil
+}
+
+func (m alertMatcher) matches(a *alert) bool {
+	if m.Rule != "" {
+		if ok, _ := path.Match(m.Rule, a.Rule); !ok {
+			return false
+		}
+	}
+	if m.Instance != "" {
+		if ok, _ := path.Match(m.Instance, a.Instance); !ok {
+			return false
+		}
+	}
+	return m.Severity == "" || m.Severity == a.Severity
+}
+
+// Silence mutes matching alerts from StartsAt to EndsAt. Silences are kept
+// in memory only and are dropped once they end.
+type Silence struct {
+	ID string `json:"id"`
+	alertMatcher
+	StartsAt  int64  `json:"startsAt"` // unix ms
+	EndsAt    int64  `json:"endsAt"`
+	Comment   string `json:"comment,omitempty"`
+	CreatedAt int64  `json:"createdAt"`
+}
+
+// silenceRequest is the body of POST /api/v1/silences. EndsAt or Duration
+// is required; StartsAt defaults to now.
+type silenceRequest struct {
+	alertMatcher
+	StartsAt int64  `json:"startsAt,omitempty"`
+	EndsAt   int64  `json:"endsAt,omitempty"`
+	Duration string `json:"duration,omitempty"` // e.g. "2h", instead of endsAt
+	Comment  string `json:"comment,omitempty"`
+}
+
+func newSilence(req silenceRequest, now int64) (Silence, error) {
+	if err := req.validate(); err != nil {
+		return Silence{}, err
+	}
+	s := Silence{alertMatcher: req.alertMatcher, StartsAt: req.StartsAt, EndsAt: req.EndsAt, Comment: req.Comment, CreatedAt: now}
+	if s.StartsAt == 0 {
+		s.StartsAt = now
+	}
+	if req.Duration != "" {
+		d, err := time.ParseDuration(req.Duration)
+		if err != nil || d <= 0 {
+			return Silence{}, fmt.Errorf("bad duration %q", req.Duration)
+		}
+		s.EndsAt = s.StartsAt + d.Milliseconds()
+	}
+	if s.EndsAt <= s.StartsAt || s.EndsAt <= now {
+		return Silence{}, fmt.Errorf("endsAt (or duration) must be in the future and after startsAt")
+	}
+	var id [8]byte
+	rand.Read(id[:])
+	s.ID = hex.EncodeToString(id[:])
+	return s, nil
+}
+
+func (s *Silence) active(now int64) bool { return s.StartsAt <= now && now < s.EndsAt }
+
+// MaintenanceWindow is one entry of the "maintenance" config list: every
+// time Schedule matches, matching alerts are muted for Duration.
+type MaintenanceWindow struct {
+	Name     string `json:"name"`
+	Schedule string `json:"schedule"` // cron, local time: minute hour day-of-month month day-of-week
+	Duration string `json:"duration"` // e.g. "2h"
+	alertMatcher
+}
+
+// 往回找开始时间最多找这么远
+const maxMaintenance = 7 * 24 * time.Hour
+
+type maintenanceWindow struct {
+	MaintenanceWindow
+	cron     *cronSchedule
+	duration time.Duration
+}
+
+func compileMaintenance(w MaintenanceWindow) (*maintenanceWindow, error) {
+	if w.Name == "" {
+		return nil, fmt.Errorf("maintenance window without a name")
+	}
+	c, err := parseCron(w.Schedule)
+	if err != nil {
+		return nil, fmt.Errorf("maintenance %q: %w", w.Name, err)
+	}
+	d, err := time.ParseDuration(w.Duration)
+	if err != nil || d < time.Minute || d > maxMaintenance {
+		return nil, fmt.Errorf("maintenance %q: duration must be between 1m and %s", w.Name, maxMaintenance)
+	}
+	if err := w.validate(); err != nil {
+		return nil, fmt.Errorf("maintenance %q: %w", w.Name, err)
+	}
+	return &maintenanceWindow{MaintenanceWindow: w, cron: c, duration: d}, nil
+}
+
+// activeAt reports whether a window started within duration before t,
+// and when it ends.
+func (w *maintenanceWindow) activeAt(t time.Time) (bool, time.Time) {
+	start := t.Truncate(time.Minute)
+	for m := start; t.Sub(m) < w.duration; m = m.Add(-time.Minute) {
+		if w.cron.matches(m) {
+			return true, m.Add(w.duration)
+		}
+	}
+	return false, time.Time{}
+}
+
+// cronSchedule is a parsed five-field cron expression. Each field is a
+// bit set of the values it allows.
+type cronSchedule struct {
+	minute, hour, dom, month, dow uint64
+	domStar, dowStar              bool
+}
+
+var cronFields = []struct {
+	name     string
+	min, max int
+}{
+	{"minute", 0, 59},
+	{"hour", 0, 23},
+	{"day of month", 1, 31},
+	{"month", 1, 12},
+	{"day of week", 0, 7}, // 0 和 7 都是周日
+}
+
+// parseCron understands *, lists, ranges and steps: "0 2 * * 0",
+// "*/15 * * * *", "30 1 1-7 * 1-5", "0 22 * * 5,6".
+func parseCron(spec string) (*cronSchedule, error) {
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("schedule %q: want 5 fields (minute hour day-of-month month day-of-week)", spec)
+	}
+	var sets [5]uint64
+	for i, f := range fields {
+		set, err := parseCronField(f, cronFields[i].min, cronFields[i].max)
+		if err != nil {
+			return nil, fmt.Errorf("schedule %q: %s: %w", spec, cronFields[i].name, err)
+		}
+		sets[i] = set
+	}
+	if sets[4]&(1<<7) != 0 {
+		sets[4] |= 1 // 7 -> 0
+	}
+	return &cronSchedule{
+		minute: sets[0], hour: sets[1], dom: sets[2], month: sets[3], dow: sets[4],
+		domStar: fields[2] == "*", dowStar: fields[4] == "*",
+	}, nil
+}
+
+func parseCronField(f string, min, max int) (uint64, error) {
+	var set uint64
+	for _, part := range strings.Split(f, ",") {
+		rng, step := part, 1
+		if i := strings.IndexByte(part, '/'); i >= 0 {
+			n, err := strconv.Atoi(part[i+1:])
+			if err != nil || n <= 0 {
+				return 0, fmt.Errorf("bad step in %q", part)
+			}
+			rng, step = part[:i], n
+		}
+		lo, hi := min, max
+		if rng != "*" {
+			a, b, isRange := strings.Cut(rng, "-")
+			var err error
+			if lo, err = strconv.Atoi(a); err != nil {
+				return 0, fmt.Errorf("bad value %q", part)
+			}
+			hi = lo
+			if isRange {
+				if hi, err = strconv.Atoi(b); err != nil {
+					return 0, fmt.Errorf("bad value %q", part)
+				}
+			} else if step > 1 {
+				hi = max // "5/10" 表示从 5 开始每 10 个
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return 0, fmt.Errorf("%q out of range %d-%d", part, min, max)
+		}
+		for v := lo; v <= hi; v += step {
+			set |= 1 << uint(v)
+		}
+	}
+	return set, nil
+}
+
+func (c *cronSchedule) matches(t time.Time) bool {
+	if c.minute&(1<<uint(t.Minute())) == 0 || c.hour&(1<<uint(t.Hour())) == 0 || c.month&(1<<uint(t.Month())) == 0 {
+		return false
+	}
+	dom := c.dom&(1<<uint(t.Day())) != 0
+	dow := c.dow&(1<<uint(t.Weekday())) != 0
+	// 和 cron 一样：两个都限定了就满足其一即可
+	if !c.domStar && !c.dowStar {
+		return dom || dow
+	}
+	return dom && dow
+}
+
+// maintenanceStatus is a window as GET /api/v1/maintenance shows it.
+type maintenanceStatus struct {
+	MaintenanceWindow
+	Active bool  `json:"active"`
+	EndsAt int64 `json:"endsAt,omitempty"` // unix ms, while active
+}
@@ -0,0 +1,206 @@
+// Copyright (C) 2025 Russell Li (xiaoxinmm)
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// at is a time in January 2025, in local time like the schedules. The
+// 1st is a Wednesday.
+func at(day, hour, minute int) time.Time {
+	return time.Date(2025, 1, day, hour, minute, 0, 0, time.Local)
+}
+
+func TestParseCron(t *testing.T) {
+	for _, tc := range []struct {
+		spec string
+		yes  []time.Time
+		no   []time.Time
+	}{
+		{"*/15 * * * *", []time.Time{at(1, 10, 0), at(1, 10, 15), at(9, 3, 45)}, []time.Time{at(1, 10, 7), at(1, 10, 59)}},
+		{"5/20 * * * *", []time.Time{at(1, 0, 5), at(1, 0, 25), at(1, 0, 45)}, []time.Time{at(1, 0, 0), at(1, 0, 20)}},
+		{"0 9-17/4 * * *", []time.Time{at(1, 9, 0), at(1, 13, 0), at(1, 17, 0)}, []time.Time{at(1, 10, 0), at(1, 21, 0)}},
+		{"0 2 * * 0", []time.Time{at(5, 2, 0), at(12, 2, 0)}, []time.Time{at(6, 2, 0), at(5, 2, 1), at(5, 3, 0)}},
+		{"0 2 * * 7", []time.Time{at(5, 2, 0)}, []time.Time{at(4, 2, 0)}}, // 7 也是周日
+		{"0 22 * * 5,6", []time.Time{at(3, 22, 0), at(4, 22, 0)}, []time.Time{at(2, 22, 0), at(5, 22, 0)}},
+		{"0 0 1,15 * *", []time.Time{at(1, 0, 0), at(15, 0, 0)}, []time.Time{at(2, 0, 0), at(16, 0, 0)}},
+		// 日和星期都限定时满足其一：1 到 7 号，或者周一到周五
+		{"30 1 1-7 * 1-5", []time.Time{at(4, 1, 30), at(15, 1, 30), at(1, 1, 30)}, []time.Time{at(18, 1, 30), at(15, 1, 31)}},
+		{"0 0 * 2-12 *", []time.Time{time.Date(2025, 2, 1, 0, 0, 0, 0, time.Local)}, []time.Time{at(1, 0, 0)}},
+	} {
+		c, err := parseCron(tc.spec)
+		if err != nil {
+			t.Errorf("%s: %v", tc.spec, err)
+			continue
+		}
+		for _, tm := range tc.yes {
+			if !c.matches(tm) {
+				t.Errorf("%s doesn't match %s", tc.spec, tm.Format("Mon Jan 2 15:04"))
+			}
+		}
+		for _, tm := range tc.no {
+			if c.matches(tm) {
+				t.Errorf("%s matches %s", tc.spec, tm.Format("Mon Jan 2 15:04"))
+			}
+		}
+	}
+
+	for _, bad := range []string{
+		"* * * *", "* * * * * *", "60 * * * *", "* 24 * * *", "* * 0 * *", "* * * 13 *",
+		"* * * * 8", "*/0 * * * *", "5-1 * * * *", "a * * * *", "1-x * * * *", "1,,2 * * * *",
+	} {
+		if _, err := parseCron(bad); err == nil {
+			t.Errorf("%q accepted", bad)
+		}
+	}
+}
+
+func TestMaintenanceWindow(t *testing.T) {
+	nightly, err := compileMaintenance(MaintenanceWindow{Name: "nightly", Schedule: "0 23 * * *", Duration: "2h"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 周六晚上开始，跨过午夜到周日
+	weekly, err := compileMaintenance(MaintenanceWindow{Name: "weekly", Schedule: "30 22 * * 6", Duration: "4h"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		w      *maintenanceWindow
+		t      time.Time
+		active bool
+		end    time.Time
+	}{
+		{nightly, at(1, 22, 59), false, time.Time{}},
+		{nightly, at(1, 23, 0), true, at(2, 1, 0)},
+		{nightly, at(2, 0, 30).Add(17 * time.Second), true, at(2, 1, 0)},
+		{nightly, at(2, 0, 59), true, at(2, 1, 0)},
+		{nightly, at(2, 1, 0), false, time.Time{}},
+		{weekly, at(4, 22, 29), false, time.Time{}},
+		{weekly, at(4, 22, 30), true, at(5, 2, 30)},
+		{weekly, at(5, 1, 45), true, at(5, 2, 30)},
+		{weekly, at(5, 2, 30), false, time.Time{}},
+		{weekly, at(11, 23, 0), true, at(12, 2, 30)},
+		{weekly, at(12, 23, 0), false, time.Time{}},
+	} {
+		active, end := tc.w.activeAt(tc.t)
+		if active != tc.active || !end.Equal(tc.end) {
+			t.Errorf("%s at %s: active %v until %s, want %v until %s", tc.w.Name, tc.t.Format("Mon Jan 2 15:04:05"),
+				active, end.Format("Mon 15:04"), tc.active, tc.end.Format("Mon 15:04"))
+		}
+	}
+
+	for _, bad := range []MaintenanceWindow{
+		{Schedule: "0 23 * * *", Duration: "1h"},
+		{Name: "x", Schedule: "0 23 * *", Duration: "1h"},
+		{Name: "x", Schedule: "0 23 * * *", Duration: "30s"},
+		{Name: "x", Schedule: "0 23 * * *", Duration: "8d"},
+		{Name: "x", Schedule: "0 23 * * *", Duration: "170h"},
+		{Name: "x", Schedule: "0 23 * * *", Duration: "1h", alertMatcher: alertMatcher{Rule: "["}},
+		{Name: "x", Schedule: "0 23 * * *", Duration: "1h", alertMatcher: alertMatcher{Severity: "fatal"}},
+	} {
+		if _, err := compileMaintenance(bad); err == nil {
+			t.Errorf("%+v accepted", bad)
+		}
+	}
+}
+
+func TestAlertMatcher(t *testing.T) {
+	a := &alert{Rule: "disk-full", Instance: "/var/lib", Severity: "warning"}
+	for m, want := range map[alertMatcher]bool{
+		{}:                                    true,
+		{Rule: "disk-full"}:                   true,
+		{Rule: "disk*", Instance: "/var/*"}:   true,
+		{Instance: "/var"}:                    false,
+		{Instance: "/*"}:                      false, // glob 不跨 /
+		{Rule: "cpu*"}:                        false,
+		{Severity: "warning"}:                 true,
+		{Rule: "disk*", Severity: "critical"}: false,
+	} {
+		if got := m.matches(a); got != want {
+			t.Errorf("%+v matches %v, want %v", m, got, want)
+		}
+	}
+}
+
+func TestSilences(t *testing.T) {
+	now := at(1, 12, 0).UnixMilli()
+	s, err := newSilence(silenceRequest{alertMatcher: alertMatcher{Rule: "cpu"}, Duration: "2h"}, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.ID == "" || s.StartsAt != now || s.EndsAt != now+2*time.Hour.Milliseconds() {
+		t.Errorf("silence %+v", s)
+	}
+	if !s.active(now) || !s.active(s.EndsAt-1) || s.active(s.EndsAt) || s.active(now-1) {
+		t.Error("active outside [startsAt, endsAt)")
+	}
+	later, err := newSilence(silenceRequest{StartsAt: now + 1000, EndsAt: now + 5000}, now)
+	if err != nil || later.active(now) || !later.active(now+1000) {
+		t.Errorf("future silence %+v, %v", later, err)
+	}
+	for _, bad := range []silenceRequest{
+		{},
+		{Duration: "soon"},
+		{Duration: "-1h"},
+		{EndsAt: now - 1},
+		{StartsAt: now - 2000, EndsAt: now - 1000},
+		{StartsAt: now + 5000, EndsAt: now + 1000},
+		{alertMatcher: alertMatcher{Instance: "[a"}, Duration: "1h"},
+	} {
+		if _, err := newSilence(bad, now); err == nil {
+			t.Errorf("%+v accepted", bad)
+		}
+	}
+
+	window, err := compileMaintenance(MaintenanceWindow{Name: "backup", Schedule: "0 2 * * *", Duration: "1h", alertMatcher: alertMatcher{Rule: "disk*"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := &alertEngine{active: make(map[string]*alert), windows: []*maintenanceWindow{window}}
+	e.silences = []Silence{s, later}
+	cpu := &alert{Rule: "cpu", Severity: "warning"}
+	disk := &alert{Rule: "disk", Instance: "/", Severity: "warning"}
+	for _, tc := range []struct {
+		a    *alert
+		at   int64
+		want string
+	}{
+		{cpu, now, "silence " + s.ID},
+		{cpu, s.EndsAt, ""},
+		{disk, now, ""},
+		{disk, now + 1000, "silence " + later.ID},
+		{disk, at(2, 2, 30).UnixMilli(), "maintenance backup"},
+		{disk, at(2, 3, 0).UnixMilli(), ""},
+		{cpu, at(2, 2, 30).UnixMilli(), ""},
+		{&alert{Rule: "cpu", AckedAt: 1}, at(2, 2, 30).UnixMilli(), "acknowledged"},
+	} {
+		if got := e.mutedLocked(tc.a, tc.at); got != tc.want {
+			t.Errorf("%s at %s: muted %q, want %q", tc.a.Rule, time.UnixMilli(tc.at).Format("Jan 2 15:04:05"), got, tc.want)
+		}
+	}
+
+	// 过期的在下一次读列表时清掉
+	e.pruneSilencesLocked(s.EndsAt)
+	if len(e.silences) != 0 {
+		t.Errorf("%d silences left after they ended", len(e.silences))
+	}
+	if err := e.deleteSilence(s.ID); err != errNoSilence {
+		t.Errorf("deleting an expired silence: %v", err)
+	}
+}
@@ -0,0 +1,147 @@
+// Copyright (C) 2025 Russell Li (xiaoxinmm)
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// 有些代理会掐掉长时间没数据的连接，定期发个注释行保活
+const sseKeepAlive = 15 * time.Second
+
+// sseTransport writes messages as Server-Sent Events. The event name is
+// the message type and the data is the same JSON the websocket carries.
+// Broadcasts get an id: line so the browser can resume with Last-Event-ID.
+type sseTransport struct {
+	w       http.ResponseWriter
+	flusher http.Flusher
+	rc      *http.ResponseController
+
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+func newSSETransport(w http.ResponseWriter, flusher http.Flusher) *sseTransport {
+	return &sseTransport{w: w, flusher: flusher, rc: http.NewResponseController(w), done: make(chan struct{})}
+}
+
+func (t *sseTransport) send(id uint64, msgType string, _ int, data []byte) error {
+	t.rc.SetWriteDeadline(time.Now().Add(clientWriteTimeout))
+	var err error
+	if id > 0 {
+		_, err = fmt.Fprintf(t.w, "id: %d\n", id)
+	}
+	if err == nil {
+		_, err = fmt.Fprintf(t.w, "event: %s\ndata: %s\n\n", msgType, data)
+	}
+	if err != nil {
+		t.close()
+		return err
+	}
+	t.flusher.Flush()
+	return nil
+}
+
+// comment writes an SSE comment line; clients ignore it.
+func (t *sseTransport) comment(text string) error {
+	t.rc.SetWriteDeadline(time.Now().Add(clientWriteTimeout))
+	if _, err := fmt.Fprintf(t.w, ": %s\n\n", text); err != nil {
+		t.close()
+		return err
+	}
+	t.flusher.Flush()
+	return nil
+}
+
+func (t *sseTransport) shutdown(reason string) {
+	data, _ := json.Marshal(wsMessage{Type: "shutdown", Payload: shutdownNotice{Reason: reason}})
+	t.send(0, "shutdown", 0, data)
+	t.close()
+}
+
+func (t *sseTransport) close() {
+	t.closeOnce.Do(func() { close(t.done) })
+}
+
+// handleStream serves /api/stream, the SSE alternative to /ws. It takes
+// the same query parameters as /ws (topics, interval, procs, mode) and is
+// always JSON. A client that reconnects with Last-Event-ID (or
+// ?lastEventId=) within the replay window gets the broadcasts it missed
+// instead of a fresh snapshot.
+func handleStream(cfg Config, h *hub, limit *connLimiter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !isAuthenticated(r, cfg.Password) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+			return
+		}
+		release, reason := limit.acquire(clientIP(r))
+		if release == nil {
+			rejectHTTP(w, reason)
+			return
+		}
+		defer release()
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Connection", "keep-alive")
+		w.Header().Set("X-Accel-Buffering", "no") // nginx 别缓冲
+		w.WriteHeader(http.StatusOK)
+
+		t := newSSETransport(w, flusher)
+		fmt.Fprint(w, "retry: 3000\n\n")
+		flusher.Flush()
+
+		lastID := r.Header.Get("Last-Event-ID")
+		if lastID == "" {
+			lastID = r.URL.Query().Get("lastEventId")
+		}
+		last, _ := strconv.ParseUint(lastID, 10, 64)
+
+		c := newClient(t, r, jsonCodec, cfg.clientLimits())
+		if !h.addResume(c, last) {
+			c.sendInitial(cfg.MaxProcesses)
+		}
+		defer h.remove(c)
+
+		keepAlive := time.NewTicker(sseKeepAlive)
+		defer keepAlive.Stop()
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-t.done:
+				return
+			case <-keepAlive.C:
+				c.mu.Lock()
+				err := t.comment("ping")
+				c.mu.Unlock()
+				if err != nil {
+					return
+				}
+			}
+		}
+	}
+}
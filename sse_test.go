@@ -0,0 +1,157 @@
+// Copyright (C) 2025 Russell Li (xiaoxinmm)
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+type sseEvent struct {
+	id, event, data string
+}
+
+// openStream connects to /api/stream and returns a function reading one
+// event at a time; retry: lines and comments are skipped.
+func openStream(t *testing.T, url, lastID string) (next func() sseEvent, hangUp func()) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	req, _ := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if lastID != "" {
+		req.Header.Set("Last-Event-ID", lastID)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		cancel()
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+		cancel()
+		t.Fatalf("%d %s", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	lines := make(chan string)
+	go func() {
+		defer close(lines)
+		sc := bufio.NewScanner(resp.Body)
+		sc.Buffer(nil, 1<<20)
+		for sc.Scan() {
+			select {
+			case lines <- sc.Text():
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	next = func() sseEvent {
+		t.Helper()
+		var ev sseEvent
+		timeout := time.After(5 * time.Second)
+		for {
+			select {
+			case line, ok := <-lines:
+				if !ok {
+					t.Fatal("stream ended")
+				}
+				switch {
+				case line == "" && ev.event != "":
+					return ev
+				case strings.HasPrefix(line, "id: "):
+					ev.id = line[4:]
+				case strings.HasPrefix(line, "event: "):
+					ev.event = line[7:]
+				case strings.HasPrefix(line, "data: "):
+					ev.data = line[6:]
+				}
+			case <-timeout:
+				t.Fatal("no event in 5s")
+			}
+		}
+	}
+	return next, func() {
+		cancel()
+		resp.Body.Close()
+	}
+}
+
+// TestSSEResume drops an SSE client, broadcasts while it is away and
+// reconnects with Last-Event-ID: it gets what it missed, in order, and
+// no fresh snapshot. Once the gap is past the replay window it gets a
+// snapshot instead.
+func TestSSEResume(t *testing.T) {
+	h := newHub()
+	srv := httptest.NewServer(handleStream(Config{RefreshInterval: 1000, MaxProcesses: 5}, h, newConnLimiter("dashboard connections", 0, 0)))
+	defer srv.Close()
+	url := srv.URL + "/api/stream?topics=docker"
+	docker := func(n int) {
+		for i := 0; i < n; i++ {
+			h.broadcast("docker", wsMessage{Type: "docker", Payload: []int{i}})
+		}
+		h.drain()
+	}
+	away := func(hangUp func()) {
+		hangUp()
+		for deadline := time.Now().Add(5 * time.Second); h.count() > 0; {
+			if time.Now().After(deadline) {
+				t.Fatal("the hub kept the client")
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	next, hangUp := openStream(t, url, "")
+	if ev := next(); ev.event != "snapshot" || ev.id != "" {
+		t.Errorf("first event %+v, want a snapshot without an id", ev)
+	}
+	docker(3)
+	var last string
+	for i := 0; i < 3; i++ {
+		ev := next()
+		if ev.event != "docker" || ev.data != `{"type":"docker","payload":[`+strconv.Itoa(i)+`]}` {
+			t.Errorf("event %+v", ev)
+		}
+		last = ev.id
+	}
+	away(hangUp)
+	docker(2)
+
+	next, hangUp = openStream(t, url, last)
+	lastID, _ := strconv.ParseUint(last, 10, 64)
+	for i := 0; i < 2; i++ {
+		ev := next()
+		if ev.event != "docker" || ev.id != strconv.FormatUint(lastID+uint64(i)+1, 10) || !strings.Contains(ev.data, "["+strconv.Itoa(i)+"]") {
+			t.Errorf("replayed %+v, want docker %d with id %d", ev, i, lastID+uint64(i)+1)
+		}
+	}
+	docker(1)
+	if ev := next(); ev.id != strconv.FormatUint(lastID+3, 10) {
+		t.Errorf("after the replay %+v, want id %d", ev, lastID+3)
+	}
+	away(hangUp)
+
+	// 离开太久，错过的已经不在缓冲里了：?lastEventId= 也一样
+	docker(replayEvents + 1)
+	next, hangUp = openStream(t, url+"&lastEventId="+strconv.FormatUint(lastID+3, 10), "")
+	defer hangUp()
+	if ev := next(); ev.event != "snapshot" || ev.id != "" {
+		t.Errorf("resumed past the window: %+v, want a snapshot", ev)
+	}
+}
@@ -23,6 +23,9 @@
   let ws = null;
   let reconnectDelay = 1000;
   let sortField = 'cpu';
+  // delta stream state: the last full snapshot and its sequence number
+  let streamState = null;
+  let streamSeq = 0;
 
   const $ = (sel) => document.querySelector(sel);
 
@@ -112,6 +115,9 @@
     }
   };
 
+  // 按当前趋势多久会满，服务端没预测就不显示
+  const fullIn = (sec) => sec ? ` <small class="full-in" title="at the current trend">full in ${fmtUptime(sec)}</small>` : '';
+
   const renderMemory = (mem) => {
     const pct = mem.usedPercent.toFixed(1);
     $('#mem-pct').textContent = pct;
@@ -121,7 +127,7 @@
     $('#mem-used').textContent = fmtBytes(mem.used);
     $('#mem-free').textContent = fmtBytes(mem.available);
     $('#mem-total').textContent = fmtBytes(mem.total);
-    $('#mem-subtitle').textContent = `${fmtBytes(mem.used)} / ${fmtBytes(mem.total)}`;
+    $('#mem-subtitle').innerHTML = `${fmtBytes(mem.used)} / ${fmtBytes(mem.total)}${fullIn(mem.fullIn)}`;
 
     if (mem.swapTotal > 0) {
       $('#swap-section').style.display = '';
@@ -162,7 +168,7 @@
         <td>${fmtBytes(d.total)}</td>
         <td>${fmtBytes(d.used)}</td>
         <td>${fmtBytes(d.free)}</td>
-        <td class="${pctColorClass(d.usedPercent)}">${d.usedPercent.toFixed(1)}%</td>
+        <td class="${pctColorClass(d.usedPercent)}">${d.usedPercent.toFixed(1)}%${fullIn(d.fullIn)}</td>
         <td><div class="mini-bar"><div class="bar-fill${cls}" style="width:${d.usedPercent.toFixed(0)}%"></div></div></td>
       </tr>`;
     }
@@ -249,55 +255,192 @@
     tbody.innerHTML = html;
   };
 
+  // 当前的 pending / firing 告警，按 id
+  let activeAlerts = {};
+
+  const renderAlerts = () => {
+    const section = $('#alerts-section');
+    if (!section) return;
+    const list = Object.values(activeAlerts);
+    if (list.length === 0) {
+      section.style.display = 'none';
+      return;
+    }
+    section.style.display = '';
+    const firing = list.filter(a => a.state === 'firing').length;
+    $('#alerts-count').textContent = `(${firing} firing, ${list.length - firing} pending)`;
+    const rank = { critical: 2, warning: 1, info: 0 };
+    list.sort((a, b) => (b.state === 'firing') - (a.state === 'firing') || rank[b.severity] - rank[a.severity] || a.since - b.since);
+
+    let html = '';
+    for (let i = 0; i < list.length; i++) {
+      const a = list[i];
+      let actions = '';
+      if (a.muted) actions += `<span class="alert-muted" title="${esc(a.ackComment || a.muted)}">${a.ackedAt ? 'acked' : 'muted'}</span> `;
+      if (a.state === 'firing' && !a.ackedAt) actions += `<button class="alert-btn" data-ack="${esc(a.id)}">ack</button> `;
+      if (!a.muted) actions += `<button class="alert-btn" data-silence="${esc(a.id)}">mute 1h</button>`;
+      html += `<tr>
+        <td><span class="alert-badge ${esc(a.severity)}">${esc(a.severity)}</span></td>
+        <td>${esc(a.state)}</td>
+        <td>${esc(a.rule)}</td>
+        <td>${esc(a.summary)}</td>
+        <td>${new Date(a.since).toLocaleTimeString()}</td>
+        <td>${actions}</td>
+      </tr>`;
+    }
+    $('#alerts-table').querySelector('tbody').innerHTML = html;
+  };
+
+  // sections from collectors other than the built-in ones: one card
+  // each, its fields as a two-column table
+  const builtinSections = ['timestamp', 'system', 'cpu', 'memory', 'disks', 'network', 'load', 'processes'];
+
+  const fmtField = (v) => {
+    if (v === null || v === undefined) return '-';
+    if (typeof v === 'number') return Number.isInteger(v) ? String(v) : v.toFixed(2);
+    if (typeof v === 'object') return JSON.stringify(v);
+    return String(v);
+  };
+
+  const renderExtraSections = (data) => {
+    const container = $('#extra-sections');
+    const names = Object.keys(data).filter((k) => !builtinSections.includes(k)).sort();
+    container.style.display = names.length ? '' : 'none';
+    container.querySelectorAll('[data-extra]').forEach((card) => {
+      if (!names.includes(card.dataset.extra)) card.remove();
+    });
+    for (const name of names) {
+      let card = container.querySelector(`[data-extra="${CSS.escape(name)}"]`);
+      if (!card) {
+        card = document.createElement('div');
+        card.className = 'card';
+        card.dataset.extra = name;
+        card.innerHTML = `<h2>${esc(name)}</h2><div class="table-wrap"><table><tbody></tbody></table></div>`;
+        container.appendChild(card);
+      }
+      const v = data[name];
+      const rows = v !== null && typeof v === 'object' && !Array.isArray(v) ? Object.entries(v) : [['value', v]];
+      card.querySelector('tbody').innerHTML = rows.map(([k, x]) =>
+        `<tr><td>${esc(k)}</td><td class="col-num">${esc(fmtField(x))}</td></tr>`).join('');
+    }
+  };
+
   const render = (data) => {
     lastData = data;
     // console.log('debug: snapshot received', msg.payload);
-    renderSystem(data.system);
-    renderCPU(data.cpu);
-    renderMemory(data.memory);
-    renderLoad(data.load, data.cpu, data.system.goVersion);
-    renderDisks(data.disks || []);
-    renderNetwork(data.network || []);
-    renderProcesses(data.processes || []);
-    addHistoryPoint(data.cpu.avgUsage, data.memory.usedPercent, Date.now());
+    // 关掉的 collector 不在快照里，对应的卡片藏起来
+    document.querySelectorAll('[data-section]').forEach((el) => {
+      el.style.display = data[el.dataset.section] === undefined ? 'none' : '';
+    });
+    $('#history-card').style.display = data.cpu || data.memory ? '' : 'none';
+    if (data.system) renderSystem(data.system);
+    if (data.cpu) renderCPU(data.cpu);
+    if (data.memory) renderMemory(data.memory);
+    if (data.load) renderLoad(data.load, data.cpu || {}, data.system ? data.system.goVersion : '');
+    if (data.disks !== undefined) renderDisks(data.disks || []);
+    if (data.network !== undefined) renderNetwork(data.network || []);
+    if (data.processes !== undefined) renderProcesses(data.processes || []);
+    renderExtraSections(data);
+    if (data.cpu && data.memory) addHistoryPoint(data.cpu.avgUsage, data.memory.usedPercent, Date.now());
   };
 
   // -- websocket --
   const getWsUrl = () => {
     const proto = location.protocol === 'https:' ? 'wss:' : 'ws:';
-    let url = `${proto}//${location.host}/ws`;
+    let url = `${proto}//${location.host}/ws?mode=delta`;
     const token = localStorage.getItem('sysmon-token') || new URLSearchParams(location.search).get('token');
     if (token) {
-      url += `?token=${encodeURIComponent(token)}`;
+      url += `&token=${encodeURIComponent(token)}`;
       localStorage.setItem('sysmon-token', token);
     }
     return url;
   };
 
+  // JSON merge patch (RFC 7386)
+  const mergePatch = (target, patch) => {
+    if (patch === null || typeof patch !== 'object' || Array.isArray(patch)) return patch;
+    if (target === null || typeof target !== 'object' || Array.isArray(target)) target = {};
+    for (const k in patch) {
+      if (patch[k] === null) delete target[k];
+      else target[k] = mergePatch(target[k], patch[k]);
+    }
+    return target;
+  };
+
+  const applyDelta = (seq, d) => {
+    if (!streamState || d.base !== streamSeq) {
+      sendControl({ type: 'resync' });
+      return;
+    }
+    if (d.set) streamState = mergePatch(streamState, d.set);
+    if (d.procs) {
+      const byPid = new Map();
+      (streamState.processes || []).forEach((p) => byPid.set(p.pid, p));
+      (d.procs.remove || []).forEach((pid) => byPid.delete(pid));
+      (d.procs.upsert || []).forEach((p) => byPid.set(p.pid, p));
+      streamState.processes = Array.from(byPid.values());
+    }
+    streamSeq = seq;
+    render(streamState);
+  };
+
+  const sendControl = (msg) => {
+    if (ws && ws.readyState === WebSocket.OPEN) ws.send(JSON.stringify(msg));
+  };
+
+  // stop the stream while the tab is hidden
+  document.addEventListener('visibilitychange', () => {
+    sendControl({ type: document.hidden ? 'pause' : 'resume' });
+  });
+
+  // wire encoding: JSON unless the page is opened with ?codec=msgpack|cbor
+  const getWsProtocols = () => {
+    const protos = window.sysmonCodec.protocols;
+    localStorage.removeItem('sysmon-codec'); // 旧版本默认存了 msgpack
+    const wanted = new URLSearchParams(location.search).get('codec') || 'json';
+    if (wanted === 'json' || !protos[wanted]) return [protos.json];
+    return [protos[wanted], protos.json];
+  };
+
   const connect = () => {
     const url = getWsUrl();
-    ws = new WebSocket(url);
+    ws = new WebSocket(url, getWsProtocols());
+    ws.binaryType = 'arraybuffer';
 
     ws.onopen = () => {
       $('#conn-status').className = 'status-dot connected';
       $('#conn-status').title = 'connected';
       reconnectDelay = 1000;
+      if (document.hidden) sendControl({ type: 'pause' });
     };
 
     ws.onmessage = (evt) => {
       try {
-        const msg = JSON.parse(evt.data);
+        const msg = window.sysmonCodec.decode(ws.protocol, evt.data);
         if (msg.type === 'snapshot') {
+          if (msg.seq) {
+            streamState = msg.payload;
+            streamSeq = msg.seq;
+          }
           render(msg.payload);
+        } else if (msg.type === 'delta') {
+          applyDelta(msg.seq, msg.payload);
         } else if (msg.type === 'history') {
-          const points = msg.payload || [];
-          for (let i = 0; i < points.length; i++) {
-            const p = points[i];
-            addHistoryPoint(p.cpu, p.mem, p.ts * 1000);
-          }
+          // 服务端发的是 {t: unix 秒, c, m}；重连时整个替换，不重复追加
+          historyData = (msg.payload || []).map(p => ({ t: p.t, c: p.c, m: p.m })).slice(-3600);
+          drawChart();
         } else if (msg.type === 'docker') {
           lastDocker = msg.payload;
           renderDocker(msg.payload);
+        } else if (msg.type === 'alerts') {
+          activeAlerts = {};
+          (msg.payload || []).forEach(a => { activeAlerts[a.id] = a; });
+          renderAlerts();
+        } else if (msg.type === 'alert') {
+          const a = msg.payload;
+          if (a.state === 'pending' || a.state === 'firing') activeAlerts[a.id] = a;
+          else delete activeAlerts[a.id];
+          renderAlerts();
         } else if (!msg.type) {
           render(msg);
         }
@@ -306,9 +449,12 @@
       }
     };
 
-    ws.onclose = () => {
+    ws.onclose = (evt) => {
+      streamState = null;
+      streamSeq = 0;
       $('#conn-status').className = 'status-dot disconnected';
-      $('#conn-status').title = 'disconnected';
+      $('#conn-status').title = evt.reason ? 'disconnected: ' + evt.reason : 'disconnected';
+      if (evt.code === 1013) reconnectDelay = 10000; // 服务端连接数满了，别猛重连
       setTimeout(() => {
         reconnectDelay = Math.min(reconnectDelay * 1.5, 10000);
         connect();
@@ -324,10 +470,18 @@
   let historyData = [];
   let chartCanvas = null;
   let chartCtx = null;
-
-  const fmtTime = (unixSec) => {
+  // 1h 是 websocket 推来的实时数据；更长的范围和拖选放大从 /api/v1/query 取
+  let chartView = null; // {start, end}（unix 秒），null = 实时
+  let viewData = [];
+  let chartGeom = null; // 上次画图的坐标换算，拖选要用
+  let dragFrom = null;
+  let dragTo = null;
+
+  const fmtTime = (unixSec, withDate) => {
     const d = new Date(unixSec * 1000);
-    return ('0' + d.getHours()).slice(-2) + ':' + ('0' + d.getMinutes()).slice(-2);
+    const hm = ('0' + d.getHours()).slice(-2) + ':' + ('0' + d.getMinutes()).slice(-2);
+    if (!withDate) return hm;
+    return ('0' + (d.getMonth() + 1)).slice(-2) + '-' + ('0' + d.getDate()).slice(-2) + ' ' + hm;
   };
 
   const initChart = () => {
@@ -336,6 +490,30 @@
     chartCtx = chartCanvas.getContext('2d');
     resizeChart();
     window.addEventListener('resize', resizeChart);
+
+    const xOf = (e) => e.clientX - chartCanvas.getBoundingClientRect().left;
+    chartCanvas.addEventListener('mousedown', (e) => {
+      dragFrom = dragTo = xOf(e);
+    });
+    chartCanvas.addEventListener('mousemove', (e) => {
+      if (dragFrom === null) return;
+      dragTo = xOf(e);
+      drawChart();
+    });
+    window.addEventListener('mouseup', () => {
+      if (dragFrom === null) return;
+      const a = Math.min(dragFrom, dragTo), b = Math.max(dragFrom, dragTo);
+      dragFrom = dragTo = null;
+      const g = chartGeom;
+      if (!g || b - a < 5) {
+        drawChart();
+        return;
+      }
+      const tAt = (x) => g.tMin + Math.max(0, Math.min(1, (x - g.padLeft) / g.plotW)) * g.tRange;
+      const start = tAt(a), end = tAt(b);
+      loadView(start, end, fmtTime(start, true) + ' – ' + fmtTime(end, true));
+    });
+    chartCanvas.addEventListener('dblclick', liveView);
   };
 
   const resizeChart = () => {
@@ -384,20 +562,22 @@
       ctx.fillText(yVal + '%', padLeft - 4, y);
     }
 
-    if (historyData.length < 2) {
+    const data = chartView ? viewData : historyData;
+    if (data.length < 2) {
+      chartGeom = null;
       ctx.fillStyle = '#8b949e';
       ctx.textAlign = 'center';
       ctx.textBaseline = 'middle';
       ctx.font = '12px monospace';
-      ctx.fillText('Collecting data...', w / 2, h / 2);
+      ctx.fillText(chartView ? 'No data in this range' : 'Collecting data...', w / 2, h / 2);
       return;
     }
 
-    const data = historyData;
-    const tMin = data[0].t;
-    const tMax = data[data.length - 1].t;
+    const tMin = chartView ? chartView.start : data[0].t;
+    const tMax = chartView ? chartView.end : data[data.length - 1].t;
     let tRange = tMax - tMin;
     if (tRange <= 0) tRange = 1;
+    chartGeom = { padLeft, plotW, tMin, tRange };
 
     // x axis labels
     const labelCount = Math.max(2, Math.min(6, Math.floor(plotW / 80)));
@@ -407,7 +587,7 @@
     for (let li = 0; li <= labelCount; li++) {
       const frac = li / labelCount;
       const xPos = padLeft + frac * plotW;
-      ctx.fillText(fmtTime(tMin + frac * tRange), xPos, padTop + plotH + 4);
+      ctx.fillText(fmtTime(tMin + frac * tRange, tRange > 86400), xPos, padTop + plotH + 4);
       ctx.beginPath();
       ctx.moveTo(xPos, padTop);
       ctx.lineTo(xPos, padTop + plotH);
@@ -438,6 +618,72 @@
 
     drawLine('#00ff41', 'c');
     drawLine('#58a6ff', 'm');
+
+    if (dragFrom !== null) {
+      ctx.globalAlpha = 0.15;
+      ctx.fillStyle = '#c9d1d9';
+      ctx.fillRect(Math.min(dragFrom, dragTo), padTop, Math.abs(dragTo - dragFrom), plotH);
+      ctx.globalAlpha = 1.0;
+    }
+  };
+
+  const setRangeLabel = (label, range) => {
+    document.getElementById('history-range').textContent = '(' + label + ')';
+    document.querySelectorAll('.range-btn').forEach((b) => {
+      b.classList.toggle('active', b.getAttribute('data-range') === String(range));
+    });
+  };
+
+  const liveView = () => {
+    chartView = null;
+    viewData = [];
+    $('#range-procs').style.display = 'none';
+    setRangeLabel('1 hour, live', 3600);
+    drawChart();
+  };
+
+  // loadView 取 start..end（unix 秒）的 CPU 和内存，服务端按范围挑精度
+  const loadView = (start, end, label, range) => {
+    const view = { start, end };
+    chartView = view;
+    viewData = [];
+    setRangeLabel(label, range);
+    drawChart();
+    apiGet('query?select=cpu&select=memory&start=' + Math.floor(start) + '&end=' + Math.ceil(end))
+      .then((res) => {
+        if (chartView !== view) return; // 已经切到别的范围了
+        const find = (m) => res.series.find((s) => s.metric === m) || { t: [], v: [] };
+        const cpu = find('cpu'), mem = find('memory');
+        const memAt = {};
+        mem.t.forEach((t, i) => { memAt[t] = mem.v[i]; });
+        viewData = [];
+        cpu.t.forEach((t, i) => {
+          if (t in memAt) viewData.push({ t: t / 1000, c: cpu.v[i], m: memAt[t] });
+        });
+        drawChart();
+      })
+      .catch((err) => console.error('api query', err));
+    loadRangeProcesses(view);
+  };
+
+  // 这段时间里谁占的 CPU 最多，来自进程历史
+  const loadRangeProcesses = (view) => {
+    apiGet('history/processes?limit=5&start=' + Math.floor(view.start) + '&end=' + Math.ceil(view.end))
+      .then((res) => {
+        if (chartView !== view) return;
+        const procs = res.processes || [];
+        $('#range-procs').style.display = procs.length ? '' : 'none';
+        $('#range-procs-info').textContent = '(' + res.samples + ' samples, ' + res.resolution + ')';
+        $('#range-proc-table tbody').innerHTML = procs.map((p) => `<tr>
+          <td class="col-pid">${p.pid || ''}</td>
+          <td>${esc(p.name)}</td>
+          <td class="col-num">${p.cpu.avg.toFixed(1)}</td>
+          <td class="col-num">${p.cpu.max.toFixed(1)}</td>
+          <td class="col-num">${fmtBytes(p.memory.avg)}</td>
+          <td class="col-num">${fmtRate(p.io.avg)}</td>
+        </tr>`).join('');
+      })
+      .catch((err) => console.error('api history/processes', err));
   };
 
   const addHistoryPoint = (cpuAvg, memPct, timestamp) => {
@@ -449,6 +695,56 @@
     drawChart();
   };
 
+  // 写接口用和 websocket 一样的 token；没有的话 cookie 会自己带上
+  const apiPost = (path, body) => {
+    const headers = { 'Content-Type': 'application/json' };
+    const token = localStorage.getItem('sysmon-token');
+    if (token) headers['Authorization'] = 'Bearer ' + token;
+    return fetch('/api/v1/' + path, { method: 'POST', headers, body: JSON.stringify(body || {}) })
+      .then((res) => res.ok ? res.json() : res.json().then((err) => Promise.reject(new Error(err.error))))
+      .catch((err) => console.error('api', path, err));
+  };
+
+  const apiGet = (path) => {
+    const headers = {};
+    const token = localStorage.getItem('sysmon-token');
+    if (token) headers['Authorization'] = 'Bearer ' + token;
+    return fetch('/api/v1/' + path, { headers })
+      .then((res) => res.ok ? res.json() : res.json().then((err) => Promise.reject(new Error(err.error))));
+  };
+
+  document.addEventListener('click', (e) => {
+    if (!e.target.classList.contains('range-btn')) return;
+    const range = Number(e.target.getAttribute('data-range'));
+    if (range === 3600) {
+      liveView();
+      return;
+    }
+    const now = Date.now() / 1000;
+    loadView(now - range, now, 'last ' + e.target.textContent, range);
+  });
+
+  // ack / mute buttons in the alerts table. The server pushes the ack back
+  // as an alert message; a silence only shows up on the next transition.
+  document.addEventListener('click', (e) => {
+    const ack = e.target.getAttribute('data-ack');
+    if (ack) {
+      apiPost('alerts/ack?id=' + encodeURIComponent(ack));
+      return;
+    }
+    const id = e.target.getAttribute('data-silence');
+    const a = id && activeAlerts[id];
+    if (a) {
+      apiPost('silences', { rule: a.rule, instance: a.instance, duration: '1h', comment: 'muted from the dashboard' })
+        .then((s) => {
+          if (s && activeAlerts[id]) {
+            activeAlerts[id].muted = 'silence ' + s.id;
+            renderAlerts();
+          }
+        });
+    }
+  });
+
   // sort buttons
   document.addEventListener('click', (e) => {
     if (e.target.classList.contains('sort-btn')) {
@@ -0,0 +1,170 @@
+/*
+ * Copyright (C) 2025 Russell Li (xiaoxinmm)
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// Minimal MessagePack / CBOR decoders for the /ws binary subprotocols.
+// Only what the server emits is supported: no ext types, no CBOR tags
+// beyond skipping them. 64-bit integers become plain Numbers.
+(function(root) {
+  'use strict';
+
+  const utf8 = new TextDecoder();
+
+  const reader = (buf) => {
+    const view = new DataView(buf);
+    const bytes = new Uint8Array(buf);
+    let pos = 0;
+    return {
+      u8: () => view.getUint8(pos++),
+      u16: () => { const v = view.getUint16(pos); pos += 2; return v; },
+      u32: () => { const v = view.getUint32(pos); pos += 4; return v; },
+      u64: () => { const v = Number(view.getBigUint64(pos)); pos += 8; return v; },
+      i8: () => view.getInt8(pos++),
+      i16: () => { const v = view.getInt16(pos); pos += 2; return v; },
+      i32: () => { const v = view.getInt32(pos); pos += 4; return v; },
+      i64: () => { const v = Number(view.getBigInt64(pos)); pos += 8; return v; },
+      f32: () => { const v = view.getFloat32(pos); pos += 4; return v; },
+      f64: () => { const v = view.getFloat64(pos); pos += 8; return v; },
+      peek: () => view.getUint8(pos),
+      str: (n) => { const s = utf8.decode(bytes.subarray(pos, pos + n)); pos += n; return s; },
+      raw: (n) => { const b = bytes.slice(pos, pos + n); pos += n; return b; },
+    };
+  };
+
+  // ---- MessagePack ----
+  const decodeMsgpack = (buf) => {
+    const r = reader(buf);
+    const arr = (n) => { const a = new Array(n); for (let i = 0; i < n; i++) a[i] = item(); return a; };
+    const map = (n) => { const o = {}; for (let i = 0; i < n; i++) { const k = item(); o[k] = item(); } return o; };
+    const item = () => {
+      const b = r.u8();
+      if (b <= 0x7f) return b;
+      if (b <= 0x8f) return map(b & 0x0f);
+      if (b <= 0x9f) return arr(b & 0x0f);
+      if (b <= 0xbf) return r.str(b & 0x1f);
+      if (b >= 0xe0) return b - 0x100;
+      switch (b) {
+        case 0xc0: return null;
+        case 0xc2: return false;
+        case 0xc3: return true;
+        case 0xc4: return r.raw(r.u8());
+        case 0xc5: return r.raw(r.u16());
+        case 0xc6: return r.raw(r.u32());
+        case 0xca: return r.f32();
+        case 0xcb: return r.f64();
+        case 0xcc: return r.u8();
+        case 0xcd: return r.u16();
+        case 0xce: return r.u32();
+        case 0xcf: return r.u64();
+        case 0xd0: return r.i8();
+        case 0xd1: return r.i16();
+        case 0xd2: return r.i32();
+        case 0xd3: return r.i64();
+        case 0xd9: return r.str(r.u8());
+        case 0xda: return r.str(r.u16());
+        case 0xdb: return r.str(r.u32());
+        case 0xdc: return arr(r.u16());
+        case 0xdd: return arr(r.u32());
+        case 0xde: return map(r.u16());
+        case 0xdf: return map(r.u32());
+      }
+      throw new Error('msgpack: unsupported type 0x' + b.toString(16));
+    };
+    return item();
+  };
+
+  // ---- CBOR ----
+  const half = (h) => {
+    const exp = (h & 0x7c00) >> 10;
+    const frac = h & 0x03ff;
+    const sign = h & 0x8000 ? -1 : 1;
+    if (exp === 0) return sign * Math.pow(2, -14) * (frac / 1024);
+    if (exp === 0x1f) return frac ? NaN : sign * Infinity;
+    return sign * Math.pow(2, exp - 15) * (1 + frac / 1024);
+  };
+
+  const decodeCBOR = (buf) => {
+    const r = reader(buf);
+    const BREAK = {};
+    const length = (info) => {
+      if (info < 24) return info;
+      if (info === 24) return r.u8();
+      if (info === 25) return r.u16();
+      if (info === 26) return r.u32();
+      if (info === 27) return r.u64();
+      if (info === 31) return -1; // indefinite
+      throw new Error('cbor: bad length ' + info);
+    };
+    const item = () => {
+      const b = r.u8();
+      const major = b >> 5;
+      const info = b & 0x1f;
+      if (major === 7) {
+        switch (info) {
+          case 20: return false;
+          case 21: return true;
+          case 22: return null;
+          case 23: return undefined;
+          case 25: return half(r.u16());
+          case 26: return r.f32();
+          case 27: return r.f64();
+          case 31: return BREAK;
+        }
+        if (info < 24) return info;
+        throw new Error('cbor: unsupported simple value ' + info);
+      }
+      const n = length(info);
+      switch (major) {
+        case 0: return n;
+        case 1: return -1 - n;
+        case 2: return r.raw(n);
+        case 3: return r.str(n);
+        case 4: {
+          const a = [];
+          for (let i = 0; n < 0 || i < n; i++) {
+            const v = item();
+            if (v === BREAK) break;
+            a.push(v);
+          }
+          return a;
+        }
+        case 5: {
+          const o = {};
+          for (let i = 0; n < 0 || i < n; i++) {
+            const k = item();
+            if (k === BREAK) break;
+            o[k] = item();
+          }
+          return o;
+        }
+        case 6: return item(); // tag: ignore, keep the content
+      }
+      throw new Error('cbor: unsupported major type ' + major);
+    };
+    return item();
+  };
+
+  root.sysmonCodec = {
+    // subprotocols in order of preference
+    protocols: { msgpack: 'sysmon.msgpack', cbor: 'sysmon.cbor', json: 'sysmon.json' },
+    decode: (protocol, data) => {
+      if (typeof data === 'string') return JSON.parse(data);
+      if (protocol === 'sysmon.msgpack') return decodeMsgpack(data);
+      if (protocol === 'sysmon.cbor') return decodeCBOR(data);
+      throw new Error('unexpected binary frame for ' + (protocol || 'json'));
+    },
+  };
+})(typeof window !== 'undefined' ? window : globalThis);
@@ -220,6 +220,8 @@
           var msg = JSON.parse(evt.data);
           if (msg.type === 'error') {
             term.write('\r\n\x1b[31m[Error] ' + msg.data + '\x1b[0m\r\n');
+          } else if (msg.type === 'notice') {
+            term.write('\r\n\x1b[33m[Notice] ' + msg.data + '\x1b[0m\r\n');
           }
         } catch(e) {
           term.write(evt.data);
@@ -228,7 +230,10 @@
     };
 
     ws.onclose = function(evt) {
-      if (term && connected) {
+      if (term && (evt.code === 1013 || evt.code === 1009)) {
+        // 1013: session limit reached, 1009: message too big
+        term.write('\r\n\x1b[31m[Error] ' + (evt.reason || 'connection refused') + '\x1b[0m\r\n');
+      } else if (term && connected) {
         term.write('\r\n\x1b[33m[Disconnected]\x1b[0m\r\n');
       }
       connected = false;